@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/haproxy_cmd"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// applyRecorder keeps the outcome of the state applies of a chaos run
+type applyRecorder struct {
+	metrics.Nop
+
+	lock      sync.Mutex
+	durations map[string][]time.Duration
+	failures  int
+}
+
+func (r *applyRecorder) ObserveDuration(name string, d time.Duration, labels metrics.Labels) {
+	if name != "connect_state_apply_duration" {
+		return
+	}
+	r.lock.Lock()
+	r.durations[labels["method"]] = append(r.durations[labels["method"]], d)
+	r.lock.Unlock()
+}
+
+func (r *applyRecorder) IncrCounter(name string, value float64, labels metrics.Labels) {
+	if name != "connect_state_applies_total" || labels["result"] != "failure" {
+		return
+	}
+	r.lock.Lock()
+	r.failures++
+	r.lock.Unlock()
+}
+
+func (r *applyRecorder) report() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for method, ds := range r.durations {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		pct := func(p float64) time.Duration {
+			return ds[int(float64(len(ds)-1)*p)]
+		}
+		fmt.Printf("%s: %d applies, p50 %s, p95 %s, p99 %s, max %s\n",
+			method, len(ds), pct(0.5), pct(0.95), pct(0.99), ds[len(ds)-1])
+	}
+	fmt.Printf("failures: %d\n", r.failures)
+}
+
+// runChaos implements the chaos subcommand, it runs HAProxy with configs
+// generated without Consul and reports the latency of the applies
+func runChaos(args []string) int {
+	fs := utils.NewFlags(flag.NewFlagSet("chaos", flag.ExitOnError), utils.FlagEnvPrefix)
+	upstreams := fs.Int("upstreams", 100, "Number of upstreams")
+	instances := fs.Int("instances", 3, "Number of instances of each upstream")
+	basePort := fs.Int("base-port", 20000, "Port of the public listener, the upstreams listen on the following ones")
+	churn := fs.Duration("churn", time.Second, "Interval between two changes of the upstream instances, 0 disables them")
+	churnRatio := fs.Float64("churn-ratio", 0.1, "Share of the upstreams changed each time")
+	certRotation := fs.Duration("cert-rotation", time.Minute, "Interval between two renewals of the leaf certificate, 0 disables them")
+	duration := fs.Duration("duration", time.Minute, "How long to run")
+	seed := fs.Int64("seed", 1, "Seed of the generated changes")
+	haproxyBin := fs.String("haproxy", haproxy_cmd.DefaultHAProxyBin, "Haproxy binary path")
+	dataplaneBin := fs.String("dataplane", "", "Data Plane API binary path, to measure the applies through the API instead of reloads")
+	haproxyCfgBasePath := fs.String("haproxy-cfg-base-path", "/tmp", "Directory the HAProxy config and certificates are written to")
+	logLevel := fs.String("log-level", "WARN", "Log level")
+	_, err := fs.Parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	ll, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	log.SetLevel(ll)
+
+	if err := haproxy_cmd.CheckEnvironment(*haproxyBin, haproxy_cmd.CheckOptions{}); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: HAProxy dependencies are not satisfied: %s\n", err)
+		return int(lib.ExitDependencies)
+	}
+
+	synth, err := consul.NewSynthetic(consul.SyntheticOptions{
+		Upstreams:    *upstreams,
+		Instances:    *instances,
+		BasePort:     *basePort,
+		Churn:        *churn,
+		ChurnRatio:   *churnRatio,
+		CertRotation: *certRotation,
+		Seed:         *seed,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	recorder := &applyRecorder{durations: map[string][]time.Duration{}}
+	sd := lib.NewShutdown()
+	go synth.Run(sd.Stop)
+
+	hap := haproxy.New(nil, synth.C, utils.Options{
+		HAProxyBin:    *haproxyBin,
+		DataplaneBin:  *dataplaneBin,
+		ConfigBaseDir: *haproxyCfgBasePath,
+		HAProxyParams: utils.DefaultHAProxyParams,
+		Metrics:       recorder,
+	})
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		if err := hap.Run(sd); err != nil {
+			log.Error(err)
+			sd.ShutdownWithError(err)
+		}
+	}()
+
+	select {
+	case <-time.After(*duration):
+		sd.Shutdown("chaos run done")
+	case <-sd.Stop:
+	}
+	sd.Wait()
+
+	recorder.report()
+	if err := sd.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return int(lib.ExitCodeOf(err))
+	}
+	return 0
+}
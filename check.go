@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+)
+
+const checkTimeout = 30 * time.Second
+
+// runCheck implements the check subcommand, it runs the self-tests of a
+// running instance through its admin endpoints and returns the exit code
+func runCheck(args []string) int {
+	fs := utils.NewFlags(flag.NewFlagSet("check", flag.ExitOnError), utils.FlagEnvPrefix)
+	statsAddr := fs.String("stats-addr", "127.0.0.1:8080", "Address of the stats server of the instance to check")
+	adminToken := fs.String("admin-token", "", "Token of the admin endpoints")
+	statsTLS := fs.Bool("stats-tls", false, "The stats server is served over TLS, its certificate is not verified as it is not issued for its address")
+	upstreams := fs.String("upstreams", "", "Comma separated list of upstreams to test as well")
+	skipDownstream := fs.Bool("skip-downstream", false, "Do not test the public listener, for client only services")
+	_, err := fs.Parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	if *adminToken == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: an admin token is required")
+		return 2
+	}
+
+	paths := []string{}
+	if !*skipDownstream {
+		paths = append(paths, "/selftest/downstream")
+	}
+	for _, up := range strings.Split(*upstreams, ",") {
+		up = strings.TrimSpace(up)
+		if up != "" {
+			paths = append(paths, "/selftest/upstream/"+url.PathEscape(up))
+		}
+	}
+
+	scheme := "http"
+	client := &http.Client{Timeout: checkTimeout}
+	if *statsTLS {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	failed := false
+	for _, p := range paths {
+		req, err := http.NewRequest(http.MethodPost, scheme+"://"+*statsAddr+p, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", p, err)
+			failed = true
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		status := "OK"
+		if resp.StatusCode != http.StatusOK {
+			status = "FAILED"
+			failed = true
+		}
+		fmt.Printf("%s %s: %s\n", status, p, strings.TrimSpace(string(body)))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
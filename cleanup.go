@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/stats"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/tproxy"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	"github.com/hashicorp/consul/api"
+)
+
+const cleanupDialTimeout = time.Second
+
+// runCleanup implements the cleanup subcommand, it removes what the
+// processes which did not exit cleanly left behind and returns the exit code
+func runCleanup(args []string) int {
+	fs := utils.NewFlags(flag.NewFlagSet("cleanup", flag.ExitOnError), utils.FlagEnvPrefix)
+	baseDir := fs.String("haproxy-cfg-base-path", "/tmp", "Base path of the config directories, the ones of running HAProxy processes are kept")
+	secretsDir := fs.String("secrets-dir", "", "Directory of the -secrets-dir directories, the ones of the kept config directories are kept")
+	consulAddr := fs.String("http-addr", "127.0.0.1:8500", "Consul agent address: host:port, https://host:port or unix:///path/to/consul.sock")
+	consulTLS := addConsulTLSFlags(fs.FlagSet)
+	token := fs.String("token", "", "Consul ACL token")
+	service := fs.String("sidecar-for", "", "The consul service id proxied, its stats service is deregistered")
+	registerProxy := fs.String("register-proxy", "", "Path of the -register-proxy registration file, the proxy is deregistered. Requires -sidecar-for")
+	transparentProxy := fs.Bool("transparent-proxy", false, "Remove the iptables redirection of -transparent-proxy")
+	iptablesBin := fs.String("iptables", tproxy.DefaultIPTablesBin, "iptables binary of the -transparent-proxy redirection")
+	dryRun := fs.Bool("dry-run", false, "Only list the leftovers")
+	_, err := fs.Parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	if *registerProxy != "" && *service == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: -register-proxy requires -sidecar-for")
+		return 2
+	}
+	if err := validateConsulAddr(*consulAddr); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	if err := validateConsulTLS(consulTLS); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	leftovers := []leftover{}
+
+	dirs, err := filepath.Glob(filepath.Join(*baseDir, "haproxy-connect-*"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	for _, dir := range dirs {
+		if !staleConfigDir(dir) {
+			fmt.Printf("in use config directory %s: kept\n", dir)
+			continue
+		}
+		dir := dir
+		leftovers = append(leftovers, leftover{
+			Artifact: lib.PathArtifact("config directory", dir),
+			remove:   func() error { return os.RemoveAll(dir) },
+		})
+	}
+
+	if *secretsDir != "" {
+		dirs, err := filepath.Glob(filepath.Join(*secretsDir, "haproxy-connect-*"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		for _, dir := range dirs {
+			// the cached configs of -bootstrap-from-cache are files
+			if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+				continue
+			}
+			configDir := filepath.Join(*baseDir, filepath.Base(dir))
+			if _, err := os.Stat(configDir); err == nil && !staleConfigDir(configDir) {
+				fmt.Printf("in use secrets directory %s: kept\n", dir)
+				continue
+			}
+			dir := dir
+			leftovers = append(leftovers, leftover{
+				Artifact: lib.PathArtifact("secrets directory", dir),
+				remove:   func() error { return os.RemoveAll(dir) },
+			})
+		}
+	}
+
+	if *service != "" {
+		cfg := newConsulConfig(*consulAddr, consulTLS)
+		cfg.Token = *token
+		client, err := api.NewClient(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		ids := map[string]string{stats.ServiceID(*service): "stats service"}
+		if *registerProxy != "" {
+			reg, err := consul.LoadProxyRegistration(*registerProxy, *service)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+				return 2
+			}
+			ids[reg.ID] = "sidecar proxy"
+		}
+		for id, kind := range ids {
+			id := id
+			leftovers = append(leftovers, leftover{
+				Artifact: consul.ServiceArtifact(client, kind, id),
+				remove:   func() error { return client.Agent().ServiceDeregister(id) },
+			})
+		}
+	}
+
+	if *transparentProxy {
+		tp := tproxy.Config{IPTablesBin: *iptablesBin}
+		leftovers = append(leftovers, leftover{
+			Artifact: lib.Artifact{Kind: "iptables chain", Name: tproxy.Chain, Exists: tp.Installed},
+			remove:   tp.Cleanup,
+		})
+	}
+
+	failed := false
+	for _, l := range leftovers {
+		exists, err := l.Exists()
+		switch {
+		case err != nil:
+			fmt.Printf("FAILED %s %s: %s\n", l.Kind, l.Name, err)
+			failed = true
+		case !exists:
+		case *dryRun:
+			fmt.Printf("left %s %s\n", l.Kind, l.Name)
+		default:
+			if err := l.remove(); err != nil {
+				fmt.Printf("FAILED %s %s: %s\n", l.Kind, l.Name, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("removed %s %s\n", l.Kind, l.Name)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// leftover is an artifact the cleanup subcommand can remove
+type leftover struct {
+	lib.Artifact
+	remove func() error
+}
+
+// staleConfigDir tells whether no HAProxy answers on the sockets of a
+// config directory, its process exited
+func staleConfigDir(dir string) bool {
+	for _, sock := range []string{"haproxy-master.sock", "haproxy.sock"} {
+		conn, err := net.DialTimeout("unix", filepath.Join(dir, sock), cleanupDialTimeout)
+		if err == nil {
+			conn.Close()
+			return false
+		}
+	}
+	return true
+}
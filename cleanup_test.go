@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	require.True(t, staleConfigDir(dir))
+
+	lis, err := net.Listen("unix", filepath.Join(dir, "haproxy.sock"))
+	require.NoError(t, err)
+	defer lis.Close()
+	require.False(t, staleConfigDir(dir))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+)
+
+// subcommand is a subcommand parsing its own flags, it returns its exit
+// code
+type subcommand struct {
+	name  string
+	short string
+	run   func(args []string) int
+}
+
+// subcommands are the subcommands with their own flags, run, render and
+// validate share the flags of the proxy
+var subcommands = []subcommand{
+	{"check", "Run the self-tests of a running instance", runCheck},
+	{"chaos", "Run HAProxy with configs generated without Consul and report the latency of the applies", runChaos},
+	{"cleanup", "Remove what the processes which did not exit cleanly left behind", runCleanup},
+	{"stats", "Print the metrics or the health summary of a running instance", runStats},
+	{"version", "Print the version", runVersion},
+}
+
+// newCommand builds the command line. The flags are parsed by each
+// subcommand with the flag package, so that they keep their -name form
+// and their CONNECT_ environment variables.
+func newCommand(code *int) *cobra.Command {
+	root := &cobra.Command{
+		Use:           "haproxy-consul-connect",
+		Short:         "Consul Connect sidecar proxy running HAProxy",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		CompletionOptions: cobra.CompletionOptions{
+			DisableDefaultCmd: true,
+		},
+	}
+
+	for _, mode := range []struct{ name, short string }{
+		{"run", "Run the proxy, the default"},
+		{"render", "Print the HAProxy config generated from the current Consul state and exit"},
+		{"validate", "Check the HAProxy config generated from the current Consul state and exit"},
+	} {
+		name := mode.name
+		root.AddCommand(&cobra.Command{
+			Use:                name + " [flags]",
+			Short:              mode.short,
+			DisableFlagParsing: true,
+			Run: func(cmd *cobra.Command, args []string) {
+				runProxy(name, args)
+			},
+		})
+	}
+	for _, sub := range subcommands {
+		run := sub.run
+		root.AddCommand(&cobra.Command{
+			Use:                sub.name + " [flags]",
+			Short:              sub.short,
+			DisableFlagParsing: true,
+			Run: func(cmd *cobra.Command, args []string) {
+				*code = run(args)
+			},
+		})
+	}
+	root.InitDefaultHelpCmd()
+	return root
+}
+
+// withSubcommand returns the arguments of the command line with run added
+// when it has no subcommand, to keep the command lines without one working,
+// eg: with -render-only or -version. Only the first argument can be the
+// subcommand, a flag value named like one is not.
+func withSubcommand(root *cobra.Command, args []string) []string {
+	if len(args) > 0 {
+		cmd, _, err := root.Find(args[:1])
+		if err == nil && cmd != root {
+			return args
+		}
+	}
+	return append([]string{"run"}, args...)
+}
+
+// execute runs the subcommand of the command line and returns its exit
+// code
+func execute(args []string) int {
+	code := 0
+	root := newCommand(&code)
+	root.SetArgs(withSubcommand(root, args))
+	err := root.Execute()
+	if err != nil {
+		root.PrintErrln("ERROR:", err)
+		return int(lib.ExitConfig)
+	}
+	return code
+}
@@ -0,0 +1,107 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-version"
+)
+
+// MinConsulVersion is the oldest Consul agent supported
+const MinConsulVersion = "1.10.0"
+
+// peeringVersion is the first Consul version with cluster peering
+var peeringVersion = version.Must(version.NewVersion("1.13.0"))
+
+// AgentInfo describes the features of the local Consul agent
+type AgentInfo struct {
+	Version        *version.Version
+	Datacenter     string
+	Enterprise     bool
+	ConnectEnabled bool
+	PeeringEnabled bool
+	GRPCPort       int
+}
+
+// CheckAgent queries the local agent and checks it can serve the sidecar,
+// the errors tell how to fix the agent configuration
+func CheckAgent(client *api.Client) (*AgentInfo, error) {
+	self, err := client.Agent().Self()
+	if err != nil {
+		return nil, ExitError(err)
+	}
+	info, err := parseAgentSelf(self)
+	if err != nil {
+		return nil, lib.NewExitError(lib.ExitDependencies, err)
+	}
+	return info, info.Validate()
+}
+
+func parseAgentSelf(self map[string]map[string]interface{}) (*AgentInfo, error) {
+	cfg, debug := self["Config"], self["DebugConfig"]
+
+	raw, _ := cfg["Version"].(string)
+	v, err := version.NewVersion(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the Consul agent version %q: %w", raw, err)
+	}
+
+	info := &AgentInfo{Version: v}
+	info.Datacenter, _ = cfg["Datacenter"].(string)
+	meta, _ := cfg["VersionMetadata"].(string)
+	info.Enterprise = meta == "ent" || strings.HasSuffix(raw, "+ent")
+	info.ConnectEnabled, _ = debug["ConnectEnabled"].(bool)
+	info.PeeringEnabled, _ = debug["PeeringEnabled"].(bool)
+	if p, ok := debug["GRPCPort"].(float64); ok {
+		info.GRPCPort = int(p)
+	}
+	return info, nil
+}
+
+// Validate checks the agent has the features every sidecar needs
+func (a *AgentInfo) Validate() error {
+	if a.Version.LessThan(version.Must(version.NewVersion(MinConsulVersion))) {
+		return lib.NewExitError(lib.ExitDependencies, fmt.Errorf("consul %s is not supported, upgrade the agent to %s or later", a.Version, MinConsulVersion))
+	}
+	if !a.ConnectEnabled {
+		return lib.NewExitError(lib.ExitConfig, fmt.Errorf("connect is disabled on the consul agent, set `connect { enabled = true }` in its configuration"))
+	}
+	return nil
+}
+
+// CheckTenancy checks the agent supports a namespace and an admin partition,
+// only the default ones exist on Consul CE
+func (a *AgentInfo) CheckTenancy(namespace, partition string) error {
+	if a == nil || a.Enterprise {
+		return nil
+	}
+	if namespace != "" && namespace != "default" {
+		return fmt.Errorf("namespace %s requires Consul Enterprise", namespace)
+	}
+	if partition != "" && partition != "default" {
+		return fmt.Errorf("partition %s requires Consul Enterprise", partition)
+	}
+	return nil
+}
+
+// CheckUpstream checks the agent supports the features used by an upstream,
+// any upstream is accepted when the agent could not be checked
+func (a *AgentInfo) CheckUpstream(up api.Upstream) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.CheckTenancy(up.DestinationNamespace, up.DestinationPartition); err != nil {
+		return err
+	}
+	if up.DestinationPeer != "" {
+		if a.Version.LessThan(peeringVersion) {
+			return fmt.Errorf("peer %s requires Consul %s or later, the agent runs %s", up.DestinationPeer, peeringVersion, a.Version)
+		}
+		if !a.PeeringEnabled {
+			return fmt.Errorf("peer %s requires cluster peering, set `peering { enabled = true }` in the consul agent configuration", up.DestinationPeer)
+		}
+	}
+	return nil
+}
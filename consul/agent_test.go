@@ -0,0 +1,39 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentSelf(t *testing.T) {
+	self := map[string]map[string]interface{}{
+		"Config":      {"Version": "1.17.2", "Datacenter": "dc1"},
+		"DebugConfig": {"ConnectEnabled": true, "PeeringEnabled": false, "GRPCPort": float64(8502)},
+	}
+	info, err := parseAgentSelf(self)
+	require.NoError(t, err)
+	require.NoError(t, info.Validate())
+	require.Equal(t, "dc1", info.Datacenter)
+	require.Equal(t, 8502, info.GRPCPort)
+
+	require.NoError(t, info.CheckUpstream(api.Upstream{DestinationName: "api"}))
+	require.Error(t, info.CheckUpstream(api.Upstream{DestinationName: "api", DestinationNamespace: "team"}))
+	require.Error(t, info.CheckUpstream(api.Upstream{DestinationName: "api", DestinationPeer: "other"}))
+	require.NoError(t, info.CheckTenancy("default", ""))
+	require.Error(t, info.CheckTenancy("", "team"))
+	info.Enterprise = true
+	require.NoError(t, info.CheckTenancy("team", "team"))
+
+	self["DebugConfig"]["ConnectEnabled"] = false
+	info, err = parseAgentSelf(self)
+	require.NoError(t, err)
+	require.Equal(t, lib.ExitConfig, lib.ExitCodeOf(info.Validate()))
+
+	self["Config"]["Version"] = "1.8.0"
+	info, err = parseAgentSelf(self)
+	require.NoError(t, err)
+	require.Equal(t, lib.ExitDependencies, lib.ExitCodeOf(info.Validate()))
+}
@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// agentless tells if the watcher queries the Consul servers directly, the
+// proxy is then looked up in the catalog of its node instead of the local
+// agent
+func (w *Watcher) agentless() bool {
+	return w.opts.NodeName != ""
+}
+
+// nodeServices indexes the services of a node by id, an unknown node has no
+// services
+func nodeServices(list *api.CatalogNodeServiceList) map[string]*api.AgentService {
+	services := map[string]*api.AgentService{}
+	if list == nil {
+		return services
+	}
+	for _, s := range list.Services {
+		services[s.ID] = s
+	}
+	return services
+}
+
+// localServices lists the services registered next to the proxy
+func (w *Watcher) localServices() (map[string]*api.AgentService, error) {
+	if !w.agentless() {
+		return w.client().AgentServices()
+	}
+	list, _, err := w.client().NodeServiceList(w.opts.NodeName, &api.QueryOptions{
+		Token: w.currentToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodeServices(list), nil
+}
+
+// localService returns a service registered next to the proxy
+func (w *Watcher) localService(id string) (*api.AgentService, error) {
+	if !w.agentless() {
+		srv, _, err := w.client().AgentService(id, &api.QueryOptions{})
+		return srv, err
+	}
+	services, err := w.localServices()
+	if err != nil {
+		return nil, err
+	}
+	srv, ok := services[id]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found on node %s", id, w.opts.NodeName)
+	}
+	return srv, nil
+}
+
+// watchNodeService is watchService for the agentless mode. The catalog has
+// no blocking query on a single service instance, so all the services of the
+// node are watched and the handler only runs when the proxy changed.
+func (w *Watcher) watchNodeService(service string, handler func(first bool, srv *api.AgentService)) {
+	w.log.Infof("consul: watching service %s on node %s", service, w.opts.NodeName)
+
+	var lastIndex uint64
+	var last *api.AgentService
+	first := true
+	b := w.newBackoff()
+	for w.acquireQuery(w.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		list, meta, err := w.client().NodeServiceList(w.opts.NodeName, w.blocking(w.ctx, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			Token:     token,
+		}))
+		w.releaseQuery()
+		w.observeQuery("service", start)
+		if w.ctx.Err() != nil {
+			return
+		}
+		var srv *api.AgentService
+		if err == nil {
+			var ok bool
+			srv, ok = nodeServices(list)[service]
+			if !ok {
+				err = fmt.Errorf("not found on node %s", w.opts.NodeName)
+			}
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching service %s definition: %s", service, err)
+			w.waitAfterError(w.ctx, b, err, token)
+			lastIndex = 0
+			continue
+		}
+		b.reset()
+
+		lastIndex, _ = w.nextIndex("service", service, lastIndex, meta.LastIndex)
+
+		if first || !reflect.DeepEqual(srv, last) {
+			w.log.Debugf("consul: service %s changed", service)
+			handler(first, srv)
+			w.notifyChanged()
+		}
+
+		last = srv
+		first = false
+	}
+}
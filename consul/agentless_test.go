@@ -0,0 +1,22 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeServices(t *testing.T) {
+	require.Empty(t, nodeServices(nil))
+
+	services := nodeServices(&api.CatalogNodeServiceList{
+		Node: &api.Node{Node: "node1"},
+		Services: []*api.AgentService{
+			{ID: "web", Service: "web"},
+			{ID: "web-sidecar-proxy", Service: "web-sidecar-proxy", Kind: api.ServiceKindConnectProxy},
+		},
+	})
+	require.Len(t, services, 2)
+	require.Equal(t, api.ServiceKindConnectProxy, services["web-sidecar-proxy"].Kind)
+}
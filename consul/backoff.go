@@ -0,0 +1,116 @@
+package consul
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// backoffMin is the wait after the first error of a watch, doubled
+	// after each consecutive error up to backoffMax
+	backoffMin = time.Second
+	backoffMax = time.Minute
+
+	// unreachableWarn and unreachableError are how long Consul has been
+	// unreachable before it is logged as a warning, then as an error
+	// repeated every unreachableRepeat
+	unreachableWarn   = time.Minute
+	unreachableError  = 5 * time.Minute
+	unreachableRepeat = 5 * time.Minute
+)
+
+// backoff spaces the retries of a watch after consecutive errors, with a
+// jitter so that the watches and the sidecars failing together do not
+// retry together
+type backoff struct {
+	cur time.Duration
+	w   *Watcher
+}
+
+func (w *Watcher) newBackoff() *backoff {
+	return &backoff{w: w}
+}
+
+// next returns the wait before the next retry
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = backoffMin
+	} else {
+		b.cur *= 2
+	}
+	if b.cur > backoffMax {
+		b.cur = backoffMax
+	}
+	return jitter(b.cur)
+}
+
+// reset is called after a successful query
+func (b *backoff) reset() {
+	b.cur = 0
+	if b.w.outage.reached(b.w.log, time.Now()) {
+		b.w.opts.Metrics.SetGauge("connect_consul_staleness_seconds", 0, nil)
+	}
+}
+
+// unreachable tells the errors of a Consul that cannot be reached or
+// answer from the errors of the queries it answered, eg: not found
+func unreachable(err error) bool {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError
+	}
+	return ExitError(err).Code == lib.ExitConsulUnreachable
+}
+
+// outage tracks since when the queries to Consul fail, across the watches
+type outage struct {
+	lock   sync.Mutex
+	since  time.Time
+	logged time.Time
+	// level is the severity logged: 0 none, 1 warning, 2 error
+	level int
+}
+
+// failed records a failed query and returns since how long the queries
+// fail. Consul is logged as unreachable at an escalating severity the
+// longer they fail.
+func (o *outage) failed(log Logger, err error, now time.Time) time.Duration {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.since.IsZero() {
+		o.since = now
+	}
+	d := now.Sub(o.since).Round(time.Second)
+	switch {
+	case d >= unreachableError && (o.level < 2 || now.Sub(o.logged) >= unreachableRepeat):
+		log.Errorf("consul: unreachable for %s, the config is not updated anymore: %s", d, err)
+		o.level = 2
+		o.logged = now
+	case d >= unreachableWarn && o.level < 1:
+		log.Warnf("consul: unreachable for %s: %s", d, err)
+		o.level = 1
+		o.logged = now
+	}
+	return now.Sub(o.since)
+}
+
+// reached records a successful query, it returns true when it ends an
+// outage
+func (o *outage) reached(log Logger, now time.Time) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.since.IsZero() {
+		return false
+	}
+	if o.level > 0 {
+		log.Infof("consul: reachable again after %s", now.Sub(o.since).Round(time.Second))
+	}
+	o.since = time.Time{}
+	o.level = 0
+	return true
+}
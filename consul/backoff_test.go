@@ -0,0 +1,61 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	w := New("svc", nil, NewTestingLogger(t))
+	b := w.newBackoff()
+
+	d := b.next()
+	require.InDelta(t, float64(backoffMin), float64(d), pollJitter*float64(backoffMin))
+	d = b.next()
+	require.InDelta(t, float64(2*backoffMin), float64(d), pollJitter*float64(2*backoffMin))
+
+	for i := 0; i < 10; i++ {
+		d = b.next()
+	}
+	require.InDelta(t, float64(backoffMax), float64(d), pollJitter*float64(backoffMax))
+
+	b.reset()
+	d = b.next()
+	require.InDelta(t, float64(backoffMin), float64(d), pollJitter*float64(backoffMin))
+}
+
+func TestOutage(t *testing.T) {
+	log := NewTestingLogger(t)
+	o := &outage{}
+	err := errors.New("connection refused")
+	start := time.Now()
+
+	o.failed(log, err, start)
+	require.Equal(t, 0, o.level)
+	o.failed(log, err, start.Add(unreachableWarn))
+	require.Equal(t, 1, o.level)
+	o.failed(log, err, start.Add(unreachableError))
+	require.Equal(t, 2, o.level)
+	require.Equal(t, start.Add(unreachableError), o.logged)
+
+	// the error is repeated
+	o.failed(log, err, start.Add(unreachableError+time.Minute))
+	require.Equal(t, start.Add(unreachableError), o.logged)
+	o.failed(log, err, start.Add(unreachableError+unreachableRepeat))
+	require.Equal(t, start.Add(unreachableError+unreachableRepeat), o.logged)
+
+	o.reached(log, start.Add(time.Hour))
+	require.Equal(t, 0, o.level)
+	require.True(t, o.since.IsZero())
+}
+
+func TestUnreachable(t *testing.T) {
+	require.True(t, unreachable(errors.New("dial tcp 127.0.0.1:8500: connect: connection refused")))
+	require.True(t, unreachable(api.StatusError{Code: 500, Body: "No cluster leader"}))
+	require.False(t, unreachable(api.StatusError{Code: 404, Body: "not found"}))
+	require.False(t, unreachable(api.StatusError{Code: 403, Body: "Permission denied"}))
+}
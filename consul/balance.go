@@ -0,0 +1,21 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var balanceRe = regexp.MustCompile(`^(roundrobin|leastconn|source|uri|hdr\([A-Za-z0-9_-]+\))$`)
+
+// parseBalance checks a load balancing algorithm set in a proxy or upstream
+// config
+func parseBalance(v interface{}) (string, error) {
+	b, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %T", v)
+	}
+	if !balanceRe.MatchString(b) {
+		return "", fmt.Errorf("%s is not one of roundrobin, leastconn, source, uri or hdr(<name>)", b)
+	}
+	return b, nil
+}
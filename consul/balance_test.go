@@ -0,0 +1,20 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBalance(t *testing.T) {
+	for _, b := range []string{"roundrobin", "leastconn", "source", "uri", "hdr(X-User-Id)"} {
+		v, err := parseBalance(b)
+		require.NoError(t, err)
+		require.Equal(t, b, v)
+	}
+
+	for _, b := range []interface{}{"random", "hdr()", "hdr(a b)", "leastconn\nbackend x", 1} {
+		_, err := parseBalance(b)
+		require.Error(t, err)
+	}
+}
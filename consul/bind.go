@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BindOptions are the socket options of a public listener
+type BindOptions struct {
+	// NoReusePort disables SO_REUSEPORT, which HAProxy only has as a global
+	// setting: it applies to all the listeners
+	NoReusePort bool
+	// Transparent binds an address not local to the host, eg: for TPROXY
+	Transparent bool
+	// V4v6 accepts IPv4 connections on an IPv6 wildcard address
+	V4v6 bool
+	// Interface restricts the listener to a network interface
+	Interface string
+	// Backlog is the accept queue of the socket, the maxconn of the
+	// listener when 0
+	Backlog int
+}
+
+// parseBindOptions reads the bind_* keys of a listener config, the keys not
+// set keep their value in b
+func parseBindOptions(b BindOptions, c map[string]interface{}) (BindOptions, error) {
+	if v, ok := c["bind_reuseport"]; ok {
+		r, ok := v.(bool)
+		if !ok {
+			return b, fmt.Errorf("bind_reuseport: expected a bool, got %T", v)
+		}
+		b.NoReusePort = !r
+	}
+	if v, ok := c["bind_transparent"]; ok {
+		t, ok := v.(bool)
+		if !ok {
+			return b, fmt.Errorf("bind_transparent: expected a bool, got %T", v)
+		}
+		b.Transparent = t
+	}
+	if v, ok := c["bind_v4v6"]; ok {
+		t, ok := v.(bool)
+		if !ok {
+			return b, fmt.Errorf("bind_v4v6: expected a bool, got %T", v)
+		}
+		b.V4v6 = t
+	}
+	if v, ok := c["bind_interface"]; ok {
+		i, ok := v.(string)
+		if !ok {
+			return b, fmt.Errorf("bind_interface: expected a string, got %T", v)
+		}
+		// the name ends up as is on the bind line
+		if strings.ContainsAny(i, " \t\r\n/") {
+			return b, fmt.Errorf("bind_interface: expected an interface name, got %q", i)
+		}
+		b.Interface = i
+	}
+	if v, ok := c["bind_backlog"]; ok {
+		n, err := parseLimit(v)
+		if err != nil {
+			return b, fmt.Errorf("bind_backlog: %s", err)
+		}
+		b.Backlog = n
+	}
+	return b, nil
+}
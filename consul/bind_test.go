@@ -0,0 +1,35 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBindOptions(t *testing.T) {
+	b, err := parseBindOptions(BindOptions{}, map[string]interface{}{
+		"bind_reuseport":   false,
+		"bind_transparent": true,
+		"bind_interface":   "eth0",
+		"bind_backlog":     float64(4096),
+	})
+	require.NoError(t, err)
+	require.Equal(t, BindOptions{NoReusePort: true, Transparent: true, Interface: "eth0", Backlog: 4096}, b)
+
+	// extra listeners override the options of the main one
+	b, err = parseBindOptions(b, map[string]interface{}{
+		"bind_v4v6":      true,
+		"bind_reuseport": true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, BindOptions{Transparent: true, V4v6: true, Interface: "eth0", Backlog: 4096}, b)
+
+	_, err = parseBindOptions(b, map[string]interface{}{"bind_v4v6": "yes"})
+	require.Error(t, err)
+	_, err = parseBindOptions(b, map[string]interface{}{"bind_backlog": float64(-1)})
+	require.Error(t, err)
+	_, err = parseBindOptions(b, map[string]interface{}{"bind_interface": "eth0 transparent"})
+	require.Error(t, err)
+	_, err = parseBindOptions(b, map[string]interface{}{"bind_interface": "eth0\n\tbind :80"})
+	require.Error(t, err)
+}
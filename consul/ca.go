@@ -0,0 +1,192 @@
+package consul
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	DefaultCARootOverlap = time.Hour
+
+	caRotationCheckInterval = time.Minute
+)
+
+type caRoot struct {
+	ID        string
+	PEM       []byte
+	Active    bool
+	RetiredAt time.Time
+}
+
+// caRotation tracks a change of the active CA root until the leaf has been
+// reissued by the new root and the previous roots have been dropped
+type caRotation struct {
+	From    string
+	To      string
+	Started time.Time
+}
+
+// handleCARoots merges the roots returned by Consul with the known ones.
+// Roots removed by Consul are kept in the bundle for the configured overlap
+// and until the leaf is signed by the active root, so that peers still
+// presenting a certificate from the old root are accepted mid-rotation.
+// Must be called with the lock held.
+func (w *Watcher) handleCARoots(caList *api.CARootList) {
+	now := time.Now()
+	seen := map[string]bool{}
+
+	for _, r := range caList.Roots {
+		seen[r.ID] = true
+		w.caRoots[r.ID] = &caRoot{
+			ID:     r.ID,
+			PEM:    []byte(r.RootCertPEM),
+			Active: r.ID == caList.ActiveRootID,
+		}
+	}
+
+	for id, r := range w.caRoots {
+		if seen[id] || !r.RetiredAt.IsZero() {
+			continue
+		}
+		r.Active = false
+		r.RetiredAt = now
+		w.log.Infof("consul: CA root %s removed, keeping it for %s and until the leaf cert is reissued", id, w.opts.CARootOverlap)
+	}
+
+	if w.activeRootID != "" && w.activeRootID != caList.ActiveRootID {
+		w.caRotation = &caRotation{
+			From:    w.activeRootID,
+			To:      caList.ActiveRootID,
+			Started: now,
+		}
+		w.log.Warnf("consul: CA rotation started from root %s to root %s", w.activeRootID, caList.ActiveRootID)
+	}
+	w.activeRootID = caList.ActiveRootID
+
+	w.pruneCARoots(now)
+}
+
+// pruneCARoots drops retired roots which are no longer needed and rebuilds
+// the CA bundle. It returns true when the bundle changed.
+// Must be called with the lock held.
+func (w *Watcher) pruneCARoots(now time.Time) bool {
+	leafReissued := w.leafSignedByActiveRoot()
+
+	changed := false
+	for id, r := range w.caRoots {
+		if r.RetiredAt.IsZero() || now.Sub(r.RetiredAt) < w.opts.CARootOverlap || !leafReissued {
+			continue
+		}
+		w.log.Infof("consul: dropping retired CA root %s", id)
+		delete(w.caRoots, id)
+		changed = true
+	}
+
+	if w.caRotation != nil && leafReissued && !w.hasRetiredCARoots() {
+		w.log.Infof("consul: CA rotation to root %s complete after %s", w.caRotation.To, now.Sub(w.caRotation.Started).Round(time.Second))
+		w.caRotation = nil
+	}
+
+	ids := make([]string, 0, len(w.caRoots))
+	for id := range w.caRoots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// the previous bundle is shared with the configs already generated, it
+	// is replaced instead of rebuilt in place
+	cas := make([][]byte, 0, len(ids))
+	w.certCAPool = x509.NewCertPool()
+	for _, id := range ids {
+		cas = append(cas, w.caRoots[id].PEM)
+		ok := w.certCAPool.AppendCertsFromPEM(w.caRoots[id].PEM)
+		if !ok {
+			w.log.Warnf("consul: unable to add CA certificate to pool for root id: %s", id)
+		}
+	}
+	w.certCAs = cas
+
+	return changed
+}
+
+func (w *Watcher) hasRetiredCARoots() bool {
+	for _, r := range w.caRoots {
+		if !r.RetiredAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// leafSignedByActiveRoot checks the leaf chain against the active root only.
+// Must be called with the lock held.
+func (w *Watcher) leafSignedByActiveRoot() bool {
+	root, ok := w.caRoots[w.activeRootID]
+	if !ok || w.leaf == nil || len(w.leaf.Cert) == 0 {
+		return false
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(root.PEM) {
+		return false
+	}
+
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	rest := w.leaf.Cert
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return false
+		}
+		if leaf == nil {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if leaf == nil {
+		return false
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// monitorCARotation periodically drops the retired roots once they are no
+// longer needed
+func (w *Watcher) monitorCARotation() {
+	ticker := time.NewTicker(caRotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+
+		w.lock.Lock()
+		changed := false
+		if w.hasRetiredCARoots() {
+			changed = w.pruneCARoots(time.Now())
+		}
+		w.lock.Unlock()
+
+		if changed {
+			w.notifyChanged()
+		}
+	}
+}
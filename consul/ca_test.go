@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent = tmpl
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCARotation(t *testing.T) {
+	w := NewWithOptions("svc", nil, NewTestingLogger(t), Options{CARootOverlap: time.Minute})
+
+	_, _, root1PEM := testCert(t, "root1", nil, nil)
+	root2, root2Key, root2PEM := testCert(t, "root2", nil, nil)
+	_, _, leafPEM := testCert(t, "leaf", root2, root2Key)
+
+	w.handleCARoots(&api.CARootList{
+		ActiveRootID: "1",
+		Roots:        []*api.CARoot{{ID: "1", RootCertPEM: string(root1PEM), Active: true}},
+	})
+	require.Equal(t, [][]byte{root1PEM}, w.certCAs)
+	require.Nil(t, w.caRotation)
+
+	w.handleCARoots(&api.CARootList{
+		ActiveRootID: "2",
+		Roots:        []*api.CARoot{{ID: "2", RootCertPEM: string(root2PEM), Active: true}},
+	})
+	require.Equal(t, [][]byte{root1PEM, root2PEM}, w.certCAs)
+	require.NotNil(t, w.caRotation)
+	require.Equal(t, "1", w.caRotation.From)
+	require.Equal(t, "2", w.caRotation.To)
+
+	// overlap elapsed but the leaf was not reissued yet
+	require.False(t, w.pruneCARoots(time.Now().Add(2*time.Minute)))
+	require.Len(t, w.certCAs, 2)
+
+	w.leaf = &certLeaf{Cert: leafPEM}
+
+	// leaf reissued but overlap not elapsed
+	require.False(t, w.pruneCARoots(time.Now()))
+	require.Len(t, w.certCAs, 2)
+
+	// the bundle handed out before is left untouched
+	previous := w.certCAs
+	require.True(t, w.pruneCARoots(time.Now().Add(2*time.Minute)))
+	require.Equal(t, [][]byte{root2PEM}, w.certCAs)
+	require.Equal(t, [][]byte{root1PEM, root2PEM}, previous)
+	require.Nil(t, w.caRotation)
+}
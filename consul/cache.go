@@ -0,0 +1,40 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/hashicorp/consul/api"
+)
+
+// CacheOptions has the leaf certificate and CA roots served by the agent
+// cache, which refreshes them in the background
+type CacheOptions struct {
+	Enabled bool
+	// MaxAge is how old a cached value can be before the agent fetches it
+	// again from the servers, 0 leaves it to the background refresh
+	MaxAge time.Duration
+	// StaleIfError is how old a cached value can be when the servers cannot
+	// be reached, 0 keeps the agent default
+	StaleIfError time.Duration
+}
+
+// cached returns the query options with the agent cache settings applied
+func (w *Watcher) cached(q *api.QueryOptions) *api.QueryOptions {
+	if !w.opts.Cache.Enabled {
+		return q
+	}
+	q.UseCache = true
+	q.MaxAge = w.opts.Cache.MaxAge
+	q.StaleIfError = w.opts.Cache.StaleIfError
+	return q
+}
+
+// observeCache counts the queries answered from the agent cache
+func (w *Watcher) observeCache(watch string, meta *api.QueryMeta) {
+	if !meta.CacheHit {
+		return
+	}
+	w.opts.Metrics.IncrCounter("connect_consul_cache_hits_total", 1, metrics.Labels{"watch": watch})
+	w.log.Debugf("consul: %s served by the agent cache, age %s", watch, meta.CacheAge)
+}
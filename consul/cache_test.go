@@ -0,0 +1,28 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCached(t *testing.T) {
+	w := New("svc", nil, NewTestingLogger(t))
+	q := w.cached(&api.QueryOptions{WaitIndex: 10})
+	require.Equal(t, &api.QueryOptions{WaitIndex: 10}, q)
+
+	w = NewWithOptions("svc", nil, NewTestingLogger(t), Options{Cache: CacheOptions{
+		Enabled:      true,
+		MaxAge:       time.Minute,
+		StaleIfError: time.Hour,
+	}})
+	q = w.cached(&api.QueryOptions{WaitIndex: 10})
+	require.Equal(t, &api.QueryOptions{
+		WaitIndex:    10,
+		UseCache:     true,
+		MaxAge:       time.Minute,
+		StaleIfError: time.Hour,
+	}, q)
+}
@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulClient is the part of the Consul API used by the watcher. It is
+// implemented for an *api.Client by NewClient, and by consultest.Client to
+// run the watcher against a simulated topology.
+type ConsulClient interface {
+	// AgentService is Agent().Service
+	AgentService(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error)
+	// AgentServices is Agent().Services
+	AgentServices() (map[string]*api.AgentService, error)
+	// ConnectCALeaf is Agent().ConnectCALeaf
+	ConnectCALeaf(service string, q *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error)
+	// ConnectCARoots is Agent().ConnectCARoots
+	ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error)
+	// HealthConnect is Health().Connect
+	HealthConnect(service, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+	// PreparedQueryExecute is PreparedQuery().Execute
+	PreparedQueryExecute(query string, q *api.QueryOptions) (*api.PreparedQueryExecuteResponse, *api.QueryMeta, error)
+	// NodeServiceList is Catalog().NodeServiceList
+	NodeServiceList(node string, q *api.QueryOptions) (*api.CatalogNodeServiceList, *api.QueryMeta, error)
+	// ConfigEntry is ConfigEntries().Get
+	ConfigEntry(kind, name string, q *api.QueryOptions) (api.ConfigEntry, *api.QueryMeta, error)
+	// ConfigEntries is ConfigEntries().List
+	ConfigEntries(kind string, q *api.QueryOptions) ([]api.ConfigEntry, *api.QueryMeta, error)
+	// PeeringRead is Peerings().Read
+	PeeringRead(ctx context.Context, name string, q *api.QueryOptions) (*api.Peering, *api.QueryMeta, error)
+}
+
+type apiClient struct {
+	c *api.Client
+}
+
+// NewClient wraps an *api.Client into a ConsulClient
+func NewClient(c *api.Client) ConsulClient {
+	return apiClient{c: c}
+}
+
+func (a apiClient) AgentService(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+	return a.c.Agent().Service(serviceID, q)
+}
+
+func (a apiClient) AgentServices() (map[string]*api.AgentService, error) {
+	return a.c.Agent().Services()
+}
+
+func (a apiClient) ConnectCALeaf(service string, q *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error) {
+	return a.c.Agent().ConnectCALeaf(service, q)
+}
+
+func (a apiClient) ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+	return a.c.Agent().ConnectCARoots(q)
+}
+
+func (a apiClient) HealthConnect(service, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	return a.c.Health().Connect(service, tag, passingOnly, q)
+}
+
+func (a apiClient) PreparedQueryExecute(query string, q *api.QueryOptions) (*api.PreparedQueryExecuteResponse, *api.QueryMeta, error) {
+	return a.c.PreparedQuery().Execute(query, q)
+}
+
+func (a apiClient) NodeServiceList(node string, q *api.QueryOptions) (*api.CatalogNodeServiceList, *api.QueryMeta, error) {
+	return a.c.Catalog().NodeServiceList(node, q)
+}
+
+func (a apiClient) ConfigEntry(kind, name string, q *api.QueryOptions) (api.ConfigEntry, *api.QueryMeta, error) {
+	return a.c.ConfigEntries().Get(kind, name, q)
+}
+
+func (a apiClient) ConfigEntries(kind string, q *api.QueryOptions) ([]api.ConfigEntry, *api.QueryMeta, error) {
+	return a.c.ConfigEntries().List(kind, q)
+}
+
+func (a apiClient) PeeringRead(ctx context.Context, name string, q *api.QueryOptions) (*api.Peering, *api.QueryMeta, error) {
+	return a.c.Peerings().Read(ctx, name, q)
+}
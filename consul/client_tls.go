@@ -0,0 +1,44 @@
+package consul
+
+import "fmt"
+
+// ClientTLS is a client certificate presented to the instances of an
+// upstream instead of the Connect one, eg: for an external API requiring its
+// own mTLS certificates
+type ClientTLS struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the certificates of the instances, they are not
+	// verified when empty
+	CAFile string
+}
+
+// parseClientTLS reads the tls_cert_file, tls_key_file and tls_ca_file keys
+// of an upstream config, it returns nil when none is set
+func parseClientTLS(config map[string]interface{}) (*ClientTLS, error) {
+	t := &ClientTLS{}
+	set := false
+	for key, dst := range map[string]*string{
+		"tls_cert_file": &t.CertFile,
+		"tls_key_file":  &t.KeyFile,
+		"tls_ca_file":   &t.CAFile,
+	} {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("%s: expected a path, got %v", key, v)
+		}
+		*dst = s
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	return t, nil
+}
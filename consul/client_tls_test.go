@@ -0,0 +1,31 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientTLS(t *testing.T) {
+	c, err := parseClientTLS(map[string]interface{}{"protocol": "http"})
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	c, err = parseClientTLS(map[string]interface{}{
+		"tls_cert_file": "/etc/certs/api.crt",
+		"tls_key_file":  "/etc/certs/api.key",
+		"tls_ca_file":   "/etc/certs/api-ca.crt",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &ClientTLS{
+		CertFile: "/etc/certs/api.crt",
+		KeyFile:  "/etc/certs/api.key",
+		CAFile:   "/etc/certs/api-ca.crt",
+	}, c)
+
+	_, err = parseClientTLS(map[string]interface{}{"tls_cert_file": "/etc/certs/api.crt"})
+	require.Error(t, err)
+
+	_, err = parseClientTLS(map[string]interface{}{"tls_cert_file": true, "tls_key_file": "/etc/certs/api.key"})
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+var compressionAlgos = map[string]bool{
+	"gzip":        true,
+	"deflate":     true,
+	"raw-deflate": true,
+	"identity":    true,
+}
+
+// Compression configures the compression of the HTTP responses of a
+// listener
+type Compression struct {
+	// Disabled removes the compression filter
+	Disabled bool
+	// Algos are the algorithms offered to the clients, by preference
+	Algos []string
+	// Types are the MIME types compressed, all when empty
+	Types []string
+	// MinSize is the size below which a response is not compressed
+	MinSize int
+}
+
+// ParseCompressionList splits a space or comma separated list of the
+// compression flags, the algorithms are checked
+func ParseCompressionList(s string, algos bool) ([]string, error) {
+	l := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if algos {
+		for _, a := range l {
+			if !compressionAlgos[a] {
+				return nil, fmt.Errorf("unknown compression algorithm %s, expected gzip, deflate, raw-deflate or identity", a)
+			}
+		}
+	}
+	return l, nil
+}
+
+// parseCompression reads the compression key of a listener or upstream
+// config, the fields not set keep their value in c
+func parseCompression(c Compression, v interface{}) (Compression, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return c, fmt.Errorf("expected an object, got %T", v)
+	}
+	if e, ok := m["enabled"]; ok {
+		b, ok := e.(bool)
+		if !ok {
+			return c, fmt.Errorf("enabled: expected a bool, got %T", e)
+		}
+		c.Disabled = !b
+	}
+	for key, dst := range map[string]*[]string{
+		"algorithms": &c.Algos,
+		"types":      &c.Types,
+	} {
+		l, ok := m[key]
+		if !ok {
+			continue
+		}
+		items, ok := l.([]interface{})
+		if !ok {
+			return c, fmt.Errorf("%s: expected a list, got %T", key, l)
+		}
+		values := make([]string, 0, len(items))
+		for _, i := range items {
+			s, ok := i.(string)
+			if !ok || s == "" || strings.ContainsAny(s, " \t\r\n") {
+				return c, fmt.Errorf("%s: bad value %v", key, i)
+			}
+			if key == "algorithms" && !compressionAlgos[s] {
+				return c, fmt.Errorf("algorithms: unknown algorithm %s, expected gzip, deflate, raw-deflate or identity", s)
+			}
+			values = append(values, s)
+		}
+		*dst = values
+	}
+	if s, ok := m["min_size"]; ok {
+		n, err := parseLimit(s)
+		if err != nil {
+			return c, fmt.Errorf("min_size: %s", err)
+		}
+		c.MinSize = n
+	}
+	return c, nil
+}
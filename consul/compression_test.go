@@ -0,0 +1,57 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompression(t *testing.T) {
+	base := Compression{Algos: []string{"gzip"}, Types: []string{"text/html"}}
+
+	c, err := parseCompression(base, map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, base, c)
+
+	c, err = parseCompression(base, map[string]interface{}{"enabled": false})
+	require.NoError(t, err)
+	require.True(t, c.Disabled)
+
+	c, err = parseCompression(base, map[string]interface{}{
+		"algorithms": []interface{}{"deflate", "gzip"},
+		"types":      []interface{}{"application/json"},
+		"min_size":   float64(1024),
+	})
+	require.NoError(t, err)
+	require.Equal(t, Compression{
+		Algos:   []string{"deflate", "gzip"},
+		Types:   []string{"application/json"},
+		MinSize: 1024,
+	}, c)
+
+	bad := []interface{}{
+		true,
+		map[string]interface{}{"enabled": "no"},
+		map[string]interface{}{"algorithms": []interface{}{"brotli"}},
+		map[string]interface{}{"types": "text/html"},
+		map[string]interface{}{"types": []interface{}{"text/html text/css"}},
+		map[string]interface{}{"min_size": float64(-1)},
+	}
+	for _, v := range bad {
+		_, err := parseCompression(base, v)
+		require.Error(t, err, "%v", v)
+	}
+}
+
+func TestParseCompressionList(t *testing.T) {
+	l, err := ParseCompressionList("gzip, deflate", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"gzip", "deflate"}, l)
+
+	l, err = ParseCompressionList("text/html text/css", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"text/html", "text/css"}, l)
+
+	_, err = ParseCompressionList("br", true)
+	require.Error(t, err)
+}
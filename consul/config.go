@@ -3,6 +3,7 @@ package consul
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"time"
 )
 
@@ -10,21 +11,96 @@ type Config struct {
 	ServiceName string
 	ServiceID   string
 	Downstream  Downstream
-	Upstreams   []Upstream
+	// ExtraDownstreams are additional public listeners for multi-port services
+	ExtraDownstreams []Downstream
+	Upstreams        []Upstream
+	// AccessLogs enables the request logs, from the access_logs of the
+	// proxy-defaults
+	AccessLogs bool
+	// LuaScripts are the sources of the lua_scripts of the proxy config,
+	// by file name
+	LuaScripts map[string]string
+	// ChangedAt is when the watcher saw the first Consul change this config
+	// includes, zero for configs not built by the watcher
+	ChangedAt time.Time
 }
 
 type Upstream struct {
-	Name             string
-	ServiceName      string
+	Name        string
+	ServiceName string
+	// Owner is the prefix of the local service the upstream belongs to
+	// when several services share the proxy, empty for the first one
+	Owner string
+	// Datacenter is the one requested for the upstream, the local one when
+	// empty
+	Datacenter string
+	// Peer is the cluster peer exporting the service, its trust bundle is
+	// in TLS.CAs
+	Peer             string
 	LocalBindAddress string
 	LocalBindPort    int
 	Protocol         string
 	ConnectTimeout   time.Duration
 	ReadTimeout      time.Duration
+	// ALPN is advertised on the TLS connections to the upstream instances
+	ALPN string
+	// Proto forces the protocol spoken by the application on the local listener
+	Proto string
+	// DisableChecks turns off HAProxy active checks, relying only on Consul health
+	DisableChecks bool
+	// SendProxyProtocol sends the PROXY protocol v2 header to the instances,
+	// with the address of the local client and the original destination
+	SendProxyProtocol bool
+	// Balance is the load balancing algorithm of the backend, the default
+	// one is used when empty
+	Balance string
+	// HashPolicy enables session affinity, it takes precedence over Balance
+	HashPolicy *HashPolicy
+	// Pinned is set when the nodes are frozen by an operator
+	Pinned bool
+	Limits Limits
+	// OutlierDetection observes the HTTP responses of the instances instead
+	// of the connections
+	OutlierDetection *OutlierDetection
+	// HTTPCheck replaces the connection checks with HTTP requests
+	HTTPCheck *HTTPCheck
+	// SlowStart is how long new instances take to receive their full share
+	// of the traffic, disabled when 0
+	SlowStart time.Duration
+	// ClientTLS replaces the Connect certificates on the connections to the
+	// instances when set
+	ClientTLS *ClientTLS
+	// ExtraConfig are raw lines added to the generated sections
+	ExtraConfig ExtraConfig
+	// LuaActions are called on the requests of the generated sections
+	LuaActions LuaActions
+	// Headers are the changes of the requests sent to the instances and of
+	// their responses
+	Headers HeaderRules
+	// PathRewrite changes the path of the requests sent to the instances
+	PathRewrite PathRewrite
+	// Mirror copies a share of the requests to another upstream, nil when
+	// disabled
+	Mirror *Mirror
+	// Subsets share the traffic between groups of instances selected by
+	// their metadata and tags
+	Subsets []Subset
+	// Compression is the compression of the responses of the listener
+	Compression Compression
+
+	// Splits lists the services, declared as upstreams as well, traffic
+	// to this upstream is spread across
+	Splits []UpstreamSplit
+	// ConfigKeys are the keys set in the upstream config, to explain the
+	// generated proxies
+	ConfigKeys []string
 
 	TLS
 
 	Nodes []UpstreamNode
+	// VirtualIPs are the addresses Consul assigned to the service for
+	// transparent proxies, sorted
+	VirtualIPs []string
 }
 
 func (n Upstream) Equal(o Upstream) bool {
@@ -33,10 +109,41 @@ func (n Upstream) Equal(o Upstream) bool {
 		n.TLS.Equal(o.TLS)
 }
 
+// ServingNodes returns the nodes which get new connections, the draining
+// ones excluded
+func (n Upstream) ServingNodes() []UpstreamNode {
+	nodes := []UpstreamNode{}
+	for _, node := range n.Nodes {
+		if !node.Draining {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+type UpstreamSplit struct {
+	Service string
+	Weight  int
+}
+
 type UpstreamNode struct {
 	Host   string
 	Port   int
 	Weight int
+	// Datacenter is where the instance runs, it differs from the local one
+	// when a prepared query failed over
+	Datacenter string
+	// Draining is set for instances in maintenance mode, they keep their
+	// connections but get no new ones
+	Draining bool
+	// Backup is set for the instances of a failover datacenter, they only
+	// get traffic when no local instance is available
+	Backup bool
+	// Node and Meta describe the instance in the access logs
+	Node string
+	Meta map[string]string
+	// Tags are the tags of the service instance
+	Tags []string
 }
 
 func (n UpstreamNode) ID() string {
@@ -44,10 +151,15 @@ func (n UpstreamNode) ID() string {
 }
 
 func (n UpstreamNode) Equal(o UpstreamNode) bool {
-	return n == o
+	return reflect.DeepEqual(n, o)
 }
 
 type Downstream struct {
+	// Name identifies extra listeners, it is empty for the main one
+	Name string
+	// Service is the service the intentions of the listener are checked
+	// for, the one of the config when empty
+	Service          string
 	LocalBindAddress string
 	LocalBindPort    int
 	Protocol         string
@@ -59,6 +171,32 @@ type Downstream struct {
 	EnableForwardFor  bool
 	AppNameHeaderName string
 
+	// ALPN is advertised on the public TLS listener
+	ALPN string
+	// Proto forces the protocol spoken to the local application
+	Proto string
+	// Balance is the load balancing algorithm of the backend, the default
+	// one is used when empty
+	Balance string
+	// ExtraConfig are raw lines added to the generated sections
+	ExtraConfig ExtraConfig
+	// LuaActions are called on the requests of the generated sections
+	LuaActions LuaActions
+	// Headers are the changes of the requests sent to the local application
+	// and of its responses
+	Headers HeaderRules
+	// Compression is the compression of the responses of the listener
+	Compression Compression
+	// ConfigKeys are the keys set in the proxy config, to explain the
+	// generated proxies
+	ConfigKeys []string
+	// BindOptions are the socket options of the listener
+	BindOptions BindOptions
+	Limits      ListenerLimits
+	// SendProxyProtocol sends the PROXY protocol v2 header to the local
+	// application, with the address of the client
+	SendProxyProtocol bool
+
 	TLS
 }
 
@@ -66,10 +204,28 @@ func (d Downstream) Equal(o Downstream) bool {
 	return reflect.DeepEqual(d, o)
 }
 
+// ExtraConfig holds raw HAProxy lines appended to the frontend and backend
+// generated for a listener
+type ExtraConfig struct {
+	Frontend []string
+	Backend  []string
+}
+
+// configKeys lists the keys set in a proxy or upstream config, sorted
+func configKeys(config map[string]interface{}) []string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type TLS struct {
-	Cert []byte
-	Key  []byte
-	CAs  [][]byte
+	Cert     []byte
+	Key      []byte
+	CAs      [][]byte
+	NotAfter time.Time
 }
 
 func (t TLS) Equal(o TLS) bool {
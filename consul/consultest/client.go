@@ -0,0 +1,387 @@
+// Package consultest provides an in-memory Consul to run the watcher
+// without an agent.
+package consultest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+var _ consul.ConsulClient = (*Client)(nil)
+
+// Client is a consul.ConsulClient answering from an in-memory topology set
+// with its Set methods. Each value has its own index, bumped when it is
+// set, and the blocking queries return when the value they wait on
+// changes, like with an agent. The values set must not be modified
+// afterwards.
+type Client struct {
+	lock    sync.Mutex
+	index   uint64
+	indexes map[string]uint64
+	changed chan struct{}
+	err     error
+
+	services map[string]*api.AgentService
+	health   map[string][]*api.ServiceEntry
+	leaves   map[string]*api.LeafCert
+	roots    *api.CARootList
+	queries  map[string]*api.PreparedQueryExecuteResponse
+	entries  map[string]map[string]api.ConfigEntry
+	peerings map[string]*api.Peering
+}
+
+// New returns an empty Consul
+func New() *Client {
+	return &Client{
+		indexes:  map[string]uint64{},
+		changed:  make(chan struct{}),
+		services: map[string]*api.AgentService{},
+		health:   map[string][]*api.ServiceEntry{},
+		leaves:   map[string]*api.LeafCert{},
+		roots:    &api.CARootList{},
+		queries:  map[string]*api.PreparedQueryExecuteResponse{},
+		entries:  map[string]map[string]api.ConfigEntry{},
+		peerings: map[string]*api.Peering{},
+	}
+}
+
+// set bumps the index of key and wakes up the blocking queries, the lock
+// is held
+func (c *Client) set(key string) {
+	c.index++
+	c.indexes[key] = c.index
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// SetService registers a service on the agent, or removes it when srv is
+// nil. The services of the agent are the ones of every node of the
+// catalog.
+func (c *Client) SetService(id string, srv *api.AgentService) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if srv == nil {
+		delete(c.services, id)
+	} else {
+		c.services[id] = srv
+	}
+	c.set("service/" + id)
+	c.set("node")
+}
+
+// SetHealth sets the connect capable instances of a service
+func (c *Client) SetHealth(service string, entries []*api.ServiceEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.health[service] = entries
+	c.set("health/" + service)
+}
+
+// SetLeaf sets the leaf certificate of a service, or removes it when leaf
+// is nil
+func (c *Client) SetLeaf(service string, leaf *api.LeafCert) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if leaf == nil {
+		delete(c.leaves, service)
+	} else {
+		c.leaves[service] = leaf
+	}
+	c.set("leaf/" + service)
+}
+
+// SetRoots sets the CA roots
+func (c *Client) SetRoots(roots *api.CARootList) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.roots = roots
+	c.set("roots")
+}
+
+// SetQuery sets the result of a prepared query, or removes it when res is
+// nil
+func (c *Client) SetQuery(query string, res *api.PreparedQueryExecuteResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if res == nil {
+		delete(c.queries, query)
+	} else {
+		c.queries[query] = res
+	}
+	c.set("query/" + query)
+}
+
+// SetConfigEntry writes a config entry
+func (c *Client) SetConfigEntry(entry api.ConfigEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	kind, name := entry.GetKind(), entry.GetName()
+	if c.entries[kind] == nil {
+		c.entries[kind] = map[string]api.ConfigEntry{}
+	}
+	c.entries[kind][name] = entry
+	c.set("entry/" + kind + "/" + name)
+	c.set("entries/" + kind)
+}
+
+// DeleteConfigEntry removes a config entry
+func (c *Client) DeleteConfigEntry(kind, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries[kind], name)
+	c.set("entry/" + kind + "/" + name)
+	c.set("entries/" + kind)
+}
+
+// SetPeering sets a peering, or removes it when p is nil
+func (c *Client) SetPeering(name string, p *api.Peering) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p == nil {
+		delete(c.peerings, name)
+	} else {
+		c.peerings[name] = p
+	}
+	c.set("peering/" + name)
+}
+
+// Fail makes every query return err, until called with nil. The blocking
+// queries in flight return err too.
+func (c *Client) Fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait blocks until the index of key goes past the wait index of q, or its
+// hash differs from the wait hash, q is cancelled or its wait time
+// elapses. It returns with the lock held when there is no error.
+func (c *Client) wait(key string, q *api.QueryOptions) (*api.QueryMeta, error) {
+	if q == nil {
+		q = &api.QueryOptions{}
+	}
+	ctx := q.Context()
+	var timeout <-chan time.Time
+	if q.WaitTime > 0 {
+		t := time.NewTimer(q.WaitTime)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	c.lock.Lock()
+	for c.err == nil && c.unchanged(key, q) {
+		changed := c.changed
+		c.lock.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			c.lock.Lock()
+			return c.meta(key), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.lock.Lock()
+	}
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	return c.meta(key), nil
+}
+
+func (c *Client) unchanged(key string, q *api.QueryOptions) bool {
+	if q.WaitHash != "" {
+		return q.WaitHash == c.hashOf(key)
+	}
+	return q.WaitIndex > 0 && c.indexOf(key) <= q.WaitIndex
+}
+
+func (c *Client) meta(key string) *api.QueryMeta {
+	return &api.QueryMeta{
+		LastIndex:       c.indexOf(key),
+		LastContentHash: c.hashOf(key),
+	}
+}
+
+// hashOf is the content hash of key, for the agent endpoints blocking on a
+// hash
+func (c *Client) hashOf(key string) string {
+	return strconv.FormatUint(c.indexOf(key), 16)
+}
+
+// indexOf is the index of key, 1 when it was never set like for an empty
+// Consul
+func (c *Client) indexOf(key string) uint64 {
+	if i := c.indexes[key]; i > 0 {
+		return i
+	}
+	return 1
+}
+
+func notFound(format string, args ...interface{}) error {
+	return api.StatusError{Code: http.StatusNotFound, Body: fmt.Sprintf(format, args...)}
+}
+
+// AgentService implements consul.ConsulClient
+func (c *Client) AgentService(serviceID string, q *api.QueryOptions) (*api.AgentService, *api.QueryMeta, error) {
+	meta, err := c.wait("service/"+serviceID, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	srv, ok := c.services[serviceID]
+	if !ok {
+		return nil, nil, notFound("unknown service ID: %s", serviceID)
+	}
+	return srv, meta, nil
+}
+
+// AgentServices implements consul.ConsulClient
+func (c *Client) AgentServices() (map[string]*api.AgentService, error) {
+	_, err := c.wait("node", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.lock.Unlock()
+	res := make(map[string]*api.AgentService, len(c.services))
+	for id, srv := range c.services {
+		res[id] = srv
+	}
+	return res, nil
+}
+
+// ConnectCALeaf implements consul.ConsulClient
+func (c *Client) ConnectCALeaf(service string, q *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error) {
+	meta, err := c.wait("leaf/"+service, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	leaf, ok := c.leaves[service]
+	if !ok {
+		return nil, nil, notFound("no leaf certificate for %s", service)
+	}
+	return leaf, meta, nil
+}
+
+// ConnectCARoots implements consul.ConsulClient
+func (c *Client) ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+	meta, err := c.wait("roots", q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	return c.roots, meta, nil
+}
+
+// HealthConnect implements consul.ConsulClient
+func (c *Client) HealthConnect(service, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	meta, err := c.wait("health/"+service, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	res := []*api.ServiceEntry{}
+	for _, e := range c.health[service] {
+		if tag != "" && !hasTag(e.Service, tag) {
+			continue
+		}
+		if passingOnly && e.Checks.AggregatedStatus() != api.HealthPassing {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, meta, nil
+}
+
+func hasTag(srv *api.AgentService, tag string) bool {
+	if srv == nil {
+		return false
+	}
+	for _, t := range srv.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// PreparedQueryExecute implements consul.ConsulClient
+func (c *Client) PreparedQueryExecute(query string, q *api.QueryOptions) (*api.PreparedQueryExecuteResponse, *api.QueryMeta, error) {
+	meta, err := c.wait("query/"+query, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	res, ok := c.queries[query]
+	if !ok {
+		return nil, nil, notFound("query not found: %s", query)
+	}
+	return res, meta, nil
+}
+
+// NodeServiceList implements consul.ConsulClient
+func (c *Client) NodeServiceList(node string, q *api.QueryOptions) (*api.CatalogNodeServiceList, *api.QueryMeta, error) {
+	meta, err := c.wait("node", q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	res := &api.CatalogNodeServiceList{Node: &api.Node{Node: node}}
+	for _, srv := range c.services {
+		res.Services = append(res.Services, srv)
+	}
+	return res, meta, nil
+}
+
+// ConfigEntry implements consul.ConsulClient
+func (c *Client) ConfigEntry(kind, name string, q *api.QueryOptions) (api.ConfigEntry, *api.QueryMeta, error) {
+	meta, err := c.wait("entry/"+kind+"/"+name, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	entry, ok := c.entries[kind][name]
+	if !ok {
+		return nil, nil, notFound("config entry not found for %q / %q", kind, name)
+	}
+	return entry, meta, nil
+}
+
+// ConfigEntries implements consul.ConsulClient
+func (c *Client) ConfigEntries(kind string, q *api.QueryOptions) ([]api.ConfigEntry, *api.QueryMeta, error) {
+	meta, err := c.wait("entries/"+kind, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	res := []api.ConfigEntry{}
+	for _, entry := range c.entries[kind] {
+		res = append(res, entry)
+	}
+	return res, meta, nil
+}
+
+// PeeringRead implements consul.ConsulClient, an unknown peering is nil
+func (c *Client) PeeringRead(ctx context.Context, name string, q *api.QueryOptions) (*api.Peering, *api.QueryMeta, error) {
+	if q == nil {
+		q = &api.QueryOptions{}
+	}
+	meta, err := c.wait("peering/"+name, q.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.lock.Unlock()
+	return c.peerings[name], meta, nil
+}
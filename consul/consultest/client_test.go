@@ -0,0 +1,296 @@
+package consultest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+func backend(id, addr string, port int) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node: &api.Node{Node: "node-" + id, Address: addr},
+		Service: &api.AgentService{
+			ID:      id,
+			Service: "backend",
+			Address: addr,
+			Port:    port,
+			Weights: api.AgentWeights{Passing: 1, Warning: 1},
+		},
+		Checks: api.HealthChecks{{Status: api.HealthPassing}},
+	}
+}
+
+func topology() *Client {
+	c := New()
+	c.SetService("client-inst", &api.AgentService{
+		ID:      "client-inst",
+		Service: "client",
+		Port:    8080,
+	})
+	c.SetService("client-inst-sidecar-proxy", &api.AgentService{
+		Kind:    api.ServiceKindConnectProxy,
+		ID:      "client-inst-sidecar-proxy",
+		Service: "client-sidecar-proxy",
+		Port:    21000,
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: "client",
+			DestinationServiceID:   "client-inst",
+			LocalServicePort:       8080,
+			Upstreams: []api.Upstream{{
+				DestinationType: api.UpstreamDestTypeService,
+				DestinationName: "backend",
+				LocalBindPort:   9000,
+			}},
+		},
+	})
+	c.SetHealth("backend", []*api.ServiceEntry{backend("backend-1", "10.0.0.1", 8080)})
+	c.SetLeaf("client", &api.LeafCert{
+		Service:     "client",
+		CertPEM:     "cert",
+		ValidAfter:  time.Now(),
+		ValidBefore: time.Now().Add(72 * time.Hour),
+	})
+	c.SetRoots(&api.CARootList{ActiveRootID: "root"})
+	return c
+}
+
+func nextConfig(t *testing.T, w *consul.Watcher) consul.Config {
+	select {
+	case cfg := <-w.C:
+		return cfg
+	case <-time.After(10 * time.Second):
+		t.Fatal("no config from the watcher")
+	}
+	return consul.Config{}
+}
+
+func TestWatcher(t *testing.T) {
+	c := topology()
+	w := consul.NewWithClient("client-inst", c, consul.NewTestingLogger(t), consul.Options{})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.Run()
+	}()
+
+	cfg := nextConfig(t, w)
+	require.Equal(t, "client", cfg.ServiceName)
+	require.Equal(t, 21000, cfg.Downstream.LocalBindPort)
+	require.Equal(t, 8080, cfg.Downstream.TargetPort)
+	require.Len(t, cfg.Upstreams, 1)
+	require.Equal(t, 9000, cfg.Upstreams[0].LocalBindPort)
+	require.Len(t, cfg.Upstreams[0].Nodes, 1)
+
+	c.SetHealth("backend", []*api.ServiceEntry{
+		backend("backend-1", "10.0.0.1", 8080),
+		backend("backend-2", "10.0.0.2", 8080),
+	})
+	for len(cfg.Upstreams[0].Nodes) != 2 {
+		cfg = nextConfig(t, w)
+	}
+
+	w.Stop()
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the watcher did not stop")
+	}
+}
+
+func TestBlockingQuery(t *testing.T) {
+	c := New()
+	c.SetRoots(&api.CARootList{ActiveRootID: "a"})
+
+	roots, meta, err := c.ConnectCARoots(nil)
+	require.NoError(t, err)
+	require.Equal(t, "a", roots.ActiveRootID)
+
+	res := make(chan string, 1)
+	go func() {
+		roots, _, err := c.ConnectCARoots(&api.QueryOptions{WaitIndex: meta.LastIndex})
+		require.NoError(t, err)
+		res <- roots.ActiveRootID
+	}()
+
+	// an other value does not wake the query up
+	c.SetLeaf("svc", &api.LeafCert{})
+	select {
+	case <-res:
+		t.Fatal("the query returned before a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.SetRoots(&api.CARootList{ActiveRootID: "b"})
+	require.Equal(t, "b", <-res)
+}
+
+func TestBlockingQueryCancel(t *testing.T) {
+	c := New()
+	_, meta, err := c.ConnectCARoots(nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = c.ConnectCARoots((&api.QueryOptions{WaitIndex: meta.LastIndex}).WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, meta, err = c.ConnectCARoots(&api.QueryOptions{WaitIndex: meta.LastIndex, WaitTime: time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), meta.LastIndex)
+}
+
+func TestFail(t *testing.T) {
+	c := topology()
+	boom := errors.New("boom")
+	c.Fail(boom)
+	_, _, err := c.AgentService("client-inst", nil)
+	require.ErrorIs(t, err, boom)
+
+	c.Fail(nil)
+	_, _, err = c.AgentService("client-inst", nil)
+	require.NoError(t, err)
+
+	_, _, err = c.AgentService("unknown", nil)
+	var statusErr api.StatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, 404, statusErr.Code)
+}
+
+func TestWatcherInsecureDevMode(t *testing.T) {
+	c := topology()
+	// the leaf certificate is not delivered yet
+	c.SetLeaf("client", nil)
+	w := consul.NewWithClient("client-inst", c, consul.NewTestingLogger(t), consul.Options{InsecureDevMode: true})
+	go w.Run()
+	defer w.Stop()
+
+	cfg := nextConfig(t, w)
+	require.Empty(t, cfg.Downstream.Cert)
+	require.Len(t, cfg.Upstreams, 1)
+
+	c.SetLeaf("client", &api.LeafCert{
+		Service:     "client",
+		CertPEM:     "cert",
+		ValidAfter:  time.Now(),
+		ValidBefore: time.Now().Add(72 * time.Hour),
+	})
+	for len(cfg.Downstream.Cert) == 0 {
+		cfg = nextConfig(t, w)
+	}
+	require.Equal(t, []byte("cert"), cfg.Downstream.Cert)
+}
+
+func TestMulti(t *testing.T) {
+	c := topology()
+	c.SetService("api-inst", &api.AgentService{
+		ID:      "api-inst",
+		Service: "api",
+		Port:    8081,
+	})
+	c.SetService("api-inst-sidecar-proxy", &api.AgentService{
+		Kind:    api.ServiceKindConnectProxy,
+		ID:      "api-inst-sidecar-proxy",
+		Service: "api-sidecar-proxy",
+		Port:    21001,
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: "api",
+			DestinationServiceID:   "api-inst",
+			LocalServicePort:       8081,
+			Upstreams: []api.Upstream{{
+				DestinationType: api.UpstreamDestTypeService,
+				DestinationName: "backend",
+				LocalBindPort:   9001,
+			}},
+		},
+	})
+	c.SetLeaf("api", &api.LeafCert{
+		Service:     "api",
+		CertPEM:     "api cert",
+		ValidAfter:  time.Now(),
+		ValidBefore: time.Now().Add(72 * time.Hour),
+	})
+
+	log := consul.NewTestingLogger(t)
+	m := consul.NewMulti(
+		consul.NewWithClient("client-inst", c, log, consul.Options{}),
+		consul.NewWithClient("api-inst", c, log, consul.Options{}),
+	)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.Run()
+	}()
+
+	var cfg consul.Config
+	select {
+	case cfg = <-m.C:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no config from the watchers")
+	}
+	require.Equal(t, "client", cfg.ServiceName)
+	require.Equal(t, 21000, cfg.Downstream.LocalBindPort)
+	require.Len(t, cfg.ExtraDownstreams, 1)
+	require.Equal(t, "api-inst", cfg.ExtraDownstreams[0].Name)
+	require.Equal(t, "api", cfg.ExtraDownstreams[0].Service)
+	require.Equal(t, 8081, cfg.ExtraDownstreams[0].TargetPort)
+	require.Equal(t, []byte("api cert"), cfg.ExtraDownstreams[0].Cert)
+	require.Len(t, cfg.Upstreams, 2)
+
+	m.Stop()
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the watchers did not stop")
+	}
+}
+
+func TestWatcherNomadAllocation(t *testing.T) {
+	c := New()
+	for i, alloc := range []string{"aaaa", "bbbb"} {
+		id := "_nomad-task-" + alloc + "-group-web-web-http-sidecar-proxy"
+		c.SetService(id, &api.AgentService{
+			Kind:    api.ServiceKindConnectProxy,
+			ID:      id,
+			Service: "web-sidecar-proxy",
+			Port:    21000 + i,
+			Proxy: &api.AgentServiceConnectProxyConfig{
+				DestinationServiceName: "web",
+				DestinationServiceID:   "_nomad-task-" + alloc + "-group-web-web-http",
+				LocalServicePort:       8080 + i,
+			},
+		})
+	}
+	c.SetLeaf("web", &api.LeafCert{
+		Service:     "web",
+		CertPEM:     "cert",
+		ValidAfter:  time.Now(),
+		ValidBefore: time.Now().Add(72 * time.Hour),
+	})
+
+	w := consul.NewWithClient("web", c, consul.NewTestingLogger(t), consul.Options{
+		ProxyIDPrefix: consul.NomadProxyIDPrefix("bbbb", "web"),
+	})
+	go w.Run()
+	defer w.Stop()
+
+	cfg := nextConfig(t, w)
+	require.Equal(t, 21001, cfg.Downstream.LocalBindPort)
+	require.Equal(t, 8081, cfg.Downstream.TargetPort)
+
+	// the id of an Envoy bootstrap file is used as is
+	w2 := consul.NewWithClient("web", c, consul.NewTestingLogger(t), consul.Options{
+		ProxyID: "_nomad-task-aaaa-group-web-web-http-sidecar-proxy",
+	})
+	go w2.Run()
+	defer w2.Stop()
+
+	cfg = nextConfig(t, w2)
+	require.Equal(t, 21000, cfg.Downstream.LocalBindPort)
+}
@@ -0,0 +1,19 @@
+package consul
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// inMaintenance returns true when the instance or its node was put in
+// maintenance mode, it is then drained instead of removed until it is
+// deregistered or back in service
+func inMaintenance(s *api.ServiceEntry) bool {
+	for _, c := range s.Checks {
+		if c.CheckID == api.NodeMaint || strings.HasPrefix(c.CheckID, api.ServiceMaintPrefix) {
+			return true
+		}
+	}
+	return false
+}
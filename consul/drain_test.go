@@ -0,0 +1,34 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainMaintenance(t *testing.T) {
+	w := New("svc", nil, NewTestingLogger(t))
+	w.leaf = &certLeaf{}
+
+	node := func(addr string, checks ...*api.HealthCheck) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Node: addr, Address: addr},
+			Service: &api.AgentService{ID: "api-" + addr, Port: 80, Weights: api.AgentWeights{Passing: 1}},
+			Checks:  checks,
+		}
+	}
+	passing := &api.HealthCheck{CheckID: "service:api", Status: api.HealthPassing}
+	w.upstreams["api"] = &upstream{Name: "api", Nodes: []*api.ServiceEntry{
+		node("10.0.0.1", passing),
+		node("10.0.0.2", passing, &api.HealthCheck{CheckID: api.ServiceMaintPrefix + "api-10.0.0.2", Status: api.HealthCritical}),
+		node("10.0.0.3", &api.HealthCheck{CheckID: "service:api", Status: api.HealthCritical}),
+	}}
+
+	nodes := w.genCfg().Upstreams[0].Nodes
+	require.Len(t, nodes, 2)
+	require.False(t, nodes[0].Draining)
+	require.Equal(t, "10.0.0.2", nodes[1].Host)
+	require.True(t, nodes[1].Draining)
+	require.Equal(t, 0, nodes[1].Weight)
+}
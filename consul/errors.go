@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+)
+
+var errSidecarNotFound = errors.New("no sidecar proxy registered")
+
+// ExitError classifies an error returned by the Consul API, telling apart
+// ACL denials from an unreachable agent
+func ExitError(err error) *lib.ExitError {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusForbidden {
+		return lib.NewExitError(lib.ExitACLDenied, err)
+	}
+	// the errors of the connection, eg: a unix socket not readable by the
+	// process, are not ACL denials even when their message says so
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return lib.NewExitError(lib.ExitConsulUnreachable, err)
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "permission denied") || strings.Contains(msg, "acl not found") {
+		return lib.NewExitError(lib.ExitACLDenied, err)
+	}
+	return lib.NewExitError(lib.ExitConsulUnreachable, err)
+}
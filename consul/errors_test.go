@@ -0,0 +1,30 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+)
+
+func TestExitError(t *testing.T) {
+	require.Equal(t, lib.ExitACLDenied, ExitError(api.StatusError{Code: 403, Body: "Permission denied"}).Code)
+	require.Equal(t, lib.ExitACLDenied, ExitError(errors.New("Unexpected response code: 403 (ACL not found)")).Code)
+	require.Equal(t, lib.ExitConsulUnreachable, ExitError(errors.New("connection refused")).Code)
+
+	// a unix socket the process cannot open
+	sockErr := &url.Error{Op: "Get", URL: "http://consul/v1/agent/self", Err: &net.OpError{
+		Op:  "dial",
+		Net: "unix",
+		Err: os.NewSyscallError("connect", syscall.EACCES),
+	}}
+	require.Contains(t, sockErr.Error(), "permission denied")
+	require.Equal(t, lib.ExitConsulUnreachable, ExitError(sockErr).Code)
+}
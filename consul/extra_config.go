@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseExtraConfig reads raw HAProxy lines from a proxy or upstream config.
+// A list of lines is added to the frontend, an object with "frontend" and
+// "backend" lists places them in each section.
+func parseExtraConfig(v interface{}) (ExtraConfig, error) {
+	switch c := v.(type) {
+	case []interface{}:
+		lines, err := parseConfigLines(c)
+		if err != nil {
+			return ExtraConfig{}, err
+		}
+		return ExtraConfig{Frontend: lines}, nil
+
+	case map[string]interface{}:
+		extra := ExtraConfig{}
+		for k, section := range c {
+			l, ok := section.([]interface{})
+			if !ok {
+				return ExtraConfig{}, fmt.Errorf("%s: expected a list of lines, got %T", k, section)
+			}
+			lines, err := parseConfigLines(l)
+			if err != nil {
+				return ExtraConfig{}, fmt.Errorf("%s: %s", k, err)
+			}
+			switch k {
+			case "frontend":
+				extra.Frontend = lines
+			case "backend":
+				extra.Backend = lines
+			default:
+				return ExtraConfig{}, fmt.Errorf("unknown section %s, expected frontend or backend", k)
+			}
+		}
+		return extra, nil
+
+	default:
+		return ExtraConfig{}, fmt.Errorf("expected a list of lines or an object, got %T", v)
+	}
+}
+
+func parseConfigLines(l []interface{}) ([]string, error) {
+	lines := make([]string, 0, len(l))
+	for i, e := range l {
+		line, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a string, got %T", i, e)
+		}
+		// a line break would allow declaring new sections
+		if strings.ContainsAny(line, "\r\n") {
+			return nil, fmt.Errorf("line %d: must not contain line breaks", i)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
@@ -0,0 +1,35 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtraConfig(t *testing.T) {
+	extra, err := parseExtraConfig([]interface{}{"option redispatch", " ", "  timeout queue 5s"})
+	require.NoError(t, err)
+	require.Equal(t, ExtraConfig{Frontend: []string{"option redispatch", "timeout queue 5s"}}, extra)
+
+	extra, err = parseExtraConfig(map[string]interface{}{
+		"frontend": []interface{}{"option http-keep-alive"},
+		"backend":  []interface{}{"option redispatch"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, ExtraConfig{
+		Frontend: []string{"option http-keep-alive"},
+		Backend:  []string{"option redispatch"},
+	}, extra)
+
+	_, err = parseExtraConfig([]interface{}{"option redispatch\nbackend evil"})
+	require.Error(t, err)
+
+	_, err = parseExtraConfig(map[string]interface{}{"listen": []interface{}{"mode tcp"}})
+	require.Error(t, err)
+
+	_, err = parseExtraConfig("option redispatch")
+	require.Error(t, err)
+
+	_, err = parseExtraConfig([]interface{}{42})
+	require.Error(t, err)
+}
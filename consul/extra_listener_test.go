@@ -0,0 +1,32 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtraListenerPorts(t *testing.T) {
+	w := &Watcher{}
+	w.downstream.LocalBindPort = 21000
+	used := map[int]string{21000: "the main listener", 9191: "upstream db"}
+
+	d, err := w.parseExtraListener(map[string]interface{}{"port": float64(21001), "target_port": float64(9090)}, used)
+	require.NoError(t, err)
+	require.Equal(t, 21001, d.LocalBindPort)
+	require.Equal(t, 9090, d.TargetPort)
+
+	for _, c := range []map[string]interface{}{
+		{"port": float64(21000), "target_port": float64(9090)},
+		{"port": float64(9191), "target_port": float64(9090)},
+		{"port": float64(0), "target_port": float64(9090)},
+		{"port": float64(-1), "target_port": float64(9090)},
+		{"port": float64(65536), "target_port": float64(9090)},
+		{"port": float64(21001.5), "target_port": float64(9090)},
+		{"port": float64(21001), "target_port": float64(0)},
+		{"port": float64(21001), "target_port": float64(70000)},
+	} {
+		_, err := w.parseExtraListener(c, used)
+		require.Error(t, err, c)
+	}
+}
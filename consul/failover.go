@@ -0,0 +1,121 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// parseDatacenters reads the failover_datacenters of an upstream config
+func parseDatacenters(v interface{}) ([]string, error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", v)
+	}
+	dcs := make([]string, 0, len(l))
+	for _, e := range l {
+		dc, ok := e.(string)
+		if !ok || dc == "" {
+			return nil, fmt.Errorf("expected a datacenter name, got %v", e)
+		}
+		dcs = append(dcs, dc)
+	}
+	return dcs, nil
+}
+
+// resolverFailover returns the failover datacenters of the service-resolver
+// config entry of a service, if any
+func (w *Watcher) resolverFailover(u *upstream) []string {
+	service := u.ServiceName
+	entry, _, err := w.client().ConfigEntry(api.ServiceResolver, service, &api.QueryOptions{
+		Namespace: u.Namespace,
+		Partition: u.Partition,
+		Token:     w.currentToken(),
+	})
+	if err != nil {
+		w.log.Debugf("consul: no service-resolver for %s: %s", service, err)
+		return nil
+	}
+	resolver, ok := entry.(*api.ServiceResolverConfigEntry)
+	if !ok {
+		return nil
+	}
+	if f, ok := resolver.Failover["*"]; ok {
+		return f.Datacenters
+	}
+	return nil
+}
+
+// localDatacenter returns the datacenter of the agent, empty when it is not
+// known
+func (w *Watcher) localDatacenter() string {
+	if w.opts.Agent == nil {
+		return ""
+	}
+	return w.opts.Agent.Datacenter
+}
+
+// failoverDatacenters returns the datacenters whose instances back up the
+// ones of the upstream datacenter, in order of preference. The upstreams
+// without datacenter are served by the local one, local is skipped too.
+func (u *upstream) failoverDatacenters(local string) []string {
+	// the services of a peer are served by the peer only
+	if u.Peer != "" {
+		return nil
+	}
+	dcs := u.FailoverDatacenters
+	if len(dcs) == 0 {
+		dcs = u.resolverFailover
+	}
+
+	primary := u.Datacenter
+	if primary == "" {
+		primary = local
+	}
+	// without agent info the instances tell where they run
+	if primary == "" && len(u.Nodes) > 0 && u.Nodes[0].Node != nil {
+		primary = u.Nodes[0].Node.Datacenter
+	}
+
+	res := []string{}
+	for _, dc := range dcs {
+		if dc != primary {
+			res = append(res, dc)
+		}
+	}
+	return res
+}
+
+// syncFailoverHealth attaches the upstream to the watches of its failover
+// datacenters and detaches it from the ones no longer used. w.lock must be
+// held.
+func (w *Watcher) syncFailoverHealth(u *upstream) {
+	wanted := map[string]bool{}
+	for _, dc := range u.failoverDatacenters(w.localDatacenter()) {
+		key := u.healthKeyIn(dc)
+		wanted[key] = true
+		if _, ok := u.failover[key]; ok {
+			continue
+		}
+		w.log.Infof("consul: upstream %s fails over to %s", u.Name, dc)
+		hw := w.attachHealth(u, dc)
+		u.failover[key] = hw.nodes
+	}
+
+	for key := range u.failover {
+		if !wanted[key] {
+			w.detachHealth(u, key)
+			delete(u.failover, key)
+		}
+	}
+}
+
+func hasHealthy(nodes []*api.ServiceEntry) bool {
+	for _, s := range nodes {
+		status := s.Checks.AggregatedStatus()
+		if status == api.HealthPassing || status == api.HealthWarning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDatacenters(t *testing.T) {
+	dcs, err := parseDatacenters([]interface{}{"dc2", "dc3"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"dc2", "dc3"}, dcs)
+
+	_, err = parseDatacenters("dc2")
+	require.Error(t, err)
+	_, err = parseDatacenters([]interface{}{"dc2", 3})
+	require.Error(t, err)
+}
+
+func TestFailoverBackups(t *testing.T) {
+	w := New("svc", nil, NewTestingLogger(t))
+	w.leaf = &certLeaf{}
+
+	node := func(addr, dc string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Address: addr, Datacenter: dc},
+			Service: &api.AgentService{Port: 80, Weights: api.AgentWeights{Passing: 1}},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+	w.upstreams["api"] = &upstream{
+		Name:                "api",
+		ServiceName:         "api",
+		Datacenter:          "dc1",
+		FailoverDatacenters: []string{"dc1", "dc2"},
+		Nodes:               []*api.ServiceEntry{node("10.0.0.1", "dc1")},
+		failover: map[string][]*api.ServiceEntry{
+			healthKey("", "", "api", "dc2", ""): {node("10.1.0.1", "dc2")},
+		},
+	}
+
+	nodes := w.genCfg().Upstreams[0].Nodes
+	require.Len(t, nodes, 2)
+	require.False(t, nodes[0].Backup)
+	require.True(t, nodes[1].Backup)
+	require.Equal(t, "dc2", nodes[1].Datacenter)
+}
+
+func TestFailoverSkipsLocalDatacenter(t *testing.T) {
+	node := func(addr, dc string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Address: addr, Datacenter: dc},
+			Service: &api.AgentService{Port: 80, Weights: api.AgentWeights{Passing: 1}},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+	newUpstream := func() *upstream {
+		return &upstream{
+			Name:                "api",
+			ServiceName:         "api",
+			FailoverDatacenters: []string{"dc1", "dc2"},
+			Nodes:               []*api.ServiceEntry{node("10.0.0.1", "dc1")},
+			failover: map[string][]*api.ServiceEntry{
+				healthKey("", "", "api", "dc1", ""): {node("10.0.0.1", "dc1")},
+				healthKey("", "", "api", "dc2", ""): {node("10.1.0.1", "dc2")},
+			},
+		}
+	}
+
+	for name, agent := range map[string]*AgentInfo{
+		"agent":    {Datacenter: "dc1"},
+		"no agent": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := New("svc", nil, NewTestingLogger(t))
+			w.leaf = &certLeaf{}
+			w.opts.Agent = agent
+			u := newUpstream()
+			w.upstreams["api"] = u
+
+			require.Equal(t, []string{"dc2"}, u.failoverDatacenters(w.localDatacenter()))
+			nodes := w.genCfg().Upstreams[0].Nodes
+			require.Len(t, nodes, 2)
+			require.False(t, nodes[0].Backup)
+			require.Equal(t, "10.1.0.1", nodes[1].Host)
+			require.True(t, nodes[1].Backup)
+		})
+	}
+}
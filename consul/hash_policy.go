@@ -0,0 +1,54 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	HashFieldHeader = "header"
+	HashFieldCookie = "cookie"
+)
+
+var hashFieldValueRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// HashPolicy keeps the requests of a client on the same upstream instance,
+// it uses the same fields as the Consul service-resolver hash policies
+type HashPolicy struct {
+	// Field is header or cookie, FieldValue is the name of the header or
+	// cookie
+	Field      string
+	FieldValue string
+	// SourceIP hashes the client address instead of a field
+	SourceIP bool
+}
+
+func parseHashPolicy(v interface{}) (*HashPolicy, error) {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", v)
+	}
+
+	p := &HashPolicy{}
+	if s, ok := c["source_ip"].(bool); ok {
+		p.SourceIP = s
+	}
+	if f, ok := c["field"].(string); ok {
+		p.Field = f
+	}
+	if f, ok := c["field_value"].(string); ok {
+		p.FieldValue = f
+	}
+
+	switch {
+	case p.SourceIP && p.Field != "":
+		return nil, fmt.Errorf("source_ip and field are exclusive")
+	case p.SourceIP:
+		return p, nil
+	case p.Field != HashFieldHeader && p.Field != HashFieldCookie:
+		return nil, fmt.Errorf("field must be header or cookie, got %q", p.Field)
+	case !hashFieldValueRe.MatchString(p.FieldValue):
+		return nil, fmt.Errorf("invalid field_value %q", p.FieldValue)
+	}
+	return p, nil
+}
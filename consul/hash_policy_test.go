@@ -0,0 +1,28 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHashPolicy(t *testing.T) {
+	p, err := parseHashPolicy(map[string]interface{}{"field": "header", "field_value": "X-User-Id"})
+	require.NoError(t, err)
+	require.Equal(t, &HashPolicy{Field: HashFieldHeader, FieldValue: "X-User-Id"}, p)
+
+	p, err = parseHashPolicy(map[string]interface{}{"source_ip": true})
+	require.NoError(t, err)
+	require.Equal(t, &HashPolicy{SourceIP: true}, p)
+
+	for _, v := range []interface{}{
+		"header",
+		map[string]interface{}{"field": "query_parameter", "field_value": "id"},
+		map[string]interface{}{"field": "cookie", "field_value": "a b"},
+		map[string]interface{}{"field": "cookie", "field_value": "SESSION", "source_ip": true},
+		map[string]interface{}{},
+	} {
+		_, err := parseHashPolicy(v)
+		require.Error(t, err)
+	}
+}
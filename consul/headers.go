@@ -0,0 +1,98 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions of a HeaderRule
+const (
+	HeaderActionAdd     = "add"
+	HeaderActionSet     = "set"
+	HeaderActionDel     = "del"
+	HeaderActionReplace = "replace"
+)
+
+// HeaderRule changes a header of the requests or responses, in order
+type HeaderRule struct {
+	// Action is add, set, del or replace
+	Action string
+	Header string
+	// Value is a log-format string, eg: %[env(VERSION)], it is the
+	// replacement of the matched values with replace
+	Value string
+	// Match is the regex of the values to replace
+	Match string
+}
+
+// HeaderRules are the header changes of a listener or an upstream, they
+// need the http protocol
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+// parseHeaderRules reads the request_headers and response_headers keys of a
+// proxy or upstream config
+func parseHeaderRules(config map[string]interface{}) (HeaderRules, error) {
+	rules := HeaderRules{}
+	for key, dst := range map[string]*[]HeaderRule{
+		"request_headers":  &rules.Request,
+		"response_headers": &rules.Response,
+	} {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		l, ok := v.([]interface{})
+		if !ok {
+			return HeaderRules{}, fmt.Errorf("%s: expected a list, got %T", key, v)
+		}
+		for i, e := range l {
+			r, err := parseHeaderRule(e)
+			if err != nil {
+				return HeaderRules{}, fmt.Errorf("%s[%d]: %s", key, i, err)
+			}
+			*dst = append(*dst, r)
+		}
+	}
+	return rules, nil
+}
+
+func parseHeaderRule(v interface{}) (HeaderRule, error) {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return HeaderRule{}, fmt.Errorf("expected an object, got %T", v)
+	}
+
+	r := HeaderRule{}
+	r.Action, _ = c["action"].(string)
+	r.Header, _ = c["header"].(string)
+	r.Value, _ = c["value"].(string)
+	r.Match, _ = c["match"].(string)
+
+	if r.Header == "" || strings.ContainsAny(r.Header, " \t\r\n:") {
+		return HeaderRule{}, fmt.Errorf("header must be a name without spaces, got %v", c["header"])
+	}
+	if strings.ContainsAny(r.Value, "\r\n") || strings.ContainsAny(r.Match, "\r\n") {
+		return HeaderRule{}, fmt.Errorf("header %s: value and match must be on a single line", r.Header)
+	}
+
+	switch r.Action {
+	case HeaderActionAdd, HeaderActionSet:
+		if r.Value == "" {
+			return HeaderRule{}, fmt.Errorf("header %s: %s requires a value", r.Header, r.Action)
+		}
+		r.Match = ""
+	case HeaderActionReplace:
+		if r.Match == "" {
+			return HeaderRule{}, fmt.Errorf("header %s: replace requires a match", r.Header)
+		}
+	case HeaderActionDel:
+		r.Value = ""
+		r.Match = ""
+	default:
+		return HeaderRule{}, fmt.Errorf("header %s: action must be one of add, set, del or replace, got %v", r.Header, c["action"])
+	}
+	return r, nil
+}
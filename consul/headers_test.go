@@ -0,0 +1,49 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	r, err := parseHeaderRules(map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, HeaderRules{}, r)
+
+	r, err = parseHeaderRules(map[string]interface{}{
+		"request_headers": []interface{}{
+			map[string]interface{}{"action": "set", "header": "X-Env", "value": "production"},
+			map[string]interface{}{"action": "del", "header": "X-Debug", "value": "ignored"},
+		},
+		"response_headers": []interface{}{
+			map[string]interface{}{"action": "add", "header": "X-Version", "value": "%[env(VERSION)]"},
+			map[string]interface{}{"action": "replace", "header": "Location", "match": "^http://(.*)", "value": "https://\\1"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, HeaderRules{
+		Request: []HeaderRule{
+			{Action: HeaderActionSet, Header: "X-Env", Value: "production"},
+			{Action: HeaderActionDel, Header: "X-Debug"},
+		},
+		Response: []HeaderRule{
+			{Action: HeaderActionAdd, Header: "X-Version", Value: "%[env(VERSION)]"},
+			{Action: HeaderActionReplace, Header: "Location", Match: "^http://(.*)", Value: "https://\\1"},
+		},
+	}, r)
+
+	bad := []map[string]interface{}{
+		{"request_headers": map[string]interface{}{}},
+		{"request_headers": []interface{}{"X-Env"}},
+		{"request_headers": []interface{}{map[string]interface{}{"action": "rename", "header": "X-Env"}}},
+		{"request_headers": []interface{}{map[string]interface{}{"action": "set", "header": "X-Env"}}},
+		{"request_headers": []interface{}{map[string]interface{}{"action": "set", "header": "X Env", "value": "a"}}},
+		{"response_headers": []interface{}{map[string]interface{}{"action": "replace", "header": "Location", "value": "a"}}},
+		{"response_headers": []interface{}{map[string]interface{}{"action": "add", "header": "X-A", "value": "a\r\nb"}}},
+	}
+	for _, c := range bad {
+		_, err := parseHeaderRules(c)
+		require.Error(t, err, "%v", c)
+	}
+}
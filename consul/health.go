@@ -0,0 +1,284 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// a watch changing burstChanges times within burstWindow, eg: during a
+	// rolling deploy, has its updates delayed to be applied together
+	burstWindow  = 30 * time.Second
+	burstChanges = 3
+	// the delay starts at coalesceMin and doubles with each change of the
+	// burst, up to coalesceMax
+	coalesceMin = 2 * time.Second
+	coalesceMax = 30 * time.Second
+)
+
+// healthWatch is a blocking query on the healthy instances of a service in
+// a datacenter, shared by all the upstreams targeting them
+type healthWatch struct {
+	key        string
+	service    string
+	namespace  string
+	partition  string
+	datacenter string
+	peer       string
+	consumers  map[*upstream]bool
+	nodes      []*api.ServiceEntry
+	fetched    bool
+	// pendingReady counts the consumers declared at startup waiting for
+	// the first result
+	pendingReady int
+	// ctx is cancelled once the watch has no consumer left
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// changes are the times of the recent changes, used to detect bursts
+	changes []time.Time
+	delay   time.Duration
+	// delayed is set while an update waits to be applied
+	delayed bool
+}
+
+// coalesceDelay records a change and returns how long to wait before
+// applying it, 0 outside of bursts
+func (hw *healthWatch) coalesceDelay(now time.Time) time.Duration {
+	recent := hw.changes[:0]
+	for _, c := range hw.changes {
+		if now.Sub(c) < burstWindow {
+			recent = append(recent, c)
+		}
+	}
+	hw.changes = append(recent, now)
+
+	switch {
+	case len(hw.changes) < burstChanges:
+		hw.delay = 0
+	case hw.delay == 0:
+		hw.delay = coalesceMin
+	default:
+		hw.delay *= 2
+		if hw.delay > coalesceMax {
+			hw.delay = coalesceMax
+		}
+	}
+	return hw.delay
+}
+
+// healthKey identifies a watch, the partition and namespace are only set on
+// Consul Enterprise. The services imported from a peer are keyed by the peer
+// instead of the datacenter.
+func healthKey(partition, namespace, service, datacenter, peer string) string {
+	at := "@" + datacenter
+	if peer != "" {
+		at = "@peer:" + peer
+	}
+	if partition == "" && namespace == "" {
+		return service + at
+	}
+	return partition + "/" + namespace + "/" + service + at
+}
+
+// healthKeyIn returns the key of the watch of the upstream destination in a
+// datacenter
+func (u *upstream) healthKeyIn(datacenter string) string {
+	return healthKey(u.Partition, u.Namespace, u.ServiceName, datacenter, u.Peer)
+}
+
+// subscribeHealth attaches the upstream to the watch of its destination,
+// starting it if needed. w.lock must be held.
+func (w *Watcher) subscribeHealth(u *upstream, startup bool) {
+	u.healthKey = u.healthKeyIn(u.Datacenter)
+	hw := w.attachHealth(u, u.Datacenter)
+
+	switch {
+	case hw.fetched:
+		u.Nodes = hw.nodes
+		u.fetched = true
+		if startup {
+			w.ready.Done()
+		}
+	case startup:
+		hw.pendingReady++
+	}
+}
+
+// unsubscribeHealth detaches the upstream, the watch is stopped when it
+// has no consumer left. w.lock must be held.
+func (w *Watcher) unsubscribeHealth(u *upstream) {
+	w.detachHealth(u, u.healthKey)
+	u.healthKey = ""
+}
+
+// attachHealth adds the upstream to the consumers of a watch, starting it
+// if needed. w.lock must be held.
+func (w *Watcher) attachHealth(u *upstream, datacenter string) *healthWatch {
+	key := u.healthKeyIn(datacenter)
+	hw, ok := w.healthWatches[key]
+	if !ok {
+		hw = &healthWatch{
+			key:        key,
+			service:    u.ServiceName,
+			namespace:  u.Namespace,
+			partition:  u.Partition,
+			datacenter: datacenter,
+			peer:       u.Peer,
+			consumers:  map[*upstream]bool{},
+		}
+		hw.ctx, hw.cancel = context.WithCancel(w.ctx)
+		w.healthWatches[key] = hw
+		w.opts.Metrics.SetGauge("connect_consul_health_watches", float64(len(w.healthWatches)), nil)
+		go w.runHealthWatch(hw)
+	} else {
+		w.log.Debugf("consul: upstream %s shares the watch of %s", u.Name, key)
+	}
+	hw.consumers[u] = true
+	return hw
+}
+
+// detachHealth removes the upstream from the consumers of a watch, the
+// watch is stopped when it has no consumer left. w.lock must be held.
+func (w *Watcher) detachHealth(u *upstream, key string) {
+	hw, ok := w.healthWatches[key]
+	if !ok {
+		return
+	}
+	delete(hw.consumers, u)
+	if len(hw.consumers) == 0 {
+		hw.cancel()
+		delete(w.healthWatches, hw.key)
+		w.opts.Metrics.SetGauge("connect_consul_health_watches", float64(len(w.healthWatches)), nil)
+	}
+}
+
+func (w *Watcher) runHealthWatch(hw *healthWatch) {
+	index := uint64(0)
+	b := w.newBackoff()
+	for w.acquireQuery(hw.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		// instances in maintenance are drained, they are only returned with
+		// the critical ones
+		nodes, meta, err := w.client().HealthConnect(hw.service, "", false, w.blocking(hw.ctx, &api.QueryOptions{
+			Datacenter: hw.datacenter,
+			Namespace:  hw.namespace,
+			Partition:  hw.partition,
+			Peer:       hw.peer,
+			WaitIndex:  index,
+			Token:      token,
+		}))
+		w.releaseQuery()
+		w.observeQuery("upstream", start)
+		// the upstreams were removed, the result is not needed
+		if hw.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching service definition for service %s: %s", hw.service, err)
+			w.waitAfterError(hw.ctx, b, err, token)
+			index = 0
+			continue
+		}
+		b.reset()
+		var changed bool
+		index, changed = w.nextIndex("upstream", hw.service, index, meta.LastIndex)
+
+		w.lock.Lock()
+		first := !hw.fetched
+		apply := false
+		if changed {
+			hw.nodes = withoutCritical(nodes)
+			hw.fetched = true
+			apply = w.scheduleHealthUpdate(hw)
+		}
+		pending := hw.pendingReady
+		hw.pendingReady = 0
+		w.lock.Unlock()
+
+		if apply {
+			w.notifyChanged()
+		}
+
+		if first {
+			w.logHealthyNodes(hw.service, nodes)
+		}
+		for i := 0; i < pending; i++ {
+			w.ready.Done()
+		}
+	}
+}
+
+// scheduleHealthUpdate applies the nodes of the watch to its consumers and
+// returns true, or delays it during a burst of changes so that the other
+// upstreams stay responsive. w.lock must be held.
+func (w *Watcher) scheduleHealthUpdate(hw *healthWatch) bool {
+	delay := hw.coalesceDelay(time.Now())
+	w.opts.Metrics.SetGauge("connect_consul_coalesce_delay_seconds", delay.Seconds(), metrics.Labels{"service": hw.key})
+
+	if delay == 0 {
+		w.applyHealthNodes(hw)
+		return true
+	}
+
+	// a delayed update picks the latest nodes when it fires
+	if hw.delayed {
+		return false
+	}
+	w.log.Infof("consul: upstream %s changed %d times in %s, delaying the update by %s", hw.key, len(hw.changes), burstWindow, delay)
+	hw.delayed = true
+	time.AfterFunc(delay, func() {
+		w.lock.Lock()
+		hw.delayed = false
+		if hw.ctx.Err() == nil {
+			w.applyHealthNodes(hw)
+		}
+		w.lock.Unlock()
+		w.notifyChanged()
+	})
+	return false
+}
+
+func (w *Watcher) applyHealthNodes(hw *healthWatch) {
+	for u := range hw.consumers {
+		if u.healthKey == hw.key {
+			u.Nodes = hw.nodes
+			u.fetched = true
+		} else {
+			u.failover[hw.key] = hw.nodes
+		}
+	}
+}
+
+// withoutCritical removes the critical instances, except the ones in
+// maintenance which are drained
+func withoutCritical(nodes []*api.ServiceEntry) []*api.ServiceEntry {
+	kept := make([]*api.ServiceEntry, 0, len(nodes))
+	for _, s := range nodes {
+		if s.Checks.AggregatedStatus() == api.HealthCritical && !inMaintenance(s) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept
+}
+
+func (w *Watcher) logHealthyNodes(service string, nodes []*api.ServiceEntry) {
+	healthyCount := 0
+	for _, node := range nodes {
+		status := node.Checks.AggregatedStatus()
+		if status == api.HealthPassing || status == api.HealthWarning {
+			healthyCount++
+		}
+	}
+
+	if healthyCount > 0 {
+		w.log.Infof("consul: upstream %s ready with %d healthy node(s)", service, healthyCount)
+	} else {
+		w.log.Warnf("consul: upstream %s has no healthy nodes yet (will retry)", service)
+	}
+}
@@ -0,0 +1,68 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthKey(t *testing.T) {
+	u := &upstream{ServiceName: "api"}
+	require.Equal(t, "api@dc1", u.healthKeyIn("dc1"))
+
+	u.Namespace = "team"
+	require.Equal(t, "/team/api@dc1", u.healthKeyIn("dc1"))
+	u.Partition = "team"
+	require.NotEqual(t, healthKey("", "team", "api", "dc1", ""), u.healthKeyIn("dc1"))
+
+	// the same service imported from a peer is another watch
+	u.Peer = "eu"
+	require.Equal(t, "team/team/api@peer:eu", u.healthKeyIn("dc1"))
+}
+
+func TestCoalesceDelay(t *testing.T) {
+	hw := &healthWatch{}
+	now := time.Now()
+
+	require.Equal(t, time.Duration(0), hw.coalesceDelay(now))
+	require.Equal(t, time.Duration(0), hw.coalesceDelay(now.Add(time.Second)))
+
+	// rolling deploy
+	require.Equal(t, coalesceMin, hw.coalesceDelay(now.Add(2*time.Second)))
+	require.Equal(t, 2*coalesceMin, hw.coalesceDelay(now.Add(3*time.Second)))
+	for i := 0; i < 10; i++ {
+		hw.coalesceDelay(now.Add(4 * time.Second))
+	}
+	require.Equal(t, coalesceMax, hw.delay)
+
+	// quiet again
+	require.Equal(t, time.Duration(0), hw.coalesceDelay(now.Add(time.Hour)))
+	require.Len(t, hw.changes, 1)
+}
+
+func TestWithoutCritical(t *testing.T) {
+	node := func(addr string, checks ...*api.HealthCheck) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Node: addr, Address: addr},
+			Service: &api.AgentService{ID: "api-" + addr, Port: 80},
+			Checks:  checks,
+		}
+	}
+	passing := &api.HealthCheck{CheckID: "service:api", Status: api.HealthPassing}
+	warning := &api.HealthCheck{CheckID: "service:api", Status: api.HealthWarning}
+	critical := &api.HealthCheck{CheckID: "service:api", Status: api.HealthCritical}
+	maint := &api.HealthCheck{CheckID: api.NodeMaint, Status: api.HealthCritical}
+
+	nodes := withoutCritical([]*api.ServiceEntry{
+		node("10.0.0.1", passing),
+		node("10.0.0.2", critical),
+		node("10.0.0.3", warning),
+		node("10.0.0.4", passing, maint),
+	})
+	require.Len(t, nodes, 3)
+	require.Equal(t, "10.0.0.1", nodes[0].Node.Address)
+	require.Equal(t, "10.0.0.3", nodes[1].Node.Address)
+	require.Equal(t, "10.0.0.4", nodes[2].Node.Address)
+}
@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPCheckInterval is the interval of the HTTP checks without one
+const DefaultHTTPCheckInterval = 10 * time.Second
+
+var httpCheckMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"POST":    true,
+	"PUT":     true,
+}
+
+// HTTPCheck replaces the connection checks of the instances of an upstream
+// with HTTP requests
+type HTTPCheck struct {
+	Method string
+	Path   string
+	// Host is the Host header of the requests, the upstream service name
+	// when empty
+	Host    string
+	Headers []HTTPCheckHeader
+	// Interval is the interval between two checks of an instance
+	Interval time.Duration
+}
+
+type HTTPCheckHeader struct {
+	Name  string
+	Value string
+}
+
+func parseHTTPCheck(v interface{}) (*HTTPCheck, error) {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", v)
+	}
+
+	check := &HTTPCheck{
+		Method:   "GET",
+		Path:     "/",
+		Interval: DefaultHTTPCheckInterval,
+	}
+	if m, ok := c["method"]; ok {
+		s, _ := m.(string)
+		s = strings.ToUpper(s)
+		if !httpCheckMethods[s] {
+			return nil, fmt.Errorf("method must be one of GET, HEAD, OPTIONS, POST or PUT, got %v", m)
+		}
+		check.Method = s
+	}
+	if p, ok := c["path"]; ok {
+		s, _ := p.(string)
+		if !strings.HasPrefix(s, "/") || strings.ContainsAny(s, " \t\r\n") {
+			return nil, fmt.Errorf("path must start with / and have no spaces, got %v", p)
+		}
+		check.Path = s
+	}
+	if h, ok := c["host"]; ok {
+		s, _ := h.(string)
+		if s == "" || strings.ContainsAny(s, " \t\r\n") {
+			return nil, fmt.Errorf("host must be a name without spaces, got %v", h)
+		}
+		check.Host = s
+	}
+	if i, ok := c["interval"]; ok {
+		s, _ := i.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("interval must be a positive duration, got %v", i)
+		}
+		check.Interval = d
+	}
+	if h, ok := c["headers"]; ok {
+		headers, ok := h.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("headers: expected an object, got %T", h)
+		}
+		for name, v := range headers {
+			value, ok := v.(string)
+			if !ok || name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("headers: bad header %s: %v", name, v)
+			}
+			// the Host header has its own key
+			if strings.EqualFold(name, "host") {
+				return nil, fmt.Errorf("headers: the Host header is set with the host key")
+			}
+			check.Headers = append(check.Headers, HTTPCheckHeader{Name: name, Value: value})
+		}
+		sort.Slice(check.Headers, func(i, j int) bool {
+			return check.Headers[i].Name < check.Headers[j].Name
+		})
+	}
+	return check, nil
+}
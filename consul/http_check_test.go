@@ -0,0 +1,51 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHTTPCheck(t *testing.T) {
+	c, err := parseHTTPCheck(map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, &HTTPCheck{Method: "GET", Path: "/", Interval: DefaultHTTPCheckInterval}, c)
+
+	c, err = parseHTTPCheck(map[string]interface{}{
+		"method":   "head",
+		"path":     "/health?full=1",
+		"host":     "api.internal",
+		"interval": "5s",
+		"headers": map[string]interface{}{
+			"X-Probe":       "haproxy",
+			"Authorization": "Bearer abc",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &HTTPCheck{
+		Method:   "HEAD",
+		Path:     "/health?full=1",
+		Host:     "api.internal",
+		Interval: 5 * time.Second,
+		Headers: []HTTPCheckHeader{
+			{Name: "Authorization", Value: "Bearer abc"},
+			{Name: "X-Probe", Value: "haproxy"},
+		},
+	}, c)
+
+	bad := []interface{}{
+		"/health",
+		map[string]interface{}{"method": "DELETE"},
+		map[string]interface{}{"path": "health"},
+		map[string]interface{}{"path": "/a b"},
+		map[string]interface{}{"interval": "-1s"},
+		map[string]interface{}{"headers": map[string]interface{}{"Host": "api"}},
+		map[string]interface{}{"headers": map[string]interface{}{"X-Bad": "a\r\nb"}},
+		map[string]interface{}{"headers": map[string]interface{}{"X-Num": float64(1)}},
+	}
+	for _, v := range bad {
+		_, err := parseHTTPCheck(v)
+		require.Error(t, err, "%v", v)
+	}
+}
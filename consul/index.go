@@ -0,0 +1,35 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+)
+
+// observeQuery records the latency of a blocking query, including the time
+// spent blocked waiting for a change
+func (w *Watcher) observeQuery(watch string, start time.Time) {
+	w.opts.Metrics.ObserveDuration("connect_consul_query_duration", time.Since(start), metrics.Labels{"watch": watch})
+}
+
+// nextIndex returns the index to wait on after a blocking query returned
+// index, following the Consul guidance:
+//   - an index lower than the previous one means the agent state was reset,
+//     eg: restarted or restored from a snapshot. Waiting on the previous
+//     index would block until the new one catches up, the watch is restarted
+//     from 0 and the result considered changed.
+//   - an index of 0 would make the next query return immediately, 1 is used
+//     instead
+func (w *Watcher) nextIndex(watch, name string, prev, index uint64) (uint64, bool) {
+	w.opts.Metrics.SetGauge("connect_consul_query_index", float64(index), metrics.Labels{"watch": watch})
+
+	if index == 0 {
+		index = 1
+	}
+	if index < prev {
+		w.log.Warnf("consul: %s %s: index went backwards from %d to %d, consul state was reset, fetching again", watch, name, prev, index)
+		w.opts.Metrics.IncrCounter("connect_consul_index_regressions_total", 1, metrics.Labels{"watch": watch})
+		return 0, true
+	}
+	return index, index != prev
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextIndex(t *testing.T) {
+	m := metrics.NewPrometheus()
+	w := NewWithOptions("svc", nil, NewTestingLogger(t), Options{Metrics: m})
+
+	index, changed := w.nextIndex("ca", "roots", 0, 10)
+	require.Equal(t, uint64(10), index)
+	require.True(t, changed)
+
+	index, changed = w.nextIndex("ca", "roots", index, 10)
+	require.Equal(t, uint64(10), index)
+	require.False(t, changed)
+
+	// agent restarted: start over and process the result
+	index, changed = w.nextIndex("ca", "roots", index, 4)
+	require.Equal(t, uint64(0), index)
+	require.True(t, changed)
+
+	index, changed = w.nextIndex("ca", "roots", index, 4)
+	require.Equal(t, uint64(4), index)
+	require.True(t, changed)
+
+	// a zero index would not block
+	index, changed = w.nextIndex("leaf", "svc", 0, 0)
+	require.Equal(t, uint64(1), index)
+	require.True(t, changed)
+
+	index, changed = w.nextIndex("leaf", "svc", index, 0)
+	require.Equal(t, uint64(1), index)
+	require.False(t, changed)
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	require.Contains(t, buf.String(), `connect_consul_index_regressions_total{watch="ca"} 1`)
+}
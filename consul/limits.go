@@ -0,0 +1,114 @@
+package consul
+
+import "fmt"
+
+// Limits caps the load sent to an upstream, zero values are unlimited
+type Limits struct {
+	// MaxConn is the number of concurrent connections per instance, the
+	// extra requests are queued
+	MaxConn int
+	// MaxQueue is the number of requests queued per instance, the extra
+	// requests are sent to another instance
+	MaxQueue int
+	// FullConn is the backend load at which instances accept MaxConn
+	// connections, below it the limit is lowered in proportion
+	FullConn int
+	// ListenerMaxConn is the number of concurrent connections accepted by
+	// the local listener, it overrides the share of the global maxconn
+	ListenerMaxConn int
+}
+
+// ListenerLimits protect a public listener from inbound floods, 0 disables
+// a limit
+type ListenerLimits struct {
+	// MaxConn is the number of concurrent connections the listener accepts
+	MaxConn int
+	// ConnRate is the number of new connections per second accepted from a
+	// source address
+	ConnRate int
+	// ReqRate is the number of HTTP requests per second accepted from a
+	// source address, only with the http protocol
+	ReqRate int
+	// SourceReqRates is the number of HTTP requests per second accepted
+	// from all the instances of a source service, by service name. * is
+	// the budget of the services not listed.
+	SourceReqRates map[string]int
+}
+
+// parseLimits reads the maxconn, maxqueue, fullconn and listener_maxconn keys
+// of an upstream config, invalid values are reported and ignored
+func parseLimits(config map[string]interface{}, logError func(key string, err error)) Limits {
+	l := Limits{}
+	for key, dst := range map[string]*int{
+		"maxconn":          &l.MaxConn,
+		"maxqueue":         &l.MaxQueue,
+		"fullconn":         &l.FullConn,
+		"listener_maxconn": &l.ListenerMaxConn,
+	} {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		n, err := parseLimit(v)
+		if err != nil {
+			logError(key, err)
+			continue
+		}
+		*dst = n
+	}
+	return l
+}
+
+// parseListenerLimits reads the listener_maxconn, connection_rate_limit,
+// request_rate_limit and source_rate_limits keys of a listener config,
+// invalid values are reported and ignored
+func parseListenerLimits(config map[string]interface{}, logError func(key string, err error)) ListenerLimits {
+	l := ListenerLimits{}
+	for key, dst := range map[string]*int{
+		"listener_maxconn":      &l.MaxConn,
+		"connection_rate_limit": &l.ConnRate,
+		"request_rate_limit":    &l.ReqRate,
+	} {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		n, err := parseLimit(v)
+		if err != nil {
+			logError(key, err)
+			continue
+		}
+		*dst = n
+	}
+
+	if v, ok := config["source_rate_limits"]; ok {
+		rates, ok := v.(map[string]interface{})
+		if !ok {
+			logError("source_rate_limits", fmt.Errorf("expected an object, got %T", v))
+			return l
+		}
+		for service, r := range rates {
+			n, err := parseLimit(r)
+			if err != nil {
+				logError("source_rate_limits."+service, err)
+				continue
+			}
+			if l.SourceReqRates == nil {
+				l.SourceReqRates = map[string]int{}
+			}
+			l.SourceReqRates[service] = n
+		}
+	}
+	return l
+}
+
+func parseLimit(v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+	if f < 1 || f != float64(int(f)) {
+		return 0, fmt.Errorf("expected a positive integer, got %v", f)
+	}
+	return int(f), nil
+}
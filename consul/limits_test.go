@@ -0,0 +1,41 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimits(t *testing.T) {
+	bad := []string{}
+	l := parseLimits(map[string]interface{}{
+		"maxconn":          float64(100),
+		"maxqueue":         float64(-1),
+		"fullconn":         "1000",
+		"listener_maxconn": float64(300),
+	}, func(key string, err error) {
+		bad = append(bad, key)
+	})
+
+	require.Equal(t, Limits{MaxConn: 100, ListenerMaxConn: 300}, l)
+	require.ElementsMatch(t, []string{"maxqueue", "fullconn"}, bad)
+}
+
+func TestParseListenerLimits(t *testing.T) {
+	bad := []string{}
+	l := parseListenerLimits(map[string]interface{}{
+		"listener_maxconn":      float64(500),
+		"connection_rate_limit": float64(0),
+		"request_rate_limit":    float64(100),
+		"source_rate_limits": map[string]interface{}{
+			"web": float64(50),
+			"*":   float64(10),
+			"api": "100",
+		},
+	}, func(key string, err error) {
+		bad = append(bad, key)
+	})
+
+	require.Equal(t, ListenerLimits{MaxConn: 500, ReqRate: 100, SourceReqRates: map[string]int{"web": 50, "*": 10}}, l)
+	require.ElementsMatch(t, []string{"connection_rate_limit", "source_rate_limits.api"}, bad)
+}
@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// luaScriptName is the file name of a script, it is written in the
+	// config dir
+	luaScriptName = regexp.MustCompile(`^[A-Za-z0-9_-]+\.lua$`)
+	// luaActionName is the name of an action registered by a script with
+	// core.register_action
+	luaActionName = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+)
+
+// LuaActions are the Lua actions called on the requests of the frontend
+// and backend generated for a listener
+type LuaActions struct {
+	Frontend []string
+	Backend  []string
+}
+
+// parseLuaScripts reads the lua_scripts of a proxy config, an object of the
+// scripts source by file name
+func parseLuaScripts(v interface{}) (map[string]string, error) {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", v)
+	}
+	scripts := make(map[string]string, len(c))
+	for name, s := range c {
+		if !luaScriptName.MatchString(name) {
+			return nil, fmt.Errorf("%s: the name must be a .lua file name", name)
+		}
+		source, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected the source of the script, got %T", name, s)
+		}
+		scripts[name] = source
+	}
+	return scripts, nil
+}
+
+// parseLuaActions reads the lua_actions of a proxy or upstream config, in
+// the shape of extra_config: a list of actions is called in the frontend,
+// an object with "frontend" and "backend" lists in each section
+func parseLuaActions(v interface{}) (LuaActions, error) {
+	sections, err := parseExtraConfig(v)
+	if err != nil {
+		return LuaActions{}, err
+	}
+	actions := LuaActions{
+		Frontend: trimLuaPrefix(sections.Frontend),
+		Backend:  trimLuaPrefix(sections.Backend),
+	}
+	for _, names := range [][]string{actions.Frontend, actions.Backend} {
+		for _, name := range names {
+			if !luaActionName.MatchString(name) {
+				return LuaActions{}, fmt.Errorf("invalid action name %q", name)
+			}
+		}
+	}
+	return actions, nil
+}
+
+// trimLuaPrefix accepts the actions named as in the HAProxy rules, eg:
+// lua.auth
+func trimLuaPrefix(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	trimmed := make([]string, 0, len(names))
+	for _, name := range names {
+		trimmed = append(trimmed, strings.TrimPrefix(name, "lua."))
+	}
+	return trimmed
+}
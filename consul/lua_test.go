@@ -0,0 +1,42 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLuaScripts(t *testing.T) {
+	scripts, err := parseLuaScripts(map[string]interface{}{
+		"auth.lua": "core.register_action('auth', {'http-req'}, function(txn) end)",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"auth.lua": "core.register_action('auth', {'http-req'}, function(txn) end)"}, scripts)
+
+	// the scripts are written in the config dir
+	for _, name := range []string{"../auth.lua", "auth", "a b.lua"} {
+		_, err = parseLuaScripts(map[string]interface{}{name: ""})
+		require.Error(t, err, name)
+	}
+
+	_, err = parseLuaScripts(map[string]interface{}{"auth.lua": 1})
+	require.Error(t, err)
+	_, err = parseLuaScripts([]interface{}{"auth.lua"})
+	require.Error(t, err)
+}
+
+func TestParseLuaActions(t *testing.T) {
+	actions, err := parseLuaActions([]interface{}{"auth", "lua.tag"})
+	require.NoError(t, err)
+	require.Equal(t, LuaActions{Frontend: []string{"auth", "tag"}}, actions)
+
+	actions, err = parseLuaActions(map[string]interface{}{
+		"frontend": []interface{}{"auth"},
+		"backend":  []interface{}{"tag"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, LuaActions{Frontend: []string{"auth"}, Backend: []string{"tag"}}, actions)
+
+	_, err = parseLuaActions([]interface{}{"auth if { src 10.0.0.1 }"})
+	require.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mirror copies a share of the HTTP requests of an upstream to another
+// upstream of the proxy, the responses of the copies are discarded
+type Mirror struct {
+	// Upstream is the name of the upstream receiving the copies
+	Upstream string
+	// Percent of the requests copied, 1 to 100
+	Percent int
+}
+
+// parseMirror reads the mirror_to key of an upstream config, either the name
+// of the upstream receiving all the copies or an object with the upstream
+// and percent keys
+func parseMirror(v interface{}) (*Mirror, error) {
+	m := &Mirror{Percent: 100}
+	switch c := v.(type) {
+	case string:
+		m.Upstream = c
+	case map[string]interface{}:
+		m.Upstream, _ = c["upstream"].(string)
+		if p, ok := c["percent"]; ok {
+			f, ok := p.(float64)
+			if !ok || f != float64(int(f)) || f < 1 || f > 100 {
+				return nil, fmt.Errorf("percent must be an integer between 1 and 100, got %v", p)
+			}
+			m.Percent = int(f)
+		}
+	default:
+		return nil, fmt.Errorf("expected an upstream name or an object, got %T", v)
+	}
+
+	if m.Upstream == "" || strings.ContainsAny(m.Upstream, " \t\r\n") {
+		return nil, fmt.Errorf("upstream must be a name without spaces, got %q", m.Upstream)
+	}
+	return m, nil
+}
+
+// Mirrored tells if an upstream copies its requests to another one
+func (c Config) Mirrored() bool {
+	for _, up := range c.Upstreams {
+		if up.Mirror != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMirror(t *testing.T) {
+	m, err := parseMirror("api-v2")
+	require.NoError(t, err)
+	require.Equal(t, &Mirror{Upstream: "api-v2", Percent: 100}, m)
+
+	m, err = parseMirror(map[string]interface{}{"upstream": "api-v2", "percent": float64(10)})
+	require.NoError(t, err)
+	require.Equal(t, &Mirror{Upstream: "api-v2", Percent: 10}, m)
+
+	bad := []interface{}{
+		"",
+		"api v2",
+		float64(10),
+		map[string]interface{}{"percent": float64(10)},
+		map[string]interface{}{"upstream": "api-v2", "percent": float64(0)},
+		map[string]interface{}{"upstream": "api-v2", "percent": float64(101)},
+		map[string]interface{}{"upstream": "api-v2", "percent": float64(2.5)},
+		map[string]interface{}{"upstream": "api-v2", "percent": "10"},
+	}
+	for _, v := range bad {
+		_, err := parseMirror(v)
+		require.Error(t, err, "%v", v)
+	}
+}
@@ -0,0 +1,182 @@
+package consul
+
+import (
+	"context"
+	"strings"
+)
+
+// Multi merges the configs of the watchers of several services proxied by
+// the same HAProxy. The first service keeps the names of its listeners and
+// upstreams, the ones of the other services are prefixed with their service
+// id so that they do not collide.
+type Multi struct {
+	C chan Config
+
+	watchers []*Watcher
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewMulti merges the configs of watchers, the first one is the main
+// service of the proxy
+func NewMulti(watchers ...*Watcher) *Multi {
+	m := &Multi{
+		C:        make(chan Config),
+		watchers: watchers,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// prefix is the prefix of the listeners and upstreams of the i-th service
+func (m *Multi) prefix(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return m.watchers[i].service
+}
+
+// Run runs the watchers and sends a merged config each time one of them
+// changes, once all of them sent their first one. It returns the first
+// error of a watcher, the others are stopped.
+func (m *Multi) Run() error {
+	type update struct {
+		i   int
+		cfg Config
+	}
+	updates := make(chan update)
+	errs := make(chan error, len(m.watchers))
+	for i, w := range m.watchers {
+		go func() {
+			errs <- w.Run()
+		}()
+		go func() {
+			for {
+				select {
+				case cfg := <-w.C:
+					select {
+					case updates <- update{i: i, cfg: cfg}:
+					case <-m.ctx.Done():
+						return
+					}
+				case <-m.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	latest := make([]*Config, len(m.watchers))
+	for {
+		select {
+		case u := <-updates:
+			latest[u.i] = &u.cfg
+			cfgs := make([]Config, 0, len(latest))
+			for _, cfg := range latest {
+				if cfg == nil {
+					break
+				}
+				cfgs = append(cfgs, *cfg)
+			}
+			if len(cfgs) < len(latest) {
+				continue
+			}
+			merged := m.merge(cfgs)
+			// the other configs were already sent
+			merged.ChangedAt = u.cfg.ChangedAt
+			select {
+			case m.C <- merged:
+			case <-m.ctx.Done():
+				return nil
+			}
+		case err := <-errs:
+			// a watcher returns without error only when stopped
+			if err != nil {
+				m.Stop()
+				return err
+			}
+		case <-m.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Stop stops the watchers
+func (m *Multi) Stop() {
+	m.cancel()
+	for _, w := range m.watchers {
+		w.Stop()
+	}
+}
+
+// merge returns the config of the first service with the listeners and
+// upstreams of the others added, renamed with their prefix. The listeners
+// of the other services check the intentions of their own service.
+func (m *Multi) merge(cfgs []Config) Config {
+	if len(cfgs) == 1 {
+		return cfgs[0]
+	}
+
+	merged := cfgs[0]
+	merged.ExtraDownstreams = append([]Downstream{}, cfgs[0].ExtraDownstreams...)
+	merged.Upstreams = append([]Upstream{}, cfgs[0].Upstreams...)
+	merged.LuaScripts = map[string]string{}
+	for name, source := range cfgs[0].LuaScripts {
+		merged.LuaScripts[name] = source
+	}
+	for i, cfg := range cfgs[1:] {
+		prefix := m.prefix(i + 1)
+		if cfg.Downstream.TargetPort > 0 {
+			d := cfg.Downstream
+			d.Name = prefix
+			d.Service = cfg.ServiceName
+			merged.ExtraDownstreams = append(merged.ExtraDownstreams, d)
+		}
+		for _, d := range cfg.ExtraDownstreams {
+			d.Name = prefix + "_" + d.Name
+			d.Service = cfg.ServiceName
+			merged.ExtraDownstreams = append(merged.ExtraDownstreams, d)
+		}
+		for _, up := range cfg.Upstreams {
+			up.Name = prefix + "_" + up.Name
+			up.Owner = prefix
+			if up.Mirror != nil {
+				mirror := *up.Mirror
+				mirror.Upstream = prefix + "_" + mirror.Upstream
+				up.Mirror = &mirror
+			}
+			merged.Upstreams = append(merged.Upstreams, up)
+		}
+		merged.AccessLogs = merged.AccessLogs || cfg.AccessLogs
+		// the scripts are loaded globally, the first service wins
+		for name, source := range cfg.LuaScripts {
+			if _, ok := merged.LuaScripts[name]; !ok {
+				merged.LuaScripts[name] = source
+			}
+		}
+	}
+	return merged
+}
+
+// watcherOf returns the watcher of an upstream name of the merged config
+// and its name in that watcher
+func (m *Multi) watcherOf(name string) (*Watcher, string) {
+	for i := len(m.watchers) - 1; i > 0; i-- {
+		if n, ok := strings.CutPrefix(name, m.prefix(i)+"_"); ok {
+			return m.watchers[i], n
+		}
+	}
+	return m.watchers[0], name
+}
+
+// PinUpstream implements UpstreamPinner
+func (m *Multi) PinUpstream(name string) error {
+	w, name := m.watcherOf(name)
+	return w.PinUpstream(name)
+}
+
+// UnpinUpstream implements UpstreamPinner
+func (m *Multi) UnpinUpstream(name string) error {
+	w, name := m.watcherOf(name)
+	return w.UnpinUpstream(name)
+}
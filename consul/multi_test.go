@@ -0,0 +1,58 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiMerge(t *testing.T) {
+	m := NewMulti(
+		New("web", nil, NewTestingLogger(t)),
+		New("api", nil, NewTestingLogger(t)),
+	)
+	merged := m.merge([]Config{
+		{
+			ServiceName: "web",
+			Downstream:  Downstream{LocalBindPort: 21000, TargetPort: 8080},
+			Upstreams:   []Upstream{{Name: "db", LocalBindPort: 9000}},
+		},
+		{
+			ServiceName:      "api",
+			Downstream:       Downstream{LocalBindPort: 21001, TargetPort: 8081},
+			ExtraDownstreams: []Downstream{{Name: "grpc", LocalBindPort: 21002, TargetPort: 9090}},
+			Upstreams: []Upstream{
+				{Name: "db", LocalBindPort: 9001, Mirror: &Mirror{Upstream: "db_shadow", Percent: 10}},
+				{Name: "db_shadow", LocalBindPort: 9002},
+			},
+			AccessLogs: true,
+		},
+	})
+
+	require.Equal(t, "web", merged.ServiceName)
+	require.Equal(t, 21000, merged.Downstream.LocalBindPort)
+	require.True(t, merged.AccessLogs)
+
+	require.Len(t, merged.ExtraDownstreams, 2)
+	require.Equal(t, "api", merged.ExtraDownstreams[0].Name)
+	require.Equal(t, "api", merged.ExtraDownstreams[0].Service)
+	require.Equal(t, 21001, merged.ExtraDownstreams[0].LocalBindPort)
+	require.Equal(t, "api_grpc", merged.ExtraDownstreams[1].Name)
+	require.Equal(t, "api", merged.ExtraDownstreams[1].Service)
+
+	names := []string{}
+	for _, up := range merged.Upstreams {
+		names = append(names, up.Name)
+	}
+	require.Equal(t, []string{"db", "api_db", "api_db_shadow"}, names)
+	require.Equal(t, "api_db_shadow", merged.Upstreams[1].Mirror.Upstream)
+	require.Equal(t, "", merged.Upstreams[0].Owner)
+	require.Equal(t, "api", merged.Upstreams[1].Owner)
+
+	w, name := m.watcherOf("api_db")
+	require.Equal(t, "api", w.service)
+	require.Equal(t, "db", name)
+	w, name = m.watcherOf("db")
+	require.Equal(t, "web", w.service)
+	require.Equal(t, "db", name)
+}
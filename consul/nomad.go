@@ -0,0 +1,16 @@
+package consul
+
+// NomadProxyIDPrefix returns the prefix of the ids of the services Nomad
+// registers for an allocation, and for one of its task groups when group
+// is set, eg: _nomad-task-<alloc id>-group-<group>-<service>-<port>-sidecar-proxy.
+// It is empty without an allocation id.
+func NomadProxyIDPrefix(allocID, group string) string {
+	if allocID == "" {
+		return ""
+	}
+	prefix := "_nomad-task-" + allocID + "-"
+	if group != "" {
+		prefix += "group-" + group + "-"
+	}
+	return prefix
+}
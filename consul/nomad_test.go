@@ -0,0 +1,13 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNomadProxyIDPrefix(t *testing.T) {
+	require.Equal(t, "", NomadProxyIDPrefix("", "api"))
+	require.Equal(t, "_nomad-task-0c6b5a3e-", NomadProxyIDPrefix("0c6b5a3e", ""))
+	require.Equal(t, "_nomad-task-0c6b5a3e-group-api-", NomadProxyIDPrefix("0c6b5a3e", "api"))
+}
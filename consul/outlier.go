@@ -0,0 +1,49 @@
+package consul
+
+import "fmt"
+
+const DefaultOutlierErrorLimit = 5
+
+var outlierOnErrors = map[string]bool{
+	"fastinter":    true,
+	"fail-check":   true,
+	"sudden-death": true,
+	"mark-down":    true,
+}
+
+// OutlierDetection switches the passive health observation of an HTTP
+// upstream to the responses of its instances
+type OutlierDetection struct {
+	// ErrorLimit is the number of consecutive errors triggering OnError
+	ErrorLimit int
+	// OnError is the HAProxy on-error action: fastinter, fail-check,
+	// sudden-death or mark-down
+	OnError string
+}
+
+func parseOutlierDetection(v interface{}) (*OutlierDetection, error) {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", v)
+	}
+
+	o := &OutlierDetection{
+		ErrorLimit: DefaultOutlierErrorLimit,
+		OnError:    "mark-down",
+	}
+	if l, ok := c["error_limit"]; ok {
+		n, err := parseLimit(l)
+		if err != nil {
+			return nil, fmt.Errorf("error_limit: %s", err)
+		}
+		o.ErrorLimit = n
+	}
+	if a, ok := c["on_error"]; ok {
+		s, _ := a.(string)
+		if !outlierOnErrors[s] {
+			return nil, fmt.Errorf("on_error must be one of fastinter, fail-check, sudden-death or mark-down, got %v", a)
+		}
+		o.OnError = s
+	}
+	return o, nil
+}
@@ -0,0 +1,26 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutlierDetection(t *testing.T) {
+	o, err := parseOutlierDetection(map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, &OutlierDetection{ErrorLimit: DefaultOutlierErrorLimit, OnError: "mark-down"}, o)
+
+	o, err = parseOutlierDetection(map[string]interface{}{"error_limit": float64(3), "on_error": "sudden-death"})
+	require.NoError(t, err)
+	require.Equal(t, &OutlierDetection{ErrorLimit: 3, OnError: "sudden-death"}, o)
+
+	for _, v := range []interface{}{
+		true,
+		map[string]interface{}{"error_limit": float64(0)},
+		map[string]interface{}{"on_error": "drop"},
+	} {
+		_, err := parseOutlierDetection(v)
+		require.Error(t, err)
+	}
+}
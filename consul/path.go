@@ -0,0 +1,39 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pathPrefixRe restricts the prefixes to characters that need no escaping
+// in the generated regexes and converters
+var pathPrefixRe = regexp.MustCompile(`^/[A-Za-z0-9/._~-]*$`)
+
+// PathRewrite changes the path of the requests sent to the instances of an
+// upstream, the prefix is stripped before the new one is added
+type PathRewrite struct {
+	StripPrefix   string
+	PrefixRewrite string
+}
+
+// parsePathRewrite reads the strip_prefix and prefix_rewrite keys of an
+// upstream config, the trailing slashes are dropped
+func parsePathRewrite(config map[string]interface{}) (PathRewrite, error) {
+	r := PathRewrite{}
+	for key, dst := range map[string]*string{
+		"strip_prefix":   &r.StripPrefix,
+		"prefix_rewrite": &r.PrefixRewrite,
+	} {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		s, _ := v.(string)
+		if !pathPrefixRe.MatchString(s) {
+			return PathRewrite{}, fmt.Errorf("%s must be a path starting with /, got %v", key, v)
+		}
+		*dst = strings.TrimRight(s, "/")
+	}
+	return r, nil
+}
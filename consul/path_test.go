@@ -0,0 +1,37 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePathRewrite(t *testing.T) {
+	r, err := parsePathRewrite(map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, PathRewrite{}, r)
+
+	r, err = parsePathRewrite(map[string]interface{}{
+		"strip_prefix":   "/v1/",
+		"prefix_rewrite": "/api/v1.2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, PathRewrite{StripPrefix: "/v1", PrefixRewrite: "/api/v1.2"}, r)
+
+	// a / prefix strips nothing
+	r, err = parsePathRewrite(map[string]interface{}{"strip_prefix": "/"})
+	require.NoError(t, err)
+	require.Equal(t, PathRewrite{}, r)
+
+	bad := []map[string]interface{}{
+		{"strip_prefix": "v1"},
+		{"strip_prefix": float64(1)},
+		{"prefix_rewrite": "/a b"},
+		{"prefix_rewrite": "/a,b"},
+		{"prefix_rewrite": "/a)"},
+	}
+	for _, c := range bad {
+		_, err := parsePathRewrite(c)
+		require.Error(t, err, "%v", c)
+	}
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// peerPollInterval spaces the reads of the trust bundle of a peer when the
+// agent answers without blocking
+const peerPollInterval = 30 * time.Second
+
+// peerBundle is the trust bundle of a cluster peer, the instances of the
+// services imported from it present certificates signed by its CA
+type peerBundle struct {
+	peer      string
+	consumers map[*upstream]bool
+	cas       [][]byte
+	fetched   bool
+	// ctx is cancelled once the bundle has no consumer left
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// attachPeer adds the upstream to the consumers of the trust bundle of its
+// peer, starting the watch if needed. w.lock must be held.
+func (w *Watcher) attachPeer(u *upstream) {
+	if u.Peer == "" {
+		return
+	}
+	pb, ok := w.peerBundles[u.Peer]
+	if !ok {
+		pb = &peerBundle{
+			peer:      u.Peer,
+			consumers: map[*upstream]bool{},
+		}
+		pb.ctx, pb.cancel = context.WithCancel(w.ctx)
+		w.peerBundles[u.Peer] = pb
+		go w.runPeerBundle(pb)
+	}
+	pb.consumers[u] = true
+	u.peerBundle = u.Peer
+}
+
+// detachPeer removes the upstream from the consumers of the trust bundle,
+// the watch is stopped when it has no consumer left. w.lock must be held.
+func (w *Watcher) detachPeer(u *upstream) {
+	pb, ok := w.peerBundles[u.peerBundle]
+	u.peerBundle = ""
+	if !ok {
+		return
+	}
+	delete(pb.consumers, u)
+	if len(pb.consumers) == 0 {
+		pb.cancel()
+		delete(w.peerBundles, pb.peer)
+	}
+}
+
+// peerCAs returns the CAs to verify the instances of a peer upstream with,
+// the local ones until the trust bundle is fetched. w.lock must be held.
+func (w *Watcher) peerCAs(peer string) [][]byte {
+	pb, ok := w.peerBundles[peer]
+	if !ok || !pb.fetched {
+		return w.certCAs
+	}
+	return pb.cas
+}
+
+func (w *Watcher) runPeerBundle(pb *peerBundle) {
+	w.log.Debugf("consul: watching trust bundle of peer %s", pb.peer)
+
+	index := uint64(0)
+	b := w.newBackoff()
+	for w.acquireQuery(pb.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		peering, meta, err := w.client().PeeringRead(pb.ctx, pb.peer, w.blocking(pb.ctx, &api.QueryOptions{
+			WaitIndex: index,
+			Token:     token,
+		}))
+		w.releaseQuery()
+		w.observeQuery("peering", start)
+		if pb.ctx.Err() != nil {
+			return
+		}
+		if err == nil && peering == nil {
+			w.log.Errorf("consul: peer %s not found", pb.peer)
+			sleep(pb.ctx, jitter(peerPollInterval))
+			continue
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching trust bundle of peer %s: %s", pb.peer, err)
+			w.waitAfterError(pb.ctx, b, err, token)
+			index = 0
+			continue
+		}
+		b.reset()
+		var changed bool
+		index, changed = w.nextIndex("peering", pb.peer, index, meta.LastIndex)
+
+		if changed {
+			if peering.State != api.PeeringStateActive {
+				w.log.Warnf("consul: peer %s is %s", pb.peer, peering.State)
+			}
+			cas := make([][]byte, 0, len(peering.PeerCAPems))
+			for _, pem := range peering.PeerCAPems {
+				cas = append(cas, []byte(pem))
+			}
+
+			w.lock.Lock()
+			pb.cas = cas
+			pb.fetched = true
+			w.lock.Unlock()
+
+			w.log.Infof("consul: trust bundle of peer %s has %d CA(s)", pb.peer, len(cas))
+			w.notifyChanged()
+		}
+
+		if time.Since(start) < time.Second {
+			sleep(pb.ctx, jitter(peerPollInterval))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package consul
+
+import (
+	"errors"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrUnknownUpstream is returned when pinning an upstream that is not in
+// the proxy config
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+// ErrUpstreamNotFetched is returned when pinning an upstream whose nodes
+// were not received from Consul yet, it would pin an empty node set
+var ErrUpstreamNotFetched = errors.New("upstream nodes not fetched yet")
+
+// UpstreamPinner freezes the node set of upstreams
+type UpstreamPinner interface {
+	PinUpstream(name string) error
+	UnpinUpstream(name string) error
+}
+
+// PinUpstream keeps the current nodes of an upstream in the generated
+// config, the updates from Consul are ignored until it is unpinned. The
+// pin is dropped with the upstream when it is removed from the proxy config.
+func (w *Watcher) PinUpstream(name string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	u, ok := w.upstreams[name]
+	if !ok {
+		return ErrUnknownUpstream
+	}
+	if u.pinned {
+		return nil
+	}
+	if !u.fetched {
+		return ErrUpstreamNotFetched
+	}
+
+	u.pinned = true
+	u.pinnedNodes = u.Nodes
+	u.pinnedFailover = map[string][]*api.ServiceEntry{}
+	for k, v := range u.failover {
+		u.pinnedFailover[k] = v
+	}
+	w.log.Warnf("consul: upstream %s pinned to its %d current nodes, consul updates are ignored", name, len(u.Nodes))
+	w.opts.Metrics.SetGauge("connect_upstream_pinned", 1, metrics.Labels{"upstream": name})
+	return nil
+}
+
+// UnpinUpstream resumes the Consul updates of an upstream, its latest nodes
+// are applied right away
+func (w *Watcher) UnpinUpstream(name string) error {
+	w.lock.Lock()
+	u, ok := w.upstreams[name]
+	if !ok {
+		w.lock.Unlock()
+		return ErrUnknownUpstream
+	}
+	wasPinned := u.pinned
+	u.pinned = false
+	u.pinnedNodes = nil
+	u.pinnedFailover = nil
+	w.lock.Unlock()
+
+	if !wasPinned {
+		return nil
+	}
+	w.log.Infof("consul: upstream %s unpinned", name)
+	w.opts.Metrics.SetGauge("connect_upstream_pinned", 0, metrics.Labels{"upstream": name})
+	w.notifyChanged()
+	return nil
+}
+
+// currentNodes returns the nodes to configure for an upstream, must be
+// called with w.lock held
+func (u *upstream) currentNodes() []*api.ServiceEntry {
+	if u.pinned {
+		return u.pinnedNodes
+	}
+	return u.Nodes
+}
+
+// currentFailover returns the failover nodes to configure for an upstream,
+// must be called with w.lock held
+func (u *upstream) currentFailover() map[string][]*api.ServiceEntry {
+	if u.pinned {
+		return u.pinnedFailover
+	}
+	return u.failover
+}
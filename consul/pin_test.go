@@ -0,0 +1,41 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinUpstream(t *testing.T) {
+	w := New("svc", nil, NewTestingLogger(t))
+	w.leaf = &certLeaf{}
+
+	node := func(addr string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Address: addr},
+			Service: &api.AgentService{Port: 80, Weights: api.AgentWeights{Passing: 1}},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+	u := &upstream{Name: "up", Nodes: []*api.ServiceEntry{node("1.1.1.1")}}
+	w.upstreams["up"] = u
+
+	require.Equal(t, ErrUnknownUpstream, w.PinUpstream("other"))
+	require.Equal(t, ErrUpstreamNotFetched, w.PinUpstream("up"))
+	require.False(t, u.pinned)
+
+	u.fetched = true
+	require.NoError(t, w.PinUpstream("up"))
+
+	u.Nodes = []*api.ServiceEntry{node("2.2.2.2"), node("3.3.3.3")}
+	cfg := w.genCfg()
+	require.True(t, cfg.Upstreams[0].Pinned)
+	require.Len(t, cfg.Upstreams[0].Nodes, 1)
+	require.Equal(t, "1.1.1.1", cfg.Upstreams[0].Nodes[0].Host)
+
+	require.NoError(t, w.UnpinUpstream("up"))
+	cfg = w.genCfg()
+	require.False(t, cfg.Upstreams[0].Pinned)
+	require.Len(t, cfg.Upstreams[0].Nodes, 2)
+}
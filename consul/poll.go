@@ -0,0 +1,14 @@
+package consul
+
+import (
+	"math/rand"
+	"time"
+)
+
+// pollJitter is the fraction of a poll interval randomly added or removed,
+// spreading the polls of sidecars started together
+const pollJitter = 0.1
+
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*pollJitter*float64(d))
+}
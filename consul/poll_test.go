@@ -0,0 +1,16 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(10 * time.Second)
+		require.GreaterOrEqual(t, d, 9*time.Second)
+		require.LessOrEqual(t, d, 11*time.Second)
+	}
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// blockingWaitTime is how long a blocking query waits for a change
+	blockingWaitTime = 10 * time.Minute
+	// pooledWaitTime is the wait of the blocking queries when their number
+	// is capped, the slots are released often enough for the watches
+	// waiting for one
+	pooledWaitTime = time.Minute
+)
+
+// acquireQuery waits for a slot of the pool of blocking queries, it returns
+// false when the watch is cancelled meanwhile. The slot is released with
+// releaseQuery.
+func (w *Watcher) acquireQuery(ctx context.Context) bool {
+	if w.queries == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case w.queries <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (w *Watcher) releaseQuery() {
+	if w.queries != nil {
+		<-w.queries
+	}
+}
+
+// blocking binds the options of a blocking query to the context of its
+// watch, the query returns as soon as the watch is cancelled
+func (w *Watcher) blocking(ctx context.Context, q *api.QueryOptions) *api.QueryOptions {
+	q.WaitTime = blockingWaitTime
+	if w.queries != nil {
+		q.WaitTime = pooledWaitTime
+	}
+	return q.WithContext(ctx)
+}
+
+// sleep waits unless the watch is cancelled, it returns false when it is
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stop cancels the watches, their blocking queries return right away
+func (w *Watcher) Stop() {
+	w.cancel()
+}
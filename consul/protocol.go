@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// serviceDefaultsPollInterval spaces the reads of the service-defaults of a
+// destination which has none, the agent answers them without blocking
+const serviceDefaultsPollInterval = 30 * time.Second
+
+// serviceDefaultsProtocol returns the protocol of the service-defaults config
+// entry of the upstream destination, if any, and the index to wait on for
+// its next change. The index is 0 when the entry does not exist.
+func (w *Watcher) serviceDefaultsProtocol(ctx context.Context, u *upstream, index uint64, token string) (string, uint64, error) {
+	w.lock.Lock()
+	q := &api.QueryOptions{
+		Namespace: u.Namespace,
+		Partition: u.Partition,
+		WaitIndex: index,
+		Token:     token,
+	}
+	w.lock.Unlock()
+	if index != 0 {
+		q = w.blocking(ctx, q)
+	}
+
+	entry, meta, err := w.client().ConfigEntry(api.ServiceDefaults, u.ServiceName, q)
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defaults, ok := entry.(*api.ServiceConfigEntry)
+	if !ok {
+		return "", meta.LastIndex, nil
+	}
+	return defaults.Protocol, meta.LastIndex, nil
+}
+
+// watchServiceDefaults follows the changes of the protocol of the
+// service-defaults of the upstream destination from index, until ctx is
+// cancelled
+func (w *Watcher) watchServiceDefaults(ctx context.Context, u *upstream, index uint64) {
+	b := w.newBackoff()
+	for w.acquireQuery(ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		protocol, next, err := w.serviceDefaultsProtocol(ctx, u, index, token)
+		w.releaseQuery()
+		w.observeQuery("service-defaults", start)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching service-defaults of %s: %s", u.ServiceName, err)
+			w.waitAfterError(ctx, b, err, token)
+			index = 0
+			continue
+		}
+		b.reset()
+
+		changed := true
+		if next != 0 {
+			index, changed = w.nextIndex("service-defaults", u.ServiceName, index, next)
+		} else {
+			index = 0
+		}
+
+		w.lock.Lock()
+		changed = changed && protocol != u.serviceProtocol
+		if changed {
+			u.serviceProtocol = protocol
+		}
+		w.lock.Unlock()
+		if changed {
+			w.log.Infof("consul: upstream %s: protocol of the service-defaults of %s changed to %q", u.Name, u.ServiceName, protocol)
+			w.notifyChanged()
+		}
+
+		if index == 0 {
+			sleep(ctx, jitter(serviceDefaultsPollInterval))
+		}
+	}
+}
+
+// protocol is the one of the upstream config, or the one of the destination
+// service-defaults as Envoy sidecars do
+func (u *upstream) protocol() string {
+	if u.Protocol != "" {
+		return u.Protocol
+	}
+	return u.serviceProtocol
+}
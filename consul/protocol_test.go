@@ -0,0 +1,18 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamProtocol(t *testing.T) {
+	u := &upstream{}
+	require.Equal(t, "", u.protocol())
+
+	u.serviceProtocol = "http"
+	require.Equal(t, "http", u.protocol())
+
+	u.Protocol = "tcp"
+	require.Equal(t, "tcp", u.protocol())
+}
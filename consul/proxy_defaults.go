@@ -0,0 +1,142 @@
+package consul
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// proxyDefaults are the settings of the global proxy-defaults config entry,
+// they apply beneath the ones of the proxy registration
+type proxyDefaults struct {
+	Config          map[string]interface{}
+	MeshGatewayMode api.MeshGatewayMode
+	AccessLogs      bool
+}
+
+func proxyDefaultsFromEntry(e *api.ProxyConfigEntry) proxyDefaults {
+	if e == nil {
+		return proxyDefaults{}
+	}
+	d := proxyDefaults{
+		Config:          e.Config,
+		MeshGatewayMode: e.MeshGateway.Mode,
+	}
+	if e.AccessLogs != nil {
+		d.AccessLogs = e.AccessLogs.Enabled
+	}
+	return d
+}
+
+// mergeProxyConfig returns the proxy config with the keys it does not set
+// taken from the defaults
+func mergeProxyConfig(defaults, config map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return config
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(config))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range config {
+		merged[k] = v
+	}
+	return merged
+}
+
+// apply returns a copy of the proxy registration with the
+// proxy-defaults applied
+func (d proxyDefaults) apply(srv *api.AgentService) *api.AgentService {
+	s := *srv
+	proxy := api.AgentServiceConnectProxyConfig{}
+	if srv.Proxy != nil {
+		proxy = *srv.Proxy
+	}
+	proxy.Config = mergeProxyConfig(d.Config, proxy.Config)
+	if proxy.MeshGateway.Mode == api.MeshGatewayModeDefault {
+		proxy.MeshGateway.Mode = d.MeshGatewayMode
+	}
+	s.Proxy = &proxy
+	return &s
+}
+
+// applyProxyChange handles a change of the proxy registration with the
+// proxy-defaults beneath it
+func (w *Watcher) applyProxyChange(first bool, srv *api.AgentService) {
+	w.proxyLock.Lock()
+	defer w.proxyLock.Unlock()
+
+	w.proxySvc = srv
+	w.handleProxyChange(first, w.proxyDefaults.apply(srv))
+}
+
+func (w *Watcher) watchProxyDefaults() {
+	w.log.Debugf("consul: watching proxy-defaults")
+
+	first := true
+	var lastIndex uint64
+	b := w.newBackoff()
+	for w.acquireQuery(w.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		entries, meta, err := w.client().ConfigEntries(api.ProxyDefaults, w.blocking(w.ctx, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			Token:     token,
+		}))
+		w.releaseQuery()
+		w.observeQuery("proxy-defaults", start)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul: error fetching proxy-defaults: %s", err)
+			// the proxy is usable without defaults
+			if first {
+				w.ready.Done()
+				first = false
+			}
+			w.waitAfterError(w.ctx, b, err, token)
+			lastIndex = 0
+			continue
+		}
+		b.reset()
+
+		var changed bool
+		lastIndex, changed = w.nextIndex("proxy-defaults", api.ProxyConfigGlobal, lastIndex, meta.LastIndex)
+
+		var entry *api.ProxyConfigEntry
+		for _, e := range entries {
+			if p, ok := e.(*api.ProxyConfigEntry); ok && p.Name == api.ProxyConfigGlobal {
+				entry = p
+			}
+		}
+		d := proxyDefaultsFromEntry(entry)
+
+		w.proxyLock.Lock()
+		changed = changed && !reflect.DeepEqual(d, w.proxyDefaults)
+		if changed {
+			w.log.Infof("consul: proxy-defaults changed")
+			if d.MeshGatewayMode != "" && d.MeshGatewayMode != api.MeshGatewayModeNone {
+				w.log.Warnf("consul: mesh gateway mode %s of proxy-defaults is not supported, upstreams are reached directly", d.MeshGatewayMode)
+			}
+			w.proxyDefaults = d
+			w.lock.Lock()
+			w.accessLogs = d.AccessLogs
+			w.lock.Unlock()
+			if w.proxySvc != nil {
+				w.handleProxyChange(false, d.apply(w.proxySvc))
+			}
+		}
+		w.proxyLock.Unlock()
+		if changed {
+			w.notifyChanged()
+		}
+
+		if first {
+			w.log.Infof("consul: proxy-defaults ready")
+			w.ready.Done()
+			first = false
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyDefaults(t *testing.T) {
+	d := proxyDefaultsFromEntry(&api.ProxyConfigEntry{
+		Kind: api.ProxyDefaults,
+		Name: api.ProxyConfigGlobal,
+		Config: map[string]interface{}{
+			"protocol":        "http",
+			"connect_timeout": "2s",
+		},
+		MeshGateway: api.MeshGatewayConfig{Mode: api.MeshGatewayModeLocal},
+		AccessLogs:  &api.AccessLogsConfig{Enabled: true},
+	})
+	require.True(t, d.AccessLogs)
+
+	srv := &api.AgentService{
+		ID: "web-sidecar-proxy",
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			Config: map[string]interface{}{"protocol": "tcp"},
+		},
+	}
+	merged := d.apply(srv)
+	require.Equal(t, "tcp", merged.Proxy.Config["protocol"])
+	require.Equal(t, "2s", merged.Proxy.Config["connect_timeout"])
+	require.Equal(t, api.MeshGatewayModeLocal, merged.Proxy.MeshGateway.Mode)
+	// the registration is left untouched
+	require.Len(t, srv.Proxy.Config, 1)
+
+	merged = proxyDefaultsFromEntry(nil).apply(&api.AgentService{ID: "web-sidecar-proxy"})
+	require.NotNil(t, merged.Proxy)
+	require.Empty(t, merged.Proxy.Config)
+}
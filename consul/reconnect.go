@@ -0,0 +1,36 @@
+package consul
+
+import "time"
+
+// client returns the client of the queries, replaced when reconnecting
+func (w *Watcher) client() ConsulClient {
+	w.clientLock.RLock()
+	defer w.clientLock.RUnlock()
+	return w.consul
+}
+
+// reconnect replaces the client once Consul has been unreachable for
+// ReconnectAfter, and then at most once every ReconnectAfter. The watches
+// retry from scratch with the new client while HAProxy keeps the last
+// config.
+func (w *Watcher) reconnect(unreachableFor time.Duration) {
+	if w.opts.Reconnect == nil || w.opts.ReconnectAfter <= 0 || unreachableFor < w.opts.ReconnectAfter {
+		return
+	}
+
+	w.clientLock.Lock()
+	defer w.clientLock.Unlock()
+	if time.Since(w.reconnected) < w.opts.ReconnectAfter {
+		return
+	}
+	w.reconnected = time.Now()
+
+	client, err := w.opts.Reconnect()
+	if err != nil {
+		w.log.Errorf("consul: cannot reconnect: %s", err)
+		return
+	}
+	w.log.Warnf("consul: unreachable for %s, reconnecting", unreachableFor.Round(time.Second))
+	w.opts.Metrics.IncrCounter("connect_consul_reconnects_total", 1, nil)
+	w.consul = client
+}
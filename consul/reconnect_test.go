@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnect(t *testing.T) {
+	reconnects := 0
+	w := NewWithOptions("svc", nil, NewTestingLogger(t), Options{
+		ReconnectAfter: time.Minute,
+		Reconnect: func() (ConsulClient, error) {
+			reconnects++
+			return NewClient(&api.Client{}), nil
+		},
+	})
+	old := w.client()
+
+	w.reconnect(30 * time.Second)
+	require.Equal(t, 0, reconnects)
+	require.Equal(t, old, w.client())
+
+	w.reconnect(time.Minute)
+	require.Equal(t, 1, reconnects)
+	require.NotEqual(t, old, w.client())
+
+	// at most once every ReconnectAfter
+	w.reconnect(2 * time.Minute)
+	require.Equal(t, 1, reconnects)
+}
@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// ProxyCheckTTL is how long the TTL check of the registered proxy stays
+	// passing without an update
+	ProxyCheckTTL = 30 * time.Second
+	// ProxyCheckInterval is the interval of the TCP check and of the
+	// updates of the TTL check
+	ProxyCheckInterval = 10 * time.Second
+)
+
+// LoadProxyRegistration reads the registration of the sidecar proxy of a
+// service from a JSON file in the format of the Consul agent service
+// registration API, eg: {"Port": 21000, "Proxy": {"Upstreams": [...]}}
+func LoadProxyRegistration(path, service string) (*api.AgentServiceRegistration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, lib.NewExitError(lib.ExitConfig, err)
+	}
+	reg, err := parseProxyRegistration(data, service)
+	if err != nil {
+		return nil, lib.NewExitError(lib.ExitConfig, fmt.Errorf("%s: %w", path, err))
+	}
+	return reg, nil
+}
+
+// parseProxyRegistration decodes a proxy registration, the kind, name, id
+// and destination default to the ones of a sidecar of the service
+func parseProxyRegistration(data []byte, service string) (*api.AgentServiceRegistration, error) {
+	reg := &api.AgentServiceRegistration{}
+	err := json.Unmarshal(data, reg)
+	if err != nil {
+		return nil, err
+	}
+
+	if reg.Kind == "" {
+		reg.Kind = api.ServiceKindConnectProxy
+	}
+	if reg.Kind != api.ServiceKindConnectProxy {
+		return nil, fmt.Errorf("kind must be %s, got %s", api.ServiceKindConnectProxy, reg.Kind)
+	}
+	if reg.Port <= 0 {
+		return nil, fmt.Errorf("a port is required")
+	}
+	if reg.Name == "" {
+		reg.Name = service + "-sidecar-proxy"
+	}
+	if reg.ID == "" {
+		reg.ID = reg.Name
+	}
+	if reg.Proxy == nil {
+		reg.Proxy = &api.AgentServiceConnectProxyConfig{}
+	}
+	if reg.Proxy.DestinationServiceName == "" {
+		reg.Proxy.DestinationServiceName = service
+	}
+	if reg.Proxy.DestinationServiceID == "" {
+		reg.Proxy.DestinationServiceID = service
+	}
+	return reg, nil
+}
+
+// RegisterProxy registers the sidecar proxy in the local agent, the returned
+// func deregisters it
+func RegisterProxy(client *api.Client, reg *api.AgentServiceRegistration) (func() error, error) {
+	err := client.Agent().ServiceRegister(reg)
+	if err != nil {
+		return nil, ExitError(fmt.Errorf("cannot register sidecar proxy %s: %w", reg.ID, err))
+	}
+	return func() error {
+		return client.Agent().ServiceDeregister(reg.ID)
+	}, nil
+}
+
+// AddProxyChecks adds to the registration a TCP check of the public
+// listener, an alias check of the destination service and a TTL check which
+// the sidecar keeps passing while HAProxy runs. It returns the id of the TTL
+// check.
+func AddProxyChecks(reg *api.AgentServiceRegistration) string {
+	host := reg.Address
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	ttlID := reg.ID + ":haproxy"
+
+	reg.Checks = append(reg.Checks,
+		&api.AgentServiceCheck{
+			Name:     "Connect Sidecar Listening",
+			TCP:      net.JoinHostPort(host, strconv.Itoa(reg.Port)),
+			Interval: ProxyCheckInterval.String(),
+		},
+		&api.AgentServiceCheck{
+			Name:         "Connect Sidecar Aliasing " + reg.Proxy.DestinationServiceID,
+			AliasService: reg.Proxy.DestinationServiceID,
+		},
+		&api.AgentServiceCheck{
+			CheckID: ttlID,
+			Name:    "HAProxy",
+			TTL:     ProxyCheckTTL.String(),
+			Status:  api.HealthCritical,
+		},
+	)
+	return ttlID
+}
+
+// ServiceArtifact is a service registered in the local agent, it exists
+// until deregistered
+func ServiceArtifact(client *api.Client, kind, id string) lib.Artifact {
+	return lib.Artifact{
+		Kind: kind,
+		Name: id,
+		Exists: func() (bool, error) {
+			_, _, err := client.Agent().Service(id, nil)
+			var statusErr api.StatusError
+			if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}
+}
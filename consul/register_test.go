@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProxyRegistration(t *testing.T) {
+	reg, err := parseProxyRegistration([]byte(`{
+		"Port": 21000,
+		"Proxy": {
+			"LocalServicePort": 8080,
+			"Upstreams": [{"DestinationName": "db", "LocalBindPort": 9191}]
+		}
+	}`), "web")
+	require.NoError(t, err)
+	require.Equal(t, api.ServiceKindConnectProxy, reg.Kind)
+	require.Equal(t, "web-sidecar-proxy", reg.ID)
+	require.Equal(t, "web-sidecar-proxy", reg.Name)
+	require.Equal(t, "web", reg.Proxy.DestinationServiceName)
+	require.Equal(t, "web", reg.Proxy.DestinationServiceID)
+	require.Equal(t, 8080, reg.Proxy.LocalServicePort)
+	require.Len(t, reg.Proxy.Upstreams, 1)
+	require.Equal(t, "db", reg.Proxy.Upstreams[0].DestinationName)
+
+	_, err = parseProxyRegistration([]byte(`{"Proxy": {}}`), "web")
+	require.Error(t, err)
+
+	_, err = parseProxyRegistration([]byte(`{"Kind": "mesh-gateway", "Port": 21000}`), "web")
+	require.Error(t, err)
+}
+
+func TestAddProxyChecks(t *testing.T) {
+	reg, err := parseProxyRegistration([]byte(`{"Port": 21000}`), "web")
+	require.NoError(t, err)
+
+	ttlID := AddProxyChecks(reg)
+	require.Equal(t, "web-sidecar-proxy:haproxy", ttlID)
+	require.Len(t, reg.Checks, 3)
+	require.Equal(t, "127.0.0.1:21000", reg.Checks[0].TCP)
+	require.Equal(t, "web", reg.Checks[1].AliasService)
+	require.Equal(t, ttlID, reg.Checks[2].CheckID)
+	require.Equal(t, "30s", reg.Checks[2].TTL)
+	require.Equal(t, api.HealthCritical, reg.Checks[2].Status)
+}
@@ -0,0 +1,107 @@
+package consul
+
+import (
+	"fmt"
+)
+
+// Subset is a group of instances of an upstream, selected by their service
+// metadata and tags, getting a share of the traffic, eg: a canary version
+type Subset struct {
+	Name string
+	// Meta and Tags must all be set on an instance of the subset
+	Meta map[string]string
+	Tags []string
+	// Weight is the percent of the traffic sent to the subset, the
+	// instances in no subset share the rest
+	Weight int
+}
+
+// Matches tells if an instance is in the subset
+func (s Subset) Matches(n UpstreamNode) bool {
+	for k, v := range s.Meta {
+		if n.Meta[k] != v {
+			return false
+		}
+	}
+	for _, t := range s.Tags {
+		found := false
+		for _, nt := range n.Tags {
+			if nt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSubsets reads the subsets key of an upstream config, a list of
+// objects with the name, meta, tags and weight keys
+func parseSubsets(v interface{}) ([]Subset, error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", v)
+	}
+
+	subsets := make([]Subset, 0, len(l))
+	total := 0
+	for i, e := range l {
+		c, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%d]: expected an object, got %T", i, e)
+		}
+
+		s := Subset{}
+		s.Name, _ = c["name"].(string)
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("subset_%d", i)
+		}
+
+		if m, ok := c["meta"]; ok {
+			meta, ok := m.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: meta must be an object, got %T", s.Name, m)
+			}
+			s.Meta = map[string]string{}
+			for k, v := range meta {
+				str, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: meta %s must be a string, got %T", s.Name, k, v)
+				}
+				s.Meta[k] = str
+			}
+		}
+		if t, ok := c["tags"]; ok {
+			tags, ok := t.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: tags must be a list, got %T", s.Name, t)
+			}
+			for _, v := range tags {
+				str, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: tags must be strings, got %T", s.Name, v)
+				}
+				s.Tags = append(s.Tags, str)
+			}
+		}
+		if len(s.Meta) == 0 && len(s.Tags) == 0 {
+			return nil, fmt.Errorf("%s: meta or tags is required", s.Name)
+		}
+
+		w, ok := c["weight"].(float64)
+		if !ok || w != float64(int(w)) || w < 0 || w > 100 {
+			return nil, fmt.Errorf("%s: weight must be a percent between 0 and 100, got %v", s.Name, c["weight"])
+		}
+		s.Weight = int(w)
+		total += s.Weight
+
+		subsets = append(subsets, s)
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("the weights add up to %d%%, more than 100%%", total)
+	}
+	return subsets, nil
+}
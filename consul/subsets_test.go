@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSubsets(t *testing.T) {
+	subsets, err := parseSubsets([]interface{}{
+		map[string]interface{}{"name": "canary", "meta": map[string]interface{}{"version": "v2"}, "weight": float64(10)},
+		map[string]interface{}{"tags": []interface{}{"beta"}, "weight": float64(5)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Subset{
+		{Name: "canary", Meta: map[string]string{"version": "v2"}, Weight: 10},
+		{Name: "subset_1", Tags: []string{"beta"}, Weight: 5},
+	}, subsets)
+
+	bad := []interface{}{
+		map[string]interface{}{},
+		[]interface{}{"canary"},
+		[]interface{}{map[string]interface{}{"weight": float64(10)}},
+		[]interface{}{map[string]interface{}{"meta": map[string]interface{}{"version": float64(2)}, "weight": float64(10)}},
+		[]interface{}{map[string]interface{}{"tags": "beta", "weight": float64(10)}},
+		[]interface{}{map[string]interface{}{"tags": []interface{}{"beta"}}},
+		[]interface{}{map[string]interface{}{"tags": []interface{}{"beta"}, "weight": float64(101)}},
+		[]interface{}{
+			map[string]interface{}{"tags": []interface{}{"a"}, "weight": float64(60)},
+			map[string]interface{}{"tags": []interface{}{"b"}, "weight": float64(50)},
+		},
+	}
+	for _, v := range bad {
+		_, err := parseSubsets(v)
+		require.Error(t, err, "%v", v)
+	}
+}
+
+func TestSubsetMatches(t *testing.T) {
+	n := UpstreamNode{Meta: map[string]string{"version": "v2", "zone": "a"}, Tags: []string{"canary", "eu"}}
+
+	require.True(t, Subset{Meta: map[string]string{"version": "v2"}}.Matches(n))
+	require.True(t, Subset{Meta: map[string]string{"version": "v2"}, Tags: []string{"canary"}}.Matches(n))
+	require.False(t, Subset{Meta: map[string]string{"version": "v1"}}.Matches(n))
+	require.False(t, Subset{Tags: []string{"canary", "us"}}.Matches(n))
+}
@@ -0,0 +1,252 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const syntheticTrustDomain = "synthetic.consul"
+
+// SyntheticOptions shapes the configs generated by Synthetic
+type SyntheticOptions struct {
+	// ServiceName is the service the sidecar proxies
+	ServiceName string
+	Upstreams   int
+	// Instances is the number of instances of each upstream
+	Instances int
+	// BasePort is the port of the public listener, the upstreams listen on
+	// the following ones
+	BasePort int
+	// Churn is the interval between two changes of the instances, disabled
+	// when 0
+	Churn time.Duration
+	// ChurnRatio is the share of the upstreams changed by each churn
+	ChurnRatio float64
+	// CertRotation is the interval between two renewals of the leaf
+	// certificate, disabled when 0
+	CertRotation time.Duration
+	// Seed makes the generated changes reproducible
+	Seed int64
+}
+
+// Synthetic generates configs without Consul, to load test the render and
+// reload pipeline with many upstreams, churn and certificate rotations
+type Synthetic struct {
+	C chan Config
+
+	opts      SyntheticOptions
+	rand      *mrand.Rand
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+	caPEM     []byte
+	tls       TLS
+	nextHost  int
+	upstreams []Upstream
+}
+
+// NewSynthetic builds a generator, its CA and first leaf certificate
+func NewSynthetic(opts SyntheticOptions) (*Synthetic, error) {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "synthetic"
+	}
+	if opts.BasePort == 0 {
+		opts.BasePort = 20000
+	}
+	if opts.BasePort+opts.Upstreams > 65535 {
+		return nil, fmt.Errorf("%d upstreams do not fit in the ports above %d", opts.Upstreams, opts.BasePort)
+	}
+	if opts.Instances <= 0 {
+		opts.Instances = 1
+	}
+
+	s := &Synthetic{
+		C:    make(chan Config),
+		opts: opts,
+		rand: mrand.New(mrand.NewSource(opts.Seed)),
+	}
+
+	err := s.newCA()
+	if err != nil {
+		return nil, err
+	}
+	err = s.rotateLeaf()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < opts.Upstreams; i++ {
+		up := Upstream{
+			Name:             fmt.Sprintf("service_upstream_%d", i),
+			ServiceName:      fmt.Sprintf("upstream_%d", i),
+			LocalBindAddress: DefaultUpstreamBindAddr,
+			LocalBindPort:    opts.BasePort + 1 + i,
+			ConnectTimeout:   DefaultConnectTimeout,
+			ReadTimeout:      DefaultReadTimeout,
+		}
+		for j := 0; j < opts.Instances; j++ {
+			up.Nodes = append(up.Nodes, s.newNode())
+		}
+		s.upstreams = append(s.upstreams, up)
+	}
+
+	return s, nil
+}
+
+// Run sends a config on C after each change until stop is closed
+func (s *Synthetic) Run(stop <-chan struct{}) {
+	churn := tick(s.opts.Churn)
+	rotation := tick(s.opts.CertRotation)
+
+	for {
+		select {
+		case s.C <- s.config():
+		case <-stop:
+			return
+		}
+
+		select {
+		case <-churn:
+			s.churn()
+		case <-rotation:
+			err := s.rotateLeaf()
+			if err != nil {
+				log.Errorf("synthetic: cannot rotate the leaf certificate: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// tick returns a ticker channel, or nil which never fires when d is 0
+func tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return time.Tick(d)
+}
+
+func (s *Synthetic) config() Config {
+	cfg := Config{
+		ServiceName: s.opts.ServiceName,
+		ServiceID:   s.opts.ServiceName + "-sidecar-proxy",
+		Downstream: Downstream{
+			LocalBindAddress: DefaultDownstreamBindAddr,
+			LocalBindPort:    s.opts.BasePort,
+			TargetAddress:    DefaultUpstreamBindAddr,
+			TargetPort:       8080,
+			ConnectTimeout:   DefaultConnectTimeout,
+			ReadTimeout:      DefaultReadTimeout,
+			TLS:              s.tls,
+		},
+	}
+	for _, up := range s.upstreams {
+		up.TLS = s.tls
+		up.Nodes = append([]UpstreamNode{}, up.Nodes...)
+		cfg.Upstreams = append(cfg.Upstreams, up)
+	}
+	return cfg
+}
+
+// churn replaces an instance and changes the weights of a share of the
+// upstreams, like rolling deploys would
+func (s *Synthetic) churn() {
+	n := int(float64(len(s.upstreams))*s.opts.ChurnRatio + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	for _, i := range s.rand.Perm(len(s.upstreams))[:min(n, len(s.upstreams))] {
+		nodes := append([]UpstreamNode{}, s.upstreams[i].Nodes...)
+		nodes[s.rand.Intn(len(nodes))] = s.newNode()
+		for j := range nodes {
+			nodes[j].Weight = 1 + s.rand.Intn(10)
+		}
+		s.upstreams[i].Nodes = nodes
+	}
+}
+
+func (s *Synthetic) newNode() UpstreamNode {
+	s.nextHost++
+	return UpstreamNode{
+		Host:   fmt.Sprintf("10.%d.%d.%d", s.nextHost>>16&0xff, s.nextHost>>8&0xff, s.nextHost&0xff),
+		Port:   21000,
+		Weight: 1,
+		Node:   fmt.Sprintf("node-%d", s.nextHost),
+	}
+}
+
+func (s *Synthetic) newCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Synthetic CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: syntheticTrustDomain}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	s.caCert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	s.caKey = key
+	s.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+// rotateLeaf issues a new leaf certificate for the service
+func (s *Synthetic) rotateLeaf() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	notAfter := time.Now().Add(72 * time.Hour)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: s.opts.ServiceName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs: []*url.URL{{
+			Scheme: "spiffe",
+			Host:   syntheticTrustDomain,
+			Path:   "/ns/default/dc/dc1/svc/" + s.opts.ServiceName,
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, &key.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	s.tls = TLS{
+		Cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		CAs:      [][]byte{s.caPEM},
+		NotAfter: notAfter,
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynthetic(t *testing.T) {
+	s, err := NewSynthetic(SyntheticOptions{Upstreams: 20, Instances: 3, ChurnRatio: 0.25, Seed: 1})
+	require.NoError(t, err)
+
+	cfg := s.config()
+	require.Equal(t, 20000, cfg.Downstream.LocalBindPort)
+	require.Len(t, cfg.Upstreams, 20)
+	require.Equal(t, 20001, cfg.Upstreams[0].LocalBindPort)
+	require.Len(t, cfg.Upstreams[0].Nodes, 3)
+
+	block, _ := pem.Decode(cfg.Downstream.Cert)
+	require.NotNil(t, block)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://synthetic.consul/ns/default/dc/dc1/svc/synthetic", leaf.URIs[0].String())
+
+	s.churn()
+	changed := 0
+	for i, up := range s.config().Upstreams {
+		require.Len(t, up.Nodes, 3)
+		if up.Nodes[0].ID() != cfg.Upstreams[i].Nodes[0].ID() ||
+			up.Nodes[1].ID() != cfg.Upstreams[i].Nodes[1].ID() ||
+			up.Nodes[2].ID() != cfg.Upstreams[i].Nodes[2].ID() {
+			changed++
+		}
+	}
+	require.Equal(t, 5, changed)
+
+	require.NoError(t, s.rotateLeaf())
+	require.NotEqual(t, cfg.Downstream.Cert, s.config().Downstream.Cert)
+
+	_, err = NewSynthetic(SyntheticOptions{Upstreams: 100, BasePort: 65500})
+	require.Error(t, err)
+}
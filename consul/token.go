@@ -0,0 +1,119 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/hashicorp/consul/api"
+)
+
+// TokenSource resolves the ACL token to use, it is called again when
+// Consul denies a query so that a rotated token is picked up
+type TokenSource func() (string, error)
+
+// currentToken returns the token to set on queries, an empty token lets
+// the client use its own
+func (w *Watcher) currentToken() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.token
+}
+
+// refreshToken resolves the token again, it returns true when it changed
+func (w *Watcher) refreshToken() bool {
+	if w.opts.TokenSource == nil {
+		return false
+	}
+
+	token, err := w.opts.TokenSource()
+	if err != nil {
+		w.log.Errorf("consul: error resolving ACL token: %s", err)
+		return false
+	}
+
+	w.lock.Lock()
+	if token == w.token {
+		w.lock.Unlock()
+		return false
+	}
+	w.token = token
+	w.lock.Unlock()
+
+	if w.opts.OnTokenChange != nil {
+		w.opts.OnTokenChange(token)
+	}
+	return true
+}
+
+// watchToken resolves the token every TokenRefresh, so that a rotated
+// token is used before the old one is revoked and the queries denied
+func (w *Watcher) watchToken() {
+	if w.opts.TokenSource == nil || w.opts.TokenRefresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.opts.TokenRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if w.refreshToken() {
+				w.log.Infof("consul: ACL token changed")
+				w.opts.Metrics.IncrCounter("connect_consul_token_rotations_total", 1, nil)
+			}
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetClientToken makes the requests of the client built from config send
+// the token returned by current when it is not empty, instead of the token
+// of config, so that the client follows the rotations. It must be called
+// after api.NewClient(config), before the client is used.
+func SetClientToken(config *api.Config, current func() string) {
+	config.HttpClient.Transport = tokenTransport{next: config.HttpClient.Transport, current: current}
+}
+
+type tokenTransport struct {
+	next    http.RoundTripper
+	current func() string
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token := t.current()
+	if token == "" || r.Header.Get("X-Consul-Token") == token {
+		return t.next.RoundTrip(r)
+	}
+	// a round tripper must not modify the request
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Consul-Token", token)
+	return t.next.RoundTrip(r)
+}
+
+// waitAfterError delays the next attempt of a watch by its backoff, unless
+// it is cancelled. When the query was denied, the token is resolved again
+// and the watch is resubscribed right away if it changed since the query
+// was made.
+func (w *Watcher) waitAfterError(ctx context.Context, b *backoff, err error, usedToken string) {
+	code := ExitError(err).Code
+	w.opts.Metrics.IncrCounter("connect_consul_watch_errors_total", 1, metrics.Labels{"kind": code.String()})
+
+	if code == lib.ExitACLDenied {
+		if w.refreshToken() {
+			w.opts.Metrics.IncrCounter("connect_consul_token_rotations_total", 1, nil)
+		}
+		if w.currentToken() != usedToken {
+			w.log.Infof("consul: ACL token changed, resubscribing")
+			return
+		}
+	} else if unreachable(err) {
+		d := w.outage.failed(w.log, err, time.Now())
+		w.opts.Metrics.SetGauge("connect_consul_staleness_seconds", d.Seconds(), nil)
+		w.reconnect(d)
+	}
+
+	sleep(ctx, b.next())
+}
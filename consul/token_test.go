@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenRefreshOnDenied(t *testing.T) {
+	token := "first"
+	w := NewWithOptions("svc", nil, NewTestingLogger(t), Options{
+		TokenSource: func() (string, error) {
+			return token, nil
+		},
+	})
+	require.Equal(t, "first", w.currentToken())
+
+	denied := api.StatusError{Code: 403, Body: "Permission denied"}
+
+	// the token was rotated, the watch is resubscribed without waiting
+	token = "second"
+	start := time.Now()
+	w.waitAfterError(context.Background(), w.newBackoff(), denied, "first")
+	require.Less(t, time.Since(start), backoffMin/2)
+	require.Equal(t, "second", w.currentToken())
+
+	// another watch denied with the old token picks up the new one right away
+	start = time.Now()
+	w.waitAfterError(context.Background(), w.newBackoff(), denied, "first")
+	require.Less(t, time.Since(start), backoffMin/2)
+}
+
+func TestWatchToken(t *testing.T) {
+	var lock sync.Mutex
+	token := "first"
+	changed := make(chan string, 2)
+	w := NewWithOptions("svc", nil, NewTestingLogger(t), Options{
+		TokenSource: func() (string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return token, nil
+		},
+		TokenRefresh: 10 * time.Millisecond,
+		OnTokenChange: func(token string) {
+			changed <- token
+		},
+	})
+	require.Equal(t, "first", <-changed)
+	go w.watchToken()
+	defer w.Stop()
+
+	lock.Lock()
+	token = "second"
+	lock.Unlock()
+	select {
+	case got := <-changed:
+		require.Equal(t, "second", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rotated token was not picked up")
+	}
+	require.Equal(t, "second", w.currentToken())
+}
+
+func TestSetClientToken(t *testing.T) {
+	tokens := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("X-Consul-Token")
+		rw.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	current := "first"
+	cfg := &api.Config{Address: srv.URL, Token: "first"}
+	c, err := api.NewClient(cfg)
+	require.NoError(t, err)
+	SetClientToken(cfg, func() string { return current })
+
+	_, err = c.Agent().Self()
+	require.NoError(t, err)
+	require.Equal(t, "first", <-tokens)
+
+	current = "second"
+	_, err = c.Agent().Self()
+	require.NoError(t, err)
+	require.Equal(t, "second", <-tokens)
+}
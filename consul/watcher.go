@@ -1,13 +1,19 @@
 package consul
 
 import (
+	"context"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
 	"github.com/hashicorp/consul/api"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,8 +24,17 @@ const (
 	DefaultReadTimeout        = 60 * time.Second
 	DefaultConnectTimeout     = 30 * time.Second
 
-	errorWaitTime             = 5 * time.Second
 	preparedQueryPollInterval = 30 * time.Second
+
+	leafExpiryCheckInterval = time.Minute
+	// leafRenewalOverdue is the fraction of the leaf lifetime after which
+	// Consul should have delivered a renewed certificate
+	leafRenewalOverdue = 0.9
+	leafExpirySoon     = time.Hour
+
+	// virtualIPTag is the tagged address of the virtual IP Consul assigns
+	// to a service for transparent proxies
+	virtualIPTag = "consul-virtual"
 )
 
 type upstream struct {
@@ -27,16 +42,67 @@ type upstream struct {
 	LocalBindPort    int
 	Name             string
 	ServiceName      string
+	// Namespace and Partition of the destination, empty for the ones of
+	// the client
+	Namespace        string
+	Partition        string
 	Datacenter       string
 	Protocol         string
 	Nodes            []*api.ServiceEntry
 	ReadTimeout      time.Duration
 	ConnectTimeout   time.Duration
-
-	done bool
+	ALPN             string
+	Proto            string
+	DisableChecks    bool
+	Balance          string
+	HashPolicy       *HashPolicy
+	Limits           Limits
+	OutlierDetection *OutlierDetection
+	HTTPCheck        *HTTPCheck
+	SlowStart        time.Duration
+	ClientTLS        *ClientTLS
+	Splits           []UpstreamSplit
+	ConfigKeys       []string
+	ExtraConfig      ExtraConfig
+	LuaActions       LuaActions
+	Headers          HeaderRules
+	PathRewrite      PathRewrite
+	Mirror           *Mirror
+	Subsets          []Subset
+	Compression      Compression
+	// FailoverDatacenters back up the upstream datacenter, the ones of the
+	// service-resolver are used when empty
+	FailoverDatacenters []string
+	// Peer is the cluster peer exporting the destination, empty for local
+	// services
+	Peer string
+	// SendProxyProtocol sends the PROXY protocol v2 header to the instances
+	SendProxyProtocol bool
+
+	// healthKey identifies the shared health watch of service upstreams
+	healthKey string
+	// peerBundle is the peer whose trust bundle the upstream is attached to
+	peerBundle string
+	// failover holds the nodes of the failover watches by key
+	failover         map[string][]*api.ServiceEntry
+	resolverFailover []string
+	// serviceProtocol is the protocol of the destination service-defaults,
+	// used when the upstream config has none
+	serviceProtocol string
+	// fetched is set once Nodes holds a response from Consul
+	fetched bool
+	// pinnedNodes replace Nodes in the config while the upstream is pinned
+	pinned         bool
+	pinnedNodes    []*api.ServiceEntry
+	pinnedFailover map[string][]*api.ServiceEntry
+	// cancel stops the prepared query watch, or the service-defaults watch
+	// of a service upstream, once the upstream is removed. The service
+	// upstreams share the health watches instead.
+	cancel context.CancelFunc
 }
 
 type downstream struct {
+	Name              string
 	LocalBindAddress  string
 	LocalBindPort     int
 	Protocol          string
@@ -46,11 +112,24 @@ type downstream struct {
 	AppNameHeaderName string
 	ReadTimeout       time.Duration
 	ConnectTimeout    time.Duration
+	ALPN              string
+	Proto             string
+	Balance           string
+	ExtraConfig       ExtraConfig
+	LuaActions        LuaActions
+	Headers           HeaderRules
+	Compression       Compression
+	ConfigKeys        []string
+	BindOptions       BindOptions
+	Limits            ListenerLimits
+	SendProxyProtocol bool
 }
 
 type certLeaf struct {
-	Cert []byte
-	Key  []byte
+	Cert      []byte
+	Key       []byte
+	NotBefore time.Time
+	NotAfter  time.Time
 
 	done bool
 }
@@ -58,42 +137,150 @@ type certLeaf struct {
 type Watcher struct {
 	service     string
 	serviceName string
-	consul      *api.Client
 	token       string
 	C           chan Config
 
 	lock  sync.Mutex
 	ready sync.WaitGroup
 
-	upstreams  map[string]*upstream
-	downstream downstream
-	certCAs    [][]byte
-	certCAPool *x509.CertPool
-	leaf       *certLeaf
+	upstreams        map[string]*upstream
+	healthWatches    map[string]*healthWatch
+	peerBundles      map[string]*peerBundle
+	downstream       downstream
+	extraDownstreams []downstream
+	certCAs          [][]byte
+	certCAPool       *x509.CertPool
+	caRoots          map[string]*caRoot
+	activeRootID     string
+	caRotation       *caRotation
+	leaf             *certLeaf
+	accessLogs       bool
+	luaScripts       map[string]string
+
+	// proxyLock serializes the handling of the proxy registration and of
+	// the proxy-defaults
+	proxyLock     sync.Mutex
+	proxySvc      *api.AgentService
+	proxyDefaults proxyDefaults
+
+	// clientLock guards consul, replaced when reconnecting
+	clientLock  sync.RWMutex
+	consul      ConsulClient
+	reconnected time.Time
 
 	update chan struct{}
+	// ctx is cancelled when the watcher stops, the watches of an upstream
+	// have their own context cancelled when it is removed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// queries holds a slot per running blocking query when their number is
+	// capped, nil otherwise
+	queries chan struct{}
+	// changedAt is the unix time in ns of the first change not yet sent on
+	// C, 0 when there is none
+	changedAt int64
+	// outage tracks since when the queries to Consul fail
+	outage outage
 	log    Logger
+	opts   Options
+}
+
+// Options tunes the watcher behaviour
+type Options struct {
+	// CARootOverlap is how long a CA root removed by Consul is kept in the
+	// bundle during a CA rotation
+	CARootOverlap time.Duration
+	// TokenSource, when set, provides the ACL token of the watches and is
+	// called again when a watch is denied
+	TokenSource TokenSource
+	// TokenRefresh, when set, calls TokenSource again at this interval to
+	// pick up the rotated tokens before the queries are denied
+	TokenRefresh time.Duration
+	// OnTokenChange, when set, is called with the token each time it
+	// changes, starting with the first one, eg: to update the clients
+	// used outside the watcher
+	OnTokenChange func(token string)
+	// Metrics receives the watcher samples, they are discarded when nil
+	Metrics metrics.Metrics
+	// Agent, when set, rejects the upstreams using features the local
+	// agent does not have
+	Agent *AgentInfo
+	// NodeName, when set, runs the watcher agentless: the client talks to
+	// the Consul servers and the proxy is looked up in the catalog of this
+	// node
+	NodeName string
+	// Cache sets the use of the agent cache for the leaf certificate and
+	// the CA roots
+	Cache CacheOptions
+	// Compression is the compression of the listeners without a
+	// compression key in their config
+	Compression Compression
+	// MaxQueries caps the number of concurrent blocking queries, the
+	// watches above wait for a slot. Unlimited when 0.
+	MaxQueries int
+	// InsecureDevMode sends the config without waiting for the CA roots
+	// and the leaf certificate
+	InsecureDevMode bool
+	// ProxyID, when set, is the id of the sidecar proxy of the service, eg:
+	// from an Envoy bootstrap file, it is not looked up
+	ProxyID string
+	// ProxyIDPrefix, when set, restricts the sidecar proxies considered for
+	// the service to the ones whose id starts with it, eg: the services
+	// registered by Nomad for an allocation
+	ProxyIDPrefix string
+	// Reconnect, when set, builds a new client once Consul has been
+	// unreachable for ReconnectAfter, eg: to reach a restarted agent or a
+	// new address of its name
+	Reconnect      func() (ConsulClient, error)
+	ReconnectAfter time.Duration
 }
 
 // New builds a new watcher
 func New(service string, consul *api.Client, log Logger) *Watcher {
-	return &Watcher{
-		service: service,
-		consul:  consul,
+	return NewWithOptions(service, consul, log, Options{})
+}
+
+// NewWithOptions builds a new watcher with non default options
+func NewWithOptions(service string, consul *api.Client, log Logger, opts Options) *Watcher {
+	return NewWithClient(service, NewClient(consul), log, opts)
+}
 
-		C:         make(chan Config),
-		upstreams: make(map[string]*upstream),
-		update:    make(chan struct{}, 1),
-		log:       log,
+// NewWithClient builds a new watcher querying Consul through client
+func NewWithClient(service string, client ConsulClient, log Logger, opts Options) *Watcher {
+	if opts.CARootOverlap == 0 {
+		opts.CARootOverlap = DefaultCARootOverlap
 	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.Nop{}
+	}
+	w := &Watcher{
+		service: service,
+		consul:  client,
+
+		C:             make(chan Config),
+		upstreams:     make(map[string]*upstream),
+		healthWatches: make(map[string]*healthWatch),
+		peerBundles:   make(map[string]*peerBundle),
+		caRoots:       make(map[string]*caRoot),
+		update:        make(chan struct{}, 1),
+		log:           log,
+		opts:          opts,
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	if opts.MaxQueries > 0 {
+		w.queries = make(chan struct{}, opts.MaxQueries)
+	}
+	w.refreshToken()
+	return w
 }
 
 // findSidecarProxy queries Consul's agent API to find the sidecar proxy service
 // for the given service. This mimics Envoy's approach of directly checking Consul's
 // service catalog rather than using internal Nomad APIs.
 func (w *Watcher) findSidecarProxy() (string, error) {
-	// Query all services registered with this Consul agent
-	services, err := w.consul.Agent().Services()
+	// Query all services registered with this Consul agent, or on the node
+	// of the proxy in agentless mode
+	services, err := w.localServices()
 	if err != nil {
 		return "", fmt.Errorf("failed to query Consul services: %w", err)
 	}
@@ -103,32 +290,53 @@ func (w *Watcher) findSidecarProxy() (string, error) {
 	// and its metadata or tags should indicate it's a proxy for our service
 	expectedProxyName := w.service + "-sidecar-proxy"
 
+	if w.opts.ProxyID != "" {
+		if _, ok := services[w.opts.ProxyID]; !ok {
+			return "", fmt.Errorf("%w for %s: %s is not registered", errSidecarNotFound, w.service, w.opts.ProxyID)
+		}
+		return w.opts.ProxyID, nil
+	}
+
+	candidates := []string{}
 	for serviceID, service := range services {
+		// the other allocations of the same job have the same names
+		if !strings.HasPrefix(serviceID, w.opts.ProxyIDPrefix) {
+			continue
+		}
+
 		// Check if this is a sidecar proxy service
 		if service.Kind == api.ServiceKindConnectProxy {
 			// Check if the proxy field indicates this is for our service
 			if service.Proxy != nil && service.Proxy.DestinationServiceName == w.service {
-				w.log.Debugf("consul: found sidecar proxy %s (ID: %s) for service %s",
-					service.Service, serviceID, w.service)
-				return serviceID, nil
+				candidates = append(candidates, serviceID)
+				continue
 			}
 		}
 
 		// Also check by name pattern for compatibility
 		if service.Service == expectedProxyName || serviceID == expectedProxyName {
-			w.log.Debugf("consul: found sidecar proxy by name %s for service %s",
-				serviceID, w.service)
-			return serviceID, nil
+			candidates = append(candidates, serviceID)
 		}
 	}
 
-	return "", fmt.Errorf("no sidecar proxy registered for %s", w.service)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w for %s", errSidecarNotFound, w.service)
+	}
+	sort.Strings(candidates)
+	if len(candidates) > 1 {
+		w.log.Warnf("consul: several sidecar proxies for %s: %s, using %s. Set -nomad-alloc-id to pick the one of the allocation",
+			w.service, strings.Join(candidates, ", "), candidates[0])
+	}
+	w.log.Debugf("consul: found sidecar proxy %s for service %s", candidates[0], w.service)
+	return candidates[0], nil
 }
 
 func (w *Watcher) Run() error {
 	// Retry lookup to handle race conditions (e.g., in Nomad where service starts before sidecar is registered)
 	// Instead of using proxy.LookupServiceForSidecar (which is for Nomad internals),
 	// we directly query Consul's agent API to find the registered sidecar proxy service
+	go w.watchToken()
+
 	var proxyID string
 	var err error
 	maxRetries := 60 // Increased to match Envoy's 60 second timeout
@@ -142,7 +350,9 @@ func (w *Watcher) Run() error {
 
 		if i < maxRetries-1 {
 			w.log.Infof("consul: sidecar proxy not found for %s (attempt %d/%d), retrying in %s: %s", w.service, i+1, maxRetries, retryDelay, err)
-			time.Sleep(retryDelay)
+			if !sleep(w.ctx, retryDelay) {
+				return nil
+			}
 			// Exponential backoff with cap at 5 seconds
 			if retryDelay < 5*time.Second {
 				retryDelay = retryDelay * 2
@@ -151,14 +361,18 @@ func (w *Watcher) Run() error {
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to find sidecar proxy in Consul after %d attempts: %w", maxRetries, err)
+		err = fmt.Errorf("failed to find sidecar proxy in Consul after %d attempts: %w", maxRetries, err)
+		if errors.Is(err, errSidecarNotFound) {
+			return lib.NewExitError(lib.ExitConfig, err)
+		}
+		return ExitError(err)
 	}
 
 	w.log.Infof("consul: found sidecar proxy %s for service %s", proxyID, w.service)
 
 	// Try to get the application service, but if it doesn't exist (common in Nomad),
 	// fall back to using the service name we were given
-	svc, _, err := w.consul.Agent().Service(w.service, &api.QueryOptions{})
+	svc, err := w.localService(w.service)
 	if err != nil {
 		w.log.Warnf("consul: application service %s not found in Consul (this is normal in Nomad), using service name as-is: %v", w.service, err)
 		w.serviceName = w.service
@@ -167,9 +381,9 @@ func (w *Watcher) Run() error {
 	}
 
 	// Get the sidecar proxy service details to extract the target port
-	proxySvc, _, err := w.consul.Agent().Service(proxyID, &api.QueryOptions{})
+	proxySvc, err := w.localService(proxyID)
 	if err != nil {
-		return fmt.Errorf("failed to get sidecar proxy details: %w", err)
+		return ExitError(fmt.Errorf("failed to get sidecar proxy details: %w", err))
 	}
 
 	// In Nomad, the application service may not be registered separately.
@@ -179,7 +393,7 @@ func (w *Watcher) Run() error {
 		w.log.Infof("consul: using target port %d from sidecar proxy configuration", w.downstream.TargetPort)
 	} else {
 		// Fallback: try to get it from the application service if it exists
-		appSvc, _, err := w.consul.Agent().Service(w.service, &api.QueryOptions{})
+		appSvc, err := w.localService(w.service)
 		if err == nil {
 			w.downstream.TargetPort = appSvc.Port
 			w.log.Infof("consul: using target port %d from application service", w.downstream.TargetPort)
@@ -188,19 +402,53 @@ func (w *Watcher) Run() error {
 		}
 	}
 
-	w.ready.Add(3) // Changed from 4 to 3 since we're not watching the app service anymore
+	// the CA roots and the leaf certificate are not awaited in insecure
+	// dev mode, the config has no TLS until they are delivered
+	w.ready.Add(2)
+	if !w.opts.InsecureDevMode {
+		w.ready.Add(2)
+	}
 
 	go w.watchCA()
 	go w.watchLeaf()
-	go w.watchService(proxyID, w.handleProxyChange)
-
-	w.ready.Wait()
+	go w.watchProxyDefaults()
+	if w.agentless() {
+		go w.watchNodeService(proxyID, w.applyProxyChange)
+	} else {
+		go w.watchService(proxyID, w.applyProxyChange)
+	}
 
-	for range w.update {
-		w.C <- w.genCfg()
+	ready := make(chan struct{})
+	go func() {
+		w.ready.Wait()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case <-w.ctx.Done():
+		return nil
 	}
 
-	return nil
+	go w.monitorLeafExpiry()
+	go w.monitorCARotation()
+
+	for {
+		select {
+		case <-w.update:
+		case <-w.ctx.Done():
+			return nil
+		}
+		w.opts.Metrics.IncrCounter("connect_consul_config_updates_total", 1, nil)
+		cfg := w.genCfg()
+		if changedAt := atomic.SwapInt64(&w.changedAt, 0); changedAt > 0 {
+			cfg.ChangedAt = time.Unix(0, changedAt)
+		}
+		select {
+		case w.C <- cfg:
+		case <-w.ctx.Done():
+			return nil
+		}
+	}
 }
 
 func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
@@ -209,8 +457,21 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 	w.downstream.TargetAddress = DefaultUpstreamBindAddr
 	w.downstream.ReadTimeout = DefaultReadTimeout
 	w.downstream.ConnectTimeout = DefaultConnectTimeout
+	w.downstream.ALPN = ""
+	w.downstream.Proto = ""
+	w.downstream.Balance = ""
+	w.downstream.ExtraConfig = ExtraConfig{}
+	w.downstream.LuaActions = LuaActions{}
+	w.luaScripts = nil
+	w.downstream.Headers = HeaderRules{}
+	w.downstream.Compression = w.opts.Compression
+	w.downstream.ConfigKeys = nil
+	w.downstream.BindOptions = BindOptions{}
+	w.downstream.Limits = ListenerLimits{}
+	w.downstream.SendProxyProtocol = false
 
 	if srv.Proxy != nil && srv.Proxy.Config != nil {
+		w.downstream.ConfigKeys = configKeys(srv.Proxy.Config)
 		if c, ok := srv.Proxy.Config["protocol"].(string); ok {
 			w.downstream.Protocol = c
 		}
@@ -231,6 +492,70 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 		if a, ok := srv.Proxy.Config["appname_header"].(string); ok {
 			w.downstream.AppNameHeaderName = a
 		}
+		if a, ok := srv.Proxy.Config["alpn"].(string); ok {
+			w.downstream.ALPN = a
+		}
+		if p, ok := srv.Proxy.Config["proto"].(string); ok {
+			w.downstream.Proto = p
+		}
+		if p, ok := srv.Proxy.Config["send_proxy_protocol"].(bool); ok {
+			w.downstream.SendProxyProtocol = p
+		}
+		if b, ok := srv.Proxy.Config["balance"]; ok {
+			balance, err := parseBalance(b)
+			if err != nil {
+				log.Errorf("bad balance value in config: %s. Ignoring", err)
+			} else {
+				w.downstream.Balance = balance
+			}
+		}
+		if e, ok := srv.Proxy.Config["extra_config"]; ok {
+			extra, err := parseExtraConfig(e)
+			if err != nil {
+				log.Errorf("bad extra_config value in config: %s. Ignoring", err)
+			} else {
+				w.downstream.ExtraConfig = extra
+			}
+		}
+		if l, ok := srv.Proxy.Config["lua_actions"]; ok {
+			actions, err := parseLuaActions(l)
+			if err != nil {
+				log.Errorf("bad lua_actions value in config: %s. Ignoring", err)
+			} else {
+				w.downstream.LuaActions = actions
+			}
+		}
+		if l, ok := srv.Proxy.Config["lua_scripts"]; ok {
+			scripts, err := parseLuaScripts(l)
+			if err != nil {
+				log.Errorf("bad lua_scripts value in config: %s. Ignoring", err)
+			} else {
+				w.luaScripts = scripts
+			}
+		}
+		headers, err := parseHeaderRules(srv.Proxy.Config)
+		if err != nil {
+			log.Errorf("bad header rules in config: %s. Ignoring", err)
+		} else {
+			w.downstream.Headers = headers
+		}
+		if c, ok := srv.Proxy.Config["compression"]; ok {
+			compression, err := parseCompression(w.downstream.Compression, c)
+			if err != nil {
+				log.Errorf("bad compression value in config: %s. Ignoring", err)
+			} else {
+				w.downstream.Compression = compression
+			}
+		}
+		bind, err := parseBindOptions(w.downstream.BindOptions, srv.Proxy.Config)
+		if err != nil {
+			log.Errorf("bad bind options in config: %s. Ignoring", err)
+		} else {
+			w.downstream.BindOptions = bind
+		}
+		w.downstream.Limits = parseListenerLimits(srv.Proxy.Config, func(key string, err error) {
+			log.Errorf("bad %s value in config: %s. Ignoring", key, err)
+		})
 		if a, ok := srv.Proxy.Config["connect_timeout"].(string); ok {
 			to, err := time.ParseDuration(a)
 			if err != nil {
@@ -249,11 +574,39 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 		}
 	}
 
+	w.extraDownstreams = nil
+	if srv.Proxy != nil && srv.Proxy.Config != nil {
+		if l, ok := srv.Proxy.Config["extra_listeners"].([]interface{}); ok {
+			// the ports already bound by the proxy, HAProxy would reject
+			// a config binding one twice
+			used := map[int]string{w.downstream.LocalBindPort: "the main listener"}
+			for _, up := range srv.Proxy.Upstreams {
+				if up.LocalBindPort > 0 {
+					used[up.LocalBindPort] = "upstream " + up.DestinationName
+				}
+			}
+			for i, e := range l {
+				d, err := w.parseExtraListener(e, used)
+				if err != nil {
+					log.Errorf("bad extra_listeners[%d] value in config: %s. Ignoring", i, err)
+					continue
+				}
+				used[d.LocalBindPort] = "extra listener " + d.Name
+				w.extraDownstreams = append(w.extraDownstreams, d)
+			}
+		}
+	}
+
 	keep := make(map[string]bool)
 
 	if srv.Proxy != nil {
-		for _, up := range srv.Proxy.Upstreams {
-			name := fmt.Sprintf("%s_%s", up.DestinationType, up.DestinationName)
+		names := upstreamNames(srv.Proxy.Upstreams)
+		for i, up := range srv.Proxy.Upstreams {
+			name := names[i]
+			if err := w.opts.Agent.CheckUpstream(up); err != nil {
+				log.Errorf("upstream %s: %s. Ignoring", name, err)
+				continue
+			}
 			keep[name] = true
 			w.lock.Lock()
 			_, ok := w.upstreams[name]
@@ -266,7 +619,22 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 					w.startUpstreamService(first, up, name)
 				}
 			} else {
-				w.updateUpstream(up, w.upstreams[name])
+				u := w.upstreams[name]
+				w.updateUpstream(up, u)
+				// the datacenter or the peer may have changed
+				w.lock.Lock()
+				if u.healthKey != "" && u.healthKey != u.healthKeyIn(u.Datacenter) {
+					w.unsubscribeHealth(u)
+					w.subscribeHealth(u, false)
+				}
+				if u.peerBundle != u.Peer {
+					w.detachPeer(u)
+					w.attachPeer(u)
+				}
+				if u.healthKey != "" {
+					w.syncFailoverHealth(u)
+				}
+				w.lock.Unlock()
 			}
 		}
 	}
@@ -282,10 +650,151 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 	}
 }
 
+// upstreamNames returns the names of the upstreams, in the same order. The
+// same destination can be declared several times, eg: for different
+// datacenters, its declarations are then named after their local port, and
+// numbered in the order of their settings when the ports are the same. The
+// names do not depend on the order of the declarations.
+func upstreamNames(ups []api.Upstream) []string {
+	names := make([]string, len(ups))
+	byName := map[string][]int{}
+	for i, up := range ups {
+		names[i] = fmt.Sprintf("%s_%s", up.DestinationType, up.DestinationName)
+		byName[names[i]] = append(byName[names[i]], i)
+	}
+
+	for name, dups := range byName {
+		if len(dups) == 1 {
+			continue
+		}
+		sort.SliceStable(dups, func(a, b int) bool {
+			return upstreamKey(ups[dups[a]]) < upstreamKey(ups[dups[b]])
+		})
+		byPort := map[string][]int{}
+		for _, i := range dups {
+			names[i] = fmt.Sprintf("%s_%d", name, ups[i].LocalBindPort)
+			byPort[names[i]] = append(byPort[names[i]], i)
+		}
+		for portName, same := range byPort {
+			if len(same) == 1 {
+				continue
+			}
+			for n, i := range same {
+				names[i] = fmt.Sprintf("%s_%d", portName, n)
+			}
+		}
+	}
+	return names
+}
+
+// upstreamKey orders the declarations of the same destination
+func upstreamKey(up api.Upstream) string {
+	return fmt.Sprintf("%010d %s %s %s %s %s %s", up.LocalBindPort, up.LocalBindAddress, up.LocalBindSocketPath,
+		up.Datacenter, up.DestinationPeer, up.DestinationPartition, up.DestinationNamespace)
+}
+
+// parseExtraListener reads an additional public listener definition, settings
+// not specified are inherited from the main downstream. used are the ports
+// already bound by the proxy, with what binds them.
+func (w *Watcher) parseExtraListener(v interface{}, used map[int]string) (downstream, error) {
+	d := w.downstream
+
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return d, fmt.Errorf("expected an object, got %T", v)
+	}
+
+	p, ok := c["port"].(float64)
+	if !ok {
+		return d, fmt.Errorf("port is required")
+	}
+	if !validPort(p) {
+		return d, fmt.Errorf("port must be between 1 and 65535, got %v", p)
+	}
+	if owner, ok := used[int(p)]; ok {
+		return d, fmt.Errorf("port %d is already bound by %s", int(p), owner)
+	}
+	d.LocalBindPort = int(p)
+	d.Name = fmt.Sprintf("%d", d.LocalBindPort)
+	d.ConfigKeys = configKeys(c)
+
+	t, ok := c["target_port"].(float64)
+	if !ok {
+		return d, fmt.Errorf("target_port is required")
+	}
+	if !validPort(t) {
+		return d, fmt.Errorf("target_port must be between 1 and 65535, got %v", t)
+	}
+	d.TargetPort = int(t)
+
+	if p, ok := c["protocol"].(string); ok {
+		d.Protocol = p
+	}
+	if b, ok := c["bind_address"].(string); ok {
+		d.LocalBindAddress = b
+	}
+	if a, ok := c["target_address"].(string); ok {
+		d.TargetAddress = a
+	}
+	if a, ok := c["alpn"].(string); ok {
+		d.ALPN = a
+	}
+	if p, ok := c["proto"].(string); ok {
+		d.Proto = p
+	}
+	if p, ok := c["send_proxy_protocol"].(bool); ok {
+		d.SendProxyProtocol = p
+	}
+	bind, err := parseBindOptions(d.BindOptions, c)
+	if err != nil {
+		return d, err
+	}
+	d.BindOptions = bind
+	if v, ok := c["compression"]; ok {
+		compression, err := parseCompression(d.Compression, v)
+		if err != nil {
+			return d, fmt.Errorf("compression: %s", err)
+		}
+		d.Compression = compression
+	}
+	// the header rules replace the ones of the main listener when set
+	_, req := c["request_headers"]
+	_, resp := c["response_headers"]
+	if req || resp {
+		headers, err := parseHeaderRules(c)
+		if err != nil {
+			return d, err
+		}
+		d.Headers = headers
+	}
+	// the limits are not inherited, each listener has its own
+	d.Limits = parseListenerLimits(c, func(key string, err error) {
+		log.Errorf("extra listener %s: bad %s value in config: %s. Ignoring", d.Name, key, err)
+	})
+
+	return d, nil
+}
+
+func validPort(p float64) bool {
+	return p >= 1 && p <= 65535 && p == float64(int(p))
+}
+
 func (w *Watcher) updateUpstream(up api.Upstream, u *upstream) {
 	u.LocalBindAddress = up.LocalBindAddress
 	u.LocalBindPort = up.LocalBindPort
 	u.Datacenter = up.Datacenter
+	u.Peer = up.DestinationPeer
+	u.Namespace = up.DestinationNamespace
+	u.Partition = up.DestinationPartition
+	u.ConfigKeys = configKeys(up.Config)
+
+	if p, ok := up.Config["local_bind_port"].(float64); ok {
+		if p <= 0 || p > 65535 {
+			log.Errorf("upstream %s: bad local_bind_port value in config: %v. Ignoring", u.Name, p)
+		} else {
+			u.LocalBindPort = int(p)
+		}
+	}
 	u.ReadTimeout = DefaultReadTimeout
 	u.ConnectTimeout = DefaultConnectTimeout
 
@@ -293,10 +802,135 @@ func (w *Watcher) updateUpstream(up api.Upstream, u *upstream) {
 		u.LocalBindAddress = "127.0.0.1"
 	}
 
+	u.Protocol = ""
 	if p, ok := up.Config["protocol"].(string); ok {
 		u.Protocol = p
 	}
 
+	u.ALPN = ""
+	if a, ok := up.Config["alpn"].(string); ok {
+		u.ALPN = a
+	}
+	u.Proto = ""
+	if p, ok := up.Config["proto"].(string); ok {
+		u.Proto = p
+	}
+
+	u.DisableChecks = false
+	if d, ok := up.Config["disable_checks"].(bool); ok {
+		u.DisableChecks = d
+	}
+	u.SendProxyProtocol = false
+	if p, ok := up.Config["send_proxy_protocol"].(bool); ok {
+		u.SendProxyProtocol = p
+	}
+
+	u.Balance = ""
+	if b, ok := up.Config["balance"]; ok {
+		balance, err := parseBalance(b)
+		if err != nil {
+			log.Errorf("upstream %s: bad balance value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.Balance = balance
+		}
+	}
+
+	u.HashPolicy = nil
+	if h, ok := up.Config["hash_policy"]; ok {
+		policy, err := parseHashPolicy(h)
+		if err != nil {
+			log.Errorf("upstream %s: bad hash_policy value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.HashPolicy = policy
+		}
+	}
+
+	u.Limits = parseLimits(up.Config, func(key string, err error) {
+		log.Errorf("upstream %s: bad %s value in config: %s. Ignoring", u.Name, key, err)
+	})
+
+	u.OutlierDetection = nil
+	if o, ok := up.Config["outlier_detection"]; ok {
+		outlier, err := parseOutlierDetection(o)
+		if err != nil {
+			log.Errorf("upstream %s: bad outlier_detection value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.OutlierDetection = outlier
+		}
+	}
+
+	u.HTTPCheck = nil
+	if c, ok := up.Config["http_check"]; ok {
+		check, err := parseHTTPCheck(c)
+		if err != nil {
+			log.Errorf("upstream %s: bad http_check value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.HTTPCheck = check
+		}
+	}
+
+	headers, err := parseHeaderRules(up.Config)
+	if err != nil {
+		log.Errorf("upstream %s: bad header rules in config: %s. Ignoring", u.Name, err)
+	}
+	u.Headers = headers
+
+	pathRewrite, err := parsePathRewrite(up.Config)
+	if err != nil {
+		log.Errorf("upstream %s: bad path rewrite in config: %s. Ignoring", u.Name, err)
+	}
+	u.PathRewrite = pathRewrite
+
+	u.Mirror = nil
+	if m, ok := up.Config["mirror_to"]; ok {
+		mirror, err := parseMirror(m)
+		if err != nil {
+			log.Errorf("upstream %s: bad mirror_to value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.Mirror = mirror
+		}
+	}
+
+	u.Subsets = nil
+	if v, ok := up.Config["subsets"]; ok {
+		subsets, err := parseSubsets(v)
+		if err != nil {
+			log.Errorf("upstream %s: bad subsets value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.Subsets = subsets
+		}
+	}
+
+	u.Compression = w.opts.Compression
+	if c, ok := up.Config["compression"]; ok {
+		compression, err := parseCompression(u.Compression, c)
+		if err != nil {
+			log.Errorf("upstream %s: bad compression value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.Compression = compression
+		}
+	}
+
+	u.ExtraConfig = ExtraConfig{}
+	if e, ok := up.Config["extra_config"]; ok {
+		extra, err := parseExtraConfig(e)
+		if err != nil {
+			log.Errorf("upstream %s: bad extra_config value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.ExtraConfig = extra
+		}
+	}
+
+	u.LuaActions = LuaActions{}
+	if l, ok := up.Config["lua_actions"]; ok {
+		actions, err := parseLuaActions(l)
+		if err != nil {
+			log.Errorf("upstream %s: bad lua_actions value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.LuaActions = actions
+		}
+	}
+
 	if a, ok := up.Config["read_timeout"].(string); ok {
 		to, err := time.ParseDuration(a)
 		if err != nil {
@@ -314,6 +948,50 @@ func (w *Watcher) updateUpstream(up api.Upstream, u *upstream) {
 			u.ConnectTimeout = to
 		}
 	}
+
+	u.SlowStart = 0
+	if a, ok := up.Config["slowstart"].(string); ok {
+		d, err := time.ParseDuration(a)
+		if err != nil || d < 0 {
+			log.Errorf("upstream %s: bad slowstart value in config: %s. Ignoring", u.Name, a)
+		} else {
+			u.SlowStart = d
+		}
+	}
+
+	clientTLS, err := parseClientTLS(up.Config)
+	if err != nil {
+		log.Errorf("upstream %s: bad client certificate in config: %s. Ignoring", u.Name, err)
+	}
+	u.ClientTLS = clientTLS
+
+	u.FailoverDatacenters = nil
+	if f, ok := up.Config["failover_datacenters"]; ok {
+		dcs, err := parseDatacenters(f)
+		if err != nil {
+			log.Errorf("upstream %s: bad failover_datacenters value in config: %s. Ignoring", u.Name, err)
+		} else {
+			u.FailoverDatacenters = dcs
+		}
+	}
+
+	u.Splits = nil
+	if splits, ok := up.Config["splits"].(map[string]interface{}); ok {
+		for service, w := range splits {
+			weight, ok := w.(float64)
+			if !ok || weight < 0 {
+				log.Errorf("upstream %s: bad weight for split %s: %v. Ignoring", u.Name, service, w)
+				continue
+			}
+			u.Splits = append(u.Splits, UpstreamSplit{
+				Service: service,
+				Weight:  int(weight),
+			})
+		}
+		sort.Slice(u.Splits, func(i, j int) bool {
+			return u.Splits[i].Service < u.Splits[j].Service
+		})
+	}
 }
 
 func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name string) {
@@ -326,64 +1004,32 @@ func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name strin
 	u := &upstream{
 		Name:        name,
 		ServiceName: up.DestinationName,
+		failover:    map[string][]*api.ServiceEntry{},
 	}
 
 	w.updateUpstream(up, u)
+	u.resolverFailover = w.resolverFailover(u)
+	// the first config is generated with the protocol, its changes are
+	// watched next
+	ctx, cancel := context.WithCancel(w.ctx)
+	u.cancel = cancel
+	protocol, index, err := w.serviceDefaultsProtocol(ctx, u, 0, w.currentToken())
+	if err != nil {
+		w.log.Debugf("consul: no service-defaults for %s: %s", u.ServiceName, err)
+	}
+	u.serviceProtocol = protocol
+	if u.Protocol == "" && u.serviceProtocol != "" {
+		w.log.Infof("consul: upstream %s: using protocol %s of the service-defaults of %s", name, u.serviceProtocol, u.ServiceName)
+	}
 
 	w.lock.Lock()
 	w.upstreams[name] = u
+	w.subscribeHealth(u, startup)
+	w.attachPeer(u)
+	w.syncFailoverHealth(u)
 	w.lock.Unlock()
 
-	go func() {
-		index := uint64(0)
-		first := true
-		for {
-			if u.done {
-				return
-			}
-			nodes, meta, err := w.consul.Health().Connect(up.DestinationName, "", true, &api.QueryOptions{
-				Datacenter: up.Datacenter,
-				WaitTime:   10 * time.Minute,
-				WaitIndex:  index,
-			})
-			if err != nil {
-				w.log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
-				time.Sleep(errorWaitTime)
-				index = 0
-				continue
-			}
-			changed := index != meta.LastIndex
-			index = meta.LastIndex
-
-			if changed {
-				w.lock.Lock()
-				u.Nodes = nodes
-				w.lock.Unlock()
-				w.notifyChanged()
-			}
-
-			if startup && first {
-				// Count healthy nodes
-				healthyCount := 0
-				for _, node := range nodes {
-					status := node.Checks.AggregatedStatus()
-					if status == api.HealthPassing || status == api.HealthWarning {
-						healthyCount++
-					}
-				}
-
-				if healthyCount > 0 {
-					w.log.Infof("consul: upstream %s ready with %d healthy node(s)", up.DestinationName, healthyCount)
-				} else {
-					w.log.Warnf("consul: upstream %s has no healthy nodes yet (will retry)", up.DestinationName)
-				}
-
-				w.ready.Done()
-			}
-
-			first = false
-		}
-	}()
+	go w.watchServiceDefaults(ctx, u, index)
 }
 
 func (w *Watcher) startUpstreamPreparedQuery(startup bool, up api.Upstream, name string) {
@@ -416,36 +1062,59 @@ func (w *Watcher) startUpstreamPreparedQuery(startup bool, up api.Upstream, name
 		interval = dur
 	}
 
+	ctx, cancel := context.WithCancel(w.ctx)
+	u.cancel = cancel
+
 	w.lock.Lock()
 	w.upstreams[name] = u
 	w.lock.Unlock()
 
 	go func() {
 		var last []*api.ServiceEntry
+		b := w.newBackoff()
+		lastDC := ""
 		first := true
-		for {
-			if u.done {
-				return
-			}
-			nodes, _, err := w.consul.PreparedQuery().Execute(up.DestinationName, &api.QueryOptions{
+		for w.acquireQuery(ctx) {
+			token := w.currentToken()
+			start := time.Now()
+			nodes, _, err := w.client().PreparedQueryExecute(up.DestinationName, w.blocking(ctx, &api.QueryOptions{
 				Connect:    true,
 				Datacenter: up.Datacenter,
-				WaitTime:   10 * time.Minute,
-			})
+				Token:      token,
+			}))
+			w.releaseQuery()
+			w.observeQuery("prepared_query", start)
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
-				w.log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
-				time.Sleep(errorWaitTime)
+				w.log.Errorf("consul: error executing prepared_query %s: %s", up.DestinationName, err)
+				w.waitAfterError(ctx, b, err, token)
 				continue
 			}
+			b.reset()
+
+			if nodes.Datacenter != lastDC {
+				if lastDC != "" {
+					w.log.Warnf("consul: prepared_query upstream %s now served by datacenter %s instead of %s, failovers: %d", up.DestinationName, nodes.Datacenter, lastDC, nodes.Failovers)
+				}
+				lastDC = nodes.Datacenter
+			}
+			w.opts.Metrics.SetGauge("connect_prepared_query_failovers", float64(nodes.Failovers), metrics.Labels{"upstream": name})
 
 			nodesP := []*api.ServiceEntry{}
 			for i := range nodes.Nodes {
+				// instances carry the datacenter they were found in
+				if nodes.Nodes[i].Node.Datacenter == "" {
+					nodes.Nodes[i].Node.Datacenter = nodes.Datacenter
+				}
 				nodesP = append(nodesP, &nodes.Nodes[i])
 			}
 
-			if !reflect.DeepEqual(last, nodesP) {
+			if first || !reflect.DeepEqual(last, nodesP) {
 				w.lock.Lock()
 				u.Nodes = nodesP
+				u.fetched = true
 				w.lock.Unlock()
 				w.notifyChanged()
 				last = nodesP
@@ -471,7 +1140,7 @@ func (w *Watcher) startUpstreamPreparedQuery(startup bool, up api.Upstream, name
 			}
 
 			first = false
-			time.Sleep(interval)
+			sleep(ctx, jitter(interval))
 		}
 	}()
 }
@@ -480,7 +1149,20 @@ func (w *Watcher) removeUpstream(name string) {
 	w.log.Infof("consul: removing upstream for service %s", name)
 
 	w.lock.Lock()
-	w.upstreams[name].done = true
+	u := w.upstreams[name]
+	if u.cancel != nil {
+		u.cancel()
+	}
+	if u.healthKey != "" {
+		w.unsubscribeHealth(u)
+	}
+	w.detachPeer(u)
+	for key := range u.failover {
+		w.detachHealth(u, key)
+	}
+	if u.pinned {
+		w.opts.Metrics.SetGauge("connect_upstream_pinned", 0, metrics.Labels{"upstream": name})
+	}
 	delete(w.upstreams, name)
 	w.lock.Unlock()
 }
@@ -490,20 +1172,31 @@ func (w *Watcher) watchLeaf() {
 
 	var lastIndex uint64
 	first := true
-	for {
-		cert, meta, err := w.consul.Agent().ConnectCALeaf(w.serviceName, &api.QueryOptions{
-			WaitTime:  10 * time.Minute,
+	b := w.newBackoff()
+	for w.acquireQuery(w.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		cert, meta, err := w.client().ConnectCALeaf(w.serviceName, w.cached(w.blocking(w.ctx, &api.QueryOptions{
 			WaitIndex: lastIndex,
-		})
+			Token:     token,
+		})))
+		w.releaseQuery()
+		w.observeQuery("leaf", start)
+		if w.ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			w.log.Errorf("consul error fetching leaf cert for service %s: %s", w.serviceName, err)
-			time.Sleep(errorWaitTime)
+			w.waitAfterError(w.ctx, b, err, token)
 			lastIndex = 0
 			continue
 		}
+		b.reset()
 
-		changed := lastIndex != meta.LastIndex
-		lastIndex = meta.LastIndex
+		w.observeCache("leaf", meta)
+
+		var changed bool
+		lastIndex, changed = w.nextIndex("leaf", w.serviceName, lastIndex, meta.LastIndex)
 
 		if changed {
 			w.log.Infof("consul: leaf cert for service %s changed, serial: %s, valid before: %s, valid after: %s", w.serviceName, cert.SerialNumber, cert.ValidBefore, cert.ValidAfter)
@@ -513,34 +1206,104 @@ func (w *Watcher) watchLeaf() {
 			}
 			w.leaf.Cert = []byte(cert.CertPEM)
 			w.leaf.Key = []byte(cert.PrivateKeyPEM)
+			w.leaf.NotBefore = cert.ValidAfter
+			w.leaf.NotAfter = cert.ValidBefore
 			w.lock.Unlock()
 			w.notifyChanged()
 		}
 
 		if first {
 			w.log.Infof("consul: leaf cert for %s ready", w.serviceName)
-			w.ready.Done()
+			if !w.opts.InsecureDevMode {
+				w.ready.Done()
+			}
 			first = false
 		}
 	}
 }
 
+// monitorLeafExpiry logs escalating messages as the leaf certificate
+// gets close to its expiry without Consul delivering a renewed one.
+func (w *Watcher) monitorLeafExpiry() {
+	level := 0
+	ticker := time.NewTicker(leafExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+
+		w.lock.Lock()
+		var notBefore, notAfter time.Time
+		if w.leaf != nil {
+			notBefore, notAfter = w.leaf.NotBefore, w.leaf.NotAfter
+		}
+		w.lock.Unlock()
+
+		if notAfter.IsZero() {
+			continue
+		}
+
+		remaining := time.Until(notAfter)
+		newLevel := leafExpiryLevel(time.Now(), notBefore, notAfter)
+		switch {
+		case newLevel == 3:
+			w.log.Errorf("consul: leaf cert for service %s expired at %s, TLS connections will fail", w.serviceName, notAfter)
+		case newLevel == 2:
+			w.log.Errorf("consul: leaf cert for service %s expires in %s and has not been renewed", w.serviceName, remaining.Round(time.Second))
+		case newLevel == 1 && level < 1:
+			w.log.Warnf("consul: leaf cert for service %s expires in %s, consul has not delivered a renewed certificate", w.serviceName, remaining.Round(time.Second))
+		case newLevel == 0 && level > 0:
+			w.log.Infof("consul: leaf cert for service %s renewed, expires at %s", w.serviceName, notAfter)
+		}
+		level = newLevel
+	}
+}
+
+// leafExpiryLevel tells how close to its expiry a leaf certificate is at
+// now: 3 when it expired, 2 when it expires soon, 1 when its renewal is
+// overdue and 0 otherwise
+func leafExpiryLevel(now, notBefore, notAfter time.Time) int {
+	remaining := notAfter.Sub(now)
+	lifetime := notAfter.Sub(notBefore)
+	switch {
+	case remaining <= 0:
+		return 3
+	case remaining < leafExpirySoon:
+		return 2
+	case lifetime > 0 && float64(now.Sub(notBefore)) > float64(lifetime)*leafRenewalOverdue:
+		return 1
+	}
+	return 0
+}
+
 func (w *Watcher) watchService(service string, handler func(first bool, srv *api.AgentService)) {
 	w.log.Infof("consul: watching service %s", service)
 
 	hash := ""
 	first := true
-	for {
-		srv, meta, err := w.consul.Agent().Service(service, &api.QueryOptions{
+	b := w.newBackoff()
+	for w.acquireQuery(w.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		srv, meta, err := w.client().AgentService(service, w.blocking(w.ctx, &api.QueryOptions{
 			WaitHash: hash,
-			WaitTime: 10 * time.Minute,
-		})
+			Token:    token,
+		}))
+		w.releaseQuery()
+		w.observeQuery("service", start)
+		if w.ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			w.log.Errorf("consul: error fetching service %s definition: %s", service, err)
-			time.Sleep(errorWaitTime)
+			w.waitAfterError(w.ctx, b, err, token)
 			hash = ""
 			continue
 		}
+		b.reset()
 
 		changed := hash != meta.LastContentHash
 		hash = meta.LastContentHash
@@ -560,40 +1323,45 @@ func (w *Watcher) watchCA() {
 
 	first := true
 	var lastIndex uint64
-	for {
-		caList, meta, err := w.consul.Agent().ConnectCARoots(&api.QueryOptions{
+	b := w.newBackoff()
+	for w.acquireQuery(w.ctx) {
+		token := w.currentToken()
+		start := time.Now()
+		caList, meta, err := w.client().ConnectCARoots(w.cached(w.blocking(w.ctx, &api.QueryOptions{
 			WaitIndex: lastIndex,
-			WaitTime:  10 * time.Minute,
-		})
+			Token:     token,
+		})))
+		w.releaseQuery()
+		w.observeQuery("ca", start)
+		if w.ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			w.log.Errorf("consul: error fetching cas: %s", err)
-			time.Sleep(errorWaitTime)
+			w.waitAfterError(w.ctx, b, err, token)
 			lastIndex = 0
 			continue
 		}
+		b.reset()
 
-		changed := lastIndex != meta.LastIndex
-		lastIndex = meta.LastIndex
+		w.observeCache("ca", meta)
+
+		var changed bool
+		lastIndex, changed = w.nextIndex("ca", "roots", lastIndex, meta.LastIndex)
 
 		if changed {
 			w.log.Infof("consul: CA certs changed, active root id: %s", caList.ActiveRootID)
 			w.lock.Lock()
-			w.certCAs = w.certCAs[:0]
-			w.certCAPool = x509.NewCertPool()
-			for _, ca := range caList.Roots {
-				w.certCAs = append(w.certCAs, []byte(ca.RootCertPEM))
-				ok := w.certCAPool.AppendCertsFromPEM([]byte(ca.RootCertPEM))
-				if !ok {
-					w.log.Warnf("consul: unable to add CA certificate to pool for root id: %s", caList.ActiveRootID)
-				}
-			}
+			w.handleCARoots(caList)
 			w.lock.Unlock()
 			w.notifyChanged()
 		}
 
 		if first {
 			w.log.Infof("consul: CA certs ready")
-			w.ready.Done()
+			if !w.opts.InsecureDevMode {
+				w.ready.Done()
+			}
 			first = false
 		}
 	}
@@ -610,70 +1378,133 @@ func (w *Watcher) genCfg() Config {
 			serviceInstancesAlive, serviceInstancesTotal)
 	}()
 
+	// the leaf certificate is not awaited in insecure dev mode
+	tls := TLS{CAs: w.certCAs}
+	if w.leaf != nil {
+		tls.Cert = w.leaf.Cert
+		tls.Key = w.leaf.Key
+		tls.NotAfter = w.leaf.NotAfter
+	}
+
 	config := Config{
 		ServiceName: w.serviceName,
 		ServiceID:   w.service,
-		Downstream: Downstream{
-			LocalBindAddress:  w.downstream.LocalBindAddress,
-			LocalBindPort:     w.downstream.LocalBindPort,
-			TargetAddress:     w.downstream.TargetAddress,
-			TargetPort:        w.downstream.TargetPort,
-			Protocol:          w.downstream.Protocol,
-			ConnectTimeout:    w.downstream.ConnectTimeout,
-			ReadTimeout:       w.downstream.ReadTimeout,
-			EnableForwardFor:  w.downstream.EnableForwardFor,
-			AppNameHeaderName: w.downstream.AppNameHeaderName,
-
-			TLS: TLS{
-				CAs:  w.certCAs,
-				Cert: w.leaf.Cert,
-				Key:  w.leaf.Key,
-			},
-		},
+		Downstream:  w.downstream.config(tls),
+		AccessLogs:  w.accessLogs,
+		LuaScripts:  w.luaScripts,
+	}
+
+	for _, d := range w.extraDownstreams {
+		config.ExtraDownstreams = append(config.ExtraDownstreams, d.config(tls))
 	}
 
 	for _, up := range w.upstreams {
 		upstream := Upstream{
-			Name:             up.Name,
-			ServiceName:      up.ServiceName,
-			LocalBindAddress: up.LocalBindAddress,
-			LocalBindPort:    up.LocalBindPort,
-			Protocol:         up.Protocol,
-			ConnectTimeout:   up.ConnectTimeout,
-			ReadTimeout:      up.ReadTimeout,
-			TLS: TLS{
-				CAs:  w.certCAs,
-				Cert: w.leaf.Cert,
-				Key:  w.leaf.Key,
-			},
-		}
-		for _, s := range up.Nodes {
+			Name:              up.Name,
+			ServiceName:       up.ServiceName,
+			Datacenter:        up.Datacenter,
+			LocalBindAddress:  up.LocalBindAddress,
+			LocalBindPort:     up.LocalBindPort,
+			Protocol:          up.protocol(),
+			ConnectTimeout:    up.ConnectTimeout,
+			ReadTimeout:       up.ReadTimeout,
+			ALPN:              up.ALPN,
+			Proto:             up.Proto,
+			DisableChecks:     up.DisableChecks,
+			SendProxyProtocol: up.SendProxyProtocol,
+			Balance:           up.Balance,
+			HashPolicy:        up.HashPolicy,
+			Limits:            up.Limits,
+			OutlierDetection:  up.OutlierDetection,
+			HTTPCheck:         up.HTTPCheck,
+			SlowStart:         up.SlowStart,
+			ClientTLS:         up.ClientTLS,
+			Splits:            up.Splits,
+			ExtraConfig:       up.ExtraConfig,
+			LuaActions:        up.LuaActions,
+			Headers:           up.Headers,
+			PathRewrite:       up.PathRewrite,
+			Mirror:            up.Mirror,
+			Subsets:           up.Subsets,
+			Compression:       up.Compression,
+			ConfigKeys:        up.ConfigKeys,
+			Pinned:            up.pinned,
+			TLS:               tls,
+		}
+		// the instances of a peer are signed by its own CA
+		if up.Peer != "" {
+			upstream.Peer = up.Peer
+			upstream.TLS.CAs = w.peerCAs(up.Peer)
+		}
+		// the instances of the first failover datacenter with healthy ones
+		// come after the local ones as backups
+		entries := []*api.ServiceEntry{}
+		backups := map[*api.ServiceEntry]bool{}
+		entries = append(entries, up.currentNodes()...)
+		for _, dc := range up.failoverDatacenters(w.localDatacenter()) {
+			nodes := up.currentFailover()[up.healthKeyIn(dc)]
+			if !hasHealthy(nodes) {
+				continue
+			}
+			for _, s := range nodes {
+				entries = append(entries, s)
+				backups[s] = true
+			}
+			break
+		}
+
+		virtualIPs := map[string]bool{}
+		for _, s := range entries {
 			serviceInstancesTotal++
+			if vip, ok := s.Service.TaggedAddresses[virtualIPTag]; ok && vip.Address != "" {
+				virtualIPs[vip.Address] = true
+			}
 			host := s.Service.Address
 			if host == "" {
 				host = s.Node.Address
 			}
+			dc := up.Datacenter
+			if s.Node.Datacenter != "" {
+				dc = s.Node.Datacenter
+			}
 
 			weight := 1
+			draining := false
 			switch s.Checks.AggregatedStatus() {
 			case api.HealthPassing:
 				weight = s.Service.Weights.Passing
 			case api.HealthWarning:
 				weight = s.Service.Weights.Warning
 			default:
-				continue
+				if !inMaintenance(s) {
+					continue
+				}
+				weight = 0
+				draining = true
 			}
-			if weight == 0 {
+			if weight == 0 && !draining {
 				continue
 			}
-			serviceInstancesAlive++
+			if !draining {
+				serviceInstancesAlive++
+			}
 
 			upstream.Nodes = append(upstream.Nodes, UpstreamNode{
-				Host:   host,
-				Port:   s.Service.Port,
-				Weight: weight,
+				Host:       host,
+				Port:       s.Service.Port,
+				Weight:     weight,
+				Draining:   draining,
+				Backup:     backups[s],
+				Datacenter: dc,
+				Node:       s.Node.Node,
+				Meta:       s.Service.Meta,
+				Tags:       s.Service.Tags,
 			})
 		}
+		for vip := range virtualIPs {
+			upstream.VirtualIPs = append(upstream.VirtualIPs, vip)
+		}
+		sort.Strings(upstream.VirtualIPs)
 
 		config.Upstreams = append(config.Upstreams, upstream)
 	}
@@ -685,7 +1516,36 @@ func (w *Watcher) genCfg() Config {
 	return config
 }
 
+func (d downstream) config(tls TLS) Downstream {
+	return Downstream{
+		Name:              d.Name,
+		LocalBindAddress:  d.LocalBindAddress,
+		LocalBindPort:     d.LocalBindPort,
+		TargetAddress:     d.TargetAddress,
+		TargetPort:        d.TargetPort,
+		Protocol:          d.Protocol,
+		ConnectTimeout:    d.ConnectTimeout,
+		ReadTimeout:       d.ReadTimeout,
+		EnableForwardFor:  d.EnableForwardFor,
+		AppNameHeaderName: d.AppNameHeaderName,
+		ALPN:              d.ALPN,
+		Proto:             d.Proto,
+		Balance:           d.Balance,
+		ExtraConfig:       d.ExtraConfig,
+		LuaActions:        d.LuaActions,
+		Headers:           d.Headers,
+		Compression:       d.Compression,
+		ConfigKeys:        d.ConfigKeys,
+		BindOptions:       d.BindOptions,
+		Limits:            d.Limits,
+		SendProxyProtocol: d.SendProxyProtocol,
+
+		TLS: tls,
+	}
+}
+
 func (w *Watcher) notifyChanged() {
+	atomic.CompareAndSwapInt64(&w.changedAt, 0, time.Now().UnixNano())
 	select {
 	case w.update <- struct{}{}:
 	default:
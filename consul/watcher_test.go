@@ -33,10 +33,15 @@ func clearCerts(cfg *Config) {
 	cfg.Downstream.CAs = nil
 	cfg.Downstream.Cert = nil
 	cfg.Downstream.Key = nil
+	cfg.Downstream.NotAfter = time.Time{}
+	for i := range cfg.ExtraDownstreams {
+		cfg.ExtraDownstreams[i].TLS = TLS{}
+	}
 	for i := range cfg.Upstreams {
 		cfg.Upstreams[i].CAs = nil
 		cfg.Upstreams[i].Cert = nil
 		cfg.Upstreams[i].Key = nil
+		cfg.Upstreams[i].NotAfter = time.Time{}
 	}
 }
 
@@ -100,6 +105,53 @@ var testCases = []struct {
 			},
 		},
 	},
+	{
+		name: "extra listeners",
+		reg: &api.AgentServiceRegistration{
+			Name: "client",
+			ID:   "client-inst",
+			Port: 8080,
+			Connect: &api.AgentServiceConnect{
+				SidecarService: &api.AgentServiceRegistration{
+					Proxy: &api.AgentServiceConnectProxyConfig{
+						Config: map[string]interface{}{
+							"extra_listeners": []interface{}{
+								map[string]interface{}{
+									"port":        21001,
+									"target_port": 9090,
+									"protocol":    "http",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: Config{
+			ServiceName: "client",
+			ServiceID:   "client-inst",
+			Downstream: Downstream{
+				LocalBindAddress: "0.0.0.0",
+				LocalBindPort:    21000,
+				TargetAddress:    "127.0.0.1",
+				TargetPort:       8080,
+				ConnectTimeout:   DefaultConnectTimeout,
+				ReadTimeout:      DefaultReadTimeout,
+			},
+			ExtraDownstreams: []Downstream{
+				{
+					Name:             "21001",
+					LocalBindAddress: "0.0.0.0",
+					LocalBindPort:    21001,
+					TargetAddress:    "127.0.0.1",
+					TargetPort:       9090,
+					Protocol:         "http",
+					ConnectTimeout:   DefaultConnectTimeout,
+					ReadTimeout:      DefaultReadTimeout,
+				},
+			},
+		},
+	},
 	{
 		name: "upstreams",
 		reg: &api.AgentServiceRegistration{
@@ -216,6 +268,60 @@ var testCases = []struct {
 			},
 		},
 	},
+	{
+		name: "same destination upstreams",
+		reg: &api.AgentServiceRegistration{
+			Name: "client",
+			ID:   "client-inst",
+			Port: 8080,
+			Connect: &api.AgentServiceConnect{
+				SidecarService: &api.AgentServiceRegistration{
+					Proxy: &api.AgentServiceConnectProxyConfig{
+						Upstreams: []api.Upstream{
+							{
+								DestinationType: "service",
+								DestinationName: "server",
+								LocalBindPort:   8081,
+							},
+							{
+								DestinationType: "service",
+								DestinationName: "server",
+								LocalBindPort:   8083,
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: Config{
+			ServiceName: "client",
+			ServiceID:   "client-inst",
+			Downstream: Downstream{
+				LocalBindAddress: "0.0.0.0",
+				LocalBindPort:    21000,
+				TargetAddress:    "127.0.0.1",
+				TargetPort:       8080,
+				ConnectTimeout:   DefaultConnectTimeout,
+				ReadTimeout:      DefaultReadTimeout,
+			},
+			Upstreams: []Upstream{
+				{
+					Name:             "service_server",
+					LocalBindAddress: "127.0.0.1",
+					LocalBindPort:    8081,
+					ConnectTimeout:   DefaultConnectTimeout,
+					ReadTimeout:      DefaultReadTimeout,
+				},
+				{
+					Name:             "service_server_8083",
+					LocalBindAddress: "127.0.0.1",
+					LocalBindPort:    8083,
+					ConnectTimeout:   DefaultConnectTimeout,
+					ReadTimeout:      DefaultReadTimeout,
+				},
+			},
+		},
+	},
 }
 
 func TestWatcherConfigInit(t *testing.T) {
@@ -259,6 +365,17 @@ func TestWatcherConfigInit(t *testing.T) {
 				clearCerts(&cfg)
 				require.Equal(t, tc.expected, cfg)
 			}
+
+			// upstreams of the same service share a single watch
+			services := map[string]bool{}
+			for _, up := range tc.reg.Connect.SidecarService.Proxy.Upstreams {
+				if up.DestinationType == api.UpstreamDestTypeService {
+					services[up.DestinationName] = true
+				}
+			}
+			w.lock.Lock()
+			require.Len(t, w.healthWatches, len(services))
+			w.lock.Unlock()
 		})
 	}
 
@@ -412,3 +529,44 @@ func TestWatcherConfigUpdate(t *testing.T) {
 		require.Equal(t, expected, cfg)
 	}
 }
+
+func TestLeafExpiryLevel(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(72 * time.Hour)
+
+	require.Equal(t, 0, leafExpiryLevel(notBefore.Add(time.Hour), notBefore, notAfter))
+	// 90% of the lifetime
+	require.Equal(t, 0, leafExpiryLevel(notBefore.Add(64*time.Hour), notBefore, notAfter))
+	require.Equal(t, 1, leafExpiryLevel(notBefore.Add(65*time.Hour), notBefore, notAfter))
+	require.Equal(t, 2, leafExpiryLevel(notAfter.Add(-30*time.Minute), notBefore, notAfter))
+	require.Equal(t, 3, leafExpiryLevel(notAfter, notBefore, notAfter))
+	require.Equal(t, 3, leafExpiryLevel(notAfter.Add(time.Hour), notBefore, notAfter))
+
+	// the last hour of a short lived certificate starts before 90% of its
+	// lifetime
+	notAfter = notBefore.Add(2 * time.Hour)
+	require.Equal(t, 0, leafExpiryLevel(notBefore.Add(59*time.Minute), notBefore, notAfter))
+	require.Equal(t, 2, leafExpiryLevel(notBefore.Add(61*time.Minute), notBefore, notAfter))
+}
+
+func TestUpstreamNames(t *testing.T) {
+	ups := []api.Upstream{
+		{DestinationType: api.UpstreamDestTypeService, DestinationName: "db", LocalBindPort: 9002, Datacenter: "dc2"},
+		{DestinationType: api.UpstreamDestTypeService, DestinationName: "api", LocalBindPort: 8000},
+		{DestinationType: api.UpstreamDestTypeService, DestinationName: "db", LocalBindPort: 9001},
+		{DestinationType: api.UpstreamDestTypeService, DestinationName: "cache", Datacenter: "dc2"},
+		{DestinationType: api.UpstreamDestTypeService, DestinationName: "cache", Datacenter: "dc1"},
+	}
+	expected := []string{"service_db_9002", "service_api", "service_db_9001", "service_cache_0_1", "service_cache_0_0"}
+	require.Equal(t, expected, upstreamNames(ups))
+
+	// the names do not depend on the order of the declarations
+	reversed := make([]api.Upstream, len(ups))
+	for i, up := range ups {
+		reversed[len(ups)-1-i] = up
+	}
+	names := upstreamNames(reversed)
+	for i := range ups {
+		require.Equal(t, expected[i], names[len(ups)-1-i])
+	}
+}
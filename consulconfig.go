@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// addConsulTLSFlags declares the flags of the TLS config of the Consul
+// clients on fs
+func addConsulTLSFlags(fs *flag.FlagSet) *api.TLSConfig {
+	tls := &api.TLSConfig{}
+	fs.StringVar(&tls.CAFile, "consul-cacert", "", "CA certificate file verifying the Consul agent, defaults to CONSUL_CACERT. Implies HTTPS")
+	fs.StringVar(&tls.CertFile, "consul-client-cert", "", "Client certificate file presented to the Consul agent when it verifies its clients, with -consul-client-key. Defaults to CONSUL_CLIENT_CERT. Implies HTTPS")
+	fs.StringVar(&tls.KeyFile, "consul-client-key", "", "Private key file of -consul-client-cert, defaults to CONSUL_CLIENT_KEY")
+	fs.StringVar(&tls.Address, "consul-tls-server-name", "", "Name the certificate of the Consul agent is verified for, eg: server.dc1.consul when -http-addr is an IP address. Defaults to CONSUL_TLS_SERVER_NAME. Implies HTTPS")
+	return tls
+}
+
+func validateConsulTLS(tls *api.TLSConfig) error {
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return errors.New("-consul-client-cert and -consul-client-key must be set together")
+	}
+	return nil
+}
+
+// validateConsulAddr rejects the unix socket addresses without an
+// absolute path, the other addresses are checked by the client
+func validateConsulAddr(addr string) error {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if ok && !filepath.IsAbs(path) {
+		return fmt.Errorf("-http-addr %s: the path of the unix socket must be absolute, eg: unix:///run/consul/consul.sock", addr)
+	}
+	return nil
+}
+
+// newConsulConfig returns the config of a Consul client. The TLS settings
+// left empty are taken from the CONSUL_CACERT, CONSUL_CLIENT_CERT,
+// CONSUL_CLIENT_KEY and CONSUL_TLS_SERVER_NAME environment variables by
+// the client, like with the Consul CLI.
+func newConsulConfig(addr string, tls *api.TLSConfig) *api.Config {
+	cfg := &api.Config{
+		Address:   addr,
+		TLSConfig: *tls,
+	}
+	// an address with a scheme sets it
+	if (tls.CAFile != "" || tls.CertFile != "" || tls.Address != "") && !strings.Contains(addr, "://") {
+		cfg.Scheme = "https"
+	}
+	return cfg
+}
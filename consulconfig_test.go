@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConsulConfig(t *testing.T) {
+	cfg := newConsulConfig("127.0.0.1:8500", &api.TLSConfig{})
+	require.Empty(t, cfg.Scheme)
+
+	cfg = newConsulConfig("127.0.0.1:8501", &api.TLSConfig{CAFile: "ca.pem", Address: "server.dc1.consul"})
+	require.Equal(t, "https", cfg.Scheme)
+	require.Equal(t, "ca.pem", cfg.TLSConfig.CAFile)
+	require.Equal(t, "server.dc1.consul", cfg.TLSConfig.Address)
+
+	// the scheme of the address is kept
+	cfg = newConsulConfig("unix:///run/consul.sock", &api.TLSConfig{CAFile: "ca.pem"})
+	require.Empty(t, cfg.Scheme)
+}
+
+func TestValidateConsulTLS(t *testing.T) {
+	require.NoError(t, validateConsulTLS(&api.TLSConfig{}))
+	require.NoError(t, validateConsulTLS(&api.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}))
+	require.Error(t, validateConsulTLS(&api.TLSConfig{CertFile: "cert.pem"}))
+	require.Error(t, validateConsulTLS(&api.TLSConfig{KeyFile: "key.pem"}))
+}
+
+func TestValidateConsulAddr(t *testing.T) {
+	require.NoError(t, validateConsulAddr("127.0.0.1:8500"))
+	require.NoError(t, validateConsulAddr("https://consul:8501"))
+	require.NoError(t, validateConsulAddr("unix:///run/consul/consul.sock"))
+	require.Error(t, validateConsulAddr("unix://consul.sock"))
+	require.Error(t, validateConsulAddr("unix://"))
+}
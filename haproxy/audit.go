@@ -0,0 +1,148 @@
+package haproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Triggers of an applied config
+const (
+	triggerConsul  = "consul"
+	triggerRetry   = "retry"
+	triggerDefer   = "deferred"
+	triggerRestart = "restart"
+	triggerCache   = "cache"
+)
+
+// auditTimeout bounds the write of an audit record, the applies are not
+// held by a slow agent
+const auditTimeout = 5 * time.Second
+
+// auditRecord describes an applied config
+type auditRecord struct {
+	Service   string    `json:"service"`
+	ServiceID string    `json:"service_id"`
+	At        time.Time `json:"at"`
+	// Method is reload, runtime or dataplane
+	Method string `json:"method"`
+	// Trigger is what caused the apply: consul, retry, deferred, restart
+	// or cache
+	Trigger    string `json:"trigger"`
+	ConfigHash string `json:"config_hash"`
+	Upstreams  int    `json:"upstreams"`
+	Nodes      int    `json:"nodes"`
+	// Applies is the number of configs applied since the start
+	Applies int `json:"applies"`
+}
+
+// auditor records the applied configs in the Consul KV store or as Consul
+// events, to audit the reloads of a fleet of sidecars
+type auditor struct {
+	client    *api.Client
+	kvPrefix  string
+	eventName string
+	applies   int
+}
+
+func newAuditor(client *api.Client, kvPrefix, eventName string) *auditor {
+	if client == nil || (kvPrefix == "" && eventName == "") {
+		return nil
+	}
+	return &auditor{
+		client:    client,
+		kvPrefix:  kvPrefix,
+		eventName: eventName,
+	}
+}
+
+// record writes the record of an applied config in the background, a
+// failure is only logged
+func (a *auditor) record(s state.State, cfg consul.Config, method, trigger string, at time.Time) {
+	if a == nil {
+		return
+	}
+	a.applies++
+	rec := newAuditRecord(s, cfg, method, trigger, at)
+	rec.Applies = a.applies
+
+	go func() {
+		err := a.write(rec)
+		if err != nil {
+			log.Warnf("cannot record the applied config: %s", err)
+		}
+	}()
+}
+
+func newAuditRecord(s state.State, cfg consul.Config, method, trigger string, at time.Time) auditRecord {
+	rec := auditRecord{
+		Service:    cfg.ServiceName,
+		ServiceID:  cfg.ServiceID,
+		At:         at.UTC(),
+		Method:     method,
+		Trigger:    trigger,
+		ConfigHash: stateHash(s),
+		Upstreams:  len(cfg.Upstreams),
+	}
+	for _, up := range cfg.Upstreams {
+		rec.Nodes += len(up.Nodes)
+	}
+	return rec
+}
+
+// stateHash identifies a state, the instances applying the same config have
+// the same hash
+func stateHash(s state.State) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// eventPayload is the record of an event, Consul limits their payload to
+// 100 bytes: <config hash> <method> <trigger> <applies>
+func (r auditRecord) eventPayload() string {
+	return fmt.Sprintf("%s %s %s %d", r.ConfigHash, r.Method, r.Trigger, r.Applies)
+}
+
+func (a *auditor) write(rec auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+
+	if a.kvPrefix != "" {
+		key := path.Join(a.kvPrefix, rec.ServiceID)
+		_, err := a.client.KV().Put(&api.KVPair{Key: key, Value: b}, opts)
+		if err != nil {
+			return fmt.Errorf("kv %s: %w", key, err)
+		}
+	}
+	if a.eventName != "" {
+		_, _, err := a.client.Event().Fire(&api.UserEvent{
+			Name:          a.eventName,
+			Payload:       []byte(rec.eventPayload()),
+			ServiceFilter: "^" + regexp.QuoteMeta(rec.Service) + "$",
+		}, opts)
+		if err != nil {
+			return fmt.Errorf("event %s: %w", a.eventName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditRecord(t *testing.T) {
+	cfg := consul.Config{
+		ServiceName: "web",
+		ServiceID:   "web-1",
+		Upstreams: []consul.Upstream{
+			{Name: "db", Nodes: []consul.UpstreamNode{{Host: "10.0.0.1", Port: 5432}, {Host: "10.0.0.2", Port: 5432}}},
+			{Name: "cache"},
+		},
+	}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := state.State{Frontends: []state.Frontend{{}}}
+
+	rec := newAuditRecord(s, cfg, "reload", triggerConsul, at)
+	require.Equal(t, "web", rec.Service)
+	require.Equal(t, "web-1", rec.ServiceID)
+	require.Equal(t, 2, rec.Upstreams)
+	require.Equal(t, 2, rec.Nodes)
+	require.Len(t, rec.ConfigHash, 16)
+
+	// the same state has the same hash on every instance
+	require.Equal(t, rec.ConfigHash, newAuditRecord(s, cfg, "runtime", triggerRetry, at).ConfigHash)
+	require.NotEqual(t, rec.ConfigHash, newAuditRecord(state.State{}, cfg, "reload", triggerConsul, at).ConfigHash)
+
+	rec.Applies = 3
+	require.Equal(t, rec.ConfigHash+" reload consul 3", rec.eventPayload())
+	require.LessOrEqual(t, len(rec.eventPayload()), 100)
+}
+
+func TestNewAuditorDisabled(t *testing.T) {
+	require.Nil(t, newAuditor(nil, "audit", "reloads"))
+
+	// a disabled auditor records nothing
+	var a *auditor
+	a.record(state.State{}, consul.Config{}, "reload", triggerConsul, time.Now())
+}
@@ -15,9 +15,13 @@ import (
 )
 
 func (h *haConfig) FilePath(content []byte) (string, error) {
+	if h.memFiles != nil {
+		return h.memFiles.path(content)
+	}
+
 	sum := sha256.Sum256(content)
 
-	path := path.Join(h.Base, hex.EncodeToString(sum[:]))
+	path := path.Join(h.Secrets, hex.EncodeToString(sum[:]))
 
 	_, err := os.Stat(path)
 	if err != nil && !os.IsNotExist(err) {
@@ -119,3 +123,42 @@ func (h *haConfig) CertsPath(t consul.TLS) (string, string, error) {
 
 	return caPath, crtPath, nil
 }
+
+// ClientTLSPath writes the client certificate and key of an upstream to a
+// single file, the files are read again each time so the renewed ones are
+// picked up by the next config
+func (h *haConfig) ClientTLSPath(t consul.ClientTLS) (string, string, error) {
+	cert, err := os.ReadFile(t.CertFile)
+	if err != nil {
+		return "", "", fmt.Errorf("client certificate: %w", err)
+	}
+	key, err := os.ReadFile(t.KeyFile)
+	if err != nil {
+		return "", "", fmt.Errorf("client certificate key: %w", err)
+	}
+
+	crt := append([]byte{}, cert...)
+	// files written by hand may lack the final newline separating the PEM
+	// blocks
+	if len(crt) > 0 && crt[len(crt)-1] != '\n' {
+		crt = append(crt, '\n')
+	}
+	crt = append(crt, key...)
+	crtPath, err := h.FilePath(crt)
+	if err != nil {
+		return "", "", err
+	}
+
+	if t.CAFile == "" {
+		return "", crtPath, nil
+	}
+	ca, err := os.ReadFile(t.CAFile)
+	if err != nil {
+		return "", "", fmt.Errorf("client certificate CA: %w", err)
+	}
+	caPath, err := h.FilePath(ca)
+	if err != nil {
+		return "", "", err
+	}
+	return caPath, crtPath, nil
+}
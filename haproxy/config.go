@@ -3,6 +3,7 @@ package haproxy
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"os"
 	"path"
 	"text/template"
@@ -29,7 +30,11 @@ defaults
 	{{- end }}
 	{{- end }}
 
-`
+{{if .DataplaneUser -}}
+userlist controller
+	user {{.DataplaneUser}} insecure-password {{.DataplanePass}}
+
+{{end}}`
 
 const spoeConfTmpl = `
 [intentions]
@@ -38,6 +43,7 @@ spoe-agent intentions-agent
 	messages check-intentions
 
 	option var-prefix connect
+	option set-on-error error
 
 	timeout hello      3000ms
 	timeout idle       3000s
@@ -46,27 +52,82 @@ spoe-agent intentions-agent
 	use-backend spoe_back
 
 spoe-message check-intentions
-	args ip=src cert=ssl_c_der
+	args ip=src cert=ssl_c_der fe=fe_name
 	event on-frontend-tcp-request
 
+[mirror]
+
+spoe-agent mirror-agent
+	groups mirror
+
+	option var-prefix mirror
+
+	timeout hello      3000ms
+	timeout idle       3000s
+	timeout processing 500ms
+
+	use-backend spoe_back
+
+spoe-group mirror
+	messages mirror
+
+spoe-message mirror
+	args upstream=var(txn.connect_mirror) method=method path=url ver=req.ver headers=req.hdrs_bin body=req.body
+
+[jwt]
+
+spoe-agent jwt-agent
+	groups jwt
+
+	option var-prefix jwt
+
+	timeout hello      3000ms
+	timeout idle       3000s
+	timeout processing 3000ms
+
+	use-backend spoe_back
+
+spoe-group jwt
+	messages check-jwt
+
+spoe-message check-jwt
+	args authorization=req.hdr(authorization)
+
 `
 
 type baseParams struct {
 	SocketPath    string
 	HAProxyParams utils.HAProxyParams
+	DataplaneUser string
+	DataplanePass string
 }
 
 type haConfig struct {
 	Base             string
 	HAProxy          string
 	SPOE             string
-	SPOESock         string
+	SPOESocks        []string
 	StatsSock        string
 	MasterSocketPath string
 	LogsSock         string
+	// Chroot is the chroot of the HAProxy workers, SharedGID their group
+	// or -1 when they keep the current user
+	Chroot    string
+	SharedGID int
+	// Secrets holds the certificates and their private keys, it is Base
+	// unless a secrets dir is given. They are kept in memFiles instead
+	// when set.
+	Secrets  string
+	memFiles *memFiles
+
+	// Data Plane API settings, only set when running under the API
+	DataplaneSock           string
+	DataplaneTransactionDir string
+	DataplaneUser           string
+	DataplanePass           string
 }
 
-func newHaConfig(baseDir string, params utils.HAProxyParams, sd *lib.Shutdown) (*haConfig, error) {
+func newHaConfig(baseDir, secretsDir string, params utils.HAProxyParams, dataplane bool, spoeListeners int, sd *lib.Shutdown) (*haConfig, error) {
 	cfg := &haConfig{}
 
 	sd.Add(1)
@@ -75,22 +136,57 @@ func newHaConfig(baseDir string, params utils.HAProxyParams, sd *lib.Shutdown) (
 		sd.Done()
 		return nil, err
 	}
+	secrets := base
+	if secretsDir != "" {
+		// named after the config dir for the cleanup subcommand
+		secrets = path.Join(secretsDir, path.Base(base))
+		err = os.Mkdir(secrets, 0700)
+		if err != nil {
+			os.RemoveAll(base)
+			sd.Done()
+			return nil, err
+		}
+	}
 	go func() {
 		defer sd.Done()
 		<-sd.Stop
 		log.Info("cleaning config...")
+		shredDir(secrets)
+		os.RemoveAll(secrets)
 		os.RemoveAll(base)
 	}()
 
 	cfg.Base = base
+	cfg.Secrets = secrets
+	err = cfg.setPrivileges(params)
+	if err != nil {
+		return nil, err
+	}
 
 	cfg.HAProxy = path.Join(base, "haproxy.conf")
 	cfg.SPOE = path.Join(base, "spoe.conf")
-	cfg.SPOESock = path.Join(base, "spoe.sock")
+	cfg.SPOESocks = []string{path.Join(base, "spoe.sock")}
+	for i := 1; i < spoeListeners; i++ {
+		cfg.SPOESocks = append(cfg.SPOESocks, path.Join(base, fmt.Sprintf("spoe-%d.sock", i)))
+	}
 	cfg.StatsSock = path.Join(base, "haproxy.sock")
+	// a unix socket on windows too, the config dir keeps the other local
+	// users away from the master CLI
 	cfg.MasterSocketPath = path.Join(base, "haproxy-master.sock")
 	cfg.LogsSock = path.Join(base, "logs.sock")
 
+	if dataplane {
+		cfg.DataplaneSock = path.Join(base, "dataplane.sock")
+		cfg.DataplaneTransactionDir = path.Join(base, "dataplane-transactions")
+		cfg.DataplaneUser = "haproxy-connect"
+		cfg.DataplanePass = createRandomString()
+
+		err = os.Mkdir(cfg.DataplaneTransactionDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	tmpl, err := template.New("cfg").Parse(baseCfgTmpl)
 	if err != nil {
 		return nil, err
@@ -110,6 +206,8 @@ func newHaConfig(baseDir string, params utils.HAProxyParams, sd *lib.Shutdown) (
 	err = tmpl.Execute(cfgFile, baseParams{
 		SocketPath:    cfg.StatsSock,
 		HAProxyParams: params,
+		DataplaneUser: cfg.DataplaneUser,
+		DataplanePass: cfg.DataplanePass,
 	})
 	if err != nil {
 		sd.Done()
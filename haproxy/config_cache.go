@@ -0,0 +1,81 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+// loadConfigCache reads the last config applied by a previous run, nil when
+// there is none or it cannot be used
+func (h *HAProxy) loadConfigCache() *consul.Config {
+	file := h.opts.ConfigCacheFile
+	if file == "" {
+		return nil
+	}
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Warnf("cannot read the cached config: %s", err)
+		return nil
+	}
+	var cfg consul.Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		log.Warnf("cannot read the cached config %s: %s", file, err)
+		return nil
+	}
+	// the public listener would fail the TLS handshakes
+	if !cfg.Downstream.NotAfter.IsZero() && cfg.Downstream.NotAfter.Before(time.Now()) {
+		log.Infof("ignoring the cached config %s, its leaf certificate expired at %s", file, cfg.Downstream.NotAfter)
+		return nil
+	}
+	// it is not the change of a Consul state
+	cfg.ChangedAt = time.Time{}
+	return &cfg
+}
+
+// saveConfigCache keeps the last applied config, it holds the private key
+// of the leaf certificate so it is only readable by the process user
+func (h *HAProxy) saveConfigCache(cfg consul.Config) {
+	file := h.opts.ConfigCacheFile
+	if file == "" {
+		return
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Warnf("cannot cache the config: %s", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		log.Warnf("cannot cache the config: %s", err)
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Warnf("cannot cache the config: %s", err)
+	}
+}
+
+// dropConfigCache removes a cached config HAProxy rejected
+func (h *HAProxy) dropConfigCache() {
+	err := os.Remove(h.opts.ConfigCacheFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("cannot remove the cached config: %s", err)
+	}
+}
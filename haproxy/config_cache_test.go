@@ -0,0 +1,109 @@
+package haproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func cachedConfig(notAfter time.Time) consul.Config {
+	return consul.Config{
+		ServiceName: "web",
+		Downstream: consul.Downstream{
+			LocalBindPort: 21000,
+			TargetPort:    8080,
+			TLS: consul.TLS{
+				Cert:     []byte("cert"),
+				Key:      []byte("key"),
+				CAs:      [][]byte{[]byte("ca")},
+				NotAfter: notAfter.UTC().Truncate(time.Second),
+			},
+		},
+		Upstreams: []consul.Upstream{{Name: "db", ServiceName: "db", LocalBindPort: 9000}},
+		ChangedAt: time.Now(),
+	}
+}
+
+func TestConfigCacheRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	h := &HAProxy{opts: utils.Options{ConfigCacheFile: file}}
+
+	require.Nil(t, h.loadConfigCache())
+
+	cfg := cachedConfig(time.Now().Add(time.Hour))
+	h.saveConfigCache(cfg)
+
+	loaded := h.loadConfigCache()
+	require.NotNil(t, loaded)
+	// the change time of the previous run is not kept
+	require.True(t, loaded.ChangedAt.IsZero())
+	cfg.ChangedAt = time.Time{}
+	require.Equal(t, cfg, *loaded)
+}
+
+func TestConfigCacheWrite(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	h := &HAProxy{opts: utils.Options{ConfigCacheFile: file}}
+
+	h.saveConfigCache(cachedConfig(time.Now().Add(time.Hour)))
+	cfg := cachedConfig(time.Now().Add(2 * time.Hour))
+	cfg.ServiceName = "api"
+	h.saveConfigCache(cfg)
+
+	// the private key is only readable by the process user
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the file is replaced, no temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "api", h.loadConfigCache().ServiceName)
+
+	// a failed write keeps the previous cache
+	h.opts.ConfigCacheFile = filepath.Join(dir, "missing", "config.json")
+	h.saveConfigCache(cfg)
+	_, err = os.Stat(h.opts.ConfigCacheFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestConfigCacheExpired(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	h := &HAProxy{opts: utils.Options{ConfigCacheFile: file}}
+
+	h.saveConfigCache(cachedConfig(time.Now().Add(-time.Minute)))
+	require.Nil(t, h.loadConfigCache())
+
+	require.NoError(t, os.WriteFile(file, []byte("{not json"), 0600))
+	require.Nil(t, h.loadConfigCache())
+}
+
+func TestConfigCacheDrop(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	h := &HAProxy{opts: utils.Options{ConfigCacheFile: file}}
+
+	h.saveConfigCache(cachedConfig(time.Now().Add(time.Hour)))
+	require.NotNil(t, h.loadConfigCache())
+
+	// a config rejected by haproxy is not applied again on the next start
+	h.dropConfigCache()
+	require.Nil(t, h.loadConfigCache())
+	_, err := os.Stat(file)
+	require.True(t, os.IsNotExist(err))
+
+	// dropping twice is fine
+	h.dropConfigCache()
+}
+
+func TestConfigCacheDisabled(t *testing.T) {
+	h := &HAProxy{}
+	h.saveConfigCache(cachedConfig(time.Now().Add(time.Hour)))
+	require.Nil(t, h.loadConfigCache())
+}
@@ -0,0 +1,319 @@
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/haproxytech/models/v2"
+)
+
+const (
+	configurationPath = "/v2/services/haproxy/configuration"
+	transactionsPath  = "/v2/services/haproxy/transactions"
+
+	requestTimeout = 30 * time.Second
+)
+
+// Dataplane is a client of the HAProxy Data Plane API listening on a unix socket
+type Dataplane struct {
+	client   *http.Client
+	userName string
+	password string
+}
+
+func New(sock, userName, password string) *Dataplane {
+	return &Dataplane{
+		client: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sock)
+				},
+			},
+		},
+		userName: userName,
+		password: password,
+	}
+}
+
+// Ping checks that the API answers
+func (d *Dataplane) Ping() error {
+	_, err := d.version()
+	return err
+}
+
+// Tnx starts a new transaction, the changes made through it are only applied
+// to HAProxy on commit
+func (d *Dataplane) Tnx() *Tnx {
+	return &Tnx{
+		client:  d,
+		indexes: map[string]int64{},
+	}
+}
+
+func (d *Dataplane) version() (int64, error) {
+	var version int64
+	err := d.makeReq(http.MethodGet, configurationPath+"/version", nil, &version)
+	return version, err
+}
+
+func (d *Dataplane) makeReq(method, path string, body, res interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, "http://dataplane"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(d.userName, d.password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dataplane: %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := models.Error{}
+		err = json.NewDecoder(resp.Body).Decode(&apiErr)
+		if err == nil && apiErr.Message != nil {
+			return fmt.Errorf("dataplane: %s %s: %d: %s", method, path, resp.StatusCode, *apiErr.Message)
+		}
+		return fmt.Errorf("dataplane: %s %s: unexpected status %d", method, path, resp.StatusCode)
+	}
+
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// get reads a list of the running configuration, the API wraps it in a data
+// field
+func (d *Dataplane) get(path string, params url.Values, res interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	wrapper := struct {
+		Data interface{} `json:"data"`
+	}{Data: res}
+	return d.makeReq(http.MethodGet, configurationPath+path+"?"+params.Encode(), nil, &wrapper)
+}
+
+// Frontends and the next methods implement state.HAProxyReader
+func (d *Dataplane) Frontends() ([]models.Frontend, error) {
+	res := []models.Frontend{}
+	err := d.get("/frontends", nil, &res)
+	return res, err
+}
+
+func (d *Dataplane) Binds(feName string) ([]models.Bind, error) {
+	res := []models.Bind{}
+	err := d.get("/binds", url.Values{"frontend": []string{feName}}, &res)
+	return res, err
+}
+
+func (d *Dataplane) Backends() ([]models.Backend, error) {
+	res := []models.Backend{}
+	err := d.get("/backends", nil, &res)
+	return res, err
+}
+
+func (d *Dataplane) Servers(beName string) ([]models.Server, error) {
+	res := []models.Server{}
+	err := d.get("/servers", url.Values{"backend": []string{beName}}, &res)
+	return res, err
+}
+
+func (d *Dataplane) Filters(parentType, parentName string) ([]models.Filter, error) {
+	res := []models.Filter{}
+	err := d.get("/filters", parentParams(parentType, parentName), &res)
+	return res, err
+}
+
+func (d *Dataplane) TCPRequestRules(parentType, parentName string) ([]models.TCPRequestRule, error) {
+	res := []models.TCPRequestRule{}
+	err := d.get("/tcp_request_rules", parentParams(parentType, parentName), &res)
+	return res, err
+}
+
+func (d *Dataplane) LogTargets(parentType, parentName string) ([]models.LogTarget, error) {
+	res := []models.LogTarget{}
+	err := d.get("/log_targets", parentParams(parentType, parentName), &res)
+	return res, err
+}
+
+func (d *Dataplane) HTTPRequestRules(parentType, parentName string) ([]models.HTTPRequestRule, error) {
+	res := []models.HTTPRequestRule{}
+	err := d.get("/http_request_rules", parentParams(parentType, parentName), &res)
+	return res, err
+}
+
+func (d *Dataplane) HTTPResponseRules(parentType, parentName string) ([]models.HTTPResponseRule, error) {
+	res := []models.HTTPResponseRule{}
+	err := d.get("/http_response_rules", parentParams(parentType, parentName), &res)
+	return res, err
+}
+
+func (d *Dataplane) BackendSwitchingRules(feName string) ([]models.BackendSwitchingRule, error) {
+	res := []models.BackendSwitchingRule{}
+	err := d.get("/backend_switching_rules", url.Values{"frontend": []string{feName}}, &res)
+	return res, err
+}
+
+// Tnx implements state.HAProxy, the transaction is lazily created on the
+// first change so that an empty Tnx is a no-op
+type Tnx struct {
+	client  *Dataplane
+	txID    string
+	indexes map[string]int64
+}
+
+func (t *Tnx) ensureTnx() error {
+	if t.txID != "" {
+		return nil
+	}
+
+	version, err := t.client.version()
+	if err != nil {
+		return err
+	}
+
+	res := models.Transaction{}
+	err = t.client.makeReq(http.MethodPost, fmt.Sprintf("%s?version=%d", transactionsPath, version), nil, &res)
+	if err != nil {
+		return err
+	}
+	t.txID = res.ID
+
+	return nil
+}
+
+func (t *Tnx) do(method, path string, params url.Values, body interface{}) error {
+	err := t.ensureTnx()
+	if err != nil {
+		return err
+	}
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("transaction_id", t.txID)
+
+	return t.client.makeReq(method, configurationPath+path+"?"+params.Encode(), body, nil)
+}
+
+// nextIndex returns the position of the next rule of a kind in a parent,
+// parents are always recreated with all their rules within a transaction
+func (t *Tnx) nextIndex(kind, parentType, parentName string) *int64 {
+	key := kind + "/" + parentType + "/" + parentName
+	i := t.indexes[key]
+	t.indexes[key] = i + 1
+	return &i
+}
+
+func parentParams(parentType, parentName string) url.Values {
+	return url.Values{
+		"parent_type": []string{parentType},
+		"parent_name": []string{parentName},
+	}
+}
+
+// Commit applies the changes, HAProxy is reloaded by the API only when needed
+func (t *Tnx) Commit() error {
+	if t.txID == "" {
+		return nil
+	}
+	err := t.client.makeReq(http.MethodPut, fmt.Sprintf("%s/%s", transactionsPath, t.txID), nil, nil)
+	t.txID = ""
+	return err
+}
+
+// Abort drops the pending changes
+func (t *Tnx) Abort() error {
+	if t.txID == "" {
+		return nil
+	}
+	err := t.client.makeReq(http.MethodDelete, fmt.Sprintf("%s/%s", transactionsPath, t.txID), nil, nil)
+	t.txID = ""
+	return err
+}
+
+func (t *Tnx) CreateFrontend(fe models.Frontend) error {
+	return t.do(http.MethodPost, "/frontends", nil, fe)
+}
+
+func (t *Tnx) DeleteFrontend(name string) error {
+	return t.do(http.MethodDelete, "/frontends/"+url.PathEscape(name), nil, nil)
+}
+
+func (t *Tnx) CreateBind(feName string, bind models.Bind) error {
+	return t.do(http.MethodPost, "/binds", url.Values{"frontend": []string{feName}}, bind)
+}
+
+func (t *Tnx) DeleteBackend(name string) error {
+	return t.do(http.MethodDelete, "/backends/"+url.PathEscape(name), nil, nil)
+}
+
+func (t *Tnx) CreateBackend(be models.Backend) error {
+	return t.do(http.MethodPost, "/backends", nil, be)
+}
+
+func (t *Tnx) CreateServer(beName string, srv models.Server) error {
+	return t.do(http.MethodPost, "/servers", url.Values{"backend": []string{beName}}, srv)
+}
+
+func (t *Tnx) ReplaceServer(beName string, srv models.Server) error {
+	return t.do(http.MethodPut, "/servers/"+url.PathEscape(srv.Name), url.Values{"backend": []string{beName}}, srv)
+}
+
+func (t *Tnx) DeleteServer(beName string, name string) error {
+	return t.do(http.MethodDelete, "/servers/"+url.PathEscape(name), url.Values{"backend": []string{beName}}, nil)
+}
+
+func (t *Tnx) CreateFilter(parentType, parentName string, filter models.Filter) error {
+	filter.Index = t.nextIndex("filters", parentType, parentName)
+	return t.do(http.MethodPost, "/filters", parentParams(parentType, parentName), filter)
+}
+
+func (t *Tnx) CreateTCPRequestRule(parentType, parentName string, rule models.TCPRequestRule) error {
+	rule.Index = t.nextIndex("tcp_request_rules", parentType, parentName)
+	return t.do(http.MethodPost, "/tcp_request_rules", parentParams(parentType, parentName), rule)
+}
+
+func (t *Tnx) CreateLogTargets(parentType, parentName string, rule models.LogTarget) error {
+	rule.Index = t.nextIndex("log_targets", parentType, parentName)
+	return t.do(http.MethodPost, "/log_targets", parentParams(parentType, parentName), rule)
+}
+
+func (t *Tnx) CreateHTTPRequestRule(parentType, parentName string, rule models.HTTPRequestRule) error {
+	rule.Index = t.nextIndex("http_request_rules", parentType, parentName)
+	return t.do(http.MethodPost, "/http_request_rules", parentParams(parentType, parentName), rule)
+}
+
+func (t *Tnx) CreateHTTPResponseRule(parentType, parentName string, rule models.HTTPResponseRule) error {
+	rule.Index = t.nextIndex("http_response_rules", parentType, parentName)
+	return t.do(http.MethodPost, "/http_response_rules", parentParams(parentType, parentName), rule)
+}
+
+func (t *Tnx) CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error {
+	rule.Index = t.nextIndex("backend_switching_rules", "frontend", feName)
+	return t.do(http.MethodPost, "/backend_switching_rules", url.Values{"frontend": []string{feName}}, rule)
+}
@@ -3,14 +3,23 @@ package haproxy
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/dataplane"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/haproxy_cmd"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/hooks"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/masterclient"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/renderer"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/stats"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/writer"
 	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/tracing"
 	"github.com/haproxytech/haproxy-consul-connect/utils"
 	"github.com/hashicorp/consul/api"
 	"github.com/negasus/haproxy-spoe-go/agent"
@@ -23,16 +32,48 @@ type HAProxy struct {
 	opts         utils.Options
 	renderer     *renderer.Renderer
 	configWriter *writer.ConfigWriter
+	history      *writer.History
 	statsSocket  *stats.StatsSocket
-	masterPID    int
+	dataplane    *dataplane.Dataplane
+	hooks        *hooks.Hooks
+	master       *haproxy_cmd.Master
+	masterClient *masterclient.Client
 	consulClient *api.Client
 
 	cfgC chan consul.Config
 
-	currentConsulConfig *consul.Config
-	currentHAProxyState state.State
+	// currentConsulConfig is the last config received, read by the stats
+	// server and the SPOE agent
+	currentConsulConfig     *consul.Config
+	currentConsulConfigLock sync.RWMutex
+	currentHAProxyState     state.State
 
 	haConfig *haConfig
+	// logMeta is set when the upstream access logs are enriched
+	logMeta *upstreamLogMeta
+	// loggerStarted is set once the syslog server receiving the HAProxy
+	// logs runs
+	loggerStarted bool
+	// spoaStarted is set once the SPOE agent runs
+	spoaStarted bool
+	// deferredSince is when the pending weight change was first deferred
+	deferredSince time.Time
+	// restarted is signaled when the supervised HAProxy was restarted
+	restarted chan struct{}
+	// reloadRate warns about frequent reloads
+	reloadRate reloadRate
+	// lastReload is when the config was last reloaded, coalescing is set
+	// while changes wait for the minimum interval between reloads
+	lastReload time.Time
+	coalescing bool
+	// lastApply is when a config was last applied, read by the stats server
+	lastApply     time.Time
+	lastApplyLock sync.RWMutex
+	// audit records the applied configs in Consul when enabled
+	audit *auditor
+	// dataplaneWarned are the warnings logged for the config last applied
+	// through the Data Plane API
+	dataplaneWarned map[string]bool
 
 	Ready chan struct{}
 }
@@ -41,67 +82,145 @@ func New(consulClient *api.Client, cfg chan consul.Config, opts utils.Options) *
 	if opts.HAProxyBin == "" {
 		opts.HAProxyBin = haproxy_cmd.DefaultHAProxyBin
 	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.Nop{}
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = tracing.Nop{}
+	}
 	return &HAProxy{
 		opts:         opts,
 		consulClient: consulClient,
 		cfgC:         cfg,
-		Ready:        make(chan struct{}),
+		hooks: hooks.New(hooks.Config{
+			Exec: opts.UpstreamHookExec,
+			URL:  opts.UpstreamHookURL,
+		}),
+		audit:      newAuditor(consulClient, opts.AuditKVPrefix, opts.AuditEvent),
+		restarted:  make(chan struct{}, 1),
+		reloadRate: reloadRate{limit: opts.ReloadWarnRate},
+		Ready:      make(chan struct{}),
 	}
 }
 
 func (h *HAProxy) Run(sd *lib.Shutdown) error {
-	hc, err := newHaConfig(h.opts.ConfigBaseDir, h.opts.HAProxyParams, sd)
+	hc, err := newHaConfig(h.opts.ConfigBaseDir, h.opts.SecretsDir, h.opts.HAProxyParams, h.opts.DataplaneBin != "", h.opts.SPOEListeners, sd)
 	if err != nil {
 		return err
 	}
+	if h.opts.NoCertFiles {
+		hc.memFiles = newMemFiles()
+	} else {
+		checkSecretsDir(hc.Secrets)
+	}
 	h.haConfig = hc
+	h.opts.Artifacts.Add(lib.PathArtifact("config directory", hc.Base))
+	if hc.Secrets != hc.Base {
+		h.opts.Artifacts.Add(lib.PathArtifact("secrets directory", hc.Secrets))
+	}
 
 	return h.watch(sd)
 }
 
 func (h *HAProxy) start(sd *lib.Shutdown) error {
-	if h.opts.LogRequests {
+	var err error
+	h.renderer, err = newRenderer(h.opts)
+	if err != nil {
+		return lib.NewExitError(lib.ExitConfig, err)
+	}
+
+	if h.opts.LogUpstreamMeta {
+		h.logMeta = &upstreamLogMeta{}
+	}
+
+	if h.opts.LogRequests || h.opts.LogIdentity || h.opts.LogUpstreamMeta {
 		err := h.startLogger()
 		if err != nil {
 			return err
 		}
 	}
 
-	if h.opts.EnableIntentions {
+	if h.opts.SPOE() {
 		err := h.startSPOA()
 		if err != nil {
 			return err
 		}
 	}
 
-	var err error
-	h.masterPID, err = haproxy_cmd.Start(sd, haproxy_cmd.Config{
+	haCfg := haproxy_cmd.Config{
 		HAProxyPath:       h.opts.HAProxyBin,
 		HAProxyConfigPath: h.haConfig.HAProxy,
 		MasterRuntime:     h.haConfig.MasterSocketPath,
-	})
+	}
+	if h.opts.HAProxyRestart {
+		h.master, err = haproxy_cmd.Supervise(sd, haCfg, h.haproxyRestarted)
+	} else {
+		h.master, err = haproxy_cmd.Start(sd, haCfg)
+	}
 	if err != nil {
-		return err
+		return lib.NewExitError(lib.ExitHAProxySpawn, err)
 	}
 
-	// Initialize renderer
-	h.renderer = renderer.New()
+	if h.opts.DataplaneBin != "" {
+		h.dataplane, err = haproxy_cmd.StartDataplane(sd, haproxy_cmd.Config{
+			HAProxyPath:             h.opts.HAProxyBin,
+			HAProxyConfigPath:       h.haConfig.HAProxy,
+			DataplanePath:           h.opts.DataplaneBin,
+			DataplaneTransactionDir: h.haConfig.DataplaneTransactionDir,
+			DataplaneSock:           h.haConfig.DataplaneSock,
+			DataplaneUser:           h.haConfig.DataplaneUser,
+			DataplanePass:           h.haConfig.DataplanePass,
+		}, h.master.PID())
+		if err != nil {
+			return lib.NewExitError(lib.ExitHAProxySpawn, err)
+		}
+	}
 
 	// Initialize config writer
-	h.configWriter = writer.New(h.haConfig.HAProxy, h.opts.HAProxyBin, h.masterPID)
+	h.masterClient = masterclient.New(h.haConfig.MasterSocketPath)
+	h.configWriter = writer.New(h.haConfig.HAProxy, h.opts.HAProxyBin, h.masterClient, h.master.PID)
+
+	if h.opts.ConfigHistory > 0 {
+		dir := h.opts.ConfigHistoryDir
+		if dir == "" {
+			dir = path.Join(h.haConfig.Base, "history")
+		}
+		h.history, err = writer.NewHistory(dir, h.opts.ConfigHistory)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Initialize stats socket
 	h.statsSocket = stats.NewStatsSocket(h.haConfig.StatsSock)
 
-	err = h.startStats()
+	err = h.startStats(sd)
 	if err != nil {
 		log.Error(err)
 	}
 
+	if h.opts.TTLCheckID != "" && h.consulClient != nil {
+		go h.runTTLCheck(sd)
+	}
+
 	return nil
 }
 
+// haproxyRestarted has the state applied again to the restarted HAProxy, it
+// runs with the last config written but without the changes applied at
+// runtime since
+func (h *HAProxy) haproxyRestarted(pid int) {
+	h.opts.Metrics.IncrCounter("connect_haproxy_restarts_total", 1, nil)
+	select {
+	case h.restarted <- struct{}{}:
+	default:
+	}
+}
+
 func (h *HAProxy) startLogger() error {
+	if h.loggerStarted {
+		return nil
+	}
 	channel := make(syslog.LogPartsChannel)
 	handler := syslog.NewChannelHandler(channel)
 
@@ -112,6 +231,10 @@ func (h *HAProxy) startLogger() error {
 	if err != nil {
 		return fmt.Errorf("error starting syslog logger: %s", err)
 	}
+	err = h.haConfig.share(h.haConfig.LogsSock, 0660)
+	if err != nil {
+		return fmt.Errorf("error starting syslog logger: %s", err)
+	}
 	err = server.Boot()
 	if err != nil {
 		return fmt.Errorf("error starting syslog logger: %s", err)
@@ -119,51 +242,110 @@ func (h *HAProxy) startLogger() error {
 
 	go func(channel syslog.LogPartsChannel) {
 		for logParts := range channel {
-			log.Infof("%s: %s", logParts["app_name"], logParts["message"])
+			msg, _ := logParts["message"].(string)
+			if h.logMeta != nil {
+				msg = h.logMeta.enrich(msg)
+			}
+			log.Infof("%s: %s", logParts["app_name"], msg)
 		}
 	}(channel)
 
+	h.loggerStarted = true
 	return nil
 }
 
 func (h *HAProxy) startSPOA() error {
-	handler := NewSPOEHandler(h.consulClient, func() consul.Config {
-		return *h.currentConsulConfig
-	})
+	if h.spoaStarted {
+		return nil
+	}
+	spoeOpts := SPOEOptions{
+		Authorize:    h.opts.EnableIntentions,
+		FailOpen:     h.opts.IntentionsFailOpen,
+		AuditLog:     h.opts.IntentionsAuditLog,
+		AuditMetrics: h.opts.IntentionsMetrics,
+	}
+	if h.opts.JWTJWKSURL != "" {
+		spoeOpts.JWT = &JWTOptions{
+			JWKSURL:   h.opts.JWTJWKSURL,
+			Issuer:    h.opts.JWTIssuer,
+			Audiences: h.opts.JWTAudiences,
+			Claims:    h.opts.JWTClaims,
+		}
+	}
+	handler := NewSPOEHandler(h.consulClient, h.opts.Metrics, spoeOpts, h.consulConfig)
 
 	spoeAgent := agent.New(handler.Handler, logger.NewDefaultLog())
 
-	lis, err := net.Listen("unix", h.haConfig.SPOESock)
-	if err != nil {
-		log.Fatal("error starting spoe agent:", err)
-	}
-
-	go func() {
-		err = spoeAgent.Serve(lis)
+	// the frames of a stalled listener are retried by HAProxy on the others
+	for _, sock := range h.haConfig.SPOESocks {
+		lis, err := net.Listen("unix", sock)
 		if err != nil {
 			log.Fatal("error starting spoe agent:", err)
 		}
-	}()
+		err = h.haConfig.share(sock, 0660)
+		if err != nil {
+			log.Fatal("error starting spoe agent:", err)
+		}
+
+		go func() {
+			err := spoeAgent.Serve(lis)
+			if err != nil {
+				log.Fatal("error starting spoe agent:", err)
+			}
+		}()
+	}
 
+	h.spoaStarted = true
 	return nil
 }
 
-func (h *HAProxy) startStats() error {
-	if h.opts.StatsListenAddr == "" {
+func (h *HAProxy) startStats(sd *lib.Shutdown) error {
+	// samples pushed to a collector are polled even without stats server
+	_, scraped := h.opts.Metrics.(http.Handler)
+	if h.opts.StatsListenAddr == "" && (scraped || h.opts.Metrics == (metrics.Nop{})) {
 		return nil
 	}
 
+	cfg := h.consulConfig()
 	s := stats.New(
 		h.consulClient,
 		h.statsSocket,
 		h.Ready,
 		stats.Config{
-			RegisterService: h.opts.StatsRegisterService,
-			ListenAddr:      h.opts.StatsListenAddr,
-			ServiceName:     h.currentConsulConfig.ServiceName,
-			ServiceID:       h.currentConsulConfig.ServiceID,
+			RegisterService:  h.opts.StatsRegisterService,
+			ExportMeta:       h.opts.StatsExportMeta,
+			ListenAddr:       h.opts.StatsListenAddr,
+			AdminToken:       h.opts.AdminToken,
+			EnableIntentions: h.opts.EnableIntentions,
+			BasicAuth:        h.opts.StatsBasicAuth,
+			Token:            h.opts.StatsToken,
+			TLSCertFile:      h.opts.StatsTLSCertFile,
+			TLSKeyFile:       h.opts.StatsTLSKeyFile,
+			TLSConnect:       h.opts.StatsTLSConnect,
+			StatsPagePort:    h.opts.StatsPagePort,
+			Metrics:          h.opts.Metrics,
+			ServiceName:      cfg.ServiceName,
+			ServiceID:        cfg.ServiceID,
+			ConsulConfig:     h.consulConfig,
+			Pinner:           h.opts.UpstreamPinner,
+			LastApply:        h.lastApplied,
+			MasterPID:        h.master.PID,
+			Master:           h.masterClient,
 		})
 
+	if h.opts.StatsRegisterService && h.consulClient != nil {
+		id := stats.ServiceID(cfg.ServiceID)
+		h.opts.Artifacts.Add(consul.ServiceArtifact(h.consulClient, "stats service", id))
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			<-sd.Stop
+			if err := s.Deregister(); err != nil {
+				log.Errorf("cannot deregister stats service %s: %s", id, err)
+			}
+		}()
+	}
+
 	go func() {
 		err := s.Run()
 		if err != nil {
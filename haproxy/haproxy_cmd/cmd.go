@@ -6,7 +6,6 @@ import (
 	"os/exec"
 	"path"
 	"sync/atomic"
-	"syscall"
 
 	"github.com/haproxytech/haproxy-consul-connect/lib"
 	log "github.com/sirupsen/logrus"
@@ -14,7 +13,17 @@ import (
 
 type Logger func(io.Reader)
 
+// runCommand starts a command, the program shuts down if it exits
 func runCommand(sd *lib.Shutdown, logger Logger, cmdPath string, args ...string) (*exec.Cmd, error) {
+	_, file := path.Split(cmdPath)
+	return startCommand(sd, logger, func(int) {
+		sd.ShutdownWithError(fmt.Errorf("%s exited", file))
+	}, cmdPath, args...)
+}
+
+// startCommand starts a command killed on shutdown, onExit is called with its
+// pid if it exits before
+func startCommand(sd *lib.Shutdown, logger Logger, onExit func(pid int), cmdPath string, args ...string) (*exec.Cmd, error) {
 	_, file := path.Split(cmdPath)
 	cmd := exec.Command(cmdPath, args...)
 
@@ -49,15 +58,20 @@ func runCommand(sd *lib.Shutdown, logger Logger, cmdPath string, args ...string)
 		} else {
 			log.Errorf("%s exited", file)
 		}
-		sd.Shutdown(fmt.Sprintf("%s exited", file))
+		select {
+		case <-sd.Stop:
+			// killed on shutdown
+		default:
+			onExit(cmd.Process.Pid)
+		}
 	}()
 	go func() {
 		<-sd.Stop
 		if atomic.LoadUint32(&exited) > 0 {
 			return
 		}
-		log.Infof("killing %s with sig %d", file, syscall.SIGTERM)
-		err := syscall.Kill(cmd.Process.Pid, syscall.SIGTERM)
+		log.Infof("terminating %s", file)
+		err := lib.Terminate(cmd.Process.Pid)
 		if err != nil {
 			log.Errorf("could not kill %s: %s", file, err)
 		}
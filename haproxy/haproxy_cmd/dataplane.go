@@ -0,0 +1,63 @@
+package haproxy_cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/dataplane"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/halog"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dataplaneReadyTimeout is the maximum time to wait for the API to answer
+	dataplaneReadyTimeout = 30 * time.Second
+	dataplanePollInterval = 100 * time.Millisecond
+)
+
+// StartDataplane runs the Data Plane API against the HAProxy started with
+// the same config, the API reloads HAProxy by signaling its master process
+func StartDataplane(sd *lib.Shutdown, cfg Config, masterPID int) (*dataplane.Dataplane, error) {
+	logLevel := cfg.DataplaneLogLevel
+	if logLevel == "" {
+		logLevel = "warning"
+	}
+
+	_, err := runCommand(sd, func(r io.Reader) { halog.New(r) },
+		cfg.DataplanePath,
+		"--scheme", "unix",
+		"--socket-path", cfg.DataplaneSock,
+		"--haproxy-bin", cfg.HAProxyPath,
+		"--config-file", cfg.HAProxyConfigPath,
+		"--reload-cmd", fmt.Sprintf("kill -SIGUSR2 %d", masterPID),
+		"--restart-cmd", fmt.Sprintf("kill -SIGUSR2 %d", masterPID),
+		"--reload-delay", "1",
+		"--userlist", "controller",
+		"--transaction-dir", cfg.DataplaneTransactionDir,
+		"--log-level", logLevel,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	dp := dataplane.New(cfg.DataplaneSock, cfg.DataplaneUser, cfg.DataplanePass)
+
+	timeout := time.After(dataplaneReadyTimeout)
+	for {
+		err = dp.Ping()
+		if err == nil {
+			log.Debug("Data Plane API is ready to receive transactions")
+			return dp, nil
+		}
+
+		select {
+		case <-time.After(dataplanePollInterval):
+		case <-timeout:
+			return nil, fmt.Errorf("timeout waiting for the Data Plane API to be ready (waited %s): %w", dataplaneReadyTimeout, err)
+		case <-sd.Stop:
+			return nil, fmt.Errorf("shutdown requested while waiting for the Data Plane API to be ready")
+		}
+	}
+}
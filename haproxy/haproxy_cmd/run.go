@@ -3,7 +3,9 @@ package haproxy_cmd
 import (
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -26,9 +28,28 @@ type Config struct {
 	HAProxyPath       string
 	HAProxyConfigPath string
 	MasterRuntime     string
+
+	DataplanePath           string
+	DataplaneTransactionDir string
+	DataplaneSock           string
+	DataplaneUser           string
+	DataplanePass           string
+	DataplaneLogLevel       string
+}
+
+// Start runs the HAProxy master process and waits for it to be ready, the
+// program shuts down if it exits
+func Start(sd *lib.Shutdown, cfg Config) (*Master, error) {
+	pid, err := startHAProxy(sd, cfg, func(int) {
+		sd.ShutdownWithError(fmt.Errorf("%s exited", filepath.Base(cfg.HAProxyPath)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Master{pid: int64(pid)}, nil
 }
 
-func Start(sd *lib.Shutdown, cfg Config) (int, error) {
+func startHAProxy(sd *lib.Shutdown, cfg Config, onExit func(pid int)) (int, error) {
 	// Create a buffered channel to signal when HAProxy is ready
 	// Buffered to allow non-blocking sends from multiple log readers
 	readyCh := make(chan struct{}, 1)
@@ -38,7 +59,7 @@ func Start(sd *lib.Shutdown, cfg Config) (int, error) {
 		halog.NewWithReadySignal(r, readyCh)
 	}
 
-	haCmd, err := runCommand(sd, logger,
+	haCmd, err := startCommand(sd, logger, onExit,
 		cfg.HAProxyPath,
 		"-W",
 		"-S", cfg.MasterRuntime,
@@ -59,6 +80,7 @@ func Start(sd *lib.Shutdown, cfg Config) (int, error) {
 	case <-readyCh:
 		log.Debug("HAProxy is ready to receive configuration updates")
 	case <-time.After(haproxyReadyTimeout):
+		haCmd.Process.Kill()
 		return 0, fmt.Errorf("timeout waiting for HAProxy to be ready (waited %s)", haproxyReadyTimeout)
 	case <-sd.Stop:
 		return 0, fmt.Errorf("shutdown requested while waiting for HAProxy to be ready")
@@ -67,26 +89,94 @@ func Start(sd *lib.Shutdown, cfg Config) (int, error) {
 	return haCmd.Process.Pid, nil
 }
 
+var (
+	// haproxyVersionRe matches the version line of vanilla and vendor builds, eg:
+	// "HA-Proxy version 2.0.33-0ubuntu0.1", "HAProxy version 2.6.12-1ubuntu1 2023/02/14"
+	// or "HAProxy Enterprise version 2.6.0-1.0.0"
+	haproxyVersionRe = regexp.MustCompile(`(?i)ha-?proxy(?:\s+[a-z]+)*\s+version\s+v?(\d+\.\d+(?:\.\d+)?)`)
+	anyVersionRe     = regexp.MustCompile(`\d+(\.\d+)+`)
+)
+
+// CheckOptions allows checking an haproxy that is not directly a host binary
+type CheckOptions struct {
+	// Argv is the command used to run haproxy, defaults to the haproxy binary.
+	// It allows checking a wrapped haproxy, eg: `docker exec lb haproxy`
+	Argv []string
+	// Path overrides the PATH used to find the command
+	Path string
+}
+
+func (o CheckOptions) command(haproxyBin string, args ...string) (*exec.Cmd, error) {
+	argv := o.Argv
+	if len(argv) == 0 {
+		argv = []string{haproxyBin}
+	}
+
+	bin := argv[0]
+	if o.Path != "" && !strings.Contains(bin, "/") {
+		var err error
+		bin, err = lookPathIn(bin, o.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command(bin, append(argv[1:len(argv):len(argv)], args...)...)
+	if o.Path != "" {
+		cmd.Env = append(os.Environ(), "PATH="+o.Path)
+	}
+	return cmd, nil
+}
+
+// lookPathIn works like exec.LookPath with the given PATH value
+func lookPathIn(file, path string) (string, error) {
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, file)
+		fi, err := os.Stat(p)
+		if err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in %s", file, path)
+}
+
 // getVersion Launch Help from program path and Find Version
 // to capture the output and retrieve version information
-func getVersion(path string) (string, error) {
-	cmd := exec.Command(path, "-v")
+func getVersion(path string, opts CheckOptions) (string, error) {
+	cmd, err := opts.command(path, "-v")
+	if err != nil {
+		return "", fmt.Errorf("Failed executing %s: %s", path, err.Error())
+	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("Failed executing %s: %s", path, err.Error())
 	}
-	re := regexp.MustCompile("\\d+(\\.\\d+)+")
-	return string(re.Find(out)), nil
+	return parseVersion(out)
+}
+
+// parseVersion extracts the haproxy version from `haproxy -v` output, falling
+// back to the first version looking string for unknown formats
+func parseVersion(out []byte) (string, error) {
+	if m := haproxyVersionRe.FindSubmatch(out); m != nil {
+		return string(m[1]), nil
+	}
+	if v := anyVersionRe.Find(out); v != nil {
+		return string(v), nil
+	}
+	return "", fmt.Errorf("no version found in output: %s", strings.TrimSpace(string(out)))
 }
 
 // CheckEnvironment Verifies that all dependencies are correct
-func CheckEnvironment(haproxyBin string) error {
+func CheckEnvironment(haproxyBin string, opts CheckOptions) error {
 	var err error
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	ensureVersion := func(path, minVer string, maxVer string) {
 		defer wg.Done()
-		currVer, e := getVersion(path)
+		currVer, e := getVersion(path, opts)
 		if e != nil {
 			err = e
 			return
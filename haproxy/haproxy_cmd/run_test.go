@@ -33,3 +33,22 @@ func TestCompareVersion(t *testing.T) {
 		require.Equal(t, res, test.status)
 	}
 }
+
+func TestParseVersion(t *testing.T) {
+	tests := map[string]string{
+		"HA-Proxy version 2.0.33-0ubuntu0.1 2023/06/02 - https://haproxy.org/": "2.0.33",
+		"HAProxy version 2.6.12-1ubuntu1 2023/04/03 - https://haproxy.org/\n":  "2.6.12",
+		"HAProxy version 2.8.3-86e043a 2023/09/07 - https://haproxy.org/":      "2.8.3",
+		"HAProxy Enterprise version 2.6.0-1.0.0-284.693 2023/04/24":            "2.6.0",
+		"Status: long-term supported branch\nHAProxy version 3.0.5":            "3.0.5",
+		"2.4.22": "2.4.22",
+	}
+	for out, expected := range tests {
+		v, err := parseVersion([]byte(out))
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+
+	_, err := parseVersion([]byte("command not found"))
+	require.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package haproxy_cmd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = 30 * time.Second
+	// restartStable is how long HAProxy must run after a restart for the
+	// backoff to be reset
+	restartStable = time.Minute
+)
+
+// Master is a running HAProxy master process
+type Master struct {
+	sd        *lib.Shutdown
+	cfg       Config
+	onRestart func(pid int)
+
+	pid    int64
+	exited chan int
+}
+
+// Supervise runs the HAProxy master process like Start but restarts it with
+// an exponential backoff instead of shutting down when it exits. It is
+// restarted with the config on disk, which is the last one that passed
+// validation, and onRestart is called with the new pid once it is ready.
+func Supervise(sd *lib.Shutdown, cfg Config, onRestart func(pid int)) (*Master, error) {
+	m := &Master{
+		sd:        sd,
+		cfg:       cfg,
+		onRestart: onRestart,
+		exited:    make(chan int, 1),
+	}
+
+	pid, err := m.start()
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&m.pid, int64(pid))
+
+	go m.supervise()
+	return m, nil
+}
+
+// PID returns the pid of the current master process, it changes when a
+// supervised process is restarted
+func (m *Master) PID() int {
+	return int(atomic.LoadInt64(&m.pid))
+}
+
+func (m *Master) start() (int, error) {
+	return startHAProxy(m.sd, m.cfg, func(pid int) {
+		select {
+		case m.exited <- pid:
+		default:
+		}
+	})
+}
+
+func (m *Master) supervise() {
+	backoff := restartBackoffMin
+	started := time.Now()
+
+	for {
+		select {
+		case pid := <-m.exited:
+			// a process killed after failing to start
+			if pid != m.PID() {
+				continue
+			}
+		case <-m.sd.Stop:
+			return
+		}
+
+		if time.Since(started) >= restartStable {
+			backoff = restartBackoffMin
+		}
+		log.Errorf("haproxy master process %d exited unexpectedly", m.PID())
+
+		for {
+			log.Infof("restarting haproxy in %s", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-m.sd.Stop:
+				return
+			}
+			backoff = nextBackoff(backoff)
+
+			pid, err := m.start()
+			if err != nil {
+				log.Errorf("cannot restart haproxy: %s", err)
+				continue
+			}
+			atomic.StoreInt64(&m.pid, int64(pid))
+			started = time.Now()
+			log.Infof("haproxy restarted, master pid %d", pid)
+			if m.onRestart != nil {
+				m.onRestart(pid)
+			}
+			break
+		}
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > restartBackoffMax {
+		return restartBackoffMax
+	}
+	return backoff
+}
@@ -0,0 +1,26 @@
+package haproxy_cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextBackoff(t *testing.T) {
+	backoff := restartBackoffMin
+	var backoffs []time.Duration
+	for i := 0; i < 7; i++ {
+		backoff = nextBackoff(backoff)
+		backoffs = append(backoffs, backoff)
+	}
+	require.Equal(t, []time.Duration{
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}, backoffs)
+}
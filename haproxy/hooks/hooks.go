@@ -0,0 +1,208 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventUpstreamDown      = "upstream_down"
+	EventUpstreamRecovered = "upstream_recovered"
+
+	defaultTimeout = 10 * time.Second
+	// queueSize is the number of events waiting for the hooks of the
+	// previous ones to finish
+	queueSize = 64
+)
+
+type Config struct {
+	// Exec is a command run for each event, the event is passed as JSON on stdin
+	Exec string
+	// URL is an endpoint the event is POSTed to as JSON
+	URL     string
+	Timeout time.Duration
+}
+
+type Node struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Weight int    `json:"weight"`
+}
+
+type Event struct {
+	Event       string    `json:"event"`
+	Service     string    `json:"service"`
+	ServiceID   string    `json:"service_id"`
+	Upstream    string    `json:"upstream"`
+	Destination string    `json:"destination"`
+	Nodes       []Node    `json:"nodes"`
+	At          time.Time `json:"at"`
+}
+
+type Hooks struct {
+	cfg    Config
+	client *http.Client
+	// events are fired one at a time, in order, so that the last hook run
+	// for an upstream is its current state
+	events chan Event
+
+	healthy map[string]bool
+	// nodes are the last healthy nodes of each upstream, sent with the
+	// down events
+	nodes map[string][]Node
+}
+
+func New(cfg Config) *Hooks {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	h := &Hooks{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		events:  make(chan Event, queueSize),
+		healthy: map[string]bool{},
+		nodes:   map[string][]Node{},
+	}
+	if cfg.Exec != "" || cfg.URL != "" {
+		go h.run()
+	}
+	return h
+}
+
+func (h *Hooks) run() {
+	for ev := range h.events {
+		h.fire(ev)
+	}
+}
+
+// Update compares the healthy nodes of each upstream with the previous
+// configuration and fires the hooks for upstreams that lost all their
+// nodes or got some back. The draining nodes are not healthy.
+// Upstreams are considered healthy until seen otherwise so that a sidecar
+// starting with a dead upstream still reports it.
+func (h *Hooks) Update(cfg consul.Config) {
+	if h.cfg.Exec == "" && h.cfg.URL == "" {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, up := range cfg.Upstreams {
+		seen[up.Name] = true
+
+		// the instances in maintenance get no new connections
+		nodes := []Node{}
+		for _, n := range up.ServingNodes() {
+			nodes = append(nodes, Node{
+				Host:   n.Host,
+				Port:   n.Port,
+				Weight: n.Weight,
+			})
+		}
+		healthy := len(nodes) > 0
+		was, known := h.healthy[up.Name]
+		h.healthy[up.Name] = healthy
+		lastNodes := h.nodes[up.Name]
+		if healthy {
+			h.nodes[up.Name] = nodes
+		}
+		if known && was == healthy || !known && healthy {
+			continue
+		}
+
+		ev := Event{
+			Event:       EventUpstreamDown,
+			Service:     cfg.ServiceName,
+			ServiceID:   cfg.ServiceID,
+			Upstream:    up.Name,
+			Destination: up.ServiceName,
+			Nodes:       nodes,
+			At:          time.Now(),
+		}
+		if healthy {
+			ev.Event = EventUpstreamRecovered
+		} else if lastNodes != nil {
+			// the nodes the upstream was served by before going down
+			ev.Nodes = lastNodes
+		}
+
+		log.Infof("hooks: upstream %s: %s", up.Name, ev.Event)
+		select {
+		case h.events <- ev:
+		default:
+			log.Errorf("hooks: upstream %s: too many events waiting for the hooks, dropping %s", up.Name, ev.Event)
+		}
+	}
+
+	for name := range h.healthy {
+		if !seen[name] {
+			delete(h.healthy, name)
+			delete(h.nodes, name)
+		}
+	}
+}
+
+func (h *Hooks) fire(ev Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("hooks: error encoding event: %s", err)
+		return
+	}
+
+	if h.cfg.Exec != "" {
+		err := h.exec(ev, payload)
+		if err != nil {
+			log.Errorf("hooks: upstream %s: exec hook failed: %s", ev.Upstream, err)
+		}
+	}
+
+	if h.cfg.URL != "" {
+		err := h.post(payload)
+		if err != nil {
+			log.Errorf("hooks: upstream %s: webhook failed: %s", ev.Upstream, err)
+		}
+	}
+}
+
+func (h *Hooks) exec(ev Event, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.cfg.Exec)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"CONNECT_HOOK_EVENT="+ev.Event,
+		"CONNECT_HOOK_SERVICE="+ev.Service,
+		"CONNECT_HOOK_UPSTREAM="+ev.Upstream,
+		"CONNECT_HOOK_DESTINATION="+ev.Destination,
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, string(out))
+	}
+
+	return nil
+}
+
+func (h *Hooks) post(payload []byte) error {
+	res, err := h.client.Post(h.cfg.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	return nil
+}
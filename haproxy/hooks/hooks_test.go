@@ -0,0 +1,110 @@
+package hooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var ev Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		events <- ev
+	}))
+	defer srv.Close()
+
+	h := New(Config{URL: srv.URL})
+
+	cfg := func(nodes ...consul.UpstreamNode) consul.Config {
+		return consul.Config{
+			ServiceName: "client",
+			Upstreams: []consul.Upstream{
+				{
+					Name:        "service_server",
+					ServiceName: "server",
+					Nodes:       nodes,
+				},
+			},
+		}
+	}
+
+	next := func() *Event {
+		select {
+		case ev := <-events:
+			return &ev
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+
+	node := consul.UpstreamNode{Host: "1.2.3.4", Port: 8080, Weight: 1}
+
+	h.Update(cfg(node))
+	require.Nil(t, next())
+
+	h.Update(cfg())
+	ev := next()
+	require.NotNil(t, ev)
+	require.Equal(t, EventUpstreamDown, ev.Event)
+	require.Equal(t, "client", ev.Service)
+	require.Equal(t, "server", ev.Destination)
+	require.Equal(t, []Node{{Host: "1.2.3.4", Port: 8080, Weight: 1}}, ev.Nodes)
+
+	h.Update(cfg())
+	require.Nil(t, next())
+
+	h.Update(cfg(node))
+	ev = next()
+	require.NotNil(t, ev)
+	require.Equal(t, EventUpstreamRecovered, ev.Event)
+	require.Equal(t, []Node{{Host: "1.2.3.4", Port: 8080, Weight: 1}}, ev.Nodes)
+
+	// all the instances in maintenance
+	draining := node
+	draining.Draining = true
+	h.Update(cfg(draining))
+	ev = next()
+	require.NotNil(t, ev)
+	require.Equal(t, EventUpstreamDown, ev.Event)
+}
+
+func TestUpdateOrder(t *testing.T) {
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var ev Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		// a slow hook must not be overtaken by the next event
+		if ev.Event == EventUpstreamDown {
+			time.Sleep(100 * time.Millisecond)
+		}
+		events <- ev.Event
+	}))
+	defer srv.Close()
+
+	h := New(Config{URL: srv.URL})
+
+	cfg := func(nodes ...consul.UpstreamNode) consul.Config {
+		return consul.Config{Upstreams: []consul.Upstream{{Name: "service_server", Nodes: nodes}}}
+	}
+	node := consul.UpstreamNode{Host: "1.2.3.4", Port: 8080, Weight: 1}
+
+	h.Update(cfg(node))
+	h.Update(cfg())
+	h.Update(cfg(node))
+
+	for _, expected := range []string{EventUpstreamDown, EventUpstreamRecovered} {
+		select {
+		case ev := <-events:
+			require.Equal(t, expected, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", expected)
+		}
+	}
+}
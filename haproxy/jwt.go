@@ -0,0 +1,219 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/negasus/haproxy-spoe-go/action"
+	"github.com/negasus/haproxy-spoe-go/message"
+	"github.com/negasus/haproxy-spoe-go/request"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+)
+
+const (
+	// jwksRefresh is the interval between two fetches of the keys, they are
+	// fetched sooner for a token signed by an unknown key but not more
+	// than once every jwksMinRefresh
+	jwksRefresh    = 5 * time.Minute
+	jwksMinRefresh = 30 * time.Second
+	jwksTimeout    = 2 * time.Second
+	// jwksMaxSize bounds the size of the key set read
+	jwksMaxSize = 1 << 20
+	// jwtLeeway is the clock skew allowed on the exp, nbf and iat claims
+	jwtLeeway = 30 * time.Second
+)
+
+// jwtAlgorithms are the accepted signature algorithms, the ones with a
+// public key
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// JWTOptions configures the validation of the JWT of the requests of the
+// public listeners
+type JWTOptions struct {
+	// JWKSURL serves the keys the tokens are signed with
+	JWKSURL string
+	// Issuer, when set, must be the iss claim of the tokens
+	Issuer string
+	// Audiences, when set, must contain one of the aud claim of the tokens
+	Audiences []string
+	// Claims are the claims set as txn.jwt.claim_<name> variables
+	Claims []string
+}
+
+// jwtValidator validates the bearer tokens of the check-jwt SPOE message
+// against a cached JWKS
+type jwtValidator struct {
+	opts    JWTOptions
+	client  *http.Client
+	metrics metrics.Metrics
+
+	lock      sync.Mutex
+	keys      jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+func newJWTValidator(opts JWTOptions, m metrics.Metrics) *jwtValidator {
+	return &jwtValidator{
+		opts:    opts,
+		client:  &http.Client{Timeout: jwksTimeout},
+		metrics: m,
+	}
+}
+
+// handle sets txn.jwt.valid when the token of the request is valid, with
+// the variables of its claims
+func (v *jwtValidator) handle(msg *message.Message, req *request.Request) {
+	header, _ := msg.KV.Get("authorization")
+	authorization, _ := header.(string)
+
+	claims, err := v.validate(authorization, time.Now())
+	if err != nil {
+		log.Debugf("jwt: rejecting request: %s", err)
+		v.metrics.IncrCounter("connect_jwt_validations_total", 1, metrics.Labels{"result": "invalid"})
+		return
+	}
+	v.metrics.IncrCounter("connect_jwt_validations_total", 1, metrics.Labels{"result": "valid"})
+
+	req.Actions.SetVar(action.ScopeTransaction, "valid", 1)
+	for _, name := range v.opts.Claims {
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		req.Actions.SetVar(action.ScopeTransaction, claimVar(name), claimValue(value))
+	}
+}
+
+// validate returns the claims of the bearer token of an Authorization
+// header once its signature, issuer, audience and validity period are
+// checked
+func (v *jwtValidator) validate(authorization string, now time.Time) (map[string]interface{}, error) {
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return nil, errors.New("no bearer token")
+	}
+
+	tok, err := jwt.ParseSigned(strings.TrimSpace(authorization[len(prefix):]), jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := v.key(tok.Headers[0].KeyID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var std jwt.Claims
+	claims := map[string]interface{}{}
+	if err := tok.Claims(key, &std, &claims); err != nil {
+		return nil, err
+	}
+	err = std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      v.opts.Issuer,
+		AnyAudience: v.opts.Audiences,
+		Time:        now,
+	}, jwtLeeway)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// key returns the key of a token, the keys are fetched again when they are
+// stale or do not have it
+func (v *jwtValidator) key(kid string, now time.Time) (jose.JSONWebKey, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if now.Sub(v.fetchedAt) > jwksRefresh {
+		v.fetch(now)
+	}
+	keys := v.find(kid)
+	if len(keys) == 0 && now.Sub(v.fetchedAt) > jwksMinRefresh {
+		v.fetch(now)
+		keys = v.find(kid)
+	}
+	if len(keys) == 0 {
+		return jose.JSONWebKey{}, fmt.Errorf("unknown key %q", kid)
+	}
+	return keys[0], nil
+}
+
+// find returns the keys of a kid, the token can omit it when there is a
+// single key
+func (v *jwtValidator) find(kid string) []jose.JSONWebKey {
+	if kid == "" && len(v.keys.Keys) == 1 {
+		return v.keys.Keys
+	}
+	return v.keys.Key(kid)
+}
+
+// fetch reads the keys, the previous ones are kept on error
+func (v *jwtValidator) fetch(now time.Time) {
+	// the failures are not retried before jwksMinRefresh either
+	v.fetchedAt = now
+
+	keys, err := v.fetchKeys()
+	if err != nil {
+		log.Errorf("jwt: error fetching the keys from %s: %s", v.opts.JWKSURL, err)
+		return
+	}
+	v.keys = keys
+}
+
+func (v *jwtValidator) fetchKeys() (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+
+	resp, err := v.client.Get(v.opts.JWKSURL)
+	if err != nil {
+		return keys, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keys, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, jwksMaxSize)).Decode(&keys)
+	return keys, err
+}
+
+// claimVar is the variable of a claim, HAProxy variable names only have
+// alphanumerics, underscores and dots
+func claimVar(name string) string {
+	return "claim_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// claimValue is the value of a claim variable, the claims other than
+// strings are JSON encoded
+func claimValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
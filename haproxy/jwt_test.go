@@ -0,0 +1,79 @@
+package haproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+)
+
+func TestJWTValidate(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key := jose.JSONWebKey{Key: priv, KeyID: "k1", Algorithm: string(jose.RS256), Use: "sig"}
+
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer srv.Close()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	now := time.Now()
+	sign := func(c jwt.Claims, extra map[string]interface{}) string {
+		tok, err := jwt.Signed(signer).Claims(c).Claims(extra).Serialize()
+		require.NoError(t, err)
+		return "Bearer " + tok
+	}
+
+	v := newJWTValidator(JWTOptions{
+		JWKSURL:   srv.URL,
+		Issuer:    "https://issuer.example",
+		Audiences: []string{"web"},
+	}, metrics.Nop{})
+
+	valid := jwt.Claims{
+		Issuer:   "https://issuer.example",
+		Audience: jwt.Audience{"web"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	claims, err := v.validate(sign(valid, map[string]interface{}{"email": "jane@example.com"}), now)
+	require.NoError(t, err)
+	require.Equal(t, "jane@example.com", claims["email"])
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+	_, err = v.validate(sign(expired, nil), now)
+	require.Error(t, err)
+
+	otherAudience := valid
+	otherAudience.Audience = jwt.Audience{"api"}
+	_, err = v.validate(sign(otherAudience, nil), now)
+	require.Error(t, err)
+
+	_, err = v.validate("", now)
+	require.Error(t, err)
+	_, err = v.validate("Basic dXNlcjpwYXNz", now)
+	require.Error(t, err)
+
+	// the keys are only fetched again once stale
+	require.Equal(t, 1, fetches)
+}
+
+func TestJWTClaimVar(t *testing.T) {
+	require.Equal(t, "claim_sub", claimVar("sub"))
+	require.Equal(t, "claim_https___example_com_roles", claimVar("https://example.com/roles"))
+	require.Equal(t, "jane", claimValue("jane"))
+	require.Equal(t, `["admin","dev"]`, claimValue([]interface{}{"admin", "dev"}))
+}
@@ -0,0 +1,93 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+)
+
+// logServerRe matches the backend/server field of the upstream access logs
+var logServerRe = regexp.MustCompile(`\bback_[^ /]+/srv_[0-9]+\b`)
+
+// upstreamLogMeta appends the Consul metadata of the upstream instance a
+// request was sent to to its access log line
+type upstreamLogMeta struct {
+	lock sync.RWMutex
+	// servers maps backend/server to the fields to append
+	servers map[string]string
+}
+
+// update rebuilds the lookup from the servers of a state and the nodes of
+// the config it was generated from
+func (m *upstreamLogMeta) update(st state.State, cfg consul.Config) {
+	nodes := map[string]map[string]consul.UpstreamNode{}
+	for _, up := range cfg.Upstreams {
+		byAddr := map[string]consul.UpstreamNode{}
+		for _, n := range up.Nodes {
+			byAddr[n.ID()] = n
+		}
+		nodes["back_"+up.Name] = byAddr
+	}
+
+	servers := map[string]string{}
+	for _, be := range st.Backends {
+		byAddr, ok := nodes[be.Backend.Name]
+		if !ok {
+			continue
+		}
+		for _, s := range be.Servers {
+			if s.Port == nil {
+				continue
+			}
+			n, ok := byAddr[s.Address+":"+strconv.FormatInt(*s.Port, 10)]
+			if !ok {
+				continue
+			}
+			servers[be.Backend.Name+"/"+s.Name] = logMetaFields(n)
+		}
+	}
+
+	m.lock.Lock()
+	m.servers = servers
+	m.lock.Unlock()
+}
+
+// enrich returns the line followed by the metadata of its server, the line
+// is returned as is when it has no known server
+func (m *upstreamLogMeta) enrich(line string) string {
+	server := logServerRe.FindString(line)
+	if server == "" {
+		return line
+	}
+
+	m.lock.RLock()
+	fields, ok := m.servers[server]
+	m.lock.RUnlock()
+	if !ok {
+		return line
+	}
+	return line + " " + fields
+}
+
+func logMetaFields(n consul.UpstreamNode) string {
+	fields := []string{fmt.Sprintf("node=%q", n.Node)}
+	if n.Datacenter != "" {
+		fields = append(fields, fmt.Sprintf("dc=%q", n.Datacenter))
+	}
+
+	keys := make([]string, 0, len(n.Meta))
+	for k := range n.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("meta.%s=%q", k, n.Meta[k]))
+	}
+	return strings.Join(fields, " ")
+}
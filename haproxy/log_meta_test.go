@@ -0,0 +1,38 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamLogMeta(t *testing.T) {
+	port := int64(8080)
+	m := &upstreamLogMeta{}
+	m.update(state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_api"},
+			Servers: []models.Server{{Name: "srv_0", Address: "10.0.0.1", Port: &port}},
+		}},
+	}, consul.Config{
+		Upstreams: []consul.Upstream{{
+			Name: "api",
+			Nodes: []consul.UpstreamNode{{
+				Host:       "10.0.0.1",
+				Port:       8080,
+				Node:       "node-1",
+				Datacenter: "dc1",
+				Meta:       map[string]string{"version": "v2", "az": "a"},
+			}},
+		}},
+	})
+
+	line := `127.0.0.1:51000 [16/Oct/2026:10:00:00.000] front_api back_api/srv_0 0/0/1/2/3 200 120`
+	require.Equal(t, line+` node="node-1" dc="dc1" meta.az="a" meta.version="v2"`, m.enrich(line))
+
+	other := `127.0.0.1:51000 [16/Oct/2026:10:00:00.000] front_db back_db/srv_0 0/0/1 120`
+	require.Equal(t, other, m.enrich(other))
+}
@@ -0,0 +1,26 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+)
+
+// writeLuaScripts writes the Lua scripts of the state so that they are
+// loaded by the next HAProxy reload
+func writeLuaScripts(st state.State) error {
+	for _, s := range st.LuaScripts {
+		err := os.MkdirAll(filepath.Dir(s.Path), 0700)
+		if err != nil {
+			return fmt.Errorf("failed to write lua script %s: %w", s.Name, err)
+		}
+		err = os.WriteFile(s.Path, []byte(s.Source), 0600)
+		if err != nil {
+			return fmt.Errorf("failed to write lua script %s: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// writeMaps writes the map files of the state so that they are loaded
+// by the next HAProxy reload
+func writeMaps(st state.State) error {
+	for _, m := range st.Maps {
+		var b strings.Builder
+		for _, e := range m.Entries {
+			fmt.Fprintf(&b, "%s %s\n", e.Key, e.Value)
+		}
+
+		err := os.WriteFile(m.Path, []byte(b.String()), 0600)
+		if err != nil {
+			return fmt.Errorf("failed to write map %s: %w", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMaps updates the maps content through the runtime API, avoiding
+// a reload when only map entries changed
+func (h *HAProxy) applyMaps(oldState, newState state.State) error {
+	old := map[string]state.Map{}
+	for _, m := range oldState.Maps {
+		old[m.Path] = m
+	}
+
+	for _, m := range newState.Maps {
+		o, ok := old[m.Path]
+		if !ok {
+			return fmt.Errorf("map %s is not loaded", m.Name)
+		}
+
+		current := map[string]string{}
+		for _, e := range o.Entries {
+			current[e.Key] = e.Value
+		}
+
+		for _, e := range m.Entries {
+			v, ok := current[e.Key]
+			delete(current, e.Key)
+
+			var cmd string
+			switch {
+			case !ok:
+				cmd = fmt.Sprintf("add map %s %s %s", m.Path, e.Key, e.Value)
+			case v != e.Value:
+				cmd = fmt.Sprintf("set map %s %s %s", m.Path, e.Key, e.Value)
+			default:
+				continue
+			}
+			err := h.runtimeCommand(cmd)
+			if err != nil {
+				return err
+			}
+		}
+
+		for k := range current {
+			err := h.runtimeCommand(fmt.Sprintf("del map %s %s", m.Path, k))
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("map %s updated at runtime", m.Name)
+	}
+
+	return writeMaps(newState)
+}
+
+func (h *HAProxy) runtimeCommand(cmd string) error {
+	out, err := h.statsSocket.Exec(cmd)
+	if err != nil {
+		return err
+	}
+	out = strings.TrimSpace(out)
+	if out != "" {
+		return fmt.Errorf("runtime command '%s' failed: %s", cmd, out)
+	}
+	return nil
+}
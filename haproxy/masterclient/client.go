@@ -0,0 +1,212 @@
+// Package masterclient talks to the master CLI socket HAProxy opens with -S,
+// which lists the processes and reloads them
+package masterclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+)
+
+const (
+	dialTimeout = 2 * time.Second
+	// execTimeout bounds the commands, a reload answers once the new worker
+	// started with HAProxy 2.7+
+	execTimeout = 30 * time.Second
+)
+
+// ErrReloadFailed is returned by Reload when HAProxy reports the new workers
+// failed to start
+var ErrReloadFailed = errors.New("reload failed")
+
+// ErrNotOldWorker is returned by HardStop for a pid which is not an old
+// worker of the master
+var ErrNotOldWorker = errors.New("not an old worker")
+
+var failedReloadsRe = regexp.MustCompile(`\[failed:\s*(\d+)\]`)
+
+// Process is a process listed by show proc
+type Process struct {
+	PID int `json:"pid"`
+	// Reloads is the number of reloads the process went through, it tells
+	// the generation of the workers
+	Reloads int    `json:"reloads"`
+	Uptime  string `json:"uptime"`
+	Version string `json:"version,omitempty"`
+}
+
+// Procs are the processes of a HAProxy master
+type Procs struct {
+	Master Process `json:"master"`
+	// FailedReloads is only reported by HAProxy 2.5+
+	FailedReloads int       `json:"failed_reloads"`
+	Workers       []Process `json:"workers"`
+	// OldWorkers run a previous config, until their connections are closed
+	OldWorkers []Process `json:"old_workers"`
+}
+
+type Client struct {
+	socketPath string
+}
+
+func New(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+	}
+}
+
+// Exec runs a master CLI command and returns its output
+func (c *Client) Exec(cmd string) (string, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, dialTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to master socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(execTimeout))
+
+	_, err = fmt.Fprintf(conn, "%s\n", cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to send command: %w", err)
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return string(out), nil
+}
+
+// ShowProc lists the master and worker processes
+func (c *Client) ShowProc() (Procs, error) {
+	out, err := c.Exec("show proc")
+	if err != nil {
+		return Procs{}, err
+	}
+	return parseShowProc(out)
+}
+
+// Reload has the master start workers with the current config file. HAProxy
+// 2.7+ answers once the reload is done and an error is returned when it
+// failed, older versions close the connection right away.
+func (c *Client) Reload() error {
+	out, err := c.Exec("reload")
+	if err != nil {
+		return err
+	}
+	if strings.Contains(out, "Success=0") {
+		return fmt.Errorf("%w: %s", ErrReloadFailed, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// HardStop terminates an old worker without waiting for its connections to
+// be closed, the pid must be listed in the old workers
+func (c *Client) HardStop(pid int) error {
+	procs, err := c.ShowProc()
+	if err != nil {
+		return err
+	}
+	for _, p := range procs.OldWorkers {
+		if p.PID == pid {
+			return lib.Terminate(pid)
+		}
+	}
+	return fmt.Errorf("%d: %w", pid, ErrNotOldWorker)
+}
+
+// parseShowProc reads the output of show proc, eg:
+//
+//	#<PID>          <type>          <reloads>       <uptime>        <version>
+//	1234            master          2 [failed: 0]   0d00h01m02s     2.8.3
+//	# workers
+//	5678            worker          0               0d00h00m05s     2.8.3
+//	# old workers
+//	4321            worker          1               0d00h01m02s     2.8.3
+func parseShowProc(out string) (Procs, error) {
+	p := Procs{}
+	section := ""
+	master := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#<"):
+			continue
+		case strings.HasPrefix(line, "#"):
+			section = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			continue
+		}
+
+		// the failed reloads are dropped to keep the columns aligned
+		fields := strings.Fields(failedReloadsRe.ReplaceAllString(line, ""))
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		proc := parseProcess(pid, fields[2:])
+		switch {
+		case fields[1] == "master":
+			master = true
+			p.Master = proc
+			if m := failedReloadsRe.FindStringSubmatch(line); m != nil {
+				p.FailedReloads, _ = strconv.Atoi(m[1])
+			}
+		// HAProxy 2.0 lists the workers without section
+		case section == "workers" || (section == "" && fields[1] == "worker"):
+			p.Workers = append(p.Workers, proc)
+		case section == "old workers":
+			p.OldWorkers = append(p.OldWorkers, proc)
+		}
+	}
+	if !master {
+		return Procs{}, fmt.Errorf("no master process in show proc output: %q", out)
+	}
+	return p, nil
+}
+
+// parseProcess reads the columns after the type, HAProxy 2.0 has a relative
+// pid column before the reloads and an uptime with a space
+func parseProcess(pid int, cols []string) Process {
+	proc := Process{PID: pid}
+	if len(cols) >= 4 && strings.HasSuffix(cols[2], "d") {
+		proc.Reloads, _ = strconv.Atoi(cols[1])
+		proc.Uptime = cols[2] + " " + cols[3]
+		return proc
+	}
+	if len(cols) >= 1 {
+		proc.Reloads, _ = strconv.Atoi(cols[0])
+	}
+	if len(cols) >= 2 {
+		proc.Uptime = cols[1]
+	}
+	if len(cols) >= 3 {
+		proc.Version = cols[2]
+	}
+	return proc
+}
+
+// NewWorker tells if a worker of after did not exist in before
+func NewWorker(before, after Procs) bool {
+	known := map[int]bool{}
+	for _, p := range before.Workers {
+		known[p.PID] = true
+	}
+	for _, p := range after.Workers {
+		if !known[p.PID] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package masterclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShowProc(t *testing.T) {
+	p, err := parseShowProc(`#<PID>          <type>          <reloads>       <uptime>        <version>
+1234            master          2 [failed: 1]   0d00h01m02s     2.8.3
+# workers
+5678            worker          0               0d00h00m05s     2.8.3
+# old workers
+4321            worker          1               0d00h01m02s     2.8.3
+# programs
+
+`)
+	require.NoError(t, err)
+	require.Equal(t, Procs{
+		Master:        Process{PID: 1234, Reloads: 2, Uptime: "0d00h01m02s", Version: "2.8.3"},
+		FailedReloads: 1,
+		Workers:       []Process{{PID: 5678, Reloads: 0, Uptime: "0d00h00m05s", Version: "2.8.3"}},
+		OldWorkers:    []Process{{PID: 4321, Reloads: 1, Uptime: "0d00h01m02s", Version: "2.8.3"}},
+	}, p)
+
+	// HAProxy 2.0
+	p, err = parseShowProc(`#<PID>          <type>          <relative PID>  <reloads>       <uptime>
+1234            master          0               0               0d 00h00m11s
+5678            worker          1               0               0d 00h00m11s
+`)
+	require.NoError(t, err)
+	require.Equal(t, Procs{
+		Master:  Process{PID: 1234, Uptime: "0d 00h00m11s"},
+		Workers: []Process{{PID: 5678, Uptime: "0d 00h00m11s"}},
+	}, p)
+
+	_, err = parseShowProc("Unknown command\n")
+	require.Error(t, err)
+}
+
+func TestNewWorker(t *testing.T) {
+	require.False(t, NewWorker(Procs{Workers: []Process{{PID: 1}}}, Procs{Workers: []Process{{PID: 1}}}))
+	require.False(t, NewWorker(Procs{Workers: []Process{{PID: 1}}}, Procs{OldWorkers: []Process{{PID: 1}}}))
+	require.True(t, NewWorker(Procs{Workers: []Process{{PID: 1}}}, Procs{Workers: []Process{{PID: 2}}, OldWorkers: []Process{{PID: 1}}}))
+}
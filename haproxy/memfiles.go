@@ -0,0 +1,79 @@
+package haproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memFiles keeps the certificates in memory files HAProxy reads through
+// /proc/<pid>/fd/<fd>, the private keys are never written to a filesystem.
+// The files live as long as this process.
+type memFiles struct {
+	lock  sync.Mutex
+	paths map[string]string
+	files map[string]*os.File
+}
+
+func newMemFiles() *memFiles {
+	return &memFiles{
+		paths: map[string]string{},
+		files: map[string]*os.File{},
+	}
+}
+
+// path returns the path of a memory file with content, it is created once
+// per content
+func (m *memFiles) path(content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	name := hex.EncodeToString(sum[:])
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.paths[name]; ok {
+		return p, nil
+	}
+
+	f, err := createMemFile(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create memory file: %w", err)
+	}
+	_, err = f.Write(content)
+	if err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write memory file: %w", err)
+	}
+
+	p := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+	m.paths[name] = p
+	m.files[p] = f
+	log.Debugf("wrote new memory file %s", p)
+	return p, nil
+}
+
+// release closes the memory file of a path no longer used, it is a no-op
+// for the other paths
+func (m *memFiles) release(p string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, ok := m.files[p]
+	if !ok {
+		return
+	}
+	delete(m.files, p)
+	for name, path := range m.paths {
+		if path == p {
+			delete(m.paths, name)
+		}
+	}
+	err := f.Close()
+	if err != nil {
+		log.Warnf("error closing memory file %s: %s", p, err)
+	}
+}
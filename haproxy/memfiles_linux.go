@@ -0,0 +1,17 @@
+package haproxy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// createMemFile creates an anonymous file backed by memory, it is not
+// inherited by the child processes
+func createMemFile(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate("haproxy-connect-"+name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// createMemFile creates an anonymous file backed by memory, only supported
+// on linux
+func createMemFile(name string) (*os.File, error) {
+	return nil, fmt.Errorf("memory files are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package haproxy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFiles(t *testing.T) {
+	m := newMemFiles()
+
+	p, err := m.path([]byte("leaf"))
+	require.NoError(t, err)
+	again, err := m.path([]byte("leaf"))
+	require.NoError(t, err)
+	require.Equal(t, p, again)
+
+	// read as HAProxy does
+	b, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.Equal(t, "leaf", string(b))
+
+	m.release(p)
+	_, err = os.ReadFile(p)
+	require.Error(t, err)
+
+	// a released content gets a new file
+	p, err = m.path([]byte("leaf"))
+	require.NoError(t, err)
+	b, err = os.ReadFile(p)
+	require.NoError(t, err)
+	require.Equal(t, "leaf", string(b))
+}
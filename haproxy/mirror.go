@@ -0,0 +1,186 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/negasus/haproxy-spoe-go/message"
+	"github.com/negasus/haproxy-spoe-go/varint"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+)
+
+const (
+	mirrorTimeout = 10 * time.Second
+	// mirrorConcurrency bounds the copies in flight, the copies above are
+	// dropped so that a slow mirror does not pile up requests
+	mirrorConcurrency = 64
+)
+
+// mirrorRequest is a copy of a request received from HAProxy
+type mirrorRequest struct {
+	upstream string
+	method   string
+	path     string
+	headers  http.Header
+	body     []byte
+}
+
+// mirror sends the copies of the requests of the mirror SPOE message to
+// the local listener of their upstream, their responses are discarded
+type mirror struct {
+	cfg     func() consul.Config
+	metrics metrics.Metrics
+	client  *http.Client
+	slots   chan struct{}
+}
+
+func newMirror(m metrics.Metrics, cfg func() consul.Config) *mirror {
+	return &mirror{
+		cfg:     cfg,
+		metrics: m,
+		client: &http.Client{
+			Timeout: mirrorTimeout,
+			// the redirects are the concern of the client of the original
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots: make(chan struct{}, mirrorConcurrency),
+	}
+}
+
+// handle sends the copy of a request in the background, the message is
+// released once the handler returns so its content is copied
+func (m *mirror) handle(msg *message.Message) {
+	req, err := decodeMirrorRequest(msg)
+	if err != nil {
+		log.Errorf("spoe handler: mirror: %s", err)
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.metrics.IncrCounter("connect_mirror_requests_total", 1, metrics.Labels{"upstream": req.upstream, "result": "dropped"})
+		return
+	}
+	go func() {
+		defer func() { <-m.slots }()
+		result := "success"
+		err := m.send(req)
+		if err != nil {
+			result = "failure"
+			log.Debugf("mirror to %s: %s", req.upstream, err)
+		}
+		m.metrics.IncrCounter("connect_mirror_requests_total", 1, metrics.Labels{"upstream": req.upstream, "result": result})
+	}()
+}
+
+func (m *mirror) send(req mirrorRequest) error {
+	addr := ""
+	for _, up := range m.cfg().Upstreams {
+		if up.Name == req.upstream && up.LocalBindPort > 0 {
+			addr = localAddr(up.LocalBindAddress, up.LocalBindPort)
+		}
+	}
+	if addr == "" {
+		return fmt.Errorf("upstream %s has no local listener", req.upstream)
+	}
+
+	r, err := http.NewRequest(req.method, "http://"+addr+req.path, bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	r.Header = req.headers
+	r.Host = req.headers.Get("Host")
+	r.Header.Del("Host")
+	// the length is the one of the body received
+	r.Header.Del("Content-Length")
+	r.Header.Del("Transfer-Encoding")
+
+	resp, err := m.client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func localAddr(host string, port int) string {
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func decodeMirrorRequest(msg *message.Message) (mirrorRequest, error) {
+	req := mirrorRequest{}
+	req.upstream, _ = kvString(msg, "upstream")
+	req.method, _ = kvString(msg, "method")
+	req.path, _ = kvString(msg, "path")
+	if req.upstream == "" || req.method == "" || req.path == "" {
+		return req, fmt.Errorf("upstream, method and path arguments are required")
+	}
+
+	hdrs, _ := msg.KV.Get("headers")
+	b, _ := hdrs.([]byte)
+	headers, err := decodeHeaders(b)
+	if err != nil {
+		return req, fmt.Errorf("invalid headers: %w", err)
+	}
+	req.headers = headers
+
+	if body, ok := msg.KV.Get("body"); ok {
+		if b, ok := body.([]byte); ok {
+			req.body = append([]byte(nil), b...)
+		}
+	}
+	return req, nil
+}
+
+func kvString(msg *message.Message, name string) (string, bool) {
+	v, ok := msg.KV.Get(name)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// decodeHeaders reads the headers of req.hdrs_bin: the name and value of
+// each header as varint prefixed strings, ended by an empty name and value
+func decodeHeaders(b []byte) (http.Header, error) {
+	headers := http.Header{}
+	for {
+		name, n, err := decodeHeaderString(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		value, n, err := decodeHeaderString(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		if name == "" {
+			return headers, nil
+		}
+		headers.Add(name, value)
+	}
+}
+
+func decodeHeaderString(b []byte) (string, int, error) {
+	l, n := varint.Uvarint(b)
+	if n < 0 || uint64(len(b)-n) < l {
+		return "", 0, fmt.Errorf("truncated header")
+	}
+	return string(b[n : n+int(l)]), n + int(l), nil
+}
@@ -0,0 +1,36 @@
+package haproxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeHeaders(t *testing.T) {
+	b := []byte{}
+	for _, s := range []string{"Host", "api", "X-Id", "1", "X-Id", "2", "", ""} {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+
+	headers, err := decodeHeaders(b)
+	require.NoError(t, err)
+	require.Equal(t, http.Header{"Host": {"api"}, "X-Id": {"1", "2"}}, headers)
+
+	// a long value has a multi bytes length
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+	b = append([]byte{1, 'A', 0xfc, 0x03}, long...)
+	b = append(b, 0, 0)
+	headers, err = decodeHeaders(b)
+	require.NoError(t, err)
+	require.Equal(t, string(long), headers.Get("A"))
+
+	_, err = decodeHeaders([]byte{4, 'H', 'o'})
+	require.Error(t, err)
+	_, err = decodeHeaders(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+)
+
+// lastGlobal returns the value of a global setting, the last one when it is
+// set several times
+func lastGlobal(params utils.HAProxyParams, name string) string {
+	vs := params.Globals[name]
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[len(vs)-1]
+}
+
+// setPrivileges reads the group and chroot the HAProxy workers run with. The
+// config dir and the sockets the workers connect to are shared with their
+// group, and the chroot must contain the config dir.
+func (c *haConfig) setPrivileges(params utils.HAProxyParams) error {
+	c.SharedGID = -1
+	if group := lastGlobal(params, "group"); group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("haproxy group: %w", err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("haproxy group %s: bad gid %s", group, g.Gid)
+		}
+		c.SharedGID = gid
+	}
+	if chroot := lastGlobal(params, "chroot"); chroot != "" {
+		rel, err := filepath.Rel(chroot, c.Base)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("the config dir %s must be inside the haproxy chroot %s, see -haproxy-cfg-base-path", c.Base, chroot)
+		}
+		c.Chroot = chroot
+	}
+	// the workers only need to reach the sockets
+	return c.share(c.Base, 0710)
+}
+
+// share gives the group of the HAProxy workers access to a file of the config
+// dir
+func (c *haConfig) share(path string, mode os.FileMode) error {
+	if c.SharedGID < 0 {
+		return nil
+	}
+	err := os.Chown(path, -1, c.SharedGID)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// workerPath is the path of a file of the config dir seen by the HAProxy
+// workers, they resolve it in their chroot
+func (c *haConfig) workerPath(p string) string {
+	if c.Chroot == "" {
+		return p
+	}
+	rel, err := filepath.Rel(c.Chroot, p)
+	if err != nil {
+		return p
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,26 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+)
+
+func TestSetPrivileges(t *testing.T) {
+	c := &haConfig{Base: "/var/lib/haproxy/haproxy-connect-123"}
+	err := c.setPrivileges(utils.HAProxyParams{Globals: map[string][]string{"chroot": {"/var/lib/haproxy"}}})
+	require.NoError(t, err)
+	require.Equal(t, -1, c.SharedGID)
+	require.Equal(t, "/haproxy-connect-123/spoe.sock", c.workerPath("/var/lib/haproxy/haproxy-connect-123/spoe.sock"))
+
+	// the workers would not reach the sockets
+	c = &haConfig{Base: "/tmp/haproxy-connect-123"}
+	err = c.setPrivileges(utils.HAProxyParams{Globals: map[string][]string{"chroot": {"/var/lib/haproxy"}}})
+	require.Error(t, err)
+
+	c = &haConfig{Base: "/tmp/haproxy-connect-123"}
+	require.NoError(t, c.setPrivileges(utils.HAProxyParams{}))
+	require.Equal(t, "/tmp/haproxy-connect-123/spoe.sock", c.workerPath("/tmp/haproxy-connect-123/spoe.sock"))
+}
@@ -0,0 +1,34 @@
+package haproxy
+
+import (
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// coalesceWait tells how long a reload must wait to keep the minimum
+// interval since the previous one, the changes received meanwhile are
+// applied by a single reload. The certificate changes are applied right
+// away, along with the pending ones.
+func (h *HAProxy) coalesceWait(currentState, newState state.State, now time.Time) time.Duration {
+	wait := h.lastReload.Add(h.opts.ReloadMinInterval).Sub(now)
+	if h.opts.ReloadMinInterval <= 0 || h.lastReload.IsZero() || wait <= 0 {
+		h.coalescing = false
+		return 0
+	}
+	if currentState.CertsChanged(newState) {
+		if h.coalescing {
+			log.Info("certificates changed, applying the pending changes without waiting")
+		}
+		h.coalescing = false
+		return 0
+	}
+
+	if !h.coalescing {
+		log.Infof("last reload %s ago, waiting %s to apply the changes", now.Sub(h.lastReload).Round(time.Millisecond), wait.Round(time.Millisecond))
+		h.coalescing = true
+		h.opts.Metrics.IncrCounter("connect_reloads_coalesced_total", 1, nil)
+	}
+	return wait
+}
@@ -0,0 +1,42 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesceWait(t *testing.T) {
+	withCert := func(cert string, addrs ...string) state.State {
+		be := state.Backend{Backend: models.Backend{Name: "back_api"}}
+		for _, a := range addrs {
+			be.Servers = append(be.Servers, models.Server{Name: a, Address: a, SslCertificate: cert})
+		}
+		return state.State{Backends: []state.Backend{be}}
+	}
+
+	now := time.Now()
+	h := &HAProxy{opts: utils.Options{ReloadMinInterval: 10 * time.Second, Metrics: metrics.Nop{}}}
+	current := withCert("/leaf1", "10.0.0.1")
+
+	// first reload
+	require.Zero(t, h.coalesceWait(current, withCert("/leaf1", "10.0.0.1", "10.0.0.2"), now))
+
+	h.lastReload = now
+	require.Equal(t, 7*time.Second, h.coalesceWait(current, withCert("/leaf1", "10.0.0.1", "10.0.0.2"), now.Add(3*time.Second)))
+	require.True(t, h.coalescing)
+
+	// a rotated certificate is not held back
+	require.Zero(t, h.coalesceWait(current, withCert("/leaf2", "10.0.0.1", "10.0.0.2"), now.Add(4*time.Second)))
+
+	require.Zero(t, h.coalesceWait(current, withCert("/leaf1", "10.0.0.2"), now.Add(10*time.Second)))
+	require.False(t, h.coalescing)
+
+	h.opts.ReloadMinInterval = 0
+	require.Zero(t, h.coalesceWait(current, withCert("/leaf1", "10.0.0.2"), now.Add(time.Second)))
+}
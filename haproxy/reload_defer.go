@@ -0,0 +1,81 @@
+package haproxy
+
+import (
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultReloadDeferMax is how long a non critical change is deferred
+	// at most
+	DefaultReloadDeferMax = 5 * time.Minute
+	// reloadDeferCheck is the interval between two checks of the request
+	// rate while a change is deferred
+	reloadDeferCheck = 10 * time.Second
+)
+
+// deferReload tells if the change between the states should wait for a
+// quieter period. Only the changes of server weights are deferred, the other
+// ones (certificates, added or removed instances...) and the drains of
+// servers are applied right away.
+func (h *HAProxy) deferReload(currentState, newState state.State, now time.Time) bool {
+	if h.opts.ReloadDeferRate <= 0 || !currentState.EqualExceptWeights(newState) || currentState.Drains(newState) {
+		h.deferredSince = time.Time{}
+		return false
+	}
+
+	maxDefer := h.opts.ReloadDeferMax
+	if maxDefer <= 0 {
+		maxDefer = DefaultReloadDeferMax
+	}
+	if !h.deferredSince.IsZero() && now.Sub(h.deferredSince) >= maxDefer {
+		log.Warnf("weight change deferred for %s, applying it anyway", maxDefer)
+		h.deferredSince = time.Time{}
+		return false
+	}
+
+	stats, err := h.statsSocket.Stats()
+	if err != nil {
+		log.Warnf("cannot read the request rate, not deferring the reload: %s", err)
+		h.deferredSince = time.Time{}
+		return false
+	}
+	rate := requestRate(stats)
+	if rate <= h.opts.ReloadDeferRate {
+		if !h.deferredSince.IsZero() {
+			log.Infof("request rate down to %d/s, applying the deferred weight change", rate)
+		}
+		h.deferredSince = time.Time{}
+		return false
+	}
+
+	if h.deferredSince.IsZero() {
+		log.Infof("request rate at %d/s, deferring the weight change", rate)
+		h.deferredSince = now
+		h.opts.Metrics.IncrCounter("connect_reloads_deferred_total", 1, nil)
+	}
+	return true
+}
+
+// requestRate sums the request rate of the frontends, the session rate is
+// used for the TCP ones which have no requests
+func requestRate(stats models.NativeStats) int64 {
+	var rate int64
+	for _, c := range stats {
+		for _, st := range c.Stats {
+			if st.Type != "frontend" || st.Stats == nil {
+				continue
+			}
+			switch {
+			case st.Stats.ReqRate != nil:
+				rate += *st.Stats.ReqRate
+			case st.Stats.Rate != nil:
+				rate += *st.Stats.Rate
+			}
+		}
+	}
+	return rate
+}
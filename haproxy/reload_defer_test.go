@@ -0,0 +1,68 @@
+package haproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestRate(t *testing.T) {
+	rate := func(v int64) *int64 { return &v }
+	stats := models.NativeStats{{Stats: []*models.NativeStat{
+		{Type: "frontend", Name: "front_downstream", Stats: &models.NativeStatStats{ReqRate: rate(120), Rate: rate(40)}},
+		{Type: "frontend", Name: "front_db", Stats: &models.NativeStatStats{Rate: rate(15)}},
+		{Type: "backend", Name: "back_api", Stats: &models.NativeStatStats{ReqRate: rate(1000)}},
+	}}}
+	require.Equal(t, int64(135), requestRate(stats))
+}
+
+func TestEqualExceptWeights(t *testing.T) {
+	weight := func(v int64) *int64 { return &v }
+	backend := func(w int64, addrs ...string) state.State {
+		be := state.Backend{Backend: models.Backend{Name: "back_api"}}
+		for _, a := range addrs {
+			be.Servers = append(be.Servers, models.Server{Name: a, Address: a, Weight: weight(w)})
+		}
+		return state.State{Backends: []state.Backend{be}}
+	}
+
+	current := backend(100, "10.0.0.1", "10.0.0.2")
+	require.True(t, current.EqualExceptWeights(backend(50, "10.0.0.1", "10.0.0.2")))
+	require.False(t, current.EqualExceptWeights(backend(100, "10.0.0.1")))
+	require.Equal(t, int64(100), *current.Backends[0].Servers[0].Weight)
+}
+
+func TestDrains(t *testing.T) {
+	weight := func(v int64) *int64 { return &v }
+	backend := func(weights ...int64) state.State {
+		be := state.Backend{Backend: models.Backend{Name: "back_api"}}
+		for i, w := range weights {
+			be.Servers = append(be.Servers, models.Server{Name: fmt.Sprintf("srv_%d", i), Weight: weight(w)})
+		}
+		return state.State{Backends: []state.Backend{be}}
+	}
+
+	require.False(t, backend(100, 100).Drains(backend(50, 100)))
+	require.True(t, backend(100, 100).Drains(backend(100, 0)))
+	require.False(t, backend(100, 0).Drains(backend(50, 0)))
+	require.False(t, backend(100, 0).Drains(backend(100, 100)))
+}
+
+func TestDeferReloadAppliesDrains(t *testing.T) {
+	weight := func(v int64) *int64 { return &v }
+	backend := func(w int64) state.State {
+		return state.State{Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_api"},
+			Servers: []models.Server{{Name: "srv_0", Weight: weight(w)}},
+		}}}
+	}
+
+	// the stats socket is not read for a drain, the change is never deferred
+	h := &HAProxy{opts: utils.Options{ReloadDeferRate: 1}}
+	require.False(t, h.deferReload(backend(100), backend(0), time.Now()))
+}
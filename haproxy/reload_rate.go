@@ -0,0 +1,40 @@
+package haproxy
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadRateWindow is the period the reloads are counted over
+const reloadRateWindow = time.Minute
+
+// reloadRate warns when HAProxy is reloaded more often than limit times per
+// minute, each reload leaves an old worker running until its connections
+// are closed
+type reloadRate struct {
+	limit   int
+	reloads []time.Time
+	// warned is when the last warning was logged, it is logged once per
+	// window
+	warned time.Time
+}
+
+// record counts a reload and tells if the limit is exceeded
+func (r *reloadRate) record(now time.Time) bool {
+	if r.limit <= 0 {
+		return false
+	}
+
+	r.reloads = append(r.reloads, now)
+	for len(r.reloads) > 0 && now.Sub(r.reloads[0]) >= reloadRateWindow {
+		r.reloads = r.reloads[1:]
+	}
+	if len(r.reloads) <= r.limit || now.Sub(r.warned) < reloadRateWindow {
+		return false
+	}
+
+	r.warned = now
+	log.Warnf("haproxy reloaded %d times in the last %s, old workers holding long lived connections pile up", len(r.reloads), reloadRateWindow)
+	return true
+}
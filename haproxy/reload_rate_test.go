@@ -0,0 +1,25 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadRate(t *testing.T) {
+	r := &reloadRate{limit: 2}
+	now := time.Now()
+
+	require.False(t, r.record(now))
+	require.False(t, r.record(now.Add(10*time.Second)))
+	require.True(t, r.record(now.Add(20*time.Second)))
+	// warned once per window
+	require.False(t, r.record(now.Add(30*time.Second)))
+
+	// the first reloads left the window
+	require.False(t, r.record(now.Add(85*time.Second)))
+	require.Len(t, r.reloads, 2)
+
+	require.False(t, (&reloadRate{}).record(now))
+}
@@ -0,0 +1,76 @@
+package haproxy
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/renderer"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/writer"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+)
+
+func newRenderer(opts utils.Options) (*renderer.Renderer, error) {
+	if opts.HAProxyTemplate == "" {
+		return renderer.New(), nil
+	}
+	return renderer.NewFromFile(opts.HAProxyTemplate)
+}
+
+// RenderOnly returns the HAProxy config generated for a Consul config
+// without starting anything. The certificates and maps it references are
+// written to a temporary directory removed on shutdown.
+func RenderOnly(sd *lib.Shutdown, cfg consul.Config, opts utils.Options) (string, error) {
+	_, conf, err := render(sd, cfg, opts)
+	return conf, err
+}
+
+// ValidateOnly renders the HAProxy config of a Consul config like
+// RenderOnly and checks it with haproxy -c
+func ValidateOnly(sd *lib.Shutdown, cfg consul.Config, opts utils.Options) error {
+	hc, conf, err := render(sd, cfg, opts)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(hc.HAProxy, []byte(conf), 0600)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command(opts.HAProxyBin, "-c", "-f", hc.HAProxy).CombinedOutput()
+	if err != nil {
+		return lib.NewExitError(lib.ExitValidation, &writer.ValidationError{Err: err, Output: string(output)})
+	}
+	return nil
+}
+
+func render(sd *lib.Shutdown, cfg consul.Config, opts utils.Options) (*haConfig, string, error) {
+	hc, err := newHaConfig(opts.ConfigBaseDir, opts.SecretsDir, opts.HAProxyParams, false, opts.SPOEListeners, sd)
+	if err != nil {
+		return nil, "", err
+	}
+	checkSecretsDir(hc.Secrets)
+
+	r, err := newRenderer(opts)
+	if err != nil {
+		return nil, "", lib.NewExitError(lib.ExitConfig, err)
+	}
+
+	st, err := state.Generate(stateOptions(opts, hc), hc, state.State{}, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	// haproxy -c loads the scripts
+	err = writeLuaScripts(st)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conf, err := r.Render(st, hc.StatsSock, renderer.HAProxyParams{
+		Globals:  opts.HAProxyParams.Globals,
+		Defaults: opts.HAProxyParams.Defaults,
+	})
+	return hc, conf, err
+}
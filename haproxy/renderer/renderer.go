@@ -3,22 +3,64 @@ package renderer
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"strings"
 	"text/template"
 
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
 )
 
-type Renderer struct{}
+type Renderer struct {
+	tmpl *template.Template
+}
 
+// New returns a renderer using the embedded template
 func New() *Renderer {
-	return &Renderer{}
+	return &Renderer{
+		tmpl: template.Must(parse(DefaultTemplate)),
+	}
+}
+
+// NewFromFile returns a renderer using a custom template, the template is
+// validated by rendering a sample state
+func NewFromFile(path string) (*Renderer, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", path, err)
+	}
+
+	r := &Renderer{tmpl: tmpl}
+	_, err = r.Render(sampleState, "/tmp/haproxy.sock", HAProxyParams{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", path, err)
+	}
+
+	return r, nil
 }
 
-type renderContext struct {
-	SocketPath    string
+// RenderContext is the data templates are executed with
+type RenderContext struct {
+	// SocketPath is the admin stats socket, it must be declared in the
+	// global section as the runtime API is used through it
+	SocketPath string
+	// HAProxyParams are the global and defaults parameters, by name
 	HAProxyParams HAProxyParams
-	Frontends     []state.Frontend
-	Backends      []state.Backend
+	// Frontends and Backends are the generated proxies, sorted by name
+	Frontends []state.Frontend
+	Backends  []state.Backend
+	// NoReusePort disables SO_REUSEPORT on all the listeners
+	NoReusePort bool
+	// LuaScripts are loaded with lua-load
+	LuaScripts []state.LuaScript
+	// StatsPagePort is the localhost port of the HAProxy stats page,
+	// disabled when 0
+	StatsPagePort int
 }
 
 type HAProxyParams struct {
@@ -26,9 +68,94 @@ type HAProxyParams struct {
 	Defaults map[string][]string
 }
 
-const configTemplate = `global
+// sampleState exercises the optional parts of the template for validation
+var sampleState = state.State{
+	Frontends: []state.Frontend{{
+		Frontend: models.Frontend{Name: "front_sample", Mode: models.FrontendModeHTTP, DefaultBackend: "back_sample", LogFormat: "%ci:%cp", Maxconn: int64p(100)},
+		Bind:     models.Bind{Name: "bind_sample", Address: "127.0.0.1", Port: int64p(10000), Transparent: true, V4v6: true, Interface: "eth0", Backlog: "1024", Ssl: true, SslCertificate: "/tmp/sample.pem", NoTLSTickets: true, TLSTicketKeys: "/tmp/sample.keys"},
+		LogTarget: &models.LogTarget{
+			Address:  "/tmp/logs.sock",
+			Facility: models.LogTargetFacilityLocal0,
+			Format:   models.LogTargetFormatRfc5424,
+		},
+		FilterCompression: &state.FrontendFilter{Filter: models.Filter{Type: models.FilterTypeCompression}},
+		Compression:       &state.Compression{Algos: []string{"gzip"}, Types: []string{"text/html"}, MinSize: 1024},
+		FilterSpoe:        &state.FrontendFilter{Filter: models.Filter{Type: models.FilterTypeSpoe}},
+		JWT:               &state.JWT{SPOEConfig: "/tmp/spoe.conf"},
+		BackendMap:        "/tmp/sample.map",
+		DstMap:            "/tmp/sample_dst.map",
+		RateLimit: &state.RateLimit{
+			Conn:          100,
+			Req:           100,
+			SourceTable:   "st_front_sample",
+			Sources:       []state.SourceRateLimit{{Service: "web", Req: 50}},
+			SourceDefault: 10,
+		},
+		LuaActions:  []string{"auth"},
+		ExtraConfig: []string{"option http-keep-alive"},
+		Explain:     []string{"public listener of service sample"},
+	}},
+	Backends: []state.Backend{{
+		Backend: models.Backend{
+			Name:       "back_sample",
+			Mode:       models.BackendModeHTTP,
+			HashType:   &models.BackendHashType{Method: models.BackendHashTypeMethodConsistent},
+			Allbackups: "enabled",
+			Cookie:     &models.Cookie{Name: stringp("SESSION"), Type: models.CookieTypePrefix, Nocache: true},
+		},
+		LogTarget: &models.LogTarget{
+			Address:  "/tmp/logs.sock",
+			Facility: models.LogTargetFacilityLocal0,
+		},
+		Servers: []models.Server{{
+			Name:        "srv_0",
+			Address:     "127.0.0.1",
+			Port:        int64p(8080),
+			Weight:      int64p(1),
+			Cookie:      "srv_0",
+			Maxconn:     int64p(100),
+			Maxqueue:    int64p(10),
+			Slowstart:   int64p(30000),
+			Backup:      models.ServerBackupEnabled,
+			SendProxyV2: models.ServerSendProxyV2Enabled,
+		}},
+		Fullconn:          1000,
+		HTTPRequestRules:  []models.HTTPRequestRule{{Type: models.HTTPRequestRuleTypeReplaceHeader, HdrName: "X-Sample", HdrMatch: "^(.*)$", HdrFormat: "\\1"}, {Type: models.HTTPRequestRuleTypeSetPath, PathFmt: "/sample%[path]"}},
+		HTTPResponseRules: []models.HTTPResponseRule{{Type: models.HTTPResponseRuleTypeSetHeader, HdrName: "X-Sample", HdrFormat: "sample"}},
+		LuaActions:        []string{"tag"},
+		ExtraConfig:       []string{"option redispatch"},
+		Explain:           []string{"srv_0: instance 127.0.0.1:8080"},
+		HTTPCheck: &state.HTTPCheck{
+			Method:  "GET",
+			URI:     "/health",
+			Headers: []state.HTTPCheckHeader{{Name: "Host", Value: "sample"}},
+		},
+		Mirror: &state.Mirror{SPOEConfig: "/tmp/spoe.conf", Upstream: "sample_v2", Percent: 10},
+	}},
+	NoReusePort:   true,
+	LuaScripts:    []state.LuaScript{{Name: "sample.lua", Path: "/tmp/sample.lua"}},
+	StatsPagePort: 10001,
+}
+
+func int64p(i int64) *int64 {
+	return &i
+}
+
+func stringp(s string) *string {
+	return &s
+}
+
+// DefaultTemplate is the embedded template, custom templates are executed
+// with the same RenderContext and functions
+const DefaultTemplate = `global
 	stats socket {{.SocketPath}} mode 600 level admin expose-fd listeners
 	expose-experimental-directives
+	{{- if .NoReusePort}}
+	noreuseport
+	{{- end}}
+	{{- range .LuaScripts}}
+	lua-load {{.Path}}
+	{{- end}}
 	{{- range $k, $vs := .HAProxyParams.Globals}}
 	{{- range $v := $vs}}
 	{{$k}} {{$v}}
@@ -41,14 +168,31 @@ defaults
 	{{$k}} {{$v}}
 	{{- end }}
 	{{- end }}
-
+{{if .StatsPagePort}}
+frontend haproxy_stats
+	mode http
+	bind 127.0.0.1:{{.StatsPagePort}}
+	stats enable
+	stats uri /haproxy/
+	stats refresh 10s
+	stats show-legends
+{{end}}
 {{range .Frontends}}
 frontend {{.Frontend.Name}}
+	{{- range .Explain}}
+	# {{comment .}}
+	{{- end}}
 	{{- if .Frontend.Mode}}
 	mode {{.Frontend.Mode}}
 	{{- end}}
 	{{- if .Bind.Address}}
-	bind {{.Bind.Address}}:{{derefInt64 .Bind.Port}}{{if .Bind.Ssl}} ssl crt {{.Bind.SslCertificate}}{{if .Bind.SslCafile}} ca-file {{.Bind.SslCafile}}{{end}}{{if .Bind.Verify}} verify {{.Bind.Verify}}{{end}}{{if eq .Frontend.Mode "http"}} alpn h2,http/1.1{{end}} ktls on{{end}}
+	bind {{.Bind.Address}}:{{derefInt64 .Bind.Port}}{{if .Bind.Ssl}} ssl crt {{.Bind.SslCertificate}}{{if .Bind.SslCafile}} ca-file {{.Bind.SslCafile}}{{end}}{{if .Bind.Verify}} verify {{.Bind.Verify}}{{end}}{{if .Bind.Alpn}} alpn {{.Bind.Alpn}}{{end}}{{if .Bind.NoTLSTickets}} no-tls-tickets{{end}}{{if .Bind.TLSTicketKeys}} tls-ticket-keys {{.Bind.TLSTicketKeys}}{{end}} ktls on{{end}}{{if .Bind.Proto}} proto {{.Bind.Proto}}{{end}}{{if .Bind.Transparent}} transparent{{end}}{{if .Bind.V4v6}} v4v6{{end}}{{if .Bind.Interface}} interface {{.Bind.Interface}}{{end}}{{if .Bind.Backlog}} backlog {{.Bind.Backlog}}{{end}}
+	{{- end}}
+	{{- if .BackendMap}}
+	use_backend %[rand({{splitSlots}}),map_int({{.BackendMap}},{{.Frontend.DefaultBackend}})]
+	{{- end}}
+	{{- if .DstMap}}
+	use_backend %[dst,map_ip({{.DstMap}})]
 	{{- end}}
 	{{- if .Frontend.DefaultBackend}}
 	default_backend {{.Frontend.DefaultBackend}}
@@ -56,16 +200,66 @@ frontend {{.Frontend.Name}}
 	{{- if .Frontend.ClientTimeout}}
 	timeout client {{.Frontend.ClientTimeout}}ms
 	{{- end}}
+	{{- if .Frontend.Maxconn}}
+	maxconn {{derefInt64 .Frontend.Maxconn}}
+	{{- end}}
+	{{- if .RateLimit}}
+	{{- if or .RateLimit.Conn .RateLimit.Req}}
+	stick-table type ipv6 size 100k expire 10s store {{if .RateLimit.Conn}}conn_rate(1s){{end}}{{if and .RateLimit.Conn .RateLimit.Req}},{{end}}{{if .RateLimit.Req}}http_req_rate(1s){{end}}
+	tcp-request connection track-sc0 src
+	{{- end}}
+	{{- if .RateLimit.Conn}}
+	tcp-request connection reject if { sc0_conn_rate gt {{.RateLimit.Conn}} }
+	{{- end}}
+	{{- if .RateLimit.Req}}
+	http-request deny deny_status 429 if { sc0_http_req_rate gt {{.RateLimit.Req}} }
+	{{- end}}
+	{{- if .RateLimit.SourceTable}}
+	{{- $rl := .RateLimit}}
+	http-request track-sc1 var(sess.connect.source_app) table {{$rl.SourceTable}} if { var(sess.connect.source_app) -m found }
+	{{- range $rl.Sources}}
+	http-request deny deny_status 429 if { var(sess.connect.source_app) -m str {{.Service}} } { sc1_http_req_rate({{$rl.SourceTable}}) gt {{.Req}} }
+	{{- end}}
+	{{- if $rl.SourceDefault}}
+	http-request deny deny_status 429 if {{if $rl.Sources}}!{ var(sess.connect.source_app) -m str{{range $rl.Sources}} {{.Service}}{{end}} } {{end}}{ sc1_http_req_rate({{$rl.SourceTable}}) gt {{$rl.SourceDefault}} }
+	{{- end}}
+	{{- end}}
+	{{- end}}
 	{{- if .Frontend.Httplog}}
 	option httplog
 	{{- end}}
+	{{- if .Frontend.LogFormat}}
+	log-format "{{.Frontend.LogFormat}}"
+	{{- end}}
 	{{- if .FilterSpoe}}
 	filter spoe engine {{.FilterSpoe.Filter.SpoeEngine}} config {{.FilterSpoe.Filter.SpoeConfig}}
+	{{- if .FilterSpoe.Rule.Action}}
 	tcp-request content {{.FilterSpoe.Rule.Action}}{{if .FilterSpoe.Rule.Cond}} {{.FilterSpoe.Rule.Cond}}{{end}}{{if .FilterSpoe.Rule.CondTest}} {{.FilterSpoe.Rule.CondTest}}{{end}}
 	{{- end}}
+	{{- end}}
+	{{- if .JWT}}
+	filter spoe engine jwt config {{.JWT.SPOEConfig}}
+	http-request send-spoe-group jwt jwt
+	http-request deny deny_status 401 unless { var(txn.jwt.valid) -m int eq 1 }
+	{{- end}}
+	{{- $mode := .Frontend.Mode}}
+	{{- range .LuaActions}}
+	{{if eq $mode "http"}}http-request{{else}}tcp-request content{{end}} lua.{{.}}
+	{{- end}}
 	{{- if .FilterCompression}}
 	filter compression
 	{{- end}}
+	{{- if .Compression}}
+	{{- if .Compression.Algos}}
+	compression algo{{range .Compression.Algos}} {{.}}{{end}}
+	{{- end}}
+	{{- if .Compression.Types}}
+	compression type{{range .Compression.Types}} {{.}}{{end}}
+	{{- end}}
+	{{- if .Compression.MinSize}}
+	compression minsize-res {{.Compression.MinSize}}
+	{{- end}}
+	{{- end}}
 	{{- if .LogTarget}}
 	{{- if .LogTarget.Format}}
 	log {{.LogTarget.Address}} format {{.LogTarget.Format}} {{.LogTarget.Facility}}
@@ -73,17 +267,29 @@ frontend {{.Frontend.Name}}
 	log {{.LogTarget.Address}} {{.LogTarget.Facility}}
 	{{- end}}
 	{{- end}}
+	{{- range .ExtraConfig}}
+	{{.}}
+	{{- end}}
 {{end}}
 
 {{range .Backends}}
 backend {{.Backend.Name}}
+	{{- range .Explain}}
+	# {{comment .}}
+	{{- end}}
 	{{- if .Backend.Mode}}
 	mode {{.Backend.Mode}}
 	{{- end}}
 	{{- if .Backend.Balance}}
 	{{- if .Backend.Balance.Algorithm}}
-	balance {{.Backend.Balance.Algorithm}}
+	balance {{.Backend.Balance.Algorithm}}{{if .Backend.Balance.HdrName}}({{.Backend.Balance.HdrName}}){{end}}
+	{{- end}}
 	{{- end}}
+	{{- if .Backend.HashType}}
+	hash-type {{.Backend.HashType.Method}}
+	{{- end}}
+	{{- if .Backend.Cookie}}
+	cookie {{derefString .Backend.Cookie.Name}} {{.Backend.Cookie.Type}}{{if .Backend.Cookie.Indirect}} indirect{{end}}{{if .Backend.Cookie.Nocache}} nocache{{end}}
 	{{- end}}
 	{{- if .Backend.ServerTimeout}}
 	timeout server {{.Backend.ServerTimeout}}ms
@@ -94,6 +300,16 @@ backend {{.Backend.Name}}
 	{{- if .Backend.Retries}}
 	retries {{derefInt64 .Backend.Retries}}
 	{{- end}}
+	{{- if .Fullconn}}
+	fullconn {{.Fullconn}}
+	{{- end}}
+	{{- if .HTTPCheck}}
+	option httpchk
+	http-check send meth {{.HTTPCheck.Method}} uri {{.HTTPCheck.URI}} ver HTTP/1.1{{range .HTTPCheck.Headers}} hdr {{.Name}} {{quote .Value}}{{end}}
+	{{- end}}
+	{{- if eq .Backend.Allbackups "enabled"}}
+	option allbackups
+	{{- end}}
 	{{- if .Backend.Forwardfor}}
 	{{- if .Backend.Forwardfor.Enabled}}
 	{{- if eq .Backend.Forwardfor.Enabled "enabled"}}
@@ -108,39 +324,90 @@ backend {{.Backend.Name}}
 	log {{.LogTarget.Address}} {{.LogTarget.Facility}}
 	{{- end}}
 	{{- end}}
+	{{- if .Mirror}}
+	option http-buffer-request
+	filter spoe engine mirror config {{.Mirror.SPOEConfig}}
+	http-request set-var(txn.connect_mirror) str({{.Mirror.Upstream}}){{if lt .Mirror.Percent 100}} if { rand(100) lt {{.Mirror.Percent}} }{{end}}
+	http-request send-spoe-group mirror mirror if { var(txn.connect_mirror) -m found }
+	{{- end}}
+	{{- $mode := .Backend.Mode}}
+	{{- range .LuaActions}}
+	{{if eq $mode "http"}}http-request{{else}}tcp-request content{{end}} lua.{{.}}
+	{{- end}}
 	{{- range .HTTPRequestRules}}
-	http-request {{.Type}}{{if .HdrName}} {{.HdrName}}{{end}}{{if .HdrFormat}} {{.HdrFormat}}{{end}}
+	http-request {{.Type}}{{if .HdrName}} {{.HdrName}}{{end}}{{if .HdrMatch}} {{quote .HdrMatch}}{{end}}{{if .HdrFormat}} {{quote .HdrFormat}}{{end}}{{if .PathFmt}} {{quote .PathFmt}}{{end}}
+	{{- end}}
+	{{- range .HTTPResponseRules}}
+	http-response {{.Type}}{{if .HdrName}} {{.HdrName}}{{end}}{{if .HdrMatch}} {{quote .HdrMatch}}{{end}}{{if .HdrFormat}} {{quote .HdrFormat}}{{end}}
 	{{- end}}
 	{{- range .Servers}}
-	server {{.Name}} {{.Address}}:{{derefInt64 .Port}}{{if .Ssl}} ssl crt {{.SslCertificate}}{{if .SslCafile}} ca-file {{.SslCafile}}{{end}}{{if .Verify}} verify {{.Verify}}{{end}}{{if .NoVerifyhost}} no-verifyhost{{end}} ktls on{{end}}{{if .Weight}} weight {{derefInt64 .Weight}}{{end}}{{if eq .Maintenance "enabled"}} disabled{{end}}{{if eq .Check "enabled"}} check{{end}}{{if .Inter}} inter {{derefInt64 .Inter}}{{end}}{{if .Fastinter}} fastinter {{derefInt64 .Fastinter}}{{end}}{{if .Downinter}} downinter {{derefInt64 .Downinter}}{{end}}{{if .Rise}} rise {{derefInt64 .Rise}}{{end}}{{if .Fall}} fall {{derefInt64 .Fall}}{{end}}{{if .Observe}} observe {{.Observe}}{{end}}{{if .ErrorLimit}} error-limit {{.ErrorLimit}}{{end}}{{if .OnError}} on-error {{.OnError}}{{end}}
+	server {{.Name}} {{.Address}}:{{derefInt64 .Port}}{{if .Ssl}} ssl crt {{.SslCertificate}}{{if .SslCafile}} ca-file {{.SslCafile}}{{end}}{{if .Verify}} verify {{.Verify}}{{end}}{{if .NoVerifyhost}} no-verifyhost{{end}}{{if .Alpn}} alpn {{.Alpn}}{{end}} ktls on{{end}}{{if .Proto}} proto {{.Proto}}{{end}}{{if eq .SendProxyV2 "enabled"}} send-proxy-v2{{end}}{{if .Weight}} weight {{derefInt64 .Weight}}{{end}}{{if .Cookie}} cookie {{.Cookie}}{{end}}{{if .Maxconn}} maxconn {{derefInt64 .Maxconn}}{{end}}{{if .Maxqueue}} maxqueue {{derefInt64 .Maxqueue}}{{end}}{{if .Slowstart}} slowstart {{derefInt64 .Slowstart}}ms{{end}}{{if eq .Backup "enabled"}} backup{{end}}{{if eq .Maintenance "enabled"}} disabled{{end}}{{if eq .Check "enabled"}} check{{else if eq .Check "disabled"}} no-check{{end}}{{if .Inter}} inter {{derefInt64 .Inter}}{{end}}{{if .Fastinter}} fastinter {{derefInt64 .Fastinter}}{{end}}{{if .Downinter}} downinter {{derefInt64 .Downinter}}{{end}}{{if .Rise}} rise {{derefInt64 .Rise}}{{end}}{{if .Fall}} fall {{derefInt64 .Fall}}{{end}}{{if .Observe}} observe {{.Observe}}{{end}}{{if .ErrorLimit}} error-limit {{.ErrorLimit}}{{end}}{{if .OnError}} on-error {{.OnError}}{{end}}
+	{{- end}}
+	{{- range .ExtraConfig}}
+	{{.}}
 	{{- end}}
 {{end}}
+
+{{- range .Frontends}}
+{{- if .RateLimit}}
+{{- if .RateLimit.SourceTable}}
+backend {{.RateLimit.SourceTable}}
+	stick-table type string len 128 size 10k expire 10s store http_req_rate(1s)
+{{end}}
+{{- end}}
+{{- end}}
 `
 
-func (r *Renderer) Render(st state.State, socketPath string, haproxyParams HAProxyParams) (string, error) {
-	funcMap := template.FuncMap{
-		"derefInt64": func(p *int64) int64 {
-			if p == nil {
-				return 0
-			}
-			return *p
-		},
-	}
+var funcMap = template.FuncMap{
+	"derefInt64": func(p *int64) int64 {
+		if p == nil {
+			return 0
+		}
+		return *p
+	},
+	"derefString": func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	},
+	"comment":    comment,
+	"quote":      quote,
+	"splitSlots": func() int { return state.SplitSlots },
+}
 
-	tmpl, err := template.New("config").Funcs(funcMap).Parse(configTemplate)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
+// quote makes a single argument of a config value, single quotes keep it
+// as is while double quotes would expand the environment variables
+func quote(s string) string {
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'"
 	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(s) + `"`
+}
+
+// comment keeps a value on its comment line, a line break would end the
+// comment and the rest of the value would be read as directives
+func comment(s string) string {
+	return strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(s)
+}
+
+func parse(text string) (*template.Template, error) {
+	return template.New("config").Funcs(funcMap).Option("missingkey=error").Parse(text)
+}
 
-	ctx := renderContext{
+func (r *Renderer) Render(st state.State, socketPath string, haproxyParams HAProxyParams) (string, error) {
+	ctx := RenderContext{
 		SocketPath:    socketPath,
 		HAProxyParams: haproxyParams,
 		Frontends:     st.Frontends,
 		Backends:      st.Backends,
+		NoReusePort:   st.NoReusePort,
+		LuaScripts:    st.LuaScripts,
+		StatsPagePort: st.StatsPagePort,
 	}
 
 	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, ctx)
+	err := r.tmpl.Execute(&buf, ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to execute template: %w", err)
 	}
@@ -0,0 +1,284 @@
+package renderer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	r, err := NewFromFile(write("valid", DefaultTemplate+"\n# custom\n"))
+	require.NoError(t, err)
+	out, err := r.Render(sampleState, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "# custom")
+
+	_, err = NewFromFile(write("syntax", "{{range .Frontends}}"))
+	require.Error(t, err)
+
+	_, err = NewFromFile(write("field", "{{range .Frontends}}{{.Unknown}}{{end}}"))
+	require.Error(t, err)
+}
+
+func TestRenderExtraConfig(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend:    models.Frontend{Name: "front_a"},
+			ExtraConfig: []string{"http-request set-header X-A a"},
+		}},
+		Backends: []state.Backend{{
+			Backend:     models.Backend{Name: "back_a"},
+			ExtraConfig: []string{"option redispatch"},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "frontend front_a\n\thttp-request set-header X-A a\n")
+	require.Contains(t, out, "backend back_a\n\toption redispatch\n")
+}
+
+func TestRenderBindOptions(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend: models.Frontend{Name: "front_a"},
+			Bind:     models.Bind{Name: "bind_a", Address: "::", Port: int64p(21000), Transparent: true, V4v6: true, Interface: "eth0"},
+		}},
+		NoReusePort: true,
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\tnoreuseport\n")
+	require.Contains(t, out, "bind :::21000 transparent v4v6 interface eth0\n")
+}
+
+func TestRenderListenerLimits(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend:  models.Frontend{Name: "front_a", Maxconn: int64p(500)},
+			Bind:      models.Bind{Name: "bind_a", Address: "0.0.0.0", Port: int64p(21000), Backlog: "4096"},
+			RateLimit: &state.RateLimit{Conn: 50, Req: 200},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "bind 0.0.0.0:21000 backlog 4096\n")
+	require.Contains(t, out, "\tmaxconn 500\n")
+	require.Contains(t, out, "\tstick-table type ipv6 size 100k expire 10s store conn_rate(1s),http_req_rate(1s)\n")
+	require.Contains(t, out, "\ttcp-request connection reject if { sc0_conn_rate gt 50 }\n")
+	require.Contains(t, out, "\thttp-request deny deny_status 429 if { sc0_http_req_rate gt 200 }\n")
+}
+
+func TestRenderSourceRateLimits(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend: models.Frontend{Name: "front_a", Mode: models.FrontendModeHTTP},
+			Bind:     models.Bind{Name: "bind_a", Address: "0.0.0.0", Port: int64p(21000)},
+			RateLimit: &state.RateLimit{
+				SourceTable:   "st_front_a",
+				Sources:       []state.SourceRateLimit{{Service: "api", Req: 100}, {Service: "web", Req: 50}},
+				SourceDefault: 10,
+			},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.NotContains(t, out, "track-sc0")
+	require.Contains(t, out, "\thttp-request track-sc1 var(sess.connect.source_app) table st_front_a if { var(sess.connect.source_app) -m found }\n")
+	require.Contains(t, out, "\thttp-request deny deny_status 429 if { var(sess.connect.source_app) -m str web } { sc1_http_req_rate(st_front_a) gt 50 }\n")
+	require.Contains(t, out, "\thttp-request deny deny_status 429 if !{ var(sess.connect.source_app) -m str api web } { sc1_http_req_rate(st_front_a) gt 10 }\n")
+	require.Contains(t, out, "backend st_front_a\n\tstick-table type string len 128 size 10k expire 10s store http_req_rate(1s)\n")
+}
+
+func TestRenderHeaderRules(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a", Mode: models.BackendModeHTTP},
+			HTTPRequestRules: []models.HTTPRequestRule{
+				{Type: models.HTTPRequestRuleTypeAddHeader, HdrName: "X-App", HdrFormat: "%[var(sess.connect.source_app)]"},
+				{Type: models.HTTPRequestRuleTypeSetHeader, HdrName: "X-Env", HdrFormat: "prod eu"},
+				{Type: models.HTTPRequestRuleTypeDelHeader, HdrName: "X-Debug"},
+			},
+			HTTPResponseRules: []models.HTTPResponseRule{
+				{Type: models.HTTPResponseRuleTypeReplaceHeader, HdrName: "Location", HdrMatch: "^http://(.*)", HdrFormat: "https://\\1"},
+			},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	// the formats are quoted, a value with spaces stays a single argument
+	require.Contains(t, out, "\thttp-request add-header X-App '%[var(sess.connect.source_app)]'\n")
+	require.Contains(t, out, "\thttp-request set-header X-Env 'prod eu'\n")
+	require.Contains(t, out, "\thttp-request del-header X-Debug\n")
+	require.Contains(t, out, "\thttp-response replace-header Location '^http://(.*)' 'https://\\1'\n")
+}
+
+func TestRenderSetPath(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a", Mode: models.BackendModeHTTP},
+			HTTPRequestRules: []models.HTTPRequestRule{
+				{Type: models.HTTPRequestRuleTypeSetPath, PathFmt: "/api%[path,regsub(^/v1$,/),regsub(^/v1/,/)]"},
+			},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\thttp-request set-path '/api%[path,regsub(^/v1$,/),regsub(^/v1/,/)]'\n")
+}
+
+func TestRenderMirror(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a", Mode: models.BackendModeHTTP},
+			Mirror:  &state.Mirror{SPOEConfig: "/tmp/spoe.conf", Upstream: "a_v2", Percent: 10},
+		}, {
+			Backend: models.Backend{Name: "back_b", Mode: models.BackendModeHTTP},
+			Mirror:  &state.Mirror{SPOEConfig: "/tmp/spoe.conf", Upstream: "b_v2", Percent: 100},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\toption http-buffer-request\n\tfilter spoe engine mirror config /tmp/spoe.conf\n")
+	require.Contains(t, out, "\thttp-request set-var(txn.connect_mirror) str(a_v2) if { rand(100) lt 10 }\n")
+	// all the requests are copied without condition
+	require.Contains(t, out, "\thttp-request set-var(txn.connect_mirror) str(b_v2)\n")
+	require.Contains(t, out, "\thttp-request send-spoe-group mirror mirror if { var(txn.connect_mirror) -m found }\n")
+}
+
+func TestRenderJWT(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend: models.Frontend{Name: "front_downstream", Mode: models.FrontendModeHTTP},
+			JWT:      &state.JWT{SPOEConfig: "/tmp/spoe.conf"},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\tfilter spoe engine jwt config /tmp/spoe.conf\n\thttp-request send-spoe-group jwt jwt\n\thttp-request deny deny_status 401 unless { var(txn.jwt.valid) -m int eq 1 }\n")
+}
+
+func TestRenderLua(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend:   models.Frontend{Name: "front_downstream", Mode: models.FrontendModeHTTP},
+			LuaActions: []string{"auth"},
+		}},
+		Backends: []state.Backend{{
+			Backend:    models.Backend{Name: "back_db", Mode: models.BackendModeTCP},
+			LuaActions: []string{"tag"},
+		}},
+		LuaScripts: []state.LuaScript{{Name: "auth.lua", Path: "/run/connect/lua/auth.lua"}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\tlua-load /run/connect/lua/auth.lua\n")
+	require.Contains(t, out, "\thttp-request lua.auth\n")
+	require.Contains(t, out, "\ttcp-request content lua.tag\n")
+}
+
+func TestRenderCompression(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend:          models.Frontend{Name: "front_a", Mode: models.FrontendModeHTTP},
+			Bind:              models.Bind{Name: "bind_a", Address: "0.0.0.0", Port: int64p(21000)},
+			FilterCompression: &state.FrontendFilter{Filter: models.Filter{Type: models.FilterTypeCompression}},
+			Compression:       &state.Compression{Algos: []string{"gzip", "deflate"}, Types: []string{"text/html", "application/json"}, MinSize: 1024},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\tfilter compression\n\tcompression algo gzip deflate\n\tcompression type text/html application/json\n\tcompression minsize-res 1024\n")
+}
+
+func TestRenderTLSTickets(t *testing.T) {
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend: models.Frontend{Name: "front_a"},
+			Bind:     models.Bind{Name: "bind_a", Address: "0.0.0.0", Port: int64p(21000), Ssl: true, SslCertificate: "/crt.pem", TLSTicketKeys: "/keys"},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "bind 0.0.0.0:21000 ssl crt /crt.pem tls-ticket-keys /keys ktls on\n")
+}
+
+func TestRenderStatsPage(t *testing.T) {
+	out, err := New().Render(state.State{}, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.NotContains(t, out, "haproxy_stats")
+
+	out, err = New().Render(state.State{StatsPagePort: 8404}, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "\nfrontend haproxy_stats\n\tmode http\n\tbind 127.0.0.1:8404\n\tstats enable\n\tstats uri /haproxy/\n")
+}
+
+func TestRenderSendProxy(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a"},
+			Servers: []models.Server{{Name: "srv_0", Address: "127.0.0.1", Port: int64p(8080), SendProxyV2: models.ServerSendProxyV2Enabled}},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "server srv_0 127.0.0.1:8080 send-proxy-v2")
+}
+
+func TestRenderHTTPCheck(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a"},
+			HTTPCheck: &state.HTTPCheck{
+				Method: "GET",
+				URI:    "/health",
+				Headers: []state.HTTPCheckHeader{
+					{Name: "Host", Value: "api"},
+					{Name: "Authorization", Value: "Bearer a b"},
+					{Name: "X-Quote", Value: `it's "$HOME"`},
+				},
+			},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "backend back_a\n\toption httpchk\n\thttp-check send meth GET uri /health ver HTTP/1.1 hdr Host 'api' hdr Authorization 'Bearer a b' hdr X-Quote \"it's \\\"\\$HOME\\\"\"\n")
+}
+
+func TestRenderExplainLineBreak(t *testing.T) {
+	st := state.State{
+		Backends: []state.Backend{{
+			Backend: models.Backend{Name: "back_a"},
+			Explain: []string{"srv_0: instance 127.0.0.1:8080, node web\r\n\tbind :80"},
+		}},
+	}
+
+	out, err := New().Render(st, "/sock", HAProxyParams{})
+	require.NoError(t, err)
+	require.Contains(t, out, "backend back_a\n\t# srv_0: instance 127.0.0.1:8080, node web\\r\\n\tbind :80\n")
+	require.NotContains(t, out, "\n\tbind :80")
+}
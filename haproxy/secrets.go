@@ -0,0 +1,89 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+)
+
+// checkSecretsDir warns when the private keys written to dir may be kept on a
+// persistent disk
+func checkSecretsDir(dir string) {
+	memory, err := inMemoryFS(dir)
+	if err != nil {
+		log.Warnf("cannot tell if the private keys written to %s are kept in memory: %s", dir, err)
+		return
+	}
+	if !memory {
+		log.Warnf("SECURITY: the private keys are written to %s, which is not a tmpfs and may keep them on disk. Set -secrets-dir to a tmpfs mount, eg: /dev/shm", dir)
+	}
+}
+
+// shredUnusedCerts shreds the certificate files of the previous state once
+// the new one is applied, eg: after the rotation of the leaf certificate.
+// The memory files are closed.
+func (h *HAProxy) shredUnusedCerts(previous, current state.State) {
+	for _, file := range previous.UnusedCerts(current) {
+		if h.haConfig.memFiles != nil {
+			h.haConfig.memFiles.release(file)
+			continue
+		}
+		// only the files written by the sidecar
+		if filepath.Dir(file) != h.haConfig.Secrets {
+			continue
+		}
+		err := shred(file)
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// shred overwrites a file with zeros before removing it, so that its content
+// is not left on the filesystem
+func shred(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, st.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to shred %s: %w", file, err)
+	}
+	return os.Remove(file)
+}
+
+// shredDir shreds the regular files of a dir, the sockets and sub dirs are
+// left
+func shredDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Errorf("cannot shred the files of %s: %s", dir, err)
+		return
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		err := shred(filepath.Join(dir, e.Name()))
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
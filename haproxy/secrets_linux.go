@@ -0,0 +1,22 @@
+package haproxy
+
+import (
+	"syscall"
+)
+
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// inMemoryFS tells if the filesystem of a dir keeps its files in memory
+func inMemoryFS(dir string) (bool, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return false, err
+	}
+	// the type is signed on some architectures
+	t := uint32(st.Type)
+	return t == tmpfsMagic || t == ramfsMagic, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package haproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// inMemoryFS tells if the filesystem of a dir keeps its files in memory
+func inMemoryFS(dir string) (bool, error) {
+	return false, fmt.Errorf("filesystem types are not checked on %s", runtime.GOOS)
+}
@@ -0,0 +1,60 @@
+package haproxy
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// warmUpServers puts the servers added by a change through the maintenance
+// mode: HAProxy does not apply slowstart to the servers it starts with, only
+// to the ones coming back
+func (h *HAProxy) warmUpServers(oldState, newState state.State) {
+	for _, be := range addedServers(oldState, newState) {
+		for _, cmd := range []string{"maint", "ready"} {
+			_, err := h.statsSocket.Exec(fmt.Sprintf("set server %s state %s", be, cmd))
+			if err != nil {
+				log.Warnf("cannot slow start server %s: %s", be, err)
+				break
+			}
+		}
+		log.Infof("server %s slow starting", be)
+	}
+}
+
+// addedServers returns backend/server for the servers with a slowstart
+// that were not in the existing backends of the old state
+func addedServers(oldState, newState state.State) []string {
+	old := map[string]map[string]bool{}
+	for _, be := range oldState.Backends {
+		addrs := map[string]bool{}
+		for _, s := range be.Servers {
+			addrs[serverAddr(s.Address, s.Port)] = true
+		}
+		old[be.Backend.Name] = addrs
+	}
+
+	added := []string{}
+	for _, be := range newState.Backends {
+		addrs, ok := old[be.Backend.Name]
+		if !ok {
+			continue
+		}
+		for _, s := range be.Servers {
+			if s.Slowstart == nil || addrs[serverAddr(s.Address, s.Port)] {
+				continue
+			}
+			added = append(added, be.Backend.Name+"/"+s.Name)
+		}
+	}
+	return added
+}
+
+func serverAddr(host string, port *int64) string {
+	if port == nil {
+		return host
+	}
+	return host + ":" + strconv.FormatInt(*port, 10)
+}
@@ -0,0 +1,36 @@
+package haproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddedServers(t *testing.T) {
+	port := int64(80)
+	slowstart := int64(30000)
+	backend := func(name string, addrs ...string) state.Backend {
+		be := state.Backend{Backend: models.Backend{Name: name}}
+		for i, a := range addrs {
+			be.Servers = append(be.Servers, models.Server{
+				Name:      fmt.Sprintf("srv_%d", i),
+				Address:   a,
+				Port:      &port,
+				Slowstart: &slowstart,
+			})
+		}
+		return be
+	}
+
+	oldState := state.State{Backends: []state.Backend{backend("back_a", "10.0.0.1")}}
+	newState := state.State{Backends: []state.Backend{
+		backend("back_a", "10.0.0.1", "10.0.0.2"),
+		// a new backend starts at full capacity
+		backend("back_b", "10.0.1.1"),
+	}}
+
+	require.Equal(t, []string{"back_a/srv_1"}, addedServers(oldState, newState))
+}
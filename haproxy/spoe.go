@@ -12,6 +12,8 @@ import (
 	"zvelo.io/ttlru"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
 	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/api"
 )
@@ -21,31 +23,82 @@ const (
 	cacheTTL     = time.Second
 )
 
+// decision is the answer of the agent to an authorization call
+type decision struct {
+	Allowed bool
+	// Reason tells the intention that matched, or why the intentions
+	// could not be checked
+	Reason string
+}
+
 type cacheEntry struct {
-	Value bool
+	Value decision
 	At    time.Time
 	C     chan struct{}
+	// Err is the error of the authz call, the entry is fetched again by
+	// the next request
+	Err error
+}
+
+// SPOEOptions configures the checks of the SPOE handler
+type SPOEOptions struct {
+	// Authorize enables the intentions check, otherwise only the client
+	// identity is recorded
+	Authorize bool
+	// FailOpen allows the clients when the intentions cannot be checked,
+	// they are denied otherwise
+	FailOpen bool
+	// AuditLog logs each intentions decision
+	AuditLog bool
+	// AuditMetrics counts the intentions decisions per source and
+	// destination service
+	AuditMetrics bool
+	// JWT validates the tokens of the check-jwt message, disabled when nil
+	JWT *JWTOptions
 }
 
 type SPOEHandler struct {
-	c   *api.Client
-	cfg func() consul.Config
+	c       *api.Client
+	cfg     func() consul.Config
+	metrics metrics.Metrics
+	opts    SPOEOptions
+
+	// mirror sends the copies of the requests of the mirror message
+	mirror *mirror
+	// jwt validates the tokens of the check-jwt message
+	jwt *jwtValidator
 
 	certCache     ttlru.Cache
 	authCache     map[string]*cacheEntry
 	authCacheLock sync.Mutex
 }
 
-func NewSPOEHandler(c *api.Client, cfg func() consul.Config) *SPOEHandler {
-	return &SPOEHandler{
+func NewSPOEHandler(c *api.Client, m metrics.Metrics, opts SPOEOptions, cfg func() consul.Config) *SPOEHandler {
+	h := &SPOEHandler{
 		c:         c,
 		cfg:       cfg,
+		metrics:   m,
+		opts:      opts,
+		mirror:    newMirror(m, cfg),
 		certCache: ttlru.New(128, ttlru.WithTTL(time.Minute)),
 		authCache: map[string]*cacheEntry{},
 	}
+	if opts.JWT != nil {
+		h.jwt = newJWTValidator(*opts.JWT, m)
+	}
+	return h
 }
 
 func (h *SPOEHandler) Handler(req *request.Request) {
+	if msg, err := req.Messages.GetByName("mirror"); err == nil {
+		h.mirror.handle(msg)
+		return
+	}
+	if msg, err := req.Messages.GetByName("check-jwt"); err == nil && h.jwt != nil {
+		h.jwt.handle(msg, req)
+		return
+	}
+
 	cfg := h.cfg()
 
 	// Get the check-intentions message
@@ -86,36 +139,74 @@ func (h *SPOEHandler) Handler(req *request.Request) {
 	}
 
 	sourceApp := ""
-	authorized, err := h.isAuthorized(cfg.ServiceName, certURI.URI().String(), cert.SerialNumber.Bytes())
-	if err != nil {
-		log.Errorf("spoe handler: %s", err)
+	if sis, ok := certURI.(*connect.SpiffeIDService); ok {
+		sourceApp = sis.Service
+	}
+
+	req.Actions.SetVar(action.ScopeSession, "identity", certURI.URI().String())
+	req.Actions.SetVar(action.ScopeSession, "source_app", sourceApp)
+
+	if !h.opts.Authorize {
 		return
 	}
 
-	if sis, ok := certURI.(*connect.SpiffeIDService); ok {
-		sourceApp = sis.Service
+	target := cfg.ServiceName
+	if fe, ok := msg.KV.Get("fe"); ok {
+		target = downstreamService(cfg, fmt.Sprint(fe))
+	}
+
+	start := time.Now()
+	authz, err := h.isAuthorized(target, certURI.URI().String(), cert.SerialNumber.Bytes())
+	took := time.Since(start)
+	h.metrics.ObserveDuration("connect_spoe_authz_duration", took, nil)
+	if err != nil {
+		h.metrics.IncrCounter("connect_spoe_authz_total", 1, metrics.Labels{"result": "error"})
+		if h.opts.FailOpen {
+			log.Warnf("spoe handler: allowing %s to %s, intentions cannot be checked: %s", certURI.URI(), target, err)
+			h.audit(certURI.URI().String(), sourceApp, target, decision{Allowed: true, Reason: err.Error()}, took)
+			req.Actions.SetVar(action.ScopeSession, "auth", 1)
+			return
+		}
+		log.Errorf("spoe handler: %s", err)
+		h.audit(certURI.URI().String(), sourceApp, target, decision{Reason: err.Error()}, took)
+		return
 	}
+	h.audit(certURI.URI().String(), sourceApp, target, authz, took)
 
 	res := 1
-	if !authorized {
+	result := "allowed"
+	if !authz.Allowed {
 		res = 0
+		result = "denied"
 	}
+	h.metrics.IncrCounter("connect_spoe_authz_total", 1, metrics.Labels{"result": result})
 
 	// Set variables using the new API
 	req.Actions.SetVar(action.ScopeSession, "auth", res)
-	req.Actions.SetVar(action.ScopeSession, "source_app", sourceApp)
 }
 
-func (h *SPOEHandler) isAuthorized(target, uri string, serial []byte) (bool, error) {
+// downstreamService returns the service a frontend is the listener of, the
+// listeners of the other services proxied check their own intentions
+func downstreamService(cfg consul.Config, frontend string) string {
+	for _, d := range cfg.ExtraDownstreams {
+		if d.Service != "" && state.DownstreamFrontend(d.Name) == frontend {
+			return d.Service
+		}
+	}
+	return cfg.ServiceName
+}
+
+func (h *SPOEHandler) isAuthorized(target, uri string, serial []byte) (decision, error) {
+	key := target + " " + uri
 	h.authCacheLock.Lock()
-	entry, ok := h.authCache[uri]
+	entry, ok := h.authCache[key]
 	now := time.Now()
 	if !ok || now.Sub(entry.At) > cacheTTL {
 		entry = &cacheEntry{
 			At: now,
 			C:  make(chan struct{}),
 		}
-		h.authCache[uri] = entry
+		h.authCache[key] = entry
 		h.authCacheLock.Unlock()
 
 		go func() {
@@ -126,7 +217,8 @@ func (h *SPOEHandler) isAuthorized(target, uri string, serial []byte) (bool, err
 
 			if err != nil {
 				log.Error(err)
-				entry.Value = false
+				entry.Value = decision{}
+				entry.Err = err
 				// force refech on next request
 				entry.At = time.Time{}
 			} else {
@@ -142,23 +234,49 @@ func (h *SPOEHandler) isAuthorized(target, uri string, serial []byte) (bool, err
 
 	select {
 	case <-time.After(authzTimeout):
-		return false, fmt.Errorf("authz call failed: timeout after %s", authzTimeout)
+		return decision{}, fmt.Errorf("authz call failed: timeout after %s", authzTimeout)
 	case <-entry.C:
-		return entry.Value, nil
+		return entry.Value, entry.Err
 	}
 }
 
-func (h *SPOEHandler) fetchAutz(target, uri string, serial []byte) (bool, error) {
+func (h *SPOEHandler) fetchAutz(target, uri string, serial []byte) (decision, error) {
 	resp, err := h.c.Agent().ConnectAuthorize(&api.AgentAuthorizeParams{
 		Target:           target,
 		ClientCertURI:    uri,
 		ClientCertSerial: connect.HexString(serial),
 	})
 	if err != nil {
-		return false, fmt.Errorf("authz call failed: %w", err)
+		return decision{}, fmt.Errorf("authz call failed: %w", err)
 	}
 
-	return resp.Authorized, nil
+	return decision{Allowed: resp.Authorized, Reason: resp.Reason}, nil
+}
+
+// audit logs and counts an intentions decision when enabled
+func (h *SPOEHandler) audit(identity, source, target string, d decision, took time.Duration) {
+	result := "denied"
+	if d.Allowed {
+		result = "allowed"
+	}
+	if h.opts.AuditMetrics {
+		h.metrics.IncrCounter("connect_intention_decisions_total", 1, metrics.Labels{
+			"source":      source,
+			"destination": target,
+			"decision":    result,
+		})
+	}
+	if !h.opts.AuditLog {
+		return
+	}
+	log.WithFields(log.Fields{
+		"identity":    identity,
+		"source":      source,
+		"destination": target,
+		"decision":    result,
+		"reason":      d.Reason,
+		"duration_ms": took.Milliseconds(),
+	}).Info("intention decision")
 }
 
 func (h *SPOEHandler) decodeCertificate(b []byte) (*x509.Certificate, error) {
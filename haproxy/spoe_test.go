@@ -0,0 +1,47 @@
+package haproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+)
+
+func TestDownstreamService(t *testing.T) {
+	cfg := consul.Config{
+		ServiceName: "web",
+		ExtraDownstreams: []consul.Downstream{
+			{Name: "admin"},
+			{Name: "api", Service: "api"},
+		},
+	}
+	require.Equal(t, "web", downstreamService(cfg, "front_downstream"))
+	require.Equal(t, "web", downstreamService(cfg, "front_downstream_admin"))
+	require.Equal(t, "api", downstreamService(cfg, "front_downstream_api"))
+}
+
+func TestSPOEAudit(t *testing.T) {
+	var out bytes.Buffer
+	prev := log.StandardLogger().Out
+	log.SetOutput(&out)
+	defer log.SetOutput(prev)
+
+	m := metrics.NewPrometheus()
+	h := NewSPOEHandler(nil, m, SPOEOptions{AuditLog: true, AuditMetrics: true}, nil)
+	h.audit("spiffe://example.consul/ns/default/dc/dc1/svc/api", "api", "web", decision{Allowed: true, Reason: "Matched L4 intention"}, 3*time.Millisecond)
+	h.audit("spiffe://example.consul/ns/default/dc/dc1/svc/db", "db", "web", decision{}, time.Millisecond)
+
+	require.Contains(t, out.String(), `decision=allowed`)
+	require.Contains(t, out.String(), `reason="Matched L4 intention"`)
+	require.Contains(t, out.String(), `source=db`)
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	require.Contains(t, buf.String(), `connect_intention_decisions_total{decision="allowed",destination="web",source="api"} 1`)
+	require.Contains(t, buf.String(), `connect_intention_decisions_total{decision="denied",destination="web",source="db"} 1`)
+}
@@ -1,12 +1,20 @@
 package haproxy
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/renderer"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/writer"
 	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/tracing"
+	"github.com/haproxytech/haproxy-consul-connect/utils"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,14 +23,78 @@ const (
 	retryBackoff       = 3 * time.Second
 )
 
+func stateOptions(opts utils.Options, hc *haConfig) state.Options {
+	return state.Options{
+		EnableIntentions:     opts.EnableIntentions,
+		IntentionsFailOpen:   opts.IntentionsFailOpen,
+		JWT:                  opts.JWTJWKSURL != "",
+		LuaScripts:           opts.LuaScripts,
+		LuaFromConfig:        opts.LuaFromConfig,
+		LogIdentity:          opts.LogIdentity,
+		LogUpstreamMeta:      opts.LogUpstreamMeta,
+		LogRequests:          opts.LogRequests,
+		LogSocket:            hc.workerPath(hc.LogsSock),
+		SPOEConfigPath:       hc.SPOE,
+		SPOESockets:          spoeWorkerSocks(hc),
+		MapsDir:              hc.Base,
+		Explain:              opts.Explain,
+		MaxConnBudget:        maxConnBudget(opts),
+		TransparentProxyPort: opts.TransparentProxyPort,
+		TLSTicketKeys:        opts.TLSTicketKeys,
+		NoTLSTickets:         opts.NoTLSTickets,
+		StatsPagePort:        opts.StatsPagePort,
+		VerifyDownstream:     opts.VerifyDownstream,
+		TrustDomain:          opts.TrustDomain,
+		InsecureDevMode:      opts.InsecureDevMode,
+	}
+}
+
+// spoeWorkerSocks are the SPOE sockets the HAProxy workers connect to
+func spoeWorkerSocks(hc *haConfig) []string {
+	socks := make([]string, 0, len(hc.SPOESocks))
+	for _, sock := range hc.SPOESocks {
+		socks = append(socks, hc.workerPath(sock))
+	}
+	return socks
+}
+
+// maxConnBudget is the global maxconn when the limits of the listeners and
+// servers are derived from it
+func maxConnBudget(opts utils.Options) int {
+	vs := opts.HAProxyParams.Globals["maxconn"]
+	if !opts.DeriveMaxConn || len(vs) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(vs[len(vs)-1])
+	if err != nil {
+		log.Warnf("cannot derive the connection limits from global maxconn %q: %s", vs[len(vs)-1], err)
+		return 0
+	}
+	return n
+}
+
 func (h *HAProxy) watch(sd *lib.Shutdown) error {
 	throttle := time.Tick(stateApplyThrottle)
 	retry := make(chan struct{})
+	// recheck is set while a change is deferred
+	var recheck <-chan time.Time
 
 	var currentState state.State
 	var currentConfig consul.Config
 	started := false
 	ready := false
+	// forceReload is set when the state must be reloaded even unchanged
+	forceReload := false
+	// trigger is what caused the pending apply, it is audited
+	trigger := triggerConsul
+	// trace spans the handling of a change until it is applied
+	var trace *tracing.Span
+	endTrace := func(result string, err error) {
+		trace.SetAttribute("result", result)
+		trace.SetError(err)
+		trace.End()
+		trace = nil
+	}
 
 	waitAndRetry := func() {
 		time.Sleep(retryBackoff)
@@ -32,10 +104,24 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 		}
 	}
 
+	// the config of the previous run is applied right away, the Consul
+	// watches may take a while to be ready
+	cached := h.loadConfigCache()
+
 	for {
 		inputReceived := false
+		fromCache := false
+		if cached != nil {
+			log.Infof("applying the config cached in %s", h.opts.ConfigCacheFile)
+			h.setConsulConfig(cached)
+			currentConfig = *cached
+			trigger = triggerCache
+			trace = h.opts.Tracer.StartSpan("config.cache", time.Now(), nil)
+			cached = nil
+			fromCache = true
+		}
 	Throttle:
-		for {
+		for !fromCache {
 			select {
 			case <-sd.Stop:
 				return nil
@@ -47,15 +133,41 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 
 			case c := <-h.cfgC:
 				log.Info("handling new configuration")
-				h.currentConsulConfig = &c
+				h.setConsulConfig(&c)
 				currentConfig = c
+				h.hooks.Update(c)
 				inputReceived = true
+				trigger = triggerConsul
+				if trace == nil {
+					changedAt := c.ChangedAt
+					if changedAt.IsZero() {
+						changedAt = time.Now()
+					}
+					trace = h.opts.Tracer.StartSpan("consul.change", changedAt, nil)
+				}
 			case <-retry:
 				log.Warn("retrying to apply config")
 				inputReceived = true
+				trigger = triggerRetry
+			case <-recheck:
+				recheck = nil
+				inputReceived = true
+				trigger = triggerDefer
+			case <-h.restarted:
+				log.Warn("haproxy restarted, applying the state again")
+				forceReload = true
+				inputReceived = true
+				trigger = triggerRestart
+				if trace == nil {
+					trace = h.opts.Tracer.StartSpan("haproxy.restart", time.Now(), nil)
+				}
 			}
 		}
 
+		if trace == nil {
+			trace = h.opts.Tracer.StartSpan("state.apply", time.Now(), nil)
+		}
+
 		if !started {
 			err := h.start(sd)
 			if err != nil {
@@ -64,40 +176,123 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 			started = true
 		}
 
-		newState, err := state.Generate(state.Options{
-			EnableIntentions: h.opts.EnableIntentions,
-			LogRequests:      h.opts.LogRequests,
-			LogSocket:        h.haConfig.LogsSock,
-			SPOEConfigPath:   h.haConfig.SPOE,
-			SPOESocket:       h.haConfig.SPOESock,
-		}, h.haConfig, currentState, currentConfig)
+		stateOpts := stateOptions(h.opts, h.haConfig)
+		// the requests are mirrored by the SPOE agent
+		if currentConfig.Mirrored() {
+			err := h.startSPOA()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		// the access logs can be enabled by the proxy-defaults
+		if currentConfig.AccessLogs && !stateOpts.LogRequests {
+			err := h.startLogger()
+			if err != nil {
+				log.Error(err)
+			} else {
+				stateOpts.LogRequests = true
+			}
+		}
+
+		span := h.opts.Tracer.StartSpan("state.generate", time.Now(), trace)
+		newState, err := state.Generate(stateOpts, h.haConfig, currentState, currentConfig)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			log.Error(err)
+			endTrace("failure", err)
 			continue
 		}
 
-		if currentState.Equal(newState) {
+		if !forceReload && currentState.Equal(newState) {
+			// the metadata may change without the state
+			h.updateLogMeta(newState, currentConfig)
 			log.Info("no change to apply to haproxy")
+			endTrace("unchanged", nil)
 			continue
 		}
 
+		if !forceReload && ready && currentState.EqualConfig(newState) {
+			span := h.opts.Tracer.StartSpan("haproxy.runtime_apply", time.Now(), trace)
+			err := h.applyMaps(currentState, newState)
+			span.SetError(err)
+			span.End()
+			if err == nil {
+				h.opts.Metrics.IncrCounter("connect_state_applies_total", 1, metrics.Labels{"method": "runtime", "result": "success"})
+				h.setLastApply(time.Now())
+				h.audit.record(newState, currentConfig, "runtime", trigger, time.Now())
+				h.saveConfigCache(currentConfig)
+				h.updateLogMeta(newState, currentConfig)
+				currentState = newState
+				log.Info("state applied at runtime")
+				endTrace("runtime", nil)
+				continue
+			}
+			h.opts.Metrics.IncrCounter("connect_state_applies_total", 1, metrics.Labels{"method": "runtime", "result": "failure"})
+			log.Warnf("failed to apply maps at runtime, reloading: %s", err)
+		}
+
+		if !forceReload && ready && h.deferReload(currentState, newState, time.Now()) {
+			recheck = time.After(reloadDeferCheck)
+			// the trace ends once the deferred change is applied
+			trace.SetAttribute("deferred", "true")
+			continue
+		}
+
+		if !forceReload && ready && h.dataplane == nil {
+			if wait := h.coalesceWait(currentState, newState, time.Now()); wait > 0 {
+				recheck = time.After(wait)
+				trace.SetAttribute("coalesced", "true")
+				continue
+			}
+		}
+
 		log.Debugf("applying new state: %+v", newState)
 
-		// Render config
-		config, err := h.renderer.Render(newState, h.haConfig.StatsSock, renderer.HAProxyParams{
-			Globals:  h.opts.HAProxyParams.Globals,
-			Defaults: h.opts.HAProxyParams.Defaults,
-		})
+		err = writeMaps(newState)
+		if err == nil {
+			err = writeLuaScripts(newState)
+		}
 		if err != nil {
-			log.Errorf("failed to render config: %s", err)
+			log.Error(err)
+			endTrace("failure", err)
 			waitAndRetry()
 			continue
 		}
 
-		// Apply config
-		err = h.configWriter.ApplyConfig(config)
+		method := "reload"
+		start := time.Now()
+		if h.dataplane != nil {
+			method = "dataplane"
+			span := h.opts.Tracer.StartSpan("dataplane.apply", start, trace)
+			err = h.applyDataplane(currentState, newState)
+			span.SetError(err)
+			span.End()
+		} else {
+			err = h.applyConfig(newState, trace)
+		}
+		h.opts.Metrics.ObserveDuration("connect_state_apply_duration", time.Since(start), metrics.Labels{"method": method})
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		h.opts.Metrics.IncrCounter("connect_state_applies_total", 1, metrics.Labels{"method": method, "result": result})
 		if err != nil {
-			log.Errorf("failed to apply config: %s", err)
+			endTrace(result, err)
+		}
+		// an initial config rejected by haproxy will not get better by
+		// retrying, a cached one is dropped to wait for Consul
+		var validationErr *writer.ValidationError
+		if !ready && errors.As(err, &validationErr) {
+			if trigger == triggerCache {
+				log.Errorf("cached config rejected, waiting for consul: %s", err)
+				h.dropConfigCache()
+				continue
+			}
+			return lib.NewExitError(lib.ExitValidation, err)
+		}
+		if err != nil {
+			log.Error(err)
 			waitAndRetry()
 			continue
 		}
@@ -105,9 +300,191 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 		if !ready {
 			close(h.Ready)
 			ready = true
+		} else {
+			h.warmUpServers(currentState, newState)
 		}
 
+		if method == "reload" {
+			h.lastReload = time.Now()
+			h.reloadRate.record(h.lastReload)
+		}
+
+		h.setLastApply(time.Now())
+		h.audit.record(newState, currentConfig, method, trigger, time.Now())
+		if trigger != triggerCache {
+			h.saveConfigCache(currentConfig)
+		}
+		h.shredUnusedCerts(currentState, newState)
+		h.updateLogMeta(newState, currentConfig)
 		currentState = newState
+		forceReload = false
 		log.Info("state applied")
+		endTrace(method, nil)
+	}
+}
+
+// updateLogMeta describes the servers of the state applied to HAProxy in
+// the upstream access logs, when they are enriched
+func (h *HAProxy) updateLogMeta(st state.State, cfg consul.Config) {
+	if h.logMeta != nil {
+		h.logMeta.update(st, cfg)
 	}
 }
+
+// applyConfig renders the whole config and reloads HAProxy with it, the
+// steps are traced as children of trace
+func (h *HAProxy) applyConfig(newState state.State, trace *tracing.Span) error {
+	span := h.opts.Tracer.StartSpan("config.render", time.Now(), trace)
+	config, err := h.renderer.Render(newState, h.haConfig.StatsSock, renderer.HAProxyParams{
+		Globals:  h.opts.HAProxyParams.Globals,
+		Defaults: h.opts.HAProxyParams.Defaults,
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return fmt.Errorf("failed to render config: %s", err)
+	}
+
+	span = h.opts.Tracer.StartSpan("haproxy.reload", time.Now(), trace)
+	err = h.configWriter.ApplyConfig(config)
+	span.SetError(err)
+	span.End()
+	var reloadErr *writer.ReloadError
+	if errors.As(err, &reloadErr) {
+		h.opts.Metrics.IncrCounter("connect_reloads_rolled_back_total", 1, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply config: %w", err)
+	}
+	h.opts.Metrics.SetGauge("connect_haproxy_old_workers", float64(h.configWriter.OldWorkers()), nil)
+
+	if h.history != nil {
+		err = h.history.Record(config)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// applyDataplane applies the differences between the states in a single
+// Data Plane API transaction, which is dropped if any change fails
+func (h *HAProxy) applyDataplane(currentState, newState state.State) error {
+	// the warnings are logged once, not on each apply of the same config
+	warned := map[string]bool{}
+	for _, w := range dataplaneWarnings(newState) {
+		if !h.dataplaneWarned[w] {
+			log.Warn(w)
+		}
+		warned[w] = true
+	}
+	h.dataplaneWarned = warned
+
+	if err := dataplaneUnsupported(newState); err != nil {
+		return err
+	}
+
+	tx := h.dataplane.Tnx()
+
+	err := state.Apply(tx, currentState, newState)
+	if err != nil {
+		abortErr := tx.Abort()
+		if abortErr != nil {
+			log.Errorf("failed to abort dataplane transaction: %s", abortErr)
+		}
+		return fmt.Errorf("failed to apply state through dataplane: %s", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit dataplane transaction: %s", err)
+	}
+
+	return nil
+}
+
+// dataplaneWarnings lists the parts of the state the Data Plane API cannot
+// apply and which can be ignored
+func dataplaneWarnings(st state.State) []string {
+	warnings := []string{}
+	if st.NoReusePort {
+		warnings = append(warnings, "bind_reuseport is not supported with the Data Plane API, ignoring")
+	}
+	if st.StatsPagePort > 0 {
+		warnings = append(warnings, "the HAProxy stats page is not supported with the Data Plane API, ignoring")
+	}
+	return warnings
+}
+
+// dataplaneUnsupported returns an error listing the parts of the state the
+// Data Plane API cannot apply and which cannot be ignored: serving without
+// a rate limit or a Lua auth hook would let through what they protect from
+func dataplaneUnsupported(st state.State) error {
+	unsupported := []string{}
+	if len(st.LuaScripts) > 0 {
+		unsupported = append(unsupported, "lua scripts")
+	}
+	// the API has no equivalent for raw lines, they are only rendered
+	for _, fe := range st.Frontends {
+		name := fe.Frontend.Name
+		if len(fe.ExtraConfig) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("frontend %s: extra_config", name))
+		}
+		if fe.RateLimit != nil {
+			unsupported = append(unsupported, fmt.Sprintf("frontend %s: rate limits", name))
+		}
+		if fe.Compression != nil {
+			unsupported = append(unsupported, fmt.Sprintf("frontend %s: compression", name))
+		}
+		if len(fe.LuaActions) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("frontend %s: lua_actions", name))
+		}
+	}
+	for _, be := range st.Backends {
+		name := be.Backend.Name
+		if len(be.ExtraConfig) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("backend %s: extra_config", name))
+		}
+		if be.Fullconn > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("backend %s: fullconn", name))
+		}
+		if be.HTTPCheck != nil {
+			unsupported = append(unsupported, fmt.Sprintf("backend %s: http_check", name))
+		}
+		if be.Mirror != nil {
+			unsupported = append(unsupported, fmt.Sprintf("backend %s: mirror_to", name))
+		}
+		if len(be.LuaActions) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("backend %s: lua_actions", name))
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	return fmt.Errorf("not supported with the Data Plane API, the config is not applied: %s", strings.Join(unsupported, "; "))
+}
+
+func (h *HAProxy) setConsulConfig(cfg *consul.Config) {
+	h.currentConsulConfigLock.Lock()
+	defer h.currentConsulConfigLock.Unlock()
+	h.currentConsulConfig = cfg
+}
+
+func (h *HAProxy) consulConfig() consul.Config {
+	h.currentConsulConfigLock.RLock()
+	defer h.currentConsulConfigLock.RUnlock()
+	return *h.currentConsulConfig
+}
+
+func (h *HAProxy) setLastApply(t time.Time) {
+	h.lastApplyLock.Lock()
+	defer h.lastApplyLock.Unlock()
+	h.lastApply = t
+}
+
+func (h *HAProxy) lastApplied() time.Time {
+	h.lastApplyLock.RLock()
+	defer h.lastApplyLock.RUnlock()
+	return h.lastApply
+}
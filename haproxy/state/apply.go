@@ -0,0 +1,265 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/haproxytech/models/v2"
+)
+
+const (
+	parentTypeFrontend = "frontend"
+	parentTypeBackend  = "backend"
+)
+
+// Apply issues the operations needed to go from the old state to the new
+// one. Frontends and backends whose definition changed are recreated,
+// servers are replaced in place when only their address, port or
+// maintenance changed so that HAProxy can update them at runtime.
+func Apply(ha HAProxy, old, new State) error {
+	// backends are created first and deleted last as frontends reference them
+	err := applyBackends(ha, old, new)
+	if err != nil {
+		return err
+	}
+
+	err = applyFrontends(ha, old, new)
+	if err != nil {
+		return err
+	}
+
+	return deleteBackends(ha, old, new)
+}
+
+func applyFrontends(ha HAProxy, old, new State) error {
+	newIdx := index(new.Frontends, func(i int) string {
+		return new.Frontends[i].Frontend.Name
+	})
+	oldIdx := index(old.Frontends, func(i int) string {
+		return old.Frontends[i].Frontend.Name
+	})
+
+	for _, f := range old.Frontends {
+		_, ok := newIdx[f.Frontend.Name]
+		if ok {
+			continue
+		}
+		err := ha.DeleteFrontend(f.Frontend.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range new.Frontends {
+		i, ok := oldIdx[f.Frontend.Name]
+		if ok {
+			if reflect.DeepEqual(old.Frontends[i], f) {
+				continue
+			}
+			err := ha.DeleteFrontend(f.Frontend.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := createFrontend(ha, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createFrontend(ha HAProxy, f Frontend) error {
+	name := f.Frontend.Name
+
+	err := ha.CreateFrontend(f.Frontend)
+	if err != nil {
+		return err
+	}
+
+	err = ha.CreateBind(name, f.Bind)
+	if err != nil {
+		return err
+	}
+
+	if f.BackendMap != "" {
+		err = ha.CreateBackendSwitchingRule(name, models.BackendSwitchingRule{
+			Name: fmt.Sprintf("%%[rand(%d),map_int(%s,%s)]", SplitSlots, f.BackendMap, f.Frontend.DefaultBackend),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.DstMap != "" {
+		err = ha.CreateBackendSwitchingRule(name, models.BackendSwitchingRule{
+			Name: fmt.Sprintf("%%[dst,map_ip(%s)]", f.DstMap),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.FilterSpoe != nil {
+		err = ha.CreateFilter(parentTypeFrontend, name, f.FilterSpoe.Filter)
+		if err != nil {
+			return err
+		}
+		if f.FilterSpoe.Rule.Action != "" {
+			err = ha.CreateTCPRequestRule(parentTypeFrontend, name, f.FilterSpoe.Rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.FilterCompression != nil {
+		err = ha.CreateFilter(parentTypeFrontend, name, f.FilterCompression.Filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.LogTarget != nil {
+		err = ha.CreateLogTargets(parentTypeFrontend, name, *f.LogTarget)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyBackends(ha HAProxy, old, new State) error {
+	for _, b := range new.Backends {
+		o, ok := old.findBackend(b.Backend.Name)
+		if !ok {
+			err := createBackend(ha, b)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !backendNeedsRecreate(o, b) {
+			err := replaceServers(ha, o, b)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := ha.DeleteBackend(b.Backend.Name)
+		if err != nil {
+			return err
+		}
+		err = createBackend(ha, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteBackends(ha HAProxy, old, new State) error {
+	for _, b := range old.Backends {
+		_, ok := new.findBackend(b.Backend.Name)
+		if ok {
+			continue
+		}
+		err := ha.DeleteBackend(b.Backend.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createBackend(ha HAProxy, b Backend) error {
+	name := b.Backend.Name
+
+	err := ha.CreateBackend(b.Backend)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range b.Servers {
+		err = ha.CreateServer(name, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.LogTarget != nil {
+		err = ha.CreateLogTargets(parentTypeBackend, name, *b.LogTarget)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range b.HTTPRequestRules {
+		err = ha.CreateHTTPRequestRule(parentTypeBackend, name, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range b.HTTPResponseRules {
+		err = ha.CreateHTTPResponseRule(parentTypeBackend, name, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backendNeedsRecreate returns false when the backends only differ by
+// the runtime modifiable fields of their servers
+func backendNeedsRecreate(old, new Backend) bool {
+	if len(old.Servers) != len(new.Servers) {
+		return true
+	}
+
+	if !reflect.DeepEqual(old.Backend, new.Backend) ||
+		!reflect.DeepEqual(old.LogTarget, new.LogTarget) ||
+		!reflect.DeepEqual(old.HTTPRequestRules, new.HTTPRequestRules) ||
+		!reflect.DeepEqual(old.HTTPResponseRules, new.HTTPResponseRules) {
+		return true
+	}
+
+	for i := range new.Servers {
+		if !reflect.DeepEqual(runtimeServerFields(old.Servers[i]), runtimeServerFields(new.Servers[i])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runtimeServerFields clears the fields of a server that can be changed
+// without recreating it
+func runtimeServerFields(s models.Server) models.Server {
+	s.Address = ""
+	s.Port = nil
+	s.Maintenance = ""
+	return s
+}
+
+func replaceServers(ha HAProxy, old, new Backend) error {
+	for i, s := range new.Servers {
+		if reflect.DeepEqual(old.Servers[i], s) {
+			continue
+		}
+		err := ha.ReplaceServer(new.Backend.Name, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
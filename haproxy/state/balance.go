@@ -0,0 +1,32 @@
+package state
+
+import (
+	"strings"
+
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// balance builds the balance of a backend from the algorithm set in the
+// Consul config, def is used when none is set or when it requires HTTP
+// and the backend is in TCP mode
+func balance(beName, algorithm, def, mode string) *models.Balance {
+	b := &models.Balance{Algorithm: stringp(def)}
+	if algorithm == "" {
+		return b
+	}
+
+	name, arg := algorithm, ""
+	if i := strings.IndexByte(algorithm, '('); i > 0 && strings.HasSuffix(algorithm, ")") {
+		name, arg = algorithm[:i], algorithm[i+1:len(algorithm)-1]
+	}
+
+	if (name == models.BalanceAlgorithmURI || name == models.BalanceAlgorithmHdr) && mode != models.BackendModeHTTP {
+		log.Warnf("%s: balance %s requires the http protocol, using %s", beName, algorithm, def)
+		return b
+	}
+
+	b.Algorithm = stringp(name)
+	b.HdrName = arg
+	return b
+}
@@ -0,0 +1,24 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalance(t *testing.T) {
+	b := balance("back", "", models.BalanceAlgorithmLeastconn, models.BackendModeHTTP)
+	require.Equal(t, models.BalanceAlgorithmLeastconn, *b.Algorithm)
+
+	b = balance("back", "source", models.BalanceAlgorithmLeastconn, models.BackendModeTCP)
+	require.Equal(t, models.BalanceAlgorithmSource, *b.Algorithm)
+
+	b = balance("back", "hdr(X-User)", models.BalanceAlgorithmLeastconn, models.BackendModeHTTP)
+	require.Equal(t, models.BalanceAlgorithmHdr, *b.Algorithm)
+	require.Equal(t, "X-User", b.HdrName)
+
+	// not usable in TCP mode
+	b = balance("back", "uri", models.BalanceAlgorithmLeastconn, models.BackendModeTCP)
+	require.Equal(t, models.BalanceAlgorithmLeastconn, *b.Algorithm)
+}
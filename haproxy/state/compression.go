@@ -0,0 +1,26 @@
+package state
+
+import (
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+)
+
+// compression adds the compression filter of an HTTP frontend, unless it
+// is disabled
+func compression(fe *Frontend, c consul.Compression) {
+	if c.Disabled {
+		return
+	}
+	fe.FilterCompression = &FrontendFilter{
+		Filter: models.Filter{
+			Type: models.FilterTypeCompression,
+		},
+	}
+	if len(c.Algos) > 0 || len(c.Types) > 0 || c.MinSize > 0 {
+		fe.Compression = &Compression{
+			Algos:   c.Algos,
+			Types:   c.Types,
+			MinSize: int64(c.MinSize),
+		}
+	}
+}
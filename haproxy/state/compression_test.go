@@ -0,0 +1,25 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	fe := Frontend{}
+	compression(&fe, consul.Compression{})
+	require.NotNil(t, fe.FilterCompression)
+	require.Nil(t, fe.Compression)
+
+	fe = Frontend{}
+	compression(&fe, consul.Compression{Algos: []string{"gzip"}, Types: []string{"text/html"}, MinSize: 1024})
+	require.NotNil(t, fe.FilterCompression)
+	require.Equal(t, &Compression{Algos: []string{"gzip"}, Types: []string{"text/html"}, MinSize: 1024}, fe.Compression)
+
+	fe = Frontend{}
+	compression(&fe, consul.Compression{Disabled: true, Algos: []string{"gzip"}})
+	require.Nil(t, fe.FilterCompression)
+	require.Nil(t, fe.Compression)
+}
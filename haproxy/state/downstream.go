@@ -2,15 +2,29 @@ package state
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
 	log "github.com/sirupsen/logrus"
 )
 
+// DownstreamFrontend returns the name of the frontend of a listener
+func DownstreamFrontend(name string) string {
+	if name == "" {
+		return "front_downstream"
+	}
+	return fmt.Sprintf("front_downstream_%s", name)
+}
+
 func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Downstream, state State) (State, error) {
-	feName := "front_downstream"
+	feName := DownstreamFrontend(cfg.Name)
 	beName := "back_downstream"
+	if cfg.Name != "" {
+		beName = fmt.Sprintf("back_downstream_%s", cfg.Name)
+	}
 	feMode := models.FrontendModeTCP
 	beMode := models.BackendModeTCP
 
@@ -24,9 +38,22 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 		beMode = models.BackendModeHTTP
 	}
 
+	// Advertise h2 like Envoy sidecars do, only in HTTP mode as a TCP
+	// frontend cannot translate for an HTTP/1 application
+	alpn := cfg.ALPN
+	if alpn == "" && feMode == models.FrontendModeHTTP {
+		alpn = defaultALPN
+	}
+
 	log.Infof("downstream: configuring frontend to listen on %s:%d, backend target %s:%d",
 		cfg.LocalBindAddress, cfg.LocalBindPort, cfg.TargetAddress, cfg.TargetPort)
 
+	// without verification, the identity is only checked by the intentions
+	verify := models.BindVerifyNone
+	if opts.VerifyDownstream || opts.TrustDomain != "" {
+		verify = models.BindVerifyRequired
+	}
+
 	// Main config
 	fe := Frontend{
 		Frontend: models.Frontend{
@@ -43,21 +70,52 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 			Ssl:            true,
 			SslCertificate: crtPath,
 			SslCafile:      caPath,
-			Verify:         models.BindVerifyNone,
+			Verify:         verify,
+			Alpn:           alpn,
+			Transparent:    cfg.BindOptions.Transparent,
+			V4v6:           cfg.BindOptions.V4v6,
+			Interface:      cfg.BindOptions.Interface,
+			NoTLSTickets:   opts.NoTLSTickets,
+			TLSTicketKeys:  opts.TLSTicketKeys,
 		},
+		LuaActions:  cfg.LuaActions.Frontend,
+		ExtraConfig: cfg.ExtraConfig.Frontend,
+	}
+
+	// Limits, a listener flooded by a client must not starve the others
+	if cfg.Limits.MaxConn > 0 {
+		fe.Frontend.Maxconn = int64p(cfg.Limits.MaxConn)
+	}
+	if cfg.BindOptions.Backlog > 0 {
+		fe.Bind.Backlog = strconv.Itoa(cfg.BindOptions.Backlog)
+	}
+	if cfg.Limits.ConnRate > 0 || cfg.Limits.ReqRate > 0 || len(cfg.Limits.SourceReqRates) > 0 {
+		fe.RateLimit = &RateLimit{Conn: int64(cfg.Limits.ConnRate)}
+		if feMode == models.FrontendModeHTTP {
+			fe.RateLimit.Req = int64(cfg.Limits.ReqRate)
+		} else if cfg.Limits.ReqRate > 0 {
+			log.Warnf("downstream: request_rate_limit requires the http protocol, ignoring")
+		}
+		sourceRateLimits(opts, feName, feMode, cfg.Limits.SourceReqRates, fe.RateLimit)
+		if fe.RateLimit.Conn == 0 && fe.RateLimit.Req == 0 && fe.RateLimit.SourceTable == "" {
+			fe.RateLimit = nil
+		}
 	}
 
 	// HTTP-specific features (disabled in TCP mode)
 	if feMode == models.FrontendModeHTTP {
-		fe.FilterCompression = &FrontendFilter{
-			Filter: models.Filter{
-				Type: models.FilterTypeCompression,
-			},
+		compression(&fe, cfg.Compression)
+	}
+	if opts.JWT {
+		if feMode == models.FrontendModeHTTP {
+			fe.JWT = &JWT{SPOEConfig: opts.SPOEConfigPath}
+		} else {
+			log.Warnf("downstream: JWT validation requires the http protocol, ignoring")
 		}
 	}
 
 	// Logging
-	if opts.LogRequests && opts.LogSocket != "" {
+	if (opts.LogRequests || opts.LogIdentity) && opts.LogSocket != "" {
 		fe.LogTarget = &models.LogTarget{
 			Address:  opts.LogSocket,
 			Facility: models.LogTargetFacilityLocal0,
@@ -65,24 +123,56 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 		}
 	}
 
-	// Intentions
-	if opts.EnableIntentions {
+	// Intentions, the SPOE agent also records the client identity
+	if opts.spoe() {
 		fe.FilterSpoe = &FrontendFilter{
 			Filter: models.Filter{
 				Type:       models.FilterTypeSpoe,
 				SpoeEngine: "intentions",
 				SpoeConfig: opts.SPOEConfigPath,
 			},
-			Rule: models.TCPRequestRule{
-				Action:   models.TCPRequestRuleActionReject,
-				Cond:     models.TCPRequestRuleCondUnless,
-				CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
-				Type:     models.TCPRequestRuleTypeContent,
-			},
+		}
+	}
+	var conds []string
+	if opts.EnableIntentions {
+		conds = append(conds, "{ var(sess.connect.auth) -m int eq 1 }")
+	}
+	trustDomain := ""
+	if opts.TrustDomain != "" {
+		trustDomain = fmt.Sprintf("{ var(sess.connect.identity) -m beg spiffe://%s/ }", opts.TrustDomain)
+		conds = append(conds, trustDomain)
+	}
+	if len(conds) > 0 {
+		condTest := strings.Join(conds, " ")
+		// the agent sets the error variable when it failed to process the
+		// frame, eg: it timed out. The trust domain is still required then,
+		// failing open must not accept the clients of another cluster.
+		if opts.EnableIntentions && opts.IntentionsFailOpen {
+			failOpen := "{ var(txn.connect.error) -m found }"
+			if trustDomain != "" {
+				failOpen += " " + trustDomain
+			}
+			condTest += " || " + failOpen
+		}
+		fe.FilterSpoe.Rule = models.TCPRequestRule{
+			Action:   models.TCPRequestRuleActionReject,
+			Cond:     models.TCPRequestRuleCondUnless,
+			CondTest: condTest,
+			Type:     models.TCPRequestRuleTypeContent,
+		}
+	}
+	if opts.LogIdentity {
+		fe.Frontend.Httplog = false
+		fe.Frontend.LogFormat = tcpIdentityLogFormat
+		if feMode == models.FrontendModeHTTP {
+			fe.Frontend.LogFormat = httpIdentityLogFormat
 		}
 	}
 
 	state.Frontends = append(state.Frontends, fe)
+	if cfg.BindOptions.NoReusePort {
+		state.NoReusePort = true
+	}
 
 	var forwardFor *models.Forwardfor
 	if cfg.EnableForwardFor && beMode == models.BackendModeHTTP {
@@ -99,15 +189,14 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 			ConnectTimeout: int64p(int(cfg.ConnectTimeout.Milliseconds())),
 			Mode:           beMode,
 			Forwardfor:     forwardFor,
-			Balance: &models.Balance{
-				Algorithm: stringp(models.BalanceAlgorithmRoundrobin),
-			},
+			Balance:        balance(beName, cfg.Balance, models.BalanceAlgorithmRoundrobin, beMode),
 		},
 		Servers: []models.Server{
 			{
 				Name:    "downstream_node",
 				Address: cfg.TargetAddress,
 				Port:    int64p(cfg.TargetPort),
+				Proto:   cfg.Proto,
 				// Circuit breaker pattern for downstream health
 				// - Infrequent checks in steady state (300s)
 				// - Fast reaction to state changes (2s)
@@ -124,6 +213,12 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 				Maintenance: models.ServerMaintenanceDisabled,
 			},
 		},
+		LuaActions:  cfg.LuaActions.Backend,
+		ExtraConfig: cfg.ExtraConfig.Backend,
+	}
+
+	if cfg.SendProxyProtocol {
+		be.Servers[0].SendProxyV2 = models.ServerSendProxyV2Enabled
 	}
 
 	// Logging
@@ -143,6 +238,7 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 			HdrFormat: "%[var(sess.connect.source_app)]",
 		})
 	}
+	headerRules(&be, cfg.Headers)
 
 	// Retries for downstream (fixed at 2 since there's only 1 server)
 	be.Backend.Retries = int64p(2)
@@ -151,3 +247,31 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 
 	return state, nil
 }
+
+// sourceRateLimits sets the request budgets of the source services, they
+// are told by the SPOE agent so it must run
+func sourceRateLimits(opts Options, feName string, feMode string, rates map[string]int, rl *RateLimit) {
+	if len(rates) == 0 {
+		return
+	}
+	if feMode != models.FrontendModeHTTP {
+		log.Warnf("downstream: source_rate_limits requires the http protocol, ignoring")
+		return
+	}
+	if !opts.spoe() {
+		log.Warnf("downstream: source_rate_limits requires intentions, identity logging or a trust domain, ignoring")
+		return
+	}
+
+	rl.SourceTable = fmt.Sprintf("st_%s", feName)
+	for service, req := range rates {
+		if service == "*" {
+			rl.SourceDefault = int64(req)
+			continue
+		}
+		rl.Sources = append(rl.Sources, SourceRateLimit{Service: service, Req: int64(req)})
+	}
+	sort.Slice(rl.Sources, func(i, j int) bool {
+		return rl.Sources[i].Service < rl.Sources[j].Service
+	})
+}
@@ -0,0 +1,133 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+// explainLineEscaper escapes the line breaks of the Consul values, eg: a node
+// name, which would otherwise end the comment and add directives
+var explainLineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+// explain annotates the frontends and backends with the Consul data and the
+// config keys they were generated from, the renderer writes them as comments
+func explain(cfg consul.Config, s State) State {
+	escape := func(lines []string) []string {
+		res := make([]string, len(lines))
+		for i, l := range lines {
+			res[i] = explainLineEscaper.Replace(l)
+		}
+		return res
+	}
+	annotate := func(name string, lines []string) {
+		for i, fe := range s.Frontends {
+			if fe.Frontend.Name == "front_"+name {
+				s.Frontends[i].Explain = escape(lines)
+			}
+		}
+		for i, be := range s.Backends {
+			if be.Backend.Name == "back_"+name {
+				s.Backends[i].Explain = escape(append(append([]string{}, lines...), explainServers(be, cfg.Upstreams, name)...))
+			}
+		}
+	}
+
+	downstreams := append([]consul.Downstream{cfg.Downstream}, cfg.ExtraDownstreams...)
+	for _, d := range downstreams {
+		name := "downstream"
+		if d.Name != "" {
+			name = "downstream_" + d.Name
+		}
+		annotate(name, []string{
+			fmt.Sprintf("public listener of service %s (proxy %s)", cfg.ServiceName, cfg.ServiceID),
+			fmt.Sprintf("%s:%d to %s:%d, protocol %s", d.LocalBindAddress, d.LocalBindPort, d.TargetAddress, d.TargetPort, protocolOrTCP(d.Protocol)),
+			explainKeys(d.ConfigKeys),
+		})
+	}
+
+	for _, up := range cfg.Upstreams {
+		dc := up.Datacenter
+		if dc == "" {
+			dc = "local"
+		}
+		lines := []string{
+			fmt.Sprintf("upstream %s: service %s, datacenter %s, protocol %s", up.Name, up.ServiceName, dc, protocolOrTCP(up.Protocol)),
+			explainKeys(up.ConfigKeys),
+		}
+		if up.HTTPCheck != nil {
+			lines = append(lines, fmt.Sprintf("http check: %s %s every %s", up.HTTPCheck.Method, up.HTTPCheck.Path, up.HTTPCheck.Interval))
+		}
+		if up.ClientTLS != nil {
+			lines = append(lines, "client certificate "+up.ClientTLS.CertFile+" instead of the Connect one")
+		}
+		if up.Pinned {
+			lines = append(lines, "instances pinned by an operator")
+		}
+		for _, sp := range up.Splits {
+			lines = append(lines, fmt.Sprintf("split: %d%% to %s", sp.Weight, sp.Service))
+		}
+		for _, ss := range up.Subsets {
+			lines = append(lines, fmt.Sprintf("subset %s: %d%% of the traffic", ss.Name, ss.Weight))
+		}
+		annotate(up.Name, lines)
+	}
+
+	return s
+}
+
+// explainServers describes the Consul instance of each server of an
+// upstream backend
+func explainServers(be Backend, upstreams []consul.Upstream, name string) []string {
+	nodes := map[string]consul.UpstreamNode{}
+	for _, up := range upstreams {
+		if up.Name != name {
+			continue
+		}
+		for _, n := range up.Nodes {
+			nodes[n.ID()] = n
+		}
+	}
+
+	lines := []string{}
+	for _, srv := range be.Servers {
+		var port int
+		if srv.Port != nil {
+			port = int(*srv.Port)
+		}
+		n, ok := nodes[consul.UpstreamNode{Host: srv.Address, Port: port}.ID()]
+		if !ok {
+			continue
+		}
+		desc := []string{fmt.Sprintf("%s: instance %s", srv.Name, n.ID())}
+		if n.Node != "" {
+			desc = append(desc, "node "+n.Node)
+		}
+		if n.Datacenter != "" {
+			desc = append(desc, "datacenter "+n.Datacenter)
+		}
+		if n.Backup {
+			desc = append(desc, "failover backup")
+		}
+		if n.Draining {
+			desc = append(desc, "draining, in maintenance")
+		}
+		lines = append(lines, strings.Join(desc, ", "))
+	}
+	return lines
+}
+
+func explainKeys(keys []string) string {
+	if len(keys) == 0 {
+		return "config keys: none, defaults apply"
+	}
+	return "config keys: " + strings.Join(keys, ", ")
+}
+
+func protocolOrTCP(protocol string) string {
+	if protocol == "" {
+		return "tcp"
+	}
+	return protocol
+}
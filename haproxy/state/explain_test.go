@@ -0,0 +1,51 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.ServiceName = "web"
+	cfg.ServiceID = "web-sidecar-proxy"
+	cfg.Upstreams[0].ConfigKeys = []string{"balance", "protocol"}
+	cfg.Upstreams[0].Nodes[1].Node = "node2\n\tbind :80"
+	cfg.Upstreams[0].Nodes[1].Draining = true
+
+	opts := TestOpts
+	opts.Explain = true
+	st, err := Generate(opts, TestCertStore, State{}, cfg)
+	require.NoError(t, err)
+
+	fe, ok := findFrontend(st, "front_service_1")
+	require.True(t, ok)
+	require.Equal(t, []string{
+		"upstream service_1: service 1, datacenter local, protocol http",
+		"config keys: balance, protocol",
+	}, fe.Explain)
+
+	be, ok := st.findBackend("back_service_1")
+	require.True(t, ok)
+	require.Equal(t, []string{
+		"upstream service_1: service 1, datacenter local, protocol http",
+		"config keys: balance, protocol",
+		"srv_0: instance 1.2.3.4:8080",
+		"srv_1: instance 1.2.3.5:8081, node node2\\n\tbind :80, draining, in maintenance",
+	}, be.Explain)
+
+	be, ok = st.findBackend("back_downstream")
+	require.True(t, ok)
+	require.Equal(t, "public listener of service web (proxy web-sidecar-proxy)", be.Explain[0])
+	require.Equal(t, "config keys: none, defaults apply", be.Explain[2])
+}
+
+func findFrontend(s State, name string) (Frontend, bool) {
+	for _, f := range s.Frontends {
+		if f.Frontend.Name == name {
+			return f, true
+		}
+	}
+	return Frontend{}, false
+}
@@ -22,6 +22,8 @@ const (
 	haOpCreateTCPRequestRule
 	haOpCreateLogTargets
 	haOpCreateHTTPRequestRule
+	haOpCreateHTTPResponseRule
+	haOpCreateBackendSwitchingRule
 )
 
 type fakeHAOp struct {
@@ -145,3 +147,19 @@ func (h *fakeHA) CreateHTTPRequestRule(parentType, parentName string, rule model
 	})
 	return nil
 }
+
+func (h *fakeHA) CreateHTTPResponseRule(parentType, parentName string, rule models.HTTPResponseRule) error {
+	h.ops = append(h.ops, fakeHAOp{
+		Type: haOpCreateHTTPResponseRule,
+		Name: parentName,
+	})
+	return nil
+}
+
+func (h *fakeHA) CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error {
+	h.ops = append(h.ops, fakeHAOp{
+		Type: haOpCreateBackendSwitchingRule,
+		Name: feName,
+	})
+	return nil
+}
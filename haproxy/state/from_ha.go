@@ -0,0 +1,152 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/haproxytech/models/v2"
+)
+
+// HAProxyReader reads the configuration HAProxy runs
+type HAProxyReader interface {
+	Frontends() ([]models.Frontend, error)
+	Binds(feName string) ([]models.Bind, error)
+	Backends() ([]models.Backend, error)
+	Servers(beName string) ([]models.Server, error)
+	Filters(parentType, parentName string) ([]models.Filter, error)
+	TCPRequestRules(parentType, parentName string) ([]models.TCPRequestRule, error)
+	LogTargets(parentType, parentName string) ([]models.LogTarget, error)
+	HTTPRequestRules(parentType, parentName string) ([]models.HTTPRequestRule, error)
+	HTTPResponseRules(parentType, parentName string) ([]models.HTTPResponseRule, error)
+	BackendSwitchingRules(feName string) ([]models.BackendSwitchingRule, error)
+}
+
+var (
+	backendMapRe = regexp.MustCompile(`^%\[rand\(\d+\),map_int\(([^,]+),[^)]*\)\]$`)
+	dstMapRe     = regexp.MustCompile(`^%\[dst,map_ip\(([^)]+)\)\]$`)
+)
+
+// FromHAProxy reads the state HAProxy runs, it is the reverse of Apply. The
+// parts only rendered to a config file are not read.
+func FromHAProxy(ha HAProxyReader) (State, error) {
+	state := State{}
+
+	fes, err := ha.Frontends()
+	if err != nil {
+		return state, err
+	}
+	for _, fe := range fes {
+		f, err := frontendFromHAProxy(ha, fe)
+		if err != nil {
+			return state, fmt.Errorf("frontend %s: %w", fe.Name, err)
+		}
+		state.Frontends = append(state.Frontends, f)
+	}
+
+	bes, err := ha.Backends()
+	if err != nil {
+		return state, err
+	}
+	for _, be := range bes {
+		b, err := backendFromHAProxy(ha, be)
+		if err != nil {
+			return state, fmt.Errorf("backend %s: %w", be.Name, err)
+		}
+		state.Backends = append(state.Backends, b)
+	}
+
+	return state, nil
+}
+
+func frontendFromHAProxy(ha HAProxyReader, fe models.Frontend) (Frontend, error) {
+	f := Frontend{Frontend: fe}
+
+	binds, err := ha.Binds(fe.Name)
+	if err != nil {
+		return f, err
+	}
+	if len(binds) > 0 {
+		f.Bind = binds[0]
+	}
+
+	rules, err := ha.BackendSwitchingRules(fe.Name)
+	if err != nil {
+		return f, err
+	}
+	for _, r := range rules {
+		if m := backendMapRe.FindStringSubmatch(r.Name); m != nil {
+			f.BackendMap = m[1]
+		}
+		if m := dstMapRe.FindStringSubmatch(r.Name); m != nil {
+			f.DstMap = m[1]
+		}
+	}
+
+	filters, err := ha.Filters(parentTypeFrontend, fe.Name)
+	if err != nil {
+		return f, err
+	}
+	for _, filter := range filters {
+		switch filter.Type {
+		case models.FilterTypeSpoe:
+			f.FilterSpoe = &FrontendFilter{Filter: filter}
+			tcpRules, err := ha.TCPRequestRules(parentTypeFrontend, fe.Name)
+			if err != nil {
+				return f, err
+			}
+			if len(tcpRules) > 0 {
+				f.FilterSpoe.Rule = tcpRules[0]
+			}
+		case models.FilterTypeCompression:
+			f.FilterCompression = &FrontendFilter{Filter: filter}
+		}
+	}
+
+	targets, err := ha.LogTargets(parentTypeFrontend, fe.Name)
+	if err != nil {
+		return f, err
+	}
+	if len(targets) > 0 {
+		f.LogTarget = &targets[0]
+	}
+
+	return f, nil
+}
+
+func backendFromHAProxy(ha HAProxyReader, be models.Backend) (Backend, error) {
+	b := Backend{Backend: be}
+
+	servers, err := ha.Servers(be.Name)
+	if err != nil {
+		return b, err
+	}
+	if len(servers) > 0 {
+		b.Servers = servers
+	}
+
+	targets, err := ha.LogTargets(parentTypeBackend, be.Name)
+	if err != nil {
+		return b, err
+	}
+	if len(targets) > 0 {
+		b.LogTarget = &targets[0]
+	}
+
+	reqRules, err := ha.HTTPRequestRules(parentTypeBackend, be.Name)
+	if err != nil {
+		return b, err
+	}
+	if len(reqRules) > 0 {
+		b.HTTPRequestRules = reqRules
+	}
+
+	respRules, err := ha.HTTPResponseRules(parentTypeBackend, be.Name)
+	if err != nil {
+		return b, err
+	}
+	if len(respRules) > 0 {
+		b.HTTPResponseRules = respRules
+	}
+
+	return b, nil
+}
@@ -102,7 +102,7 @@ RHmDi0qnL6qrKfjTOnfHgQPCgxAy9knMIiDzBRg=
 	`), 0644)
 	require.NoError(t, err)
 
-	dp, err := haproxy_cmd.Start(sd, haproxy_cmd.Config{
+	cmdCfg := haproxy_cmd.Config{
 		HAProxyPath:             os.Getenv("HAPROXY"),
 		HAProxyConfigPath:       haCfgPath,
 		DataplanePath:           os.Getenv("DATAPLANEAPI"),
@@ -111,7 +111,10 @@ RHmDi0qnL6qrKfjTOnfHgQPCgxAy9knMIiDzBRg=
 		DataplaneUser:           "usr",
 		DataplanePass:           "pass",
 		DataplaneLogLevel:       "info",
-	})
+	}
+	master, err := haproxy_cmd.Start(sd, cmdCfg)
+	require.NoError(t, err)
+	dp, err := haproxy_cmd.StartDataplane(sd, cmdCfg, master.PID())
 	require.NoError(t, err)
 
 	tx := dp.Tnx()
@@ -133,6 +136,10 @@ RHmDi0qnL6qrKfjTOnfHgQPCgxAy9knMIiDzBRg=
 }
 
 func TestFromHA(t *testing.T) {
+	if os.Getenv("HAPROXY") == "" || os.Getenv("DATAPLANEAPI") == "" {
+		t.Skip("HAPROXY and DATAPLANEAPI must be set to the binaries")
+	}
+
 	cfgDir, err := ioutil.TempDir("", fmt.Sprintf("%s_*", t.Name()))
 	require.NoError(t, err)
 
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashPolicy configures session affinity on an upstream backend, it must be
+// called once the servers are generated.
+// Header and source policies hash the key with a consistent hash so that
+// most clients keep their server when the node set changes. The cookie
+// policy prefixes the application cookie with a hash of the server address,
+// the server names are renumbered when the node set changes.
+func hashPolicy(be *Backend, p *consul.HashPolicy) {
+	if p == nil {
+		return
+	}
+
+	name := be.Backend.Name
+	if !p.SourceIP && be.Backend.Mode != models.BackendModeHTTP {
+		log.Warnf("%s: hash_policy on %s requires the http protocol, ignoring", name, p.Field)
+		return
+	}
+
+	consistent := &models.BackendHashType{Method: models.BackendHashTypeMethodConsistent}
+	switch {
+	case p.SourceIP:
+		be.Backend.Balance = &models.Balance{Algorithm: stringp(models.BalanceAlgorithmSource)}
+		be.Backend.HashType = consistent
+	case p.Field == consul.HashFieldHeader:
+		be.Backend.Balance = &models.Balance{Algorithm: stringp(models.BalanceAlgorithmHdr), HdrName: p.FieldValue}
+		be.Backend.HashType = consistent
+	case p.Field == consul.HashFieldCookie:
+		be.Backend.Cookie = &models.Cookie{
+			Name:    stringp(p.FieldValue),
+			Type:    models.CookieTypePrefix,
+			Nocache: true,
+		}
+		for i := range be.Servers {
+			be.Servers[i].Cookie = serverCookie(be.Servers[i])
+		}
+	}
+}
+
+// serverCookie identifies a server by its address and port
+func serverCookie(srv models.Server) string {
+	addr := srv.Address
+	if srv.Port != nil {
+		addr += ":" + strconv.FormatInt(*srv.Port, 10)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,58 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPolicy(t *testing.T) {
+	backend := func(mode string) *Backend {
+		return &Backend{
+			Backend: models.Backend{
+				Name:    "back",
+				Mode:    mode,
+				Balance: &models.Balance{Algorithm: stringp(models.BalanceAlgorithmLeastconn)},
+			},
+			Servers: []models.Server{
+				{Name: "srv_0", Address: "1.2.3.4", Port: int64p(8080)},
+				{Name: "srv_1", Address: "1.2.3.5", Port: int64p(8080)},
+			},
+		}
+	}
+
+	be := backend(models.BackendModeHTTP)
+	hashPolicy(be, &consul.HashPolicy{Field: consul.HashFieldHeader, FieldValue: "X-User-Id"})
+	require.Equal(t, models.BalanceAlgorithmHdr, *be.Backend.Balance.Algorithm)
+	require.Equal(t, "X-User-Id", be.Backend.Balance.HdrName)
+	require.Equal(t, models.BackendHashTypeMethodConsistent, be.Backend.HashType.Method)
+
+	be = backend(models.BackendModeTCP)
+	hashPolicy(be, &consul.HashPolicy{SourceIP: true})
+	require.Equal(t, models.BalanceAlgorithmSource, *be.Backend.Balance.Algorithm)
+	require.Equal(t, models.BackendHashTypeMethodConsistent, be.Backend.HashType.Method)
+
+	be = backend(models.BackendModeHTTP)
+	hashPolicy(be, &consul.HashPolicy{Field: consul.HashFieldCookie, FieldValue: "SESSION"})
+	require.Equal(t, "SESSION", *be.Backend.Cookie.Name)
+	require.Equal(t, models.CookieTypePrefix, be.Backend.Cookie.Type)
+	require.Len(t, be.Servers[1].Cookie, 16)
+	require.NotEqual(t, be.Servers[0].Cookie, be.Servers[1].Cookie)
+	require.Equal(t, models.BalanceAlgorithmLeastconn, *be.Backend.Balance.Algorithm)
+
+	// the cookie of a server does not depend on its name
+	renamed := backend(models.BackendModeHTTP)
+	renamed.Servers = renamed.Servers[1:]
+	renamed.Servers[0].Name = "srv_0"
+	hashPolicy(renamed, &consul.HashPolicy{Field: consul.HashFieldCookie, FieldValue: "SESSION"})
+	require.Equal(t, be.Servers[1].Cookie, renamed.Servers[0].Cookie)
+	require.Equal(t, models.BalanceAlgorithmLeastconn, *be.Backend.Balance.Algorithm)
+
+	// header and cookie policies are ignored in TCP mode
+	be = backend(models.BackendModeTCP)
+	hashPolicy(be, &consul.HashPolicy{Field: consul.HashFieldCookie, FieldValue: "SESSION"})
+	require.Nil(t, be.Backend.Cookie)
+	require.Empty(t, be.Servers[0].Cookie)
+}
@@ -0,0 +1,49 @@
+package state
+
+import (
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+var headerRequestTypes = map[string]string{
+	consul.HeaderActionAdd:     models.HTTPRequestRuleTypeAddHeader,
+	consul.HeaderActionSet:     models.HTTPRequestRuleTypeSetHeader,
+	consul.HeaderActionDel:     models.HTTPRequestRuleTypeDelHeader,
+	consul.HeaderActionReplace: models.HTTPRequestRuleTypeReplaceHeader,
+}
+
+var headerResponseTypes = map[string]string{
+	consul.HeaderActionAdd:     models.HTTPResponseRuleTypeAddHeader,
+	consul.HeaderActionSet:     models.HTTPResponseRuleTypeSetHeader,
+	consul.HeaderActionDel:     models.HTTPResponseRuleTypeDelHeader,
+	consul.HeaderActionReplace: models.HTTPResponseRuleTypeReplaceHeader,
+}
+
+// headerRules adds the header changes of a listener or upstream to its
+// backend, after the rules it already has
+func headerRules(be *Backend, rules consul.HeaderRules) {
+	if len(rules.Request) == 0 && len(rules.Response) == 0 {
+		return
+	}
+	if be.Backend.Mode != models.BackendModeHTTP {
+		log.Warnf("backend %s: request_headers and response_headers require the http protocol, ignoring", be.Backend.Name)
+		return
+	}
+	for _, r := range rules.Request {
+		be.HTTPRequestRules = append(be.HTTPRequestRules, models.HTTPRequestRule{
+			Type:      headerRequestTypes[r.Action],
+			HdrName:   r.Header,
+			HdrMatch:  r.Match,
+			HdrFormat: r.Value,
+		})
+	}
+	for _, r := range rules.Response {
+		be.HTTPResponseRules = append(be.HTTPResponseRules, models.HTTPResponseRule{
+			Type:      headerResponseTypes[r.Action],
+			HdrName:   r.Header,
+			HdrMatch:  r.Match,
+			HdrFormat: r.Value,
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules := consul.HeaderRules{
+		Request: []consul.HeaderRule{
+			{Action: consul.HeaderActionSet, Header: "X-Env", Value: "production"},
+			{Action: consul.HeaderActionDel, Header: "X-Debug"},
+		},
+		Response: []consul.HeaderRule{
+			{Action: consul.HeaderActionReplace, Header: "Location", Match: "^http://(.*)", Value: "https://\\1"},
+		},
+	}
+
+	be := &Backend{Backend: models.Backend{Name: "back", Mode: models.BackendModeHTTP}}
+	headerRules(be, rules)
+	require.Equal(t, []models.HTTPRequestRule{
+		{Type: models.HTTPRequestRuleTypeSetHeader, HdrName: "X-Env", HdrFormat: "production"},
+		{Type: models.HTTPRequestRuleTypeDelHeader, HdrName: "X-Debug"},
+	}, be.HTTPRequestRules)
+	require.Equal(t, []models.HTTPResponseRule{
+		{Type: models.HTTPResponseRuleTypeReplaceHeader, HdrName: "Location", HdrMatch: "^http://(.*)", HdrFormat: "https://\\1"},
+	}, be.HTTPResponseRules)
+
+	be = &Backend{Backend: models.Backend{Name: "back", Mode: models.BackendModeTCP}}
+	headerRules(be, rules)
+	require.Empty(t, be.HTTPRequestRules)
+	require.Empty(t, be.HTTPResponseRules)
+}
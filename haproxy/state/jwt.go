@@ -0,0 +1,7 @@
+package state
+
+// JWT has the SPOE agent validate the JWT of the requests of a listener,
+// the requests without a valid token are denied
+type JWT struct {
+	SPOEConfig string
+}
@@ -0,0 +1,50 @@
+package state
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+// LuaScript is a script written in the config dir and loaded with lua-load
+type LuaScript struct {
+	Name   string
+	Path   string
+	Source string
+}
+
+// generateLuaScripts adds the scripts of the flags and, when allowed, the
+// lua_scripts of the proxy config, the ones of the flags take precedence
+func generateLuaScripts(opts Options, cfg consul.Config, state State) State {
+	sources := map[string]string{}
+	if len(cfg.LuaScripts) > 0 && !opts.LuaFromConfig {
+		log.Warnf("lua_scripts of the proxy config are only loaded with -lua-from-config, ignoring")
+	} else {
+		for name, source := range cfg.LuaScripts {
+			sources[name] = source
+		}
+	}
+	for name, source := range opts.LuaScripts {
+		if _, ok := sources[name]; ok {
+			log.Warnf("lua script %s is given by a flag and the proxy config, using the flag one", name)
+		}
+		sources[name] = source
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		state.LuaScripts = append(state.LuaScripts, LuaScript{
+			Name:   name,
+			Path:   filepath.Join(opts.MapsDir, "lua", name),
+			Source: sources[name],
+		})
+	}
+	return state
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+// SplitSlots is the number of entries of a split map, the backend is
+// selected with rand(SplitSlots) so each entry weights for 1%
+const SplitSlots = 100
+
+type MapEntry struct {
+	Key   string
+	Value string
+}
+
+// Map is an HAProxy map file. Its content can be changed at runtime
+// without reloading HAProxy
+type Map struct {
+	Name    string
+	Path    string
+	Entries []MapEntry
+}
+
+// splitKey identifies the upstream of a service among the ones of the
+// local service owning it
+func splitKey(owner, service string) string {
+	return owner + "/" + service
+}
+
+// generateSplits builds, for each upstream with splits, a map selecting the
+// backend of the split services and makes the upstream frontend use it.
+// The split services are looked up among the upstreams of the same local
+// service only, the backends of the others present another identity.
+func generateSplits(opts Options, cfg consul.Config, state State) State {
+	backends := map[string]string{}
+	for _, up := range cfg.Upstreams {
+		backends[splitKey(up.Owner, up.ServiceName)] = fmt.Sprintf("back_%s", up.Name)
+	}
+
+	for _, up := range cfg.Upstreams {
+		if len(up.Splits) == 0 {
+			continue
+		}
+
+		feName := fmt.Sprintf("front_%s", up.Name)
+		beName := fmt.Sprintf("back_%s", up.Name)
+
+		m := Map{
+			Name: fmt.Sprintf("split_%s", up.Name),
+		}
+		m.Path = path.Join(opts.MapsDir, m.Name+".map")
+
+		total := 0
+		for _, s := range up.Splits {
+			if _, ok := backends[splitKey(up.Owner, s.Service)]; !ok {
+				log.Errorf("upstream %s: split service %s is not an upstream, ignoring", up.Name, s.Service)
+				continue
+			}
+			total += s.Weight
+		}
+		if total == 0 {
+			continue
+		}
+
+		slot := 0
+		acc := 0
+		for _, s := range up.Splits {
+			be, ok := backends[splitKey(up.Owner, s.Service)]
+			if !ok {
+				continue
+			}
+			acc += s.Weight
+			end := acc * SplitSlots / total
+			for ; slot < end; slot++ {
+				m.Entries = append(m.Entries, MapEntry{
+					Key:   strconv.Itoa(slot),
+					Value: be,
+				})
+			}
+		}
+		for ; slot < SplitSlots; slot++ {
+			m.Entries = append(m.Entries, MapEntry{
+				Key:   strconv.Itoa(slot),
+				Value: beName,
+			})
+		}
+
+		for i := range state.Frontends {
+			if state.Frontends[i].Frontend.Name == feName {
+				state.Frontends[i].BackendMap = m.Path
+			}
+		}
+		state.Maps = append(state.Maps, m)
+	}
+
+	return state
+}
@@ -0,0 +1,113 @@
+package state
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateSplits(t *testing.T) {
+	cfg := consul.Config{
+		Upstreams: []consul.Upstream{
+			{
+				Name:          "service_server",
+				ServiceName:   "server",
+				LocalBindPort: 10000,
+				Splits: []consul.UpstreamSplit{
+					{Service: "server", Weight: 90},
+					{Service: "server-canary", Weight: 10},
+					{Service: "unknown", Weight: 50},
+				},
+			},
+			{
+				Name:        "service_server-canary",
+				ServiceName: "server-canary",
+			},
+		},
+	}
+
+	st := State{
+		Frontends: []Frontend{
+			{},
+		},
+	}
+	st.Frontends[0].Frontend.Name = "front_service_server"
+
+	st = generateSplits(Options{MapsDir: "/maps"}, cfg, st)
+
+	require.Len(t, st.Maps, 1)
+	m := st.Maps[0]
+	require.Equal(t, "split_service_server", m.Name)
+	require.Equal(t, "/maps/split_service_server.map", m.Path)
+	require.Equal(t, m.Path, st.Frontends[0].BackendMap)
+
+	require.Len(t, m.Entries, SplitSlots)
+	for i, e := range m.Entries {
+		require.Equal(t, strconv.Itoa(i), e.Key)
+		if i < 90 {
+			require.Equal(t, "back_service_server", e.Value)
+		} else {
+			require.Equal(t, "back_service_server-canary", e.Value)
+		}
+	}
+}
+
+func TestGenerateSplitsMultiService(t *testing.T) {
+	// web and api both have upstreams to server and server-canary, each
+	// split must use the backends of its own service
+	cfg := consul.Config{
+		Upstreams: []consul.Upstream{
+			{
+				Name:        "server",
+				ServiceName: "server",
+				Splits: []consul.UpstreamSplit{
+					{Service: "server", Weight: 50},
+					{Service: "server-canary", Weight: 50},
+				},
+			},
+			{Name: "server-canary", ServiceName: "server-canary"},
+			{Name: "legacy", ServiceName: "legacy"},
+			{
+				Name:        "api_server",
+				ServiceName: "server",
+				Owner:       "api",
+				Splits: []consul.UpstreamSplit{
+					{Service: "server", Weight: 50},
+					{Service: "server-canary", Weight: 50},
+				},
+			},
+			{Name: "api_server-canary", ServiceName: "server-canary", Owner: "api"},
+			{
+				Name:        "api_other",
+				ServiceName: "other",
+				Owner:       "api",
+				Splits: []consul.UpstreamSplit{
+					// only an upstream of web
+					{Service: "legacy", Weight: 100},
+				},
+			},
+		},
+	}
+
+	st := generateSplits(Options{MapsDir: "/maps"}, cfg, State{})
+
+	backends := map[string]map[string]bool{}
+	for _, m := range st.Maps {
+		backends[m.Name] = map[string]bool{}
+		for _, e := range m.Entries {
+			backends[m.Name][e.Value] = true
+		}
+	}
+	require.Equal(t, map[string]map[string]bool{
+		"split_server": {
+			"back_server":        true,
+			"back_server-canary": true,
+		},
+		"split_api_server": {
+			"back_api_server":        true,
+			"back_api_server-canary": true,
+		},
+	}, backends)
+}
@@ -0,0 +1,73 @@
+package state
+
+import (
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+)
+
+// deriveMaxConn splits the global connection budget between the listeners so
+// that a single upstream cannot take all of it: each listener gets an equal
+// share, spread over the active servers of its upstream. The limits set in
+// the config of an upstream are kept.
+func deriveMaxConn(budget int, s State, upstreams []consul.Upstream) State {
+	if budget <= 0 || len(s.Frontends) == 0 {
+		return s
+	}
+	share := budget / len(s.Frontends)
+	if share < 1 {
+		share = 1
+	}
+
+	limits := map[string]consul.Limits{}
+	for _, up := range upstreams {
+		limits[up.Name] = up.Limits
+	}
+
+	// the listeners with a listener_maxconn already have their limit
+	for i, fe := range s.Frontends {
+		if fe.Frontend.Maxconn == nil {
+			s.Frontends[i].Frontend.Maxconn = int64p(share)
+		}
+	}
+
+	for i, be := range s.Backends {
+		l, ok := limits[strings.TrimPrefix(be.Backend.Name, "back_")]
+		if !ok || l.MaxConn > 0 || len(be.Servers) == 0 {
+			continue
+		}
+		maxConn := share
+		if l.ListenerMaxConn > 0 {
+			maxConn = l.ListenerMaxConn
+		}
+		perServer := ceilDiv(maxConn, activeServers(be.Servers))
+		servers := make([]models.Server, len(be.Servers))
+		for j, srv := range be.Servers {
+			srv.Maxconn = int64p(perServer)
+			servers[j] = srv
+		}
+		s.Backends[i].Servers = servers
+	}
+
+	return s
+}
+
+// activeServers counts the servers getting traffic when all are up, the
+// backup ones only replace them
+func activeServers(servers []models.Server) int {
+	n := 0
+	for _, srv := range servers {
+		if srv.Backup != models.ServerBackupEnabled {
+			n++
+		}
+	}
+	if n == 0 {
+		return len(servers)
+	}
+	return n
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,64 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveMaxConn(t *testing.T) {
+	servers := func(n int) []models.Server {
+		s := []models.Server{}
+		for i := 0; i < n; i++ {
+			s = append(s, models.Server{Name: "srv"})
+		}
+		return s
+	}
+	st := State{
+		Frontends: []Frontend{
+			{Frontend: models.Frontend{Name: "front_downstream"}},
+			{Frontend: models.Frontend{Name: "front_api"}},
+			{Frontend: models.Frontend{Name: "front_db", Maxconn: int64p(500)}},
+			{Frontend: models.Frontend{Name: "front_cache"}},
+		},
+		Backends: []Backend{
+			{Backend: models.Backend{Name: "back_downstream"}, Servers: servers(1)},
+			{Backend: models.Backend{Name: "back_api"}, Servers: append(servers(3), models.Server{Backup: models.ServerBackupEnabled})},
+			{Backend: models.Backend{Name: "back_db"}, Servers: servers(2)},
+			{Backend: models.Backend{Name: "back_cache"}, Servers: servers(2)},
+		},
+	}
+	upstreams := []consul.Upstream{
+		{Name: "api"},
+		{Name: "db", Limits: consul.Limits{ListenerMaxConn: 500}},
+		{Name: "cache", Limits: consul.Limits{MaxConn: 10}},
+	}
+
+	st = deriveMaxConn(1000, st, upstreams)
+
+	maxConn := map[string]int64{}
+	for _, fe := range st.Frontends {
+		maxConn[fe.Frontend.Name] = *fe.Frontend.Maxconn
+	}
+	require.Equal(t, map[string]int64{
+		"front_downstream": 250,
+		"front_api":        250,
+		"front_db":         500,
+		"front_cache":      250,
+	}, maxConn)
+
+	// the local service is only capped by its listener
+	require.Nil(t, st.Backends[0].Servers[0].Maxconn)
+	for _, srv := range st.Backends[1].Servers {
+		require.Equal(t, int64(84), *srv.Maxconn)
+	}
+	for _, srv := range st.Backends[2].Servers {
+		require.Equal(t, int64(250), *srv.Maxconn)
+	}
+	// set in the upstream config
+	require.Nil(t, st.Backends[3].Servers[0].Maxconn)
+
+	require.Equal(t, State{}, deriveMaxConn(0, State{}, upstreams))
+}
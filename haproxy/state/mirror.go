@@ -0,0 +1,61 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mirror copies a share of the requests of a backend to the local listener
+// of another upstream, through the SPOE agent
+type Mirror struct {
+	SPOEConfig string
+	// Upstream is the name of the upstream the agent sends the copies to
+	Upstream string
+	Percent  int
+}
+
+// generateMirrors sets the mirror of the backends of the upstreams with a
+// mirror_to key, the copies are sent by the SPOE agent to the listener of
+// the target upstream
+func generateMirrors(opts Options, cfg consul.Config, state State) State {
+	upstreams := map[string]consul.Upstream{}
+	for _, up := range cfg.Upstreams {
+		upstreams[up.Name] = up
+	}
+
+	for _, up := range cfg.Upstreams {
+		if up.Mirror == nil {
+			continue
+		}
+		target, ok := upstreams[up.Mirror.Upstream]
+		if !ok || target.Name == up.Name {
+			log.Errorf("upstream %s: mirror_to %s is not another upstream, ignoring", up.Name, up.Mirror.Upstream)
+			continue
+		}
+		if target.LocalBindPort == 0 {
+			log.Errorf("upstream %s: mirror_to %s has no local listener, ignoring", up.Name, up.Mirror.Upstream)
+			continue
+		}
+
+		beName := fmt.Sprintf("back_%s", up.Name)
+		for i, be := range state.Backends {
+			if be.Backend.Name != beName {
+				continue
+			}
+			if be.Backend.Mode != models.BackendModeHTTP {
+				log.Warnf("backend %s: mirror_to requires the http protocol, ignoring", beName)
+				break
+			}
+			state.Backends[i].Mirror = &Mirror{
+				SPOEConfig: opts.SPOEConfigPath,
+				Upstream:   target.Name,
+				Percent:    up.Mirror.Percent,
+			}
+			break
+		}
+	}
+	return state
+}
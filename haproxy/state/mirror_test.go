@@ -0,0 +1,38 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateMirrors(t *testing.T) {
+	opts := Options{SPOEConfigPath: "/tmp/spoe.conf"}
+	state := State{Backends: []Backend{
+		{Backend: models.Backend{Name: "back_api", Mode: models.BackendModeHTTP}},
+		{Backend: models.Backend{Name: "back_db", Mode: models.BackendModeTCP}},
+	}}
+	cfg := consul.Config{Upstreams: []consul.Upstream{
+		{Name: "api", Mirror: &consul.Mirror{Upstream: "api_v2", Percent: 10}},
+		{Name: "api_v2", LocalBindPort: 9191},
+		{Name: "db", Mirror: &consul.Mirror{Upstream: "api_v2", Percent: 100}},
+	}}
+
+	state = generateMirrors(opts, cfg, state)
+	require.Equal(t, &Mirror{SPOEConfig: "/tmp/spoe.conf", Upstream: "api_v2", Percent: 10}, state.Backends[0].Mirror)
+	// tcp backends are not mirrored
+	require.Nil(t, state.Backends[1].Mirror)
+
+	// the target must be another upstream with a local listener
+	for _, target := range []string{"api", "unknown", "split_only"} {
+		state := State{Backends: []Backend{{Backend: models.Backend{Name: "back_api", Mode: models.BackendModeHTTP}}}}
+		cfg := consul.Config{Upstreams: []consul.Upstream{
+			{Name: "api", LocalBindPort: 9090, Mirror: &consul.Mirror{Upstream: target, Percent: 100}},
+			{Name: "split_only"},
+		}}
+		state = generateMirrors(opts, cfg, state)
+		require.Nil(t, state.Backends[0].Mirror, target)
+	}
+}
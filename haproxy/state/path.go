@@ -0,0 +1,34 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// pathRewrite adds the set-path rule of an upstream to its backend, eg:
+// with /v1 stripped and /api added, /v1/users is sent as /api/users
+func pathRewrite(be *Backend, r consul.PathRewrite) {
+	if r.StripPrefix == "" && r.PrefixRewrite == "" {
+		return
+	}
+	if be.Backend.Mode != models.BackendModeHTTP {
+		log.Warnf("backend %s: strip_prefix and prefix_rewrite require the http protocol, ignoring", be.Backend.Name)
+		return
+	}
+
+	path := "path"
+	if r.StripPrefix != "" {
+		// the dots are escaped in a class, backslashes would be unescaped by
+		// the argument parser
+		re := strings.ReplaceAll(r.StripPrefix, ".", "[.]")
+		path = fmt.Sprintf("path,regsub(^%s$,/),regsub(^%s/,/)", re, re)
+	}
+	be.HTTPRequestRules = append(be.HTTPRequestRules, models.HTTPRequestRule{
+		Type:    models.HTTPRequestRuleTypeSetPath,
+		PathFmt: fmt.Sprintf("%s%%[%s]", r.PrefixRewrite, path),
+	})
+}
@@ -0,0 +1,34 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRewrite(t *testing.T) {
+	backend := func(mode string) *Backend {
+		return &Backend{Backend: models.Backend{Name: "back", Mode: mode}}
+	}
+
+	be := backend(models.BackendModeHTTP)
+	pathRewrite(be, consul.PathRewrite{StripPrefix: "/v1.2"})
+	require.Equal(t, []models.HTTPRequestRule{{
+		Type:    models.HTTPRequestRuleTypeSetPath,
+		PathFmt: "%[path,regsub(^/v1[.]2$,/),regsub(^/v1[.]2/,/)]",
+	}}, be.HTTPRequestRules)
+
+	be = backend(models.BackendModeHTTP)
+	pathRewrite(be, consul.PathRewrite{PrefixRewrite: "/api"})
+	require.Equal(t, "/api%[path]", be.HTTPRequestRules[0].PathFmt)
+
+	be = backend(models.BackendModeHTTP)
+	pathRewrite(be, consul.PathRewrite{StripPrefix: "/v1", PrefixRewrite: "/api"})
+	require.Equal(t, "/api%[path,regsub(^/v1$,/),regsub(^/v1/,/)]", be.HTTPRequestRules[0].PathFmt)
+
+	be = backend(models.BackendModeTCP)
+	pathRewrite(be, consul.PathRewrite{PrefixRewrite: "/api"})
+	require.Empty(t, be.HTTPRequestRules)
+}
@@ -68,23 +68,26 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 					Ssl:            true,
 					SslCafile:      baseCfg + "/ca" + certVersion,
 					SslCertificate: baseCfg + "/cert" + certVersion,
-					Verify:         models.BindVerifyRequired,
+					Verify:         models.BindVerifyNone,
+					Alpn:           "h2,http/1.1",
 				},
 				LogTarget: &models.LogTarget{
-					Index:    int64p(0),
 					Address:  baseCfg + "/logs.sock",
 					Facility: models.LogTargetFacilityLocal0,
 					Format:   models.LogTargetFormatRfc5424,
 				},
-				Filter: &FrontendFilter{
+				FilterCompression: &FrontendFilter{
+					Filter: models.Filter{
+						Type: models.FilterTypeCompression,
+					},
+				},
+				FilterSpoe: &FrontendFilter{
 					Filter: models.Filter{
-						Index:      int64p(0),
 						Type:       models.FilterTypeSpoe,
 						SpoeEngine: "intentions",
 						SpoeConfig: baseCfg + "/spoe",
 					},
 					Rule: models.TCPRequestRule{
-						Index:    int64p(0),
 						Action:   models.TCPRequestRuleActionReject,
 						Cond:     models.TCPRequestRuleCondUnless,
 						CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
@@ -108,11 +111,15 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 					Port:    int64p(10000),
 				},
 				LogTarget: &models.LogTarget{
-					Index:    int64p(0),
 					Address:  baseCfg + "/logs.sock",
 					Facility: models.LogTargetFacilityLocal0,
 					Format:   models.LogTargetFormatRfc5424,
 				},
+				FilterCompression: &FrontendFilter{
+					Filter: models.Filter{
+						Type: models.FilterTypeCompression,
+					},
+				},
 			},
 		},
 
@@ -125,23 +132,26 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 					ServerTimeout:  int64p(int(consul.DefaultReadTimeout.Milliseconds())),
 					ConnectTimeout: int64p(int(consul.DefaultConnectTimeout.Milliseconds())),
 					Mode:           models.BackendModeHTTP,
+					Balance: &models.Balance{
+						Algorithm: stringp(models.BalanceAlgorithmRoundrobin),
+					},
+					Retries: int64p(2),
 				},
 				Servers: []models.Server{
-					models.Server{
-						Name:    "downstream_node",
-						Address: "128.0.0.5",
-						Port:    int64p(8888),
-					},
+					withChecks(models.Server{
+						Name:        "downstream_node",
+						Address:     "128.0.0.5",
+						Port:        int64p(8888),
+						Maintenance: models.ServerMaintenanceDisabled,
+					}),
 				},
 				LogTarget: &models.LogTarget{
-					Index:    int64p(0),
 					Address:  baseCfg + "/logs.sock",
 					Facility: models.LogTargetFacilityLocal0,
 					Format:   models.LogTargetFormatRfc5424,
 				},
 				HTTPRequestRules: []models.HTTPRequestRule{
 					{
-						Index:     int64p(0),
 						Type:      models.HTTPRequestRuleTypeAddHeader,
 						HdrName:   "X-App",
 						HdrFormat: "%[var(sess.connect.source_app)]",
@@ -159,33 +169,13 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 					Balance: &models.Balance{
 						Algorithm: stringp(models.BalanceAlgorithmLeastconn),
 					},
+					Retries: int64p(1),
 				},
 				Servers: []models.Server{
-					models.Server{
-						Name:           "srv_0",
-						Address:        "1.2.3.4",
-						Port:           int64p(8080),
-						Weight:         int64p(5),
-						Ssl:            models.ServerSslEnabled,
-						SslCafile:      baseCfg + "/ca" + certVersion,
-						SslCertificate: baseCfg + "/cert" + certVersion,
-						Verify:         models.BindVerifyRequired,
-						Maintenance:    models.ServerMaintenanceDisabled,
-					},
-					models.Server{
-						Name:           "srv_1",
-						Address:        "1.2.3.5",
-						Port:           int64p(8081),
-						Weight:         int64p(8),
-						Ssl:            models.ServerSslEnabled,
-						SslCafile:      baseCfg + "/ca" + certVersion,
-						SslCertificate: baseCfg + "/cert" + certVersion,
-						Verify:         models.BindVerifyRequired,
-						Maintenance:    models.ServerMaintenanceDisabled,
-					},
+					testUpstreamServer("srv_0", "1.2.3.4", 8080, 5, baseCfg, certVersion),
+					testUpstreamServer("srv_1", "1.2.3.5", 8081, 8, baseCfg, certVersion),
 				},
 				LogTarget: &models.LogTarget{
-					Index:    int64p(0),
 					Address:  baseCfg + "/logs.sock",
 					Facility: models.LogTargetFacilityLocal0,
 					Format:   models.LogTargetFormatRfc5424,
@@ -203,7 +193,7 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 				Servers: []models.Server{
 					models.Server{
 						Name:    "haproxy_connect",
-						Address: "unix@",
+						Address: "unix@//spoe.sock",
 					},
 				},
 			},
@@ -221,11 +211,41 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 	return s
 }
 
+// withChecks sets the default circuit breaker of the generated servers
+func withChecks(srv models.Server) models.Server {
+	srv.Check = models.ServerCheckEnabled
+	srv.Inter = int64p(300000)
+	srv.Fastinter = int64p(2000)
+	srv.Downinter = int64p(2000)
+	srv.Rise = int64p(1)
+	srv.Fall = int64p(1)
+	srv.Observe = models.ServerObserveLayer4
+	srv.ErrorLimit = 1
+	srv.OnError = models.ServerOnErrorMarkDown
+	return srv
+}
+
+func testUpstreamServer(name, address string, port, weight int, baseCfg, certVersion string) models.Server {
+	return withChecks(models.Server{
+		Name:           name,
+		Address:        address,
+		Port:           int64p(port),
+		Weight:         int64p(weight),
+		Ssl:            models.ServerSslEnabled,
+		SslCafile:      baseCfg + "/ca" + certVersion,
+		SslCertificate: baseCfg + "/cert" + certVersion,
+		Verify:         models.ServerVerifyNone,
+		Alpn:           "h2,http/1.1",
+		Maintenance:    models.ServerMaintenanceDisabled,
+	})
+}
+
 var TestOpts = Options{
 	EnableIntentions: true,
 	LogRequests:      true,
 	LogSocket:        "//logs.sock",
 	SPOEConfigPath:   "//spoe",
+	SPOESockets:      []string{"//spoe.sock"},
 }
 
 var TestCertStore = fakeCertStore{}
@@ -245,10 +265,9 @@ func TestServerUpdate(t *testing.T) {
 
 	// remove first server
 	expectedNewState := GetTestHAConfig("/", "")
-	expectedNewState.Backends[1].Servers[0].Maintenance = models.ServerMaintenanceEnabled
-	expectedNewState.Backends[1].Servers[0].Address = "127.0.0.1"
-	expectedNewState.Backends[1].Servers[0].Port = int64p(1)
-	expectedNewState.Backends[1].Servers[0].Weight = int64p(1)
+	expectedNewState.Backends[1].Servers = []models.Server{
+		testUpstreamServer("srv_0", "1.2.3.5", 8081, 8, "/", ""),
+	}
 
 	generated, err := Generate(TestOpts, TestCertStore, oldState, consulCfg)
 	require.Nil(t, err)
@@ -268,29 +287,9 @@ func TestServerUpdate(t *testing.T) {
 	})
 
 	expectedNewState = GetTestHAConfig("/", "")
+	expectedNewState.Backends[1].Backend.Retries = int64p(2)
 	expectedNewState.Backends[1].Servers = append(expectedNewState.Backends[1].Servers,
-		models.Server{
-			Name:           "srv_2",
-			Address:        "1.2.3.6",
-			Port:           int64p(8082),
-			Weight:         int64p(10),
-			Ssl:            models.ServerSslEnabled,
-			SslCafile:      "//ca",
-			SslCertificate: "//cert",
-			Verify:         models.BindVerifyRequired,
-			Maintenance:    models.ServerMaintenanceDisabled,
-		},
-		models.Server{
-			Name:           "srv_3",
-			Address:        "127.0.0.1",
-			Port:           int64p(1),
-			Weight:         int64p(1),
-			Ssl:            models.ServerSslEnabled,
-			SslCafile:      "//ca",
-			SslCertificate: "//cert",
-			Verify:         models.BindVerifyRequired,
-			Maintenance:    models.ServerMaintenanceEnabled,
-		},
+		testUpstreamServer("srv_2", "1.2.3.6", 8082, 10, "/", ""),
 	)
 
 	generated, err = Generate(TestOpts, TestCertStore, generated, consulCfg)
@@ -317,3 +316,74 @@ type fakeCertStore struct {
 func (s fakeCertStore) CertsPath(t consul.TLS) (string, string, error) {
 	return "//ca" + s.suffix, "//cert" + s.suffix, nil
 }
+
+func (s fakeCertStore) ClientTLSPath(t consul.ClientTLS) (string, string, error) {
+	ca := ""
+	if t.CAFile != "" {
+		ca = "/" + t.CAFile
+	}
+	return ca, "/" + t.CertFile, nil
+}
+
+func TestLogIdentity(t *testing.T) {
+	opts := Options{
+		LogIdentity:    true,
+		LogSocket:      "//logs.sock",
+		SPOEConfigPath: "//spoe",
+	}
+	generated, err := Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+
+	require.Equal(t, "spoe_back", generated.Backends[len(generated.Backends)-1].Backend.Name)
+
+	fe := generated.Frontends[0]
+	require.Equal(t, "front_downstream", fe.Frontend.Name)
+	require.NotNil(t, fe.FilterSpoe)
+	require.Equal(t, models.TCPRequestRule{}, fe.FilterSpoe.Rule)
+	require.NotNil(t, fe.LogTarget)
+	require.False(t, fe.Frontend.Httplog)
+	require.Contains(t, fe.Frontend.LogFormat, "var(sess.connect.identity)")
+}
+
+func TestTrustDomain(t *testing.T) {
+	opts := Options{
+		TrustDomain:    "example.consul",
+		SPOEConfigPath: "//spoe",
+	}
+	generated, err := Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+
+	fe := generated.Frontends[0]
+	require.Equal(t, models.BindVerifyRequired, fe.Bind.Verify)
+	require.NotNil(t, fe.FilterSpoe)
+	require.Equal(t, "{ var(sess.connect.identity) -m beg spiffe://example.consul/ }", fe.FilterSpoe.Rule.CondTest)
+
+	opts.EnableIntentions = true
+	generated, err = Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, "{ var(sess.connect.auth) -m int eq 1 } { var(sess.connect.identity) -m beg spiffe://example.consul/ }", generated.Frontends[0].FilterSpoe.Rule.CondTest)
+
+	generated, err = Generate(Options{VerifyDownstream: true}, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, models.BindVerifyRequired, generated.Frontends[0].Bind.Verify)
+	require.Nil(t, generated.Frontends[0].FilterSpoe)
+}
+
+func TestIntentionsFailOpen(t *testing.T) {
+	opts := TestOpts
+	opts.IntentionsFailOpen = true
+	generated, err := Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, "{ var(sess.connect.auth) -m int eq 1 } || { var(txn.connect.error) -m found }", generated.Frontends[0].FilterSpoe.Rule.CondTest)
+
+	// the trust domain is still checked when failing open
+	opts.TrustDomain = "example.consul"
+	generated, err = Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, "{ var(sess.connect.auth) -m int eq 1 } { var(sess.connect.identity) -m beg spiffe://example.consul/ } || { var(txn.connect.error) -m found } { var(sess.connect.identity) -m beg spiffe://example.consul/ }", generated.Frontends[0].FilterSpoe.Rule.CondTest)
+
+	// failing open only applies to the intentions
+	generated, err = Generate(Options{TrustDomain: "example.consul", IntentionsFailOpen: true}, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, "{ var(sess.connect.identity) -m beg spiffe://example.consul/ }", generated.Frontends[0].FilterSpoe.Rule.CondTest)
+}
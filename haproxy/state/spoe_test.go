@@ -0,0 +1,24 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSPOEServers(t *testing.T) {
+	// a single socket is not checked, there is nothing to fail over to
+	servers := spoeServers([]string{"/run/spoe.sock"})
+	require.Equal(t, []models.Server{{Name: "haproxy_connect", Address: "unix@/run/spoe.sock"}}, servers)
+
+	servers = spoeServers([]string{"/run/spoe.sock", "/run/spoe-1.sock"})
+	require.Len(t, servers, 2)
+	require.Equal(t, "haproxy_connect", servers[0].Name)
+	require.Equal(t, "haproxy_connect_1", servers[1].Name)
+	require.Equal(t, "unix@/run/spoe-1.sock", servers[1].Address)
+	for _, srv := range servers {
+		require.Equal(t, models.ServerCheckEnabled, srv.Check)
+		require.Equal(t, models.ServerOnErrorMarkDown, srv.OnError)
+	}
+}
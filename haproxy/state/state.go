@@ -2,6 +2,7 @@ package state
 
 import (
 	"reflect"
+	"sort"
 
 	"github.com/haproxytech/models/v2"
 )
@@ -17,24 +18,205 @@ type Frontend struct {
 	LogTarget         *models.LogTarget
 	FilterCompression *FrontendFilter
 	FilterSpoe        *FrontendFilter
+	// BackendMap is the path of a map used to select the backend
+	BackendMap string
+	// DstMap is the path of a map selecting the backend by the original
+	// destination address of the connections
+	DstMap string
+	// RateLimit is only rendered, the models have no stick-table on
+	// frontends
+	RateLimit *RateLimit
+	// Compression is only rendered, the models have no compression
+	// settings
+	Compression *Compression
+	// JWT is only rendered, the models have no send-spoe-group
+	JWT *JWT
+	// LuaActions are the Lua actions called on the requests, only rendered
+	LuaActions []string
+	// ExtraConfig are raw lines appended to the section by the renderer
+	ExtraConfig []string
+	// Explain are comments describing where the section comes from
+	Explain []string
 }
 
 type Backend struct {
-	Backend          models.Backend
-	LogTarget        *models.LogTarget
-	Servers          []models.Server
-	HTTPRequestRules []models.HTTPRequestRule
+	Backend           models.Backend
+	LogTarget         *models.LogTarget
+	Servers           []models.Server
+	HTTPRequestRules  []models.HTTPRequestRule
+	HTTPResponseRules []models.HTTPResponseRule
+	// Fullconn is only rendered, the models have no equivalent
+	Fullconn int64
+	// HTTPCheck is only rendered, the models have no http-check send
+	HTTPCheck *HTTPCheck
+	// Mirror is only rendered, the models have no send-spoe-group
+	Mirror *Mirror
+	// LuaActions are the Lua actions called on the requests, only rendered
+	LuaActions []string
+	// ExtraConfig are raw lines appended to the section by the renderer
+	ExtraConfig []string
+	// Explain are comments describing where the section comes from
+	Explain []string
+}
+
+// RateLimit caps the rates of a client of a listener, tracked by source
+// address. 0 disables a limit.
+type RateLimit struct {
+	// Conn is the number of new connections per second
+	Conn int64
+	// Req is the number of HTTP requests per second
+	Req int64
+	// SourceTable is the table tracking the requests by source service,
+	// rendered as a backend as a frontend has a single table
+	SourceTable string
+	// Sources are the HTTP requests per second of the listed source
+	// services, sorted by name
+	Sources []SourceRateLimit
+	// SourceDefault is the HTTP requests per second of the source services
+	// not listed
+	SourceDefault int64
+}
+
+// Compression sets what the compression filter compresses
+type Compression struct {
+	Algos   []string
+	Types   []string
+	MinSize int64
+}
+
+// SourceRateLimit is the request budget of a source service, shared by all
+// its instances
+type SourceRateLimit struct {
+	Service string
+	Req     int64
+}
+
+// HTTPCheck is the request sent by the active checks of the servers
+type HTTPCheck struct {
+	Method  string
+	URI     string
+	Headers []HTTPCheckHeader
+}
+
+type HTTPCheckHeader struct {
+	Name  string
+	Value string
 }
 
 type State struct {
 	Frontends []Frontend
 	Backends  []Backend
+	Maps      []Map
+	// LuaScripts are loaded in the global section
+	LuaScripts []LuaScript
+	// NoReusePort is set when a listener disables SO_REUSEPORT, HAProxy
+	// only has a global setting
+	NoReusePort bool
+	// StatsPagePort is the localhost port of the HAProxy stats page,
+	// disabled when 0
+	StatsPagePort int
 }
 
 func (s State) Equal(o State) bool {
 	return reflect.DeepEqual(s, o)
 }
 
+// EqualConfig compares the parts of the states that need a reload to be
+// applied, maps content can be updated at runtime
+func (s State) EqualConfig(o State) bool {
+	s.Maps = nil
+	o.Maps = nil
+	return s.Equal(o)
+}
+
+// EqualExceptWeights tells if the states only differ by the weights of
+// their servers
+func (s State) EqualExceptWeights(o State) bool {
+	return withoutWeights(s).Equal(withoutWeights(o))
+}
+
+// Drains tells if o sets the weight of servers of s to 0, eg: instances put
+// in maintenance, which must stop receiving new traffic right away
+func (s State) Drains(o State) bool {
+	weights := map[string]int64{}
+	for _, be := range s.Backends {
+		for _, srv := range be.Servers {
+			if srv.Weight != nil {
+				weights[be.Backend.Name+"/"+srv.Name] = *srv.Weight
+			}
+		}
+	}
+	for _, be := range o.Backends {
+		for _, srv := range be.Servers {
+			if srv.Weight == nil || *srv.Weight != 0 {
+				continue
+			}
+			if w, ok := weights[be.Backend.Name+"/"+srv.Name]; !ok || w != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CertsChanged tells if the certificates or CAs of the listeners or servers
+// differ between the states, eg: after a leaf certificate rotation
+func (s State) CertsChanged(o State) bool {
+	return !reflect.DeepEqual(s.certs(), o.certs())
+}
+
+// certs is the set of the certificate and CA paths in use, the paths change
+// with the content of the files. The servers added or removed with the same
+// certificates leave it unchanged.
+func (s State) certs() map[string]bool {
+	certs := map[string]bool{}
+	add := func(paths ...string) {
+		for _, p := range paths {
+			if p != "" {
+				certs[p] = true
+			}
+		}
+	}
+	for _, fe := range s.Frontends {
+		add(fe.Bind.SslCertificate, fe.Bind.SslCafile)
+	}
+	for _, be := range s.Backends {
+		for _, srv := range be.Servers {
+			add(srv.SslCertificate, srv.SslCafile)
+		}
+	}
+	return certs
+}
+
+// UnusedCerts returns the certificate and CA paths of s which o does not
+// use, sorted
+func (s State) UnusedCerts(o State) []string {
+	used := o.certs()
+	unused := []string{}
+	for p := range s.certs() {
+		if !used[p] {
+			unused = append(unused, p)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func withoutWeights(s State) State {
+	backends := make([]Backend, len(s.Backends))
+	for i, be := range s.Backends {
+		servers := make([]models.Server, len(be.Servers))
+		for j, srv := range be.Servers {
+			srv.Weight = nil
+			servers[j] = srv
+		}
+		be.Servers = servers
+		backends[i] = be
+	}
+	s.Backends = backends
+	return s
+}
+
 func (s State) findBackend(name string) (Backend, bool) {
 	for _, b := range s.Backends {
 		if b.Backend.Name == name {
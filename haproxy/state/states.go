@@ -1,16 +1,32 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"time"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	spoeTimeout = 30 * time.Second
+	// spoeCheckInterval is the interval of the checks of the SPOE agent
+	// sockets when there are several
+	spoeCheckInterval = 2 * time.Second
+
+	// the HAProxy default TCP and HTTP log formats
+	tcpLogFormat  = `%ci:%cp [%t] %ft %b/%s %Tw/%Tc/%Tt %B %ts %ac/%fc/%bc/%sc/%rc %sq/%bq`
+	httpLogFormat = `%ci:%cp [%tr] %ft %b/%s %TR/%Tw/%Tc/%Tr/%Ta %ST %B %CC %CS %tsc %ac/%fc/%bc/%sc/%rc %sq/%bq %hr %hs %{+Q}r`
+
+	// identity log formats are followed by the client identity recorded by
+	// the SPOE agent
+	tcpIdentityLogFormat  = tcpLogFormat + ` identity=%{+Q}[var(sess.connect.identity)]`
+	httpIdentityLogFormat = httpLogFormat + ` identity=%{+Q}[var(sess.connect.identity)]`
+
+	defaultALPN = "h2,http/1.1"
 )
 
 type Options struct {
@@ -18,11 +34,96 @@ type Options struct {
 	LogRequests      bool
 	LogSocket        string
 	SPOEConfigPath   string
-	SPOESocket       string
+	MapsDir          string
+	// JWT denies the requests of the public listeners without a valid JWT,
+	// checked by the SPOE agent
+	JWT bool
+	// IntentionsFailOpen accepts the downstream clients when the SPOE agent
+	// fails to check the intentions
+	IntentionsFailOpen bool
+	// SPOESockets are the sockets of the SPOE agent, the frames of a
+	// listener that fails are retried on the others
+	SPOESockets []string
+	// LogIdentity records the identity of downstream clients in the access
+	// logs through the SPOE agent, without enforcing intentions
+	LogIdentity bool
+	// LogUpstreamMeta logs the requests of the upstream listeners, the
+	// Consul metadata of their server is added by the log consumer
+	LogUpstreamMeta bool
+	// Explain annotates the generated sections with the Consul data and
+	// config keys they come from
+	Explain bool
+	// MaxConnBudget is the global maxconn shared between the listeners and
+	// the servers of the upstreams, the limits are not derived when 0
+	MaxConnBudget int
+	// TransparentProxyPort is the port of the catch-all listener the
+	// outbound connections are redirected to, disabled when 0
+	TransparentProxyPort int
+	// TLSTicketKeys is the file of the TLS session ticket keys of the
+	// public listeners
+	TLSTicketKeys string
+	// NoTLSTickets disables the TLS session tickets of the public listeners
+	NoTLSTickets bool
+	// VerifyDownstream requires the clients of the public listeners to
+	// present a certificate signed by the Connect CA
+	VerifyDownstream bool
+	// TrustDomain, when set, rejects the clients whose SPIFFE identity is
+	// not in this trust domain
+	TrustDomain string
+	// StatsPagePort is the localhost port of the HAProxy stats page,
+	// disabled when 0
+	StatsPagePort int
+	// LuaScripts are the sources of the scripts of the flags, by file name
+	LuaScripts map[string]string
+	// LuaFromConfig loads the lua_scripts of the proxy config too
+	LuaFromConfig bool
+	// InsecureDevMode generates the upstreams in plain TCP and leaves out
+	// the public listeners while the config has no leaf certificate
+	InsecureDevMode bool
+}
+
+// spoeServers returns the servers of the SPOE agent sockets. With several
+// sockets a listener refusing connections is marked down and its frames are
+// redispatched to the others.
+func spoeServers(socks []string) []models.Server {
+	servers := make([]models.Server, 0, len(socks))
+	for i, sock := range socks {
+		srv := models.Server{
+			Name:    "haproxy_connect",
+			Address: fmt.Sprintf("unix@%s", sock),
+		}
+		if i > 0 {
+			srv.Name = fmt.Sprintf("haproxy_connect_%d", i)
+		}
+		if len(socks) > 1 {
+			srv.Check = models.ServerCheckEnabled
+			srv.Inter = int64p(int(spoeCheckInterval.Milliseconds()))
+			srv.Observe = models.ServerObserveLayer4
+			srv.ErrorLimit = 1
+			srv.OnError = models.ServerOnErrorMarkDown
+		}
+		servers = append(servers, srv)
+	}
+	return servers
+}
+
+// plainTCP tells if the upstreams are generated without TLS, the leaf
+// certificate is not delivered yet in insecure dev mode
+func (o Options) plainTCP(tls consul.TLS) bool {
+	return o.InsecureDevMode && len(tls.Cert) == 0
+}
+
+// spoe tells if the SPOE agent reads the identity of the clients
+func (o Options) spoe() bool {
+	return o.EnableIntentions || o.LogIdentity || o.TrustDomain != ""
 }
 
 type CertificateStore interface {
 	CertsPath(tls consul.TLS) (string, string, error)
+	// ClientTLSPath returns the CA and certificate paths of a client
+	// certificate overriding the Connect one, the CA path is empty when
+	// the instances are not verified
+	ClientTLSPath(tls consul.ClientTLS) (string, string, error)
 }
 
 type HAProxy interface {
@@ -38,6 +139,8 @@ type HAProxy interface {
 	CreateTCPRequestRule(parentType, parentName string, rule models.TCPRequestRule) error
 	CreateLogTargets(parentType, parentName string, rule models.LogTarget) error
 	CreateHTTPRequestRule(parentType, parentName string, rule models.HTTPRequestRule) error
+	CreateHTTPResponseRule(parentType, parentName string, rule models.HTTPResponseRule) error
+	CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error
 }
 
 func Generate(opts Options, certStore CertificateStore, oldState State, cfg consul.Config) (State, error) {
@@ -45,7 +148,8 @@ func Generate(opts Options, certStore CertificateStore, oldState State, cfg cons
 
 	var err error
 
-	if opts.EnableIntentions {
+	// the requests are mirrored by the SPOE agent as well
+	if opts.spoe() || opts.JWT || cfg.Mirrored() {
 		newState.Backends = append(newState.Backends, Backend{
 			Backend: models.Backend{
 				Name:           "spoe_back",
@@ -53,30 +157,57 @@ func Generate(opts Options, certStore CertificateStore, oldState State, cfg cons
 				ConnectTimeout: int64p(int(spoeTimeout.Milliseconds())),
 				Mode:           models.BackendModeTCP,
 			},
-			Servers: []models.Server{
-				models.Server{
-					Name:    "haproxy_connect",
-					Address: fmt.Sprintf("unix@%s", opts.SPOESocket),
-				},
-			},
+			Servers: spoeServers(opts.SPOESockets),
 		})
 	}
 
 	// Only generate downstream if there's a local service port (skip for client-only services)
-	if cfg.Downstream.TargetPort > 0 {
+	// In insecure dev mode, the public listeners wait for the leaf
+	// certificate, only the upstreams are served in plain TCP before it
+	if cfg.Downstream.TargetPort > 0 && !opts.plainTCP(cfg.Downstream.TLS) {
 		newState, err = generateDownstream(opts, certStore, cfg.Downstream, newState)
 		if err != nil {
 			return newState, err
 		}
 	}
 
-	for _, up := range cfg.Upstreams {
-		newState, err = generateUpstream(opts, certStore, up, oldState, newState)
+	for _, d := range cfg.ExtraDownstreams {
+		if opts.plainTCP(d.TLS) {
+			continue
+		}
+		newState, err = generateDownstream(opts, certStore, d, newState)
 		if err != nil {
 			return newState, err
 		}
 	}
 
+	for _, up := range cfg.Upstreams {
+		next, err := generateUpstream(opts, certStore, up, oldState, newState)
+		// an unreadable client certificate must not hold back the changes
+		// of the other upstreams, eg: a leaf certificate rotation
+		var clientTLSErr *clientTLSError
+		if errors.As(err, &clientTLSErr) {
+			log.Errorf("upstream %s: %s, keeping its previous config", up.Name, err)
+			newState = keepUpstream(oldState, newState, up.Name)
+			continue
+		}
+		if err != nil {
+			return next, err
+		}
+		newState = next
+	}
+
+	newState = generateSplits(opts, cfg, newState)
+	newState = generateMirrors(opts, cfg, newState)
+	newState = generateLuaScripts(opts, cfg, newState)
+	newState = generateTransparent(opts, cfg, newState)
+	newState.StatsPagePort = opts.StatsPagePort
+	newState = deriveMaxConn(opts.MaxConnBudget, newState, cfg.Upstreams)
+
+	if opts.Explain {
+		newState = explain(cfg, newState)
+	}
+
 	sort.Sort(Frontends(newState.Frontends))
 	sort.Sort(Backends(newState.Backends))
 
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"math"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxServerWeight is the highest weight of a HAProxy server
+const maxServerWeight = 256
+
+// subsetWeights returns the weights of the nodes sharing the traffic between
+// the subsets of an upstream, the nodes in no subset share the rest. Within
+// a group, the traffic is shared by the Consul weights. The draining and
+// backup nodes keep their weight. The share of a subset without nodes is
+// spread over the other groups.
+func subsetWeights(beName string, nodes []consul.UpstreamNode, subsets []consul.Subset) []int {
+	weights := make([]int, len(nodes))
+	for i, n := range nodes {
+		weights[i] = n.Weight
+	}
+	if len(subsets) == 0 {
+		return weights
+	}
+
+	// the group of a node is its first subset, len(subsets) for the rest
+	rest := 100
+	for _, s := range subsets {
+		rest -= s.Weight
+	}
+	shares := make([]float64, len(subsets)+1)
+	for i, s := range subsets {
+		shares[i] = float64(s.Weight)
+	}
+	shares[len(subsets)] = float64(rest)
+
+	groups := make([]int, len(nodes))
+	totals := make([]float64, len(subsets)+1)
+	for i, n := range nodes {
+		groups[i] = -1
+		if n.Draining || n.Backup {
+			continue
+		}
+		groups[i] = len(subsets)
+		for j, s := range subsets {
+			if s.Matches(n) {
+				groups[i] = j
+				break
+			}
+		}
+		totals[groups[i]] += float64(n.Weight)
+	}
+
+	fractions := make([]float64, len(nodes))
+	max := 0.0
+	for i, n := range nodes {
+		g := groups[i]
+		if g < 0 || totals[g] == 0 {
+			continue
+		}
+		fractions[i] = shares[g] * float64(n.Weight) / totals[g]
+		if fractions[i] > max {
+			max = fractions[i]
+		}
+	}
+	if max == 0 {
+		log.Warnf("backend %s: no instance gets traffic from the subsets, ignoring them", beName)
+		return weights
+	}
+
+	for i := range nodes {
+		if groups[i] < 0 {
+			continue
+		}
+		w := int(math.Round(fractions[i] / max * maxServerWeight))
+		// a tiny share still gets some traffic
+		if w == 0 && fractions[i] > 0 {
+			w = 1
+		}
+		weights[i] = w
+	}
+	for j, s := range subsets {
+		if totals[j] == 0 && s.Weight > 0 {
+			log.Warnf("backend %s: subset %s has no instance, its share goes to the others", beName, s.Name)
+		}
+	}
+	return weights
+}
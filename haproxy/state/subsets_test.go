@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubsetWeights(t *testing.T) {
+	v1 := map[string]string{"version": "v1"}
+	v2 := map[string]string{"version": "v2"}
+	nodes := []consul.UpstreamNode{
+		{Host: "10.0.0.1", Weight: 1, Meta: v1},
+		{Host: "10.0.0.2", Weight: 1, Meta: v1},
+		{Host: "10.0.0.3", Weight: 1, Meta: v1},
+		{Host: "10.0.0.4", Weight: 1, Meta: v2},
+		{Host: "10.0.0.5", Weight: 0, Meta: v2, Draining: true},
+	}
+	canary := []consul.Subset{{Name: "canary", Meta: v2, Weight: 10}}
+
+	// without subsets the Consul weights are kept
+	require.Equal(t, []int{1, 1, 1, 1, 0}, subsetWeights("back", nodes, nil))
+
+	// 90% shared by 3 nodes, 10% to the canary
+	require.Equal(t, []int{256, 256, 256, 85, 0}, subsetWeights("back", nodes, canary))
+
+	// the Consul weights share the traffic of a group
+	weighted := append([]consul.UpstreamNode{}, nodes...)
+	weighted[0].Weight = 2
+	weighted[1].Weight = 1
+	weighted[2].Weight = 1
+	require.Equal(t, []int{256, 128, 128, 57, 0}, subsetWeights("back", weighted, canary))
+
+	// a subset without nodes leaves all the traffic to the others
+	require.Equal(t, []int{256, 256, 256}, subsetWeights("back", nodes[:3], canary))
+	require.Equal(t, []int{256}, subsetWeights("back", nodes[3:4], canary))
+
+	// all the traffic to the subsets
+	all := []consul.Subset{{Name: "canary", Meta: v2, Weight: 100}}
+	require.Equal(t, []int{0, 0, 0, 256, 0}, subsetWeights("back", nodes, all))
+}
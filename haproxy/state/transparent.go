@@ -0,0 +1,80 @@
+package state
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const transparentFrontend = "front_transparent"
+
+// generateTransparent builds the catch-all listener of the transparent
+// proxy: the outbound connections redirected to it by iptables are sent to
+// the upstream owning their original destination, a virtual IP of the
+// service or the address of one of its instances. The map is updated at
+// runtime as instances come and go.
+func generateTransparent(opts Options, cfg consul.Config, state State) State {
+	if opts.TransparentProxyPort == 0 {
+		return state
+	}
+
+	upstreams := append([]consul.Upstream{}, cfg.Upstreams...)
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].Name < upstreams[j].Name
+	})
+
+	owners := map[string]string{}
+	for _, up := range upstreams {
+		beName := fmt.Sprintf("back_%s", up.Name)
+		addrs := append([]string{}, up.VirtualIPs...)
+		for _, n := range up.Nodes {
+			addrs = append(addrs, n.Host)
+		}
+		for _, addr := range addrs {
+			owner, ok := owners[addr]
+			switch {
+			case !ok:
+				owners[addr] = beName
+			case owner != beName:
+				log.Warnf("transparent proxy: %s is an address of %s and %s, using %s", addr, owner, beName, owner)
+			}
+		}
+	}
+
+	m := Map{
+		Name: "transparent",
+	}
+	m.Path = path.Join(opts.MapsDir, m.Name+".map")
+	addrs := make([]string, 0, len(owners))
+	for addr := range owners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		m.Entries = append(m.Entries, MapEntry{
+			Key:   addr,
+			Value: owners[addr],
+		})
+	}
+
+	state.Frontends = append(state.Frontends, Frontend{
+		Frontend: models.Frontend{
+			Name:          transparentFrontend,
+			ClientTimeout: int64p(int(consul.DefaultReadTimeout.Milliseconds())),
+			Mode:          models.FrontendModeTCP,
+		},
+		Bind: models.Bind{
+			Name:    fmt.Sprintf("%s_bind", transparentFrontend),
+			Address: "127.0.0.1",
+			Port:    int64p(opts.TransparentProxyPort),
+		},
+		DstMap: m.Path,
+	})
+	state.Maps = append(state.Maps, m)
+
+	return state
+}
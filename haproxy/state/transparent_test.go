@@ -0,0 +1,46 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateTransparent(t *testing.T) {
+	cfg := consul.Config{
+		Upstreams: []consul.Upstream{
+			{
+				Name:       "service_web",
+				VirtualIPs: []string{"240.0.0.2"},
+				Nodes:      []consul.UpstreamNode{{Host: "10.0.0.2", Port: 21000}, {Host: "10.0.0.1", Port: 21000}},
+			},
+			{
+				Name:       "service_api",
+				VirtualIPs: []string{"240.0.0.1"},
+				Nodes:      []consul.UpstreamNode{{Host: "10.0.0.1", Port: 21001}},
+			},
+		},
+	}
+
+	st := generateTransparent(Options{}, cfg, State{})
+	require.Empty(t, st.Frontends)
+
+	st = generateTransparent(Options{MapsDir: "/maps", TransparentProxyPort: 15001}, cfg, State{})
+	require.Len(t, st.Frontends, 1)
+	require.Equal(t, "front_transparent", st.Frontends[0].Frontend.Name)
+	require.Equal(t, int64(15001), *st.Frontends[0].Bind.Port)
+	require.Equal(t, "/maps/transparent.map", st.Frontends[0].DstMap)
+
+	// an address shared by two upstreams goes to the first one by name
+	require.Equal(t, []Map{{
+		Name: "transparent",
+		Path: "/maps/transparent.map",
+		Entries: []MapEntry{
+			{Key: "10.0.0.1", Value: "back_service_api"},
+			{Key: "10.0.0.2", Value: "back_service_web"},
+			{Key: "240.0.0.1", Value: "back_service_api"},
+			{Key: "240.0.0.2", Value: "back_service_web"},
+		},
+	}}, st.Maps)
+}
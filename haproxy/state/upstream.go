@@ -2,6 +2,8 @@ package state
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
@@ -21,51 +23,72 @@ func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstr
 		beMode = models.BackendModeHTTP
 	}
 
-	log.Infof("upstream %s: configuring frontend to listen on %s:%d", cfg.Name, cfg.LocalBindAddress, cfg.LocalBindPort)
+	// Upstreams without a local port only provide a backend, used by splits
+	if cfg.LocalBindPort > 0 {
+		log.Infof("upstream %s: configuring frontend to listen on %s:%d", cfg.Name, cfg.LocalBindAddress, cfg.LocalBindPort)
 
-	fe := Frontend{
-		Frontend: models.Frontend{
-			Name:           feName,
-			DefaultBackend: beName,
-			ClientTimeout:  int64p(int(cfg.ReadTimeout.Milliseconds())),
-			Mode:           feMode,
-			Httplog:        opts.LogRequests,
-		},
-		Bind: models.Bind{
-			Name:    fmt.Sprintf("%s_bind", feName),
-			Address: cfg.LocalBindAddress,
-			Port:    &fePort64,
-		},
-	}
-
-	// HTTP-specific features (disabled in TCP mode)
-	if feMode == models.FrontendModeHTTP {
-		fe.FilterCompression = &FrontendFilter{
-			Filter: models.Filter{
-				Type: models.FilterTypeCompression,
+		fe := Frontend{
+			Frontend: models.Frontend{
+				Name:           feName,
+				DefaultBackend: beName,
+				ClientTimeout:  int64p(int(cfg.ReadTimeout.Milliseconds())),
+				Mode:           feMode,
+				Httplog:        opts.LogRequests,
+			},
+			Bind: models.Bind{
+				Name:    fmt.Sprintf("%s_bind", feName),
+				Address: cfg.LocalBindAddress,
+				Port:    &fePort64,
+				Proto:   cfg.Proto,
 			},
+			LuaActions:  cfg.LuaActions.Frontend,
+			ExtraConfig: cfg.ExtraConfig.Frontend,
 		}
-	}
-	if opts.LogRequests && opts.LogSocket != "" {
-		fe.LogTarget = &models.LogTarget{
-			Address:  opts.LogSocket,
-			Facility: models.LogTargetFacilityLocal0,
-			Format:   models.LogTargetFormatRfc5424,
+		if cfg.Limits.ListenerMaxConn > 0 {
+			fe.Frontend.Maxconn = int64p(cfg.Limits.ListenerMaxConn)
 		}
+
+		// HTTP-specific features (disabled in TCP mode)
+		if feMode == models.FrontendModeHTTP {
+			compression(&fe, cfg.Compression)
+		}
+		if (opts.LogRequests || opts.LogUpstreamMeta) && opts.LogSocket != "" {
+			fe.LogTarget = &models.LogTarget{
+				Address:  opts.LogSocket,
+				Facility: models.LogTargetFacilityLocal0,
+				Format:   models.LogTargetFormatRfc5424,
+			}
+		}
+		// the server appears as backend/server in both formats, it is
+		// looked up by the log consumer
+		if opts.LogUpstreamMeta {
+			fe.Frontend.Httplog = false
+			fe.Frontend.LogFormat = tcpLogFormat
+			if feMode == models.FrontendModeHTTP {
+				fe.Frontend.LogFormat = httpLogFormat
+			}
+		}
+
+		newState.Frontends = append(newState.Frontends, fe)
 	}
 
-	newState.Frontends = append(newState.Frontends, fe)
+	if cfg.HTTPCheck != nil && cfg.DisableChecks {
+		log.Warnf("upstream %s: http_check is not compatible with disable_checks, ignoring", beName)
+		cfg.HTTPCheck = nil
+	}
 
 	be := Backend{
 		Backend: models.Backend{
 			Name:           beName,
 			ServerTimeout:  int64p(int(cfg.ReadTimeout.Milliseconds())),
 			ConnectTimeout: int64p(int(cfg.ConnectTimeout.Milliseconds())),
-			Balance: &models.Balance{
-				Algorithm: stringp(models.BalanceAlgorithmLeastconn),
-			},
-			Mode: beMode,
+			Balance:        balance(beName, cfg.Balance, models.BalanceAlgorithmLeastconn, beMode),
+			Mode:           beMode,
 		},
+		Fullconn:    int64(cfg.Limits.FullConn),
+		HTTPCheck:   httpCheck(cfg),
+		LuaActions:  cfg.LuaActions.Backend,
+		ExtraConfig: cfg.ExtraConfig.Backend,
 	}
 	if opts.LogRequests && opts.LogSocket != "" {
 		be.LogTarget = &models.LogTarget{
@@ -80,6 +103,16 @@ func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstr
 		return newState, err
 	}
 	be.Servers = servers
+	hashPolicy(&be, cfg.HashPolicy)
+	pathRewrite(&be, cfg.PathRewrite)
+	headerRules(&be, cfg.Headers)
+	// all the failover instances share the load, not only the first one
+	for _, s := range servers {
+		if s.Backup == models.ServerBackupEnabled {
+			be.Backend.Allbackups = "enabled"
+			break
+		}
+	}
 
 	// Dynamic retries: n-1 where n = number of servers (minimum 1)
 	retries := int64(len(servers) - 1)
@@ -93,26 +126,101 @@ func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstr
 	return newState, nil
 }
 
+// clientTLSError is returned when the client certificate files of an
+// upstream cannot be used
+type clientTLSError struct {
+	err error
+}
+
+func (e *clientTLSError) Error() string {
+	return fmt.Sprintf("client certificate: %s", e.err)
+}
+
+func (e *clientTLSError) Unwrap() error {
+	return e.err
+}
+
+// keepUpstream copies the frontend and backend of an upstream from the old
+// state, the upstream is left out when it had none
+func keepUpstream(oldState, newState State, name string) State {
+	for _, fe := range oldState.Frontends {
+		if fe.Frontend.Name == "front_"+name {
+			newState.Frontends = append(newState.Frontends, fe)
+		}
+	}
+	if be, ok := oldState.findBackend("back_" + name); ok {
+		newState.Backends = append(newState.Backends, be)
+	}
+	return newState
+}
+
 func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consul.Upstream, beName string, oldState State) ([]models.Server, error) {
-	caPath, crtPath, err := certStore.CertsPath(cfg.TLS)
+	var caPath, crtPath string
+	var err error
+	ssl := models.ServerSslEnabled
+	verify := models.ServerVerifyNone
+	switch {
+	case cfg.ClientTLS != nil:
+		caPath, crtPath, err = certStore.ClientTLSPath(*cfg.ClientTLS)
+		if err != nil {
+			return nil, &clientTLSError{err: err}
+		}
+		if caPath != "" {
+			verify = models.ServerVerifyRequired
+		}
+	case opts.plainTCP(cfg.TLS):
+		ssl = ""
+		verify = ""
+	default:
+		caPath, crtPath, err = certStore.CertsPath(cfg.TLS)
+		// the CAs of the services of a peer are its trust bundle only
+		if cfg.Peer != "" {
+			verify = models.ServerVerifyRequired
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	alpn := cfg.ALPN
+	if alpn == "" && cfg.Protocol == "http" {
+		alpn = defaultALPN
+	}
+	if ssl == "" {
+		alpn = ""
+	}
+
+	outlier := cfg.OutlierDetection
+	switch {
+	case outlier != nil && cfg.Protocol != "http":
+		log.Warnf("upstream %s: outlier_detection requires the http protocol, ignoring", beName)
+		outlier = nil
+	case outlier != nil && cfg.DisableChecks:
+		log.Warnf("upstream %s: outlier_detection is not compatible with disable_checks, ignoring", beName)
+		outlier = nil
+	}
+
 	servers := make([]models.Server, 0, len(cfg.Nodes))
+	previous := previousServers(oldState, beName)
+
+	nodes := sortedNodes(cfg.Nodes)
+	weights := subsetWeights(beName, nodes, cfg.Subsets)
 
-	for i, node := range cfg.Nodes {
-		log.Infof("upstream %s: configuring server %s:%d (weight: %d)", beName, node.Host, node.Port, node.Weight)
+	for i, node := range nodes {
+		node.Weight = weights[i]
+		logServer(beName, node, previous)
+		delete(previous, node.ID())
 
 		server := models.Server{
 			Name:           fmt.Sprintf("srv_%d", i),
 			Address:        node.Host,
 			Port:           int64p(node.Port),
 			Weight:         int64p(node.Weight),
-			Ssl:            models.ServerSslEnabled,
+			Ssl:            ssl,
 			SslCertificate: crtPath,
 			SslCafile:      caPath,
-			Verify:         models.ServerVerifyNone,
+			Verify:         verify,
+			Alpn:           alpn,
 			Maintenance:    models.ServerMaintenanceDisabled,
 
 			// Circuit breaker pattern for upstream health
@@ -128,8 +236,140 @@ func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consu
 			OnError:    models.ServerOnErrorMarkDown, // Immediate failover
 		}
 
+		if cfg.HTTPCheck != nil {
+			server.Inter = int64p(int(cfg.HTTPCheck.Interval.Milliseconds()))
+		}
+		if cfg.SendProxyProtocol {
+			server.SendProxyV2 = models.ServerSendProxyV2Enabled
+		}
+
+		// Nodes are only updated from Consul health: traffic observation
+		// is disabled as well since a server marked down would never recover
+		if cfg.DisableChecks {
+			server.Check = models.ServerCheckDisabled
+			server.Inter = nil
+			server.Fastinter = nil
+			server.Downinter = nil
+			server.Rise = nil
+			server.Fall = nil
+			server.Observe = ""
+			server.ErrorLimit = 0
+			server.OnError = ""
+		}
+
+		if node.Backup {
+			server.Backup = models.ServerBackupEnabled
+		}
+
+		if cfg.SlowStart > 0 {
+			server.Slowstart = int64p(int(cfg.SlowStart.Milliseconds()))
+		}
+
+		if outlier != nil {
+			server.Observe = models.ServerObserveLayer7
+			server.ErrorLimit = int64(outlier.ErrorLimit)
+			server.OnError = outlier.OnError
+		}
+
+		if cfg.Limits.MaxConn > 0 {
+			server.Maxconn = int64p(cfg.Limits.MaxConn)
+		}
+		if cfg.Limits.MaxQueue > 0 {
+			server.Maxqueue = int64p(cfg.Limits.MaxQueue)
+		}
+
 		servers = append(servers, server)
 	}
 
+	for _, id := range sortedKeys(previous) {
+		log.Infof("upstream %s: removing server %s", beName, id)
+	}
+
 	return servers, nil
 }
+
+// sortedNodes returns the nodes ordered by address, the order of the Consul
+// results varies and would shuffle the server names between generations
+func sortedNodes(nodes []consul.UpstreamNode) []consul.UpstreamNode {
+	sorted := append([]consul.UpstreamNode{}, nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Host != sorted[j].Host {
+			return sorted[i].Host < sorted[j].Host
+		}
+		return sorted[i].Port < sorted[j].Port
+	})
+	return sorted
+}
+
+// previousServers indexes the servers of the backend in the old state by
+// address
+func previousServers(oldState State, beName string) map[string]models.Server {
+	servers := map[string]models.Server{}
+	be, ok := oldState.findBackend(beName)
+	if !ok {
+		return servers
+	}
+	for _, srv := range be.Servers {
+		if srv.Port == nil {
+			continue
+		}
+		servers[srv.Address+":"+strconv.FormatInt(*srv.Port, 10)] = srv
+	}
+	return servers
+}
+
+// logServer logs the servers added or changed since the previous state at
+// info, the unchanged ones at debug
+func logServer(beName string, node consul.UpstreamNode, previous map[string]models.Server) {
+	desc := fmt.Sprintf("%s (weight: %d)", node.ID(), node.Weight)
+	if node.Datacenter != "" {
+		desc = fmt.Sprintf("%s (weight: %d, datacenter: %s)", node.ID(), node.Weight, node.Datacenter)
+	}
+
+	old, found := previous[node.ID()]
+	backup := old.Backup == models.ServerBackupEnabled
+	switch {
+	case !found && node.Draining:
+		log.Infof("upstream %s: adding server %s, draining in maintenance", beName, node.ID())
+	case !found:
+		log.Infof("upstream %s: adding server %s", beName, desc)
+	case old.Weight == nil || *old.Weight != int64(node.Weight) || backup != node.Backup:
+		if node.Draining {
+			log.Infof("upstream %s: draining server %s, in maintenance", beName, node.ID())
+		} else {
+			log.Infof("upstream %s: updating server %s", beName, desc)
+		}
+	default:
+		log.Debugf("upstream %s: configuring server %s", beName, desc)
+	}
+}
+
+func sortedKeys(m map[string]models.Server) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// httpCheck is the request of the active checks of an upstream, nil for the
+// connection checks
+func httpCheck(cfg consul.Upstream) *HTTPCheck {
+	if cfg.HTTPCheck == nil {
+		return nil
+	}
+	host := cfg.HTTPCheck.Host
+	if host == "" {
+		host = cfg.ServiceName
+	}
+	check := &HTTPCheck{
+		Method:  cfg.HTTPCheck.Method,
+		URI:     cfg.HTTPCheck.Path,
+		Headers: []HTTPCheckHeader{{Name: "Host", Value: host}},
+	}
+	for _, h := range cfg.HTTPCheck.Headers {
+		check.Headers = append(check.Headers, HTTPCheckHeader{Name: h.Name, Value: h.Value})
+	}
+	return check
+}
@@ -0,0 +1,247 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamDisableChecks(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.DisableChecks = true
+
+	servers, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+
+	for _, s := range servers {
+		require.Equal(t, models.ServerCheckDisabled, s.Check)
+		require.Nil(t, s.Inter)
+		require.Empty(t, s.Observe)
+		require.Empty(t, s.OnError)
+	}
+}
+
+func TestUpstreamWithoutLocalPort(t *testing.T) {
+	cfg := consul.Upstream{
+		Name:        "service_canary",
+		ServiceName: "canary",
+	}
+
+	st, err := generateUpstream(TestOpts, TestCertStore, cfg, State{}, State{})
+	require.NoError(t, err)
+	require.Empty(t, st.Frontends)
+	require.Len(t, st.Backends, 1)
+	require.Equal(t, "back_service_canary", st.Backends[0].Backend.Name)
+}
+
+func TestUpstreamLimits(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.Limits = consul.Limits{MaxConn: 50, MaxQueue: 10, FullConn: 200}
+
+	st, err := generateUpstream(TestOpts, TestCertStore, cfg, State{}, State{})
+	require.NoError(t, err)
+	be := st.Backends[0]
+	require.Equal(t, int64(200), be.Fullconn)
+	for _, s := range be.Servers {
+		require.Equal(t, int64(50), *s.Maxconn)
+		require.Equal(t, int64(10), *s.Maxqueue)
+	}
+}
+
+func TestUpstreamOutlierDetection(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.Protocol = "http"
+	cfg.OutlierDetection = &consul.OutlierDetection{ErrorLimit: 3, OnError: models.ServerOnErrorSuddenDeath}
+
+	servers, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	for _, s := range servers {
+		require.Equal(t, models.ServerObserveLayer7, s.Observe)
+		require.Equal(t, int64(3), s.ErrorLimit)
+		require.Equal(t, models.ServerOnErrorSuddenDeath, s.OnError)
+	}
+
+	// responses can only be observed in http
+	cfg.Protocol = "tcp"
+	servers, err = generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, models.ServerObserveLayer4, servers[0].Observe)
+}
+
+func TestUpstreamClientTLS(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.ClientTLS = &consul.ClientTLS{CertFile: "/api.crt", KeyFile: "/api.key"}
+
+	servers, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, "//api.crt", servers[0].SslCertificate)
+	require.Empty(t, servers[0].SslCafile)
+	require.Equal(t, models.ServerVerifyNone, servers[0].Verify)
+
+	cfg.ClientTLS.CAFile = "/api-ca.crt"
+	servers, err = generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, "//api-ca.crt", servers[0].SslCafile)
+	require.Equal(t, models.ServerVerifyRequired, servers[0].Verify)
+}
+
+// unreadableClientTLSStore fails to read the client certificates
+type unreadableClientTLSStore struct {
+	fakeCertStore
+}
+
+func (unreadableClientTLSStore) ClientTLSPath(t consul.ClientTLS) (string, string, error) {
+	return "", "", fmt.Errorf("open %s: no such file or directory", t.CertFile)
+}
+
+func TestUpstreamClientTLSUnreadable(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams = append(cfg.Upstreams, consul.Upstream{
+		Name:             "service_2",
+		ServiceName:      "2",
+		LocalBindAddress: "127.0.0.1",
+		LocalBindPort:    10001,
+		Nodes:            []consul.UpstreamNode{{Host: "1.2.3.6", Port: 8080, Weight: 1}},
+	})
+	oldState, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.NoError(t, err)
+
+	// the other upstreams are still updated
+	cfg.Upstreams[0].ClientTLS = &consul.ClientTLS{CertFile: "/api.crt", KeyFile: "/api.key"}
+	cfg.Upstreams[0].Nodes = cfg.Upstreams[0].Nodes[:1]
+	cfg.Upstreams[1].Nodes = append(cfg.Upstreams[1].Nodes, consul.UpstreamNode{Host: "1.2.3.7", Port: 8080, Weight: 1})
+	st, err := Generate(TestOpts, unreadableClientTLSStore{}, oldState, cfg)
+	require.NoError(t, err)
+
+	be, ok := st.findBackend("back_service_2")
+	require.True(t, ok)
+	require.Len(t, be.Servers, 2)
+
+	// the upstream keeps its previous config
+	be, ok = st.findBackend("back_service_1")
+	require.True(t, ok)
+	old, _ := oldState.findBackend("back_service_1")
+	require.Equal(t, old, be)
+	_, ok = findFrontend(st, "front_service_1")
+	require.True(t, ok)
+
+	// and is left out without one
+	st, err = Generate(TestOpts, unreadableClientTLSStore{}, State{}, cfg)
+	require.NoError(t, err)
+	_, ok = st.findBackend("back_service_1")
+	require.False(t, ok)
+	_, ok = findFrontend(st, "front_service_1")
+	require.False(t, ok)
+}
+
+func TestUpstreamPeer(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.Peer = "cluster-02"
+
+	servers, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, "//ca", servers[0].SslCafile)
+	require.Equal(t, models.ServerVerifyRequired, servers[0].Verify)
+}
+
+func TestUpstreamHTTPCheck(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.HTTPCheck = &consul.HTTPCheck{
+		Method:   "GET",
+		Path:     "/health",
+		Headers:  []consul.HTTPCheckHeader{{Name: "X-Probe", Value: "haproxy"}},
+		Interval: 5 * time.Second,
+	}
+
+	st, err := generateUpstream(TestOpts, TestCertStore, cfg, State{}, State{})
+	require.NoError(t, err)
+	be := st.Backends[0]
+	require.Equal(t, &HTTPCheck{
+		Method: "GET",
+		URI:    "/health",
+		Headers: []HTTPCheckHeader{
+			{Name: "Host", Value: cfg.ServiceName},
+			{Name: "X-Probe", Value: "haproxy"},
+		},
+	}, be.HTTPCheck)
+	for _, s := range be.Servers {
+		require.Equal(t, int64(5000), *s.Inter)
+	}
+
+	// there are no active checks to configure
+	cfg.DisableChecks = true
+	st, err = generateUpstream(TestOpts, TestCertStore, cfg, State{}, State{})
+	require.NoError(t, err)
+	require.Nil(t, st.Backends[0].HTTPCheck)
+	require.Nil(t, st.Backends[0].Servers[0].Inter)
+}
+
+func TestUpstreamServerOrder(t *testing.T) {
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.Nodes = []consul.UpstreamNode{
+		{Host: "1.2.3.5", Port: 8080, Weight: 1},
+		{Host: "1.2.3.4", Port: 8081, Weight: 1},
+		{Host: "1.2.3.4", Port: 8080, Weight: 1},
+	}
+
+	servers, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	addrs := []string{}
+	for _, s := range servers {
+		addrs = append(addrs, fmt.Sprintf("%s %s:%d", s.Name, s.Address, *s.Port))
+	}
+	require.Equal(t, []string{"srv_0 1.2.3.4:8080", "srv_1 1.2.3.4:8081", "srv_2 1.2.3.5:8080"}, addrs)
+
+	// the order of the Consul results does not rename the servers
+	cfg.Nodes[0], cfg.Nodes[2] = cfg.Nodes[2], cfg.Nodes[0]
+	reordered, err := generateUpstreamServers(TestOpts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, servers, reordered)
+}
+
+func TestUpstreamInsecureDevMode(t *testing.T) {
+	opts := TestOpts
+	opts.InsecureDevMode = true
+	cfg := GetTestConsulConfig().Upstreams[0]
+	cfg.Protocol = "http"
+	cfg.TLS = consul.TLS{}
+
+	// plain TCP until the leaf certificate is delivered
+	servers, err := generateUpstreamServers(opts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Empty(t, servers[0].Ssl)
+	require.Empty(t, servers[0].SslCertificate)
+	require.Empty(t, servers[0].Alpn)
+
+	cfg.TLS = consul.TLS{Cert: []byte("cert"), Key: []byte("key")}
+	servers, err = generateUpstreamServers(opts, TestCertStore, cfg, "back_service_1", State{})
+	require.NoError(t, err)
+	require.Equal(t, models.ServerSslEnabled, servers[0].Ssl)
+	require.NotEmpty(t, servers[0].SslCertificate)
+}
+
+func TestInsecureDevModeWaitsForLeafOnDownstream(t *testing.T) {
+	opts := TestOpts
+	opts.InsecureDevMode = true
+	cfg := GetTestConsulConfig()
+
+	// only the upstreams are served before the leaf certificate
+	st, err := Generate(opts, TestCertStore, State{}, cfg)
+	require.NoError(t, err)
+	_, ok := findFrontend(st, "front_downstream")
+	require.False(t, ok)
+	_, ok = findFrontend(st, "front_service_1")
+	require.True(t, ok)
+
+	cfg.Downstream.TLS = consul.TLS{Cert: []byte("cert"), Key: []byte("key")}
+	st, err = Generate(opts, TestCertStore, State{}, cfg)
+	require.NoError(t, err)
+	fe, ok := findFrontend(st, "front_downstream")
+	require.True(t, ok)
+	require.True(t, fe.Bind.Ssl)
+}
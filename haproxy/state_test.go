@@ -0,0 +1,40 @@
+package haproxy
+
+import (
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/models/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataplaneWarnings(t *testing.T) {
+	require.Empty(t, dataplaneWarnings(state.State{}))
+
+	st := state.State{
+		NoReusePort:   true,
+		StatsPagePort: 8404,
+	}
+	require.Equal(t, []string{
+		"bind_reuseport is not supported with the Data Plane API, ignoring",
+		"the HAProxy stats page is not supported with the Data Plane API, ignoring",
+	}, dataplaneWarnings(st))
+}
+
+func TestDataplaneUnsupported(t *testing.T) {
+	require.NoError(t, dataplaneUnsupported(state.State{NoReusePort: true}))
+
+	st := state.State{
+		Frontends: []state.Frontend{{
+			Frontend:   models.Frontend{Name: "front_downstream"},
+			LuaActions: []string{"auth"},
+			RateLimit:  &state.RateLimit{Req: 100},
+		}},
+		Backends: []state.Backend{{
+			Backend:  models.Backend{Name: "back_service_db"},
+			Fullconn: 100,
+		}},
+	}
+	err := dataplaneUnsupported(st)
+	require.EqualError(t, err, "not supported with the Data Plane API, the config is not applied: frontend front_downstream: rate limits; frontend front_downstream: lua_actions; backend back_service_db: fullconn")
+}
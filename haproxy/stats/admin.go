@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/masterclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminNameRe restricts the names passed to runtime commands, preventing
+// the injection of other commands
+var adminNameRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// registerAdmin exposes a selection of runtime API commands, requests must
+// be authenticated with the admin token
+func (s *Stats) registerAdmin(mux *http.ServeMux) {
+	if s.cfg.AdminToken == "" {
+		return
+	}
+
+	mux.Handle("GET /admin/servers", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+		s.adminExec(rw, "show servers state")
+	}))
+	mux.Handle("GET /admin/ssl/certs", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+		s.adminExec(rw, "show ssl cert")
+	}))
+	mux.Handle("POST /admin/servers/{backend}/{server}/enable", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+		s.adminServerExec(rw, r, "enable server %s/%s")
+	}))
+	mux.Handle("POST /admin/servers/{backend}/{server}/disable", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+		s.adminServerExec(rw, r, "disable server %s/%s")
+	}))
+	mux.Handle("POST /admin/servers/{backend}/{server}/weight", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+		weight, err := strconv.Atoi(r.URL.Query().Get("value"))
+		if err != nil || weight < 0 || weight > 256 {
+			http.Error(rw, "value must be a weight between 0 and 256", http.StatusBadRequest)
+			return
+		}
+		s.adminServerExec(rw, r, "set weight %s/%s "+strconv.Itoa(weight))
+	}))
+	if s.cfg.Pinner != nil {
+		mux.Handle("POST /admin/upstreams/{name}/pin", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+			s.adminPin(rw, r, s.cfg.Pinner.PinUpstream)
+		}))
+		mux.Handle("POST /admin/upstreams/{name}/unpin", s.adminAuth(func(rw http.ResponseWriter, r *http.Request) {
+			s.adminPin(rw, r, s.cfg.Pinner.UnpinUpstream)
+		}))
+	}
+	if s.cfg.Master != nil {
+		mux.Handle("GET /admin/workers", s.adminAuth(s.adminWorkers))
+		mux.Handle("POST /admin/workers/{pid}/hard-stop", s.adminAuth(s.adminHardStop))
+	}
+	mux.Handle("POST /selftest/upstream/{name}", s.adminAuth(s.handleSelfTest))
+	mux.Handle("POST /selftest/downstream", s.adminAuth(s.handleDownstreamSelfTest))
+}
+
+func (s *Stats) adminAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(rw, r)
+	})
+}
+
+func (s *Stats) adminServerExec(rw http.ResponseWriter, r *http.Request, format string) {
+	backend, server := r.PathValue("backend"), r.PathValue("server")
+	if !adminNameRe.MatchString(backend) || !adminNameRe.MatchString(server) {
+		http.Error(rw, "invalid backend or server name", http.StatusBadRequest)
+		return
+	}
+	s.adminExec(rw, fmt.Sprintf(format, backend, server))
+}
+
+func (s *Stats) adminPin(rw http.ResponseWriter, r *http.Request, op func(name string) error) {
+	name := r.PathValue("name")
+	if !adminNameRe.MatchString(name) {
+		http.Error(rw, "invalid upstream name", http.StatusBadRequest)
+		return
+	}
+
+	err := op(name)
+	if errors.Is(err, consul.ErrUnknownUpstream) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, consul.ErrUpstreamNotFetched) {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+// adminWorkers lists the HAProxy processes, with the old workers still
+// draining the connections of previous configs
+func (s *Stats) adminWorkers(rw http.ResponseWriter, r *http.Request) {
+	procs, err := s.cfg.Master.ShowProc()
+	if err != nil {
+		log.Errorf("admin: cannot list the haproxy processes: %s", err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(procs)
+}
+
+func (s *Stats) adminHardStop(rw http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.PathValue("pid"))
+	if err != nil {
+		http.Error(rw, "invalid pid", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("admin: hard stopping old worker %d", pid)
+	err = s.cfg.Master.HardStop(pid)
+	if errors.Is(err, masterclient.ErrNotOldWorker) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("admin: cannot hard stop worker %d: %s", pid, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+func (s *Stats) adminExec(rw http.ResponseWriter, cmd string) {
+	log.Infof("admin: running runtime command '%s'", cmd)
+
+	out, err := s.statsSocket.Exec(cmd)
+	if err != nil {
+		log.Errorf("admin: command '%s' failed: %s", cmd, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte(out))
+}
@@ -0,0 +1,149 @@
+package stats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePinner pins the upstreams it knows, fetched or not
+type fakePinner struct {
+	fetched map[string]bool
+	pinned  map[string]bool
+}
+
+func (p *fakePinner) PinUpstream(name string) error {
+	fetched, ok := p.fetched[name]
+	switch {
+	case !ok:
+		return consul.ErrUnknownUpstream
+	case !fetched:
+		return consul.ErrUpstreamNotFetched
+	}
+	p.pinned[name] = true
+	return nil
+}
+
+func (p *fakePinner) UnpinUpstream(name string) error {
+	if _, ok := p.fetched[name]; !ok {
+		return consul.ErrUnknownUpstream
+	}
+	delete(p.pinned, name)
+	return nil
+}
+
+// adminRequest sends a request to the admin endpoints of s
+func adminRequest(s *Stats, method, target, token string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	s.registerAdmin(mux)
+
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminPin(t *testing.T) {
+	pinner := &fakePinner{
+		fetched: map[string]bool{"db": true, "cache": false},
+		pinned:  map[string]bool{},
+	}
+	s := New(nil, nil, nil, Config{AdminToken: "secret", Pinner: pinner})
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/admin/upstreams/db/pin", http.StatusOK},
+		{"/admin/upstreams/cache/pin", http.StatusServiceUnavailable},
+		{"/admin/upstreams/unknown/pin", http.StatusNotFound},
+		{"/admin/upstreams/db;ls/pin", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := adminRequest(s, http.MethodPost, tt.target, "Bearer secret")
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+		})
+	}
+	require.Equal(t, map[string]bool{"db": true}, pinner.pinned)
+
+	rec := adminRequest(s, http.MethodPost, "/admin/upstreams/db/unpin", "Bearer secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, pinner.pinned)
+}
+
+func TestAdminAuth(t *testing.T) {
+	sock, _ := newFakeSocket(t, func(string) string { return "1\n" })
+	s := New(nil, sock, nil, Config{AdminToken: "secret"})
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"bearer token", "Bearer secret", http.StatusOK},
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer other", http.StatusUnauthorized},
+		{"token without scheme", "secret", http.StatusUnauthorized},
+		{"basic scheme", "Basic secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(s, http.MethodGet, "/admin/servers", tt.token)
+			require.Equal(t, tt.code, rec.Code)
+		})
+	}
+
+	// no admin endpoints without a token
+	rec := adminRequest(New(nil, sock, nil, Config{}), http.MethodGet, "/admin/servers", "Bearer ")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminServers(t *testing.T) {
+	sock, fake := newFakeSocket(t, func(cmd string) string { return "done: " + cmd + "\n" })
+	s := New(nil, sock, nil, Config{AdminToken: "secret"})
+
+	tests := []struct {
+		target string
+		code   int
+		cmd    string
+	}{
+		{"/admin/servers/back_db/srv_1/disable", http.StatusOK, "disable server back_db/srv_1"},
+		{"/admin/servers/back_db/srv_1/enable", http.StatusOK, "enable server back_db/srv_1"},
+		{"/admin/servers/back_db/srv_1/weight?value=0", http.StatusOK, "set weight back_db/srv_1 0"},
+		{"/admin/servers/back_db/srv_1/weight?value=256", http.StatusOK, "set weight back_db/srv_1 256"},
+		{"/admin/servers/back_db/srv_1/weight?value=257", http.StatusBadRequest, ""},
+		{"/admin/servers/back_db/srv_1/weight?value=-1", http.StatusBadRequest, ""},
+		{"/admin/servers/back_db/srv_1/weight", http.StatusBadRequest, ""},
+		{"/admin/servers/back_db;shutdown/srv_1/disable", http.StatusBadRequest, ""},
+		{"/admin/servers/back_db/srv%201/enable", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			before := len(fake.Commands())
+			rec := adminRequest(s, http.MethodPost, tt.target, "Bearer secret")
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+
+			cmds := fake.Commands()[before:]
+			if tt.cmd == "" {
+				require.Empty(t, cmds)
+				return
+			}
+			require.Equal(t, []string{tt.cmd}, cmds)
+			require.Equal(t, "done: "+tt.cmd+"\n", rec.Body.String())
+		})
+	}
+}
+
+func TestAdminSocketDown(t *testing.T) {
+	s := New(nil, NewStatsSocket("/nonexistent/stats.sock"), nil, Config{AdminToken: "secret"})
+
+	rec := adminRequest(s, http.MethodPost, "/admin/servers/back_db/srv_1/disable", "Bearer secret")
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
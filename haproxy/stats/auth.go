@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// statsAuth requires the credentials of the stats server, when set, to read
+// the metrics. The probes are left open for the orchestrators.
+func (s *Stats) statsAuth(next http.Handler) http.Handler {
+	if s.cfg.BasicAuth == "" && s.cfg.Token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			if s.cfg.BasicAuth != "" {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="haproxy-connect"`)
+			}
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (s *Stats) authorized(r *http.Request) bool {
+	if s.cfg.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1 {
+			return true
+		}
+	}
+	if s.cfg.BasicAuth != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(s.cfg.BasicAuth)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the TLS settings of the stats server, nil without TLS
+func (s *Stats) tlsConfig() (*tls.Config, error) {
+	switch {
+	case s.cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case s.cfg.TLSConnect:
+		leaf := &leafCertificate{get: func() ([]byte, []byte) {
+			t := s.cfg.ConsulConfig().Downstream.TLS
+			return t.Cert, t.Key
+		}}
+		return &tls.Config{GetCertificate: leaf.certificate}, nil
+	}
+	return nil, nil
+}
+
+// leafCertificate serves the current Connect leaf certificate, parsed again
+// when it is renewed
+type leafCertificate struct {
+	get func() ([]byte, []byte)
+
+	lock   sync.Mutex
+	pem    []byte
+	parsed *tls.Certificate
+}
+
+func (l *leafCertificate) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, keyPEM := l.get()
+	if len(certPEM) == 0 {
+		return nil, errors.New("no leaf certificate yet")
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.parsed != nil && string(l.pem) == string(certPEM) {
+		return l.parsed, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	l.pem = certPEM
+	l.parsed = &cert
+	return l.parsed, nil
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsAuth(t *testing.T) {
+	sock, _ := newFakeSocket(t, func(string) string { return "Name: HAProxy\n" })
+	ready := make(chan struct{})
+	close(ready)
+	s := New(nil, sock, ready, Config{
+		BasicAuth: "admin:pass",
+		Token:     "secret",
+		Metrics:   metrics.NewPrometheus(),
+	})
+	h := s.handler()
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		basic  []string
+		code   int
+	}{
+		{name: "bearer token", path: "/metrics", header: "Bearer secret", code: http.StatusOK},
+		{name: "basic auth", path: "/metrics", basic: []string{"admin", "pass"}, code: http.StatusOK},
+		{name: "no credentials", path: "/metrics", code: http.StatusUnauthorized},
+		{name: "wrong token", path: "/metrics", header: "Bearer other", code: http.StatusUnauthorized},
+		{name: "token without scheme", path: "/metrics", header: "secret", code: http.StatusUnauthorized},
+		{name: "wrong password", path: "/metrics", basic: []string{"admin", "other"}, code: http.StatusUnauthorized},
+		{name: "health", path: "/health", code: http.StatusOK},
+		{name: "ready", path: "/ready", code: http.StatusOK},
+		{name: "live", path: "/live", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.basic != nil {
+				req.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+			if tt.code == http.StatusUnauthorized {
+				require.Equal(t, `Basic realm="haproxy-connect"`, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestStatsAuthDisabled(t *testing.T) {
+	s := New(nil, nil, nil, Config{Metrics: metrics.NewPrometheus()})
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+// keyPairPEM encodes the certificate and the key of c
+func keyPairPEM(t *testing.T, c *testCert) ([]byte, []byte) {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+}
+
+func TestTLSConnectRenewal(t *testing.T) {
+	ca := newTestCert(t, nil, "")
+	leaf := newTestCert(t, ca, "spiffe://td.consul/ns/default/dc/dc1/svc/web")
+
+	cfg := consul.Config{}
+	s := New(nil, nil, nil, Config{
+		TLSConnect:   true,
+		ConsulConfig: func() consul.Config { return cfg },
+	})
+	tlsConfig, err := s.tlsConfig()
+	require.NoError(t, err)
+
+	// no leaf certificate yet
+	_, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.Error(t, err)
+
+	cfg.Downstream.TLS.Cert, cfg.Downstream.TLS.Key = keyPairPEM(t, leaf)
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, leaf.der, cert.Certificate[0])
+	again, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Same(t, cert, again)
+
+	renewed := newTestCert(t, ca, "spiffe://td.consul/ns/default/dc/dc1/svc/web")
+	cfg.Downstream.TLS.Cert, cfg.Downstream.TLS.Key = keyPairPEM(t, renewed)
+	cert, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, renewed.der, cert.Certificate[0])
+	require.Equal(t, &renewed.key.PublicKey, cert.PrivateKey.(*ecdsa.PrivateKey).Public())
+}
+
+func TestTLSNone(t *testing.T) {
+	tlsConfig, err := New(nil, nil, nil, Config{}).tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+}
@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type upstreamHealth struct {
+	Name string `json:"name"`
+	// ConsulNodes are the instances returned by Consul, the draining ones
+	// excluded
+	ConsulNodes int `json:"consul_nodes"`
+	// Servers are the servers configured in the HAProxy backend, the free
+	// slots excluded, and ServersUp the ones passing the HAProxy checks
+	Servers   int `json:"haproxy_servers"`
+	ServersUp int `json:"haproxy_servers_up"`
+}
+
+type healthResult struct {
+	Status    string           `json:"status"`
+	LastApply *time.Time       `json:"last_apply,omitempty"`
+	Upstreams []upstreamHealth `json:"upstreams"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// handleHealth answers ok once the first config is applied, with a summary
+// of the instances of every upstream
+func (s *Stats) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	res := healthResult{Status: "ok", Upstreams: []upstreamHealth{}}
+	code := http.StatusOK
+	select {
+	case <-s.ready:
+	default:
+		res.Status = "starting"
+		code = http.StatusInternalServerError
+	}
+
+	if s.cfg.LastApply != nil {
+		if t := s.cfg.LastApply(); !t.IsZero() {
+			res.LastApply = &t
+		}
+	}
+
+	if s.cfg.ConsulConfig != nil && code == http.StatusOK {
+		servers, up, err := s.backendServers()
+		if err != nil {
+			log.Warnf("health: cannot read the backend stats: %s", err)
+			res.Error = err.Error()
+		}
+		for _, u := range s.cfg.ConsulConfig().Upstreams {
+			be := "back_" + u.Name
+			res.Upstreams = append(res.Upstreams, upstreamHealth{
+				Name:        u.Name,
+				ConsulNodes: len(u.ServingNodes()),
+				Servers:     servers[be],
+				ServersUp:   up[be],
+			})
+		}
+		sort.Slice(res.Upstreams, func(i, j int) bool {
+			return res.Upstreams[i].Name < res.Upstreams[j].Name
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(res)
+}
+
+// backendServers counts the configured and up servers of every backend
+func (s *Stats) backendServers() (map[string]int, map[string]int, error) {
+	servers := map[string]int{}
+	up := map[string]int{}
+	stats, err := s.statsSocket.Stats()
+	if err != nil {
+		return servers, up, err
+	}
+	for _, c := range stats {
+		for _, st := range c.Stats {
+			if st.Type != "server" || st.Stats == nil {
+				continue
+			}
+			// the free slots of a backend are in maintenance
+			if strings.HasPrefix(st.Stats.Status, "MAINT") {
+				continue
+			}
+			servers[st.BackendName]++
+			if strings.HasPrefix(st.Stats.Status, "UP") {
+				up[st.BackendName]++
+			}
+		}
+	}
+	return servers, up, nil
+}
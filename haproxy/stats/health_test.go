@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+const healthStats = `# pxname,svname,type,status
+back_db,srv_0,2,UP
+back_db,srv_1,2,DOWN
+back_db,srv_2,2,MAINT
+back_db,BACKEND,1,UP
+back_api,srv_0,2,UP 1/2
+`
+
+func TestHandleHealth(t *testing.T) {
+	lastApply := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cfg := consul.Config{Upstreams: []consul.Upstream{
+		{Name: "db", Nodes: []consul.UpstreamNode{{Host: "10.0.0.1"}, {Host: "10.0.0.2"}, {Host: "10.0.0.3", Draining: true}}},
+		{Name: "api", Nodes: []consul.UpstreamNode{{Host: "10.0.1.1"}}},
+	}}
+
+	sock, _ := newFakeSocket(t, func(string) string { return healthStats })
+	closed := make(chan struct{})
+	close(closed)
+
+	tests := []struct {
+		name   string
+		ready  chan struct{}
+		socket *StatsSocket
+		code   int
+		res    healthResult
+	}{
+		{
+			name:   "ok",
+			ready:  closed,
+			socket: sock,
+			code:   http.StatusOK,
+			res: healthResult{
+				Status:    "ok",
+				LastApply: &lastApply,
+				Upstreams: []upstreamHealth{
+					{Name: "api", ConsulNodes: 1, Servers: 1, ServersUp: 1},
+					{Name: "db", ConsulNodes: 2, Servers: 2, ServersUp: 1},
+				},
+			},
+		},
+		{
+			name:   "starting",
+			ready:  make(chan struct{}),
+			socket: sock,
+			code:   http.StatusInternalServerError,
+			res: healthResult{
+				Status:    "starting",
+				LastApply: &lastApply,
+				Upstreams: []upstreamHealth{},
+			},
+		},
+		{
+			name:   "stats socket down",
+			ready:  closed,
+			socket: NewStatsSocket("/nonexistent/stats.sock"),
+			code:   http.StatusOK,
+			res: healthResult{
+				Status:    "ok",
+				LastApply: &lastApply,
+				Upstreams: []upstreamHealth{
+					{Name: "api", ConsulNodes: 1},
+					{Name: "db", ConsulNodes: 2},
+				},
+				Error: "failed to connect to stats socket: dial unix /nonexistent/stats.sock: connect: no such file or directory",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, tt.socket, tt.ready, Config{
+				ConsulConfig: func() consul.Config { return cfg },
+				LastApply:    func() time.Time { return lastApply },
+			})
+
+			rec := httptest.NewRecorder()
+			s.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			require.Equal(t, tt.code, rec.Code)
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var res healthResult
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestHandleHealthNoApply(t *testing.T) {
+	s := New(nil, nil, make(chan struct{}), Config{LastApply: func() time.Time { return time.Time{} }})
+
+	rec := httptest.NewRecorder()
+	s.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.JSONEq(t, `{"status": "starting", "upstreams": []}`, rec.Body.String())
+}
+
+func TestProbesNotReady(t *testing.T) {
+	s := New(nil, NewStatsSocket("/nonexistent/stats.sock"), make(chan struct{}), Config{})
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/ready": s.handleReady,
+		"/live":  s.handleLive,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, path)
+	}
+}
@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metaExportInterval = 30 * time.Second
+
+	metaSessionsKey = "connect_sessions_cur"
+	metaReqRateKey  = "connect_req_rate"
+
+	downstreamFrontendPrefix = "front_downstream"
+)
+
+// exportMeta periodically re-registers the local service instance with
+// coarse load figures in its Meta so that external schedulers can use them.
+// Checks are left untouched by the agent on re-registration.
+func (s *Stats) exportMeta() {
+	<-s.ready
+
+	for {
+		err := s.exportMetaOnce()
+		if err != nil {
+			log.Errorf("cannot export stats to service meta: %s", err)
+		}
+		time.Sleep(metaExportInterval)
+	}
+}
+
+func (s *Stats) exportMetaOnce() error {
+	stats, err := s.statsSocket.Stats()
+	if err != nil {
+		return err
+	}
+
+	var sessions, reqRate int64
+	for _, c := range stats {
+		for _, st := range c.Stats {
+			if st.Type != "frontend" || !strings.HasPrefix(st.BackendName, downstreamFrontendPrefix) || st.Stats == nil {
+				continue
+			}
+			if st.Stats.Scur != nil {
+				sessions += *st.Stats.Scur
+			}
+			if st.Stats.ReqRate != nil {
+				reqRate += *st.Stats.ReqRate
+			}
+		}
+	}
+
+	svc, _, err := s.consulClient.Agent().Service(s.cfg.ServiceID, &api.QueryOptions{})
+	if err != nil {
+		return err
+	}
+
+	meta := map[string]string{}
+	for k, v := range svc.Meta {
+		meta[k] = v
+	}
+	meta[metaSessionsKey] = strconv.FormatInt(sessions, 10)
+	meta[metaReqRateKey] = strconv.FormatInt(reqRate, 10)
+
+	if svc.Meta[metaSessionsKey] == meta[metaSessionsKey] && svc.Meta[metaReqRateKey] == meta[metaReqRateKey] {
+		return nil
+	}
+
+	weights := svc.Weights
+	return s.consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		Kind:              svc.Kind,
+		ID:                svc.ID,
+		Name:              svc.Service,
+		Tags:              svc.Tags,
+		Port:              svc.Port,
+		Address:           svc.Address,
+		SocketPath:        svc.SocketPath,
+		TaggedAddresses:   svc.TaggedAddresses,
+		EnableTagOverride: svc.EnableTagOverride,
+		Meta:              meta,
+		Weights:           &weights,
+		Proxy:             svc.Proxy,
+		Connect:           svc.Connect,
+		Namespace:         svc.Namespace,
+		Partition:         svc.Partition,
+	})
+}
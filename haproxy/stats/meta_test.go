@@ -0,0 +1,96 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+const metaStats = `# pxname,svname,type,scur,req_rate
+front_downstream,FRONTEND,0,5,12
+front_downstream_api,FRONTEND,0,3,4
+front_db,FRONTEND,0,100,100
+back_db,BACKEND,1,100,100
+`
+
+// fakeAgent serves the service of the local agent and records its
+// registrations
+type fakeAgent struct {
+	lock    sync.Mutex
+	service api.AgentService
+	regs    []api.AgentServiceRegistration
+}
+
+func (a *fakeAgent) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/agent/service/"+a.service.ID:
+		json.NewEncoder(rw).Encode(a.service)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.regs = append(a.regs, reg)
+		a.service.Meta = reg.Meta
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func TestExportMetaOnce(t *testing.T) {
+	agent := &fakeAgent{service: api.AgentService{
+		ID:      "web-1",
+		Service: "web",
+		Port:    8080,
+		Tags:    []string{"v1"},
+		Meta:    map[string]string{"version": "1.2"},
+		Weights: api.AgentWeights{Passing: 10, Warning: 1},
+	}}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	require.NoError(t, err)
+	sock, _ := newFakeSocket(t, func(string) string { return metaStats })
+	s := New(client, sock, nil, Config{ServiceID: "web-1"})
+
+	require.NoError(t, s.exportMetaOnce())
+	require.Len(t, agent.regs, 1)
+	reg := agent.regs[0]
+	require.Equal(t, "web-1", reg.ID)
+	require.Equal(t, "web", reg.Name)
+	require.Equal(t, 8080, reg.Port)
+	require.Equal(t, []string{"v1"}, reg.Tags)
+	require.Equal(t, &api.AgentWeights{Passing: 10, Warning: 1}, reg.Weights)
+	// only the public listeners are counted, the other meta are kept
+	require.Equal(t, map[string]string{
+		"version":       "1.2",
+		metaSessionsKey: "8",
+		metaReqRateKey:  "16",
+	}, reg.Meta)
+
+	// unchanged figures are not registered again
+	require.NoError(t, s.exportMetaOnce())
+	require.Len(t, agent.regs, 1)
+}
+
+func TestExportMetaOnceUnknownService(t *testing.T) {
+	srv := httptest.NewServer(&fakeAgent{service: api.AgentService{ID: "web-1"}})
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	require.NoError(t, err)
+	sock, _ := newFakeSocket(t, func(string) string { return metaStats })
+	s := New(client, sock, nil, Config{ServiceID: "other"})
+
+	require.Error(t, s.exportMetaOnce())
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsPollInterval = 10 * time.Second
+
+	// checkStatusHealthAnalyze is the check status of the servers marked
+	// down by observe
+	checkStatusHealthAnalyze = "HANA"
+)
+
+// pollMetrics periodically records the certificate expiry and the load of
+// the haproxy frontends and backends
+func (s *Stats) pollMetrics() {
+	<-s.ready
+
+	for {
+		s.pollMetricsOnce()
+		time.Sleep(metricsPollInterval)
+	}
+}
+
+func (s *Stats) pollMetricsOnce() {
+	m := s.cfg.Metrics
+
+	if s.cfg.ConsulConfig != nil {
+		cfg := s.cfg.ConsulConfig()
+		if !cfg.Downstream.NotAfter.IsZero() {
+			m.SetGauge("connect_cert_expiry_seconds", float64(int64(time.Until(cfg.Downstream.NotAfter).Seconds())),
+				metrics.Labels{"service": cfg.ServiceName})
+		}
+	}
+
+	stats, err := s.statsSocket.Stats()
+	if err != nil {
+		m.IncrCounter("connect_stats_poll_errors_total", 1, nil)
+		log.Debugf("cannot poll haproxy stats: %s", err)
+		return
+	}
+
+	for _, c := range stats {
+		for _, st := range c.Stats {
+			if st.Stats != nil && st.Type == "server" {
+				s.observeEjection(st.BackendName, st.Name, st.Stats.Status, st.Stats.CheckStatus)
+			}
+			if st.Stats == nil || (st.Type != "frontend" && st.Type != "backend") {
+				continue
+			}
+			labels := metrics.Labels{"proxy": st.BackendName, "type": st.Type}
+			if st.Stats.Scur != nil {
+				m.SetGauge("connect_sessions_current", float64(*st.Stats.Scur), labels)
+			}
+			if st.Stats.ReqRate != nil {
+				m.SetGauge("connect_request_rate", float64(*st.Stats.ReqRate), labels)
+			}
+			if st.Type == "backend" && st.Stats.Act != nil {
+				m.SetGauge("connect_backend_active_servers", float64(*st.Stats.Act), metrics.Labels{"proxy": st.BackendName})
+			}
+			if st.Type == "backend" && st.Stats.Qcur != nil {
+				m.SetGauge("connect_backend_queue_current", float64(*st.Stats.Qcur), metrics.Labels{"proxy": st.BackendName})
+			}
+		}
+	}
+}
+
+// observeEjection reports the servers marked down by passive checks, the
+// equivalent of an outlier ejection
+func (s *Stats) observeEjection(backend, server, status, checkStatus string) {
+	key := backend + "/" + server
+	// a check in progress is prefixed with "* "
+	checkStatus = strings.TrimPrefix(checkStatus, "* ")
+	ejected := strings.HasPrefix(status, "DOWN") && checkStatus == checkStatusHealthAnalyze
+	if ejected == s.ejected[key] {
+		return
+	}
+
+	if ejected {
+		s.ejected[key] = true
+		log.Warnf("stats: server %s marked down by passive checks", key)
+		s.cfg.Metrics.IncrCounter("connect_upstream_ejections_total", 1, metrics.Labels{"proxy": backend, "server": server})
+		return
+	}
+	delete(s.ejected, key)
+	log.Infof("stats: server %s is back after being marked down by passive checks", key)
+}
@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+)
+
+const probeTimeout = 2 * time.Second
+
+// handleReady answers ok once the first config is applied and the public
+// listener accepts connections
+func (s *Stats) handleReady(rw http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.ready:
+	default:
+		probeFailed(rw, fmt.Errorf("no config applied yet"))
+		return
+	}
+
+	if s.cfg.ConsulConfig != nil {
+		d := s.cfg.ConsulConfig().Downstream
+		// client only services have no public listener
+		if d.LocalBindPort > 0 {
+			conn, err := net.DialTimeout("tcp", localAddr(d.LocalBindAddress, d.LocalBindPort), probeTimeout)
+			if err != nil {
+				probeFailed(rw, fmt.Errorf("public listener: %w", err))
+				return
+			}
+			conn.Close()
+		}
+	}
+
+	rw.Write([]byte("ready"))
+}
+
+// handleLive answers ok while the HAProxy master process runs and the stats
+// socket responds
+func (s *Stats) handleLive(rw http.ResponseWriter, r *http.Request) {
+	if s.cfg.MasterPID != nil {
+		pid := s.cfg.MasterPID()
+		err := lib.ProcessAlive(pid)
+		if err != nil {
+			probeFailed(rw, fmt.Errorf("haproxy master process %d: %w", pid, err))
+			return
+		}
+	}
+
+	_, err := s.statsSocket.Exec("show info")
+	if err != nil {
+		probeFailed(rw, fmt.Errorf("stats socket: %w", err))
+		return
+	}
+
+	rw.Write([]byte("live"))
+}
+
+func probeFailed(rw http.ResponseWriter, err error) {
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write([]byte(err.Error()))
+}
+
+// localAddr is the address to connect to a local listener, listeners on all
+// the interfaces are reached through the loopback
+func localAddr(host string, port int) string {
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
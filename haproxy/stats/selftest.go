@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	selfTestTimeout = 5 * time.Second
+
+	// selfTestTCPHold is how long a tcp connection must stay open to be
+	// considered established, HAProxy closes it right away when the
+	// connection to the upstream instances fails
+	selfTestTCPHold = time.Second
+)
+
+type selfTestResult struct {
+	Upstream  string  `json:"upstream"`
+	Address   string  `json:"address"`
+	Protocol  string  `json:"protocol"`
+	Success   bool    `json:"success"`
+	LatencyMs float64 `json:"latency_ms"`
+	Status    int     `json:"status,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// handleSelfTest opens a connection through the local listener of an
+// upstream, checking the whole path up to a remote instance
+func (s *Stats) handleSelfTest(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if s.cfg.ConsulConfig == nil {
+		http.Error(rw, "no configuration available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var up *consul.Upstream
+	upstreams := s.cfg.ConsulConfig().Upstreams
+	for i := range upstreams {
+		if upstreams[i].Name == name || upstreams[i].ServiceName == name {
+			up = &upstreams[i]
+			break
+		}
+	}
+	if up == nil {
+		http.Error(rw, fmt.Sprintf("unknown upstream %s", name), http.StatusNotFound)
+		return
+	}
+	if up.LocalBindPort == 0 {
+		http.Error(rw, fmt.Sprintf("upstream %s has no local listener", name), http.StatusBadRequest)
+		return
+	}
+
+	res := selfTestUpstream(*up)
+	if res.Success {
+		log.Infof("selftest: upstream %s ok in %.1fms", res.Upstream, res.LatencyMs)
+	} else {
+		log.Warnf("selftest: upstream %s failed: %s", res.Upstream, res.Error)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !res.Success {
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(rw).Encode(res)
+}
+
+func selfTestUpstream(up consul.Upstream) selfTestResult {
+	host := up.LocalBindAddress
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+
+	res := selfTestResult{
+		Upstream: up.Name,
+		Address:  net.JoinHostPort(host, strconv.Itoa(up.LocalBindPort)),
+		Protocol: up.Protocol,
+	}
+
+	start := time.Now()
+	var err error
+	if up.Protocol == "http" {
+		res.Status, err = selfTestHTTP(res.Address)
+	} else {
+		err = selfTestTCP(res.Address)
+	}
+	res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Success = true
+	return res
+}
+
+// selfTestHTTP sends a request through the listener, any response not
+// generated by HAProxy because of a failed upstream connection is a success
+func selfTestHTTP(addr string) (int, error) {
+	client := &http.Client{Timeout: selfTestTimeout}
+	resp, err := client.Head("http://" + addr + "/")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return resp.StatusCode, fmt.Errorf("upstream unavailable: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func selfTestTCP(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, selfTestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = selfTestHold(conn)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("connection closed by haproxy, no upstream instance reachable")
+	}
+	return err
+}
+
+// selfTestHold waits for the connection to be closed by HAProxy, which
+// happens right away when it is rejected or cannot reach its server
+func selfTestHold(conn net.Conn) error {
+	err := conn.SetReadDeadline(time.Now().Add(selfTestTCPHold))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		// reading data requires an established connection as well
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,257 @@
+package stats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+type downstreamSelfTestResult struct {
+	Service           string  `json:"service"`
+	Address           string  `json:"address"`
+	ServerName        string  `json:"server_name"`
+	PeerIdentity      string  `json:"peer_identity,omitempty"`
+	ChainVerified     bool    `json:"chain_verified"`
+	IntentionsEnabled bool    `json:"intentions_enabled"`
+	IntentionAllowed  *bool   `json:"intention_allowed,omitempty"`
+	ConnectionAllowed bool    `json:"connection_allowed"`
+	Success           bool    `json:"success"`
+	LatencyMs         float64 `json:"latency_ms"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// handleDownstreamSelfTest connects to the public listener as a mesh client
+// of the same service would, with the current leaf and CA bundle
+func (s *Stats) handleDownstreamSelfTest(rw http.ResponseWriter, r *http.Request) {
+	if s.cfg.ConsulConfig == nil {
+		http.Error(rw, "no configuration available", http.StatusServiceUnavailable)
+		return
+	}
+	cfg := s.cfg.ConsulConfig()
+	if cfg.Downstream.LocalBindPort == 0 {
+		http.Error(rw, "service has no public listener", http.StatusBadRequest)
+		return
+	}
+
+	res := s.selfTestDownstream(cfg)
+	if res.Success {
+		log.Infof("selftest: downstream ok in %.1fms", res.LatencyMs)
+	} else {
+		log.Warnf("selftest: downstream failed: %s", res.Error)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !res.Success {
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(rw).Encode(res)
+}
+
+func (s *Stats) selfTestDownstream(cfg consul.Config) downstreamSelfTestResult {
+	d := cfg.Downstream
+	res := downstreamSelfTestResult{
+		Service:           cfg.ServiceName,
+		Address:           localAddr(d.LocalBindAddress, d.LocalBindPort),
+		IntentionsEnabled: s.cfg.EnableIntentions,
+	}
+
+	fail := func(err error) downstreamSelfTestResult {
+		res.Error = err.Error()
+		return res
+	}
+
+	leaf, err := tls.X509KeyPair(d.Cert, d.Key)
+	if err != nil {
+		return fail(fmt.Errorf("invalid leaf certificate: %w", err))
+	}
+	identity, err := leafIdentity(d.Cert)
+	if err != nil {
+		return fail(err)
+	}
+	res.ServerName = spiffeSNI(identity)
+
+	roots := x509.NewCertPool()
+	for _, ca := range d.CAs {
+		roots.AppendCertsFromPEM(ca)
+	}
+
+	if s.consulClient != nil {
+		allowed, _, err := s.consulClient.Connect().IntentionCheck(&api.IntentionCheck{
+			Source:      cfg.ServiceName,
+			Destination: cfg.ServiceName,
+		}, nil)
+		if err != nil {
+			return fail(fmt.Errorf("intention check failed: %w", err))
+		}
+		res.IntentionAllowed = &allowed
+	}
+
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: selfTestTimeout}, "tcp", res.Address, &tls.Config{
+		Certificates: []tls.Certificate{leaf},
+		ServerName:   res.ServerName,
+		NextProtos:   []string{"http/1.1"},
+		// mesh certificates identify services with a SPIFFE URI instead of
+		// a DNS name, the chain and the identity are verified below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			peer, err := verifyMeshChain(rawCerts, roots)
+			if err != nil {
+				return err
+			}
+			res.ChainVerified = true
+			res.PeerIdentity = peer
+			return nil
+		},
+	})
+	if err != nil {
+		return fail(fmt.Errorf("tls handshake failed: %w", err))
+	}
+	defer conn.Close()
+
+	if res.PeerIdentity != identity.String() {
+		return fail(fmt.Errorf("unexpected peer identity %s, expected %s", res.PeerIdentity, identity))
+	}
+
+	if d.Protocol == "http" {
+		err = selfTestHTTPConn(conn, res.ServerName)
+	} else {
+		err = selfTestHold(conn)
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("connection closed by haproxy")
+		}
+	}
+	res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	res.ConnectionAllowed = err == nil
+
+	enforced := s.cfg.EnableIntentions && res.IntentionAllowed != nil
+	switch {
+	case enforced && !*res.IntentionAllowed && res.ConnectionAllowed:
+		return fail(fmt.Errorf("connection accepted while intentions deny %s to %s", cfg.ServiceName, cfg.ServiceName))
+	case enforced && !*res.IntentionAllowed:
+		// rejected as expected
+	case err != nil:
+		return fail(err)
+	}
+
+	res.Success = true
+	return res
+}
+
+// verifyMeshChain checks the peer chain against the CA bundle and returns
+// the SPIFFE identity of the peer
+func verifyMeshChain(rawCerts [][]byte, roots *x509.CertPool) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", fmt.Errorf("no peer certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return "", err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", fmt.Errorf("peer chain verification failed: %w", err)
+	}
+
+	for _, u := range certs[0].URIs {
+		if u.Scheme == "spiffe" {
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("peer certificate has no SPIFFE identity")
+}
+
+func leafIdentity(certPEM []byte) (*url.URL, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid leaf certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("leaf certificate has no SPIFFE identity")
+}
+
+// spiffeSNI builds the SNI Consul uses for a service from its SPIFFE id,
+// eg: spiffe://<trust domain>/ns/<ns>/dc/<dc>/svc/<svc> gives
+// <svc>.<ns>.<dc>.internal.<trust domain>, and services of a non default
+// admin partition (spiffe://<trust domain>/ap/<ap>/ns/...) get
+// <svc>.<ns>.<ap>.<dc>.internal-v1.<trust domain>
+func spiffeSNI(id *url.URL) string {
+	parts := strings.Split(strings.Trim(id.Path, "/"), "/")
+	values := map[string]string{}
+	for i := 0; i+1 < len(parts); i += 2 {
+		values[parts[i]] = parts[i+1]
+	}
+	ns := values["ns"]
+	if ns == "" {
+		ns = "default"
+	}
+	if ap := values["ap"]; ap != "" && ap != "default" {
+		return fmt.Sprintf("%s.%s.%s.%s.internal-v1.%s", values["svc"], ns, ap, values["dc"], id.Host)
+	}
+	return fmt.Sprintf("%s.%s.%s.internal.%s", values["svc"], ns, values["dc"], id.Host)
+}
+
+func selfTestHTTPConn(conn net.Conn, host string) error {
+	err := conn.SetDeadline(time.Now().Add(selfTestTimeout))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, "http://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("no response, connection rejected: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("local service unavailable: %s", resp.Status)
+	}
+	return nil
+}
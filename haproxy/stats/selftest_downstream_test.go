@@ -0,0 +1,128 @@
+package stats
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert signs a certificate with parent, or self-signs it when parent
+// is nil. The certificates without URI are CAs.
+func newTestCert(t *testing.T, parent *testCert, uri string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  uri == "",
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		require.NoError(t, err)
+		tmpl.URIs = []*url.URL{u}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func TestVerifyMeshChain(t *testing.T) {
+	const id = "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web"
+
+	ca := newTestCert(t, nil, "")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	leaf := newTestCert(t, ca, id)
+	got, err := verifyMeshChain([][]byte{leaf.der}, roots)
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+
+	// the intermediates sent by the peer complete the chain
+	inter := newTestCert(t, ca, "")
+	interLeaf := newTestCert(t, inter, id)
+	got, err = verifyMeshChain([][]byte{interLeaf.der, inter.der}, roots)
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+	_, err = verifyMeshChain([][]byte{interLeaf.der}, roots)
+	require.Error(t, err)
+
+	_, err = verifyMeshChain(nil, roots)
+	require.Error(t, err)
+
+	_, err = verifyMeshChain([][]byte{[]byte("garbage")}, roots)
+	require.Error(t, err)
+
+	other := newTestCert(t, nil, "")
+	_, err = verifyMeshChain([][]byte{newTestCert(t, other, id).der}, roots)
+	require.Error(t, err)
+
+	_, err = verifyMeshChain([][]byte{newTestCert(t, ca, "").der}, roots)
+	require.EqualError(t, err, "peer certificate has no SPIFFE identity")
+}
+
+func TestLeafIdentity(t *testing.T) {
+	const id = "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web"
+
+	ca := newTestCert(t, nil, "")
+	leafPEM := func(c *testCert) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	}
+
+	u, err := leafIdentity(leafPEM(newTestCert(t, ca, id)))
+	require.NoError(t, err)
+	require.Equal(t, id, u.String())
+
+	_, err = leafIdentity(leafPEM(newTestCert(t, ca, "")))
+	require.EqualError(t, err, "leaf certificate has no SPIFFE identity")
+
+	_, err = leafIdentity([]byte("not a certificate"))
+	require.EqualError(t, err, "invalid leaf certificate")
+}
+
+func TestSpiffeSNI(t *testing.T) {
+	tests := []struct {
+		id  string
+		sni string
+	}{
+		{"spiffe://td.consul/ns/default/dc/dc1/svc/web", "web.default.dc1.internal.td.consul"},
+		{"spiffe://td.consul/ns/team/dc/dc2/svc/api", "api.team.dc2.internal.td.consul"},
+		{"spiffe://td.consul/dc/dc1/svc/web", "web.default.dc1.internal.td.consul"},
+		{"spiffe://td.consul/ap/default/ns/default/dc/dc1/svc/web", "web.default.dc1.internal.td.consul"},
+		{"spiffe://td.consul/ap/billing/ns/team/dc/dc1/svc/api", "api.team.billing.dc1.internal-v1.td.consul"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			u, err := url.Parse(tt.id)
+			require.NoError(t, err)
+			require.Equal(t, tt.sni, spiffeSNI(u))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+// listenerPort returns the port of a local test listener
+func listenerPort(t *testing.T, addr string) int {
+	_, p, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(p)
+	require.NoError(t, err)
+	return port
+}
+
+// tcpListener accepts connections, keeping them open when hold is set and
+// closing them right away otherwise, as HAProxy does without instances
+func tcpListener(t *testing.T, hold bool) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !hold {
+				conn.Close()
+				continue
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listenerPort(t, l.Addr().String())
+}
+
+func TestHandleSelfTest(t *testing.T) {
+	httpUp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer httpUp.Close()
+	httpDown := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer httpDown.Close()
+
+	cfg := consul.Config{Upstreams: []consul.Upstream{
+		{Name: "web", ServiceName: "web", Protocol: "http", LocalBindPort: listenerPort(t, httpUp.Listener.Addr().String())},
+		{Name: "web_down", ServiceName: "web-down", Protocol: "http", LocalBindPort: listenerPort(t, httpDown.Listener.Addr().String())},
+		{Name: "db", ServiceName: "db", LocalBindPort: tcpListener(t, true)},
+		{Name: "db_down", ServiceName: "db-down", LocalBindPort: tcpListener(t, false)},
+		{Name: "split_only", ServiceName: "split-only"},
+	}}
+	s := New(nil, nil, nil, Config{
+		AdminToken:   "secret",
+		ConsulConfig: func() consul.Config { return cfg },
+	})
+
+	tests := []struct {
+		name     string
+		code     int
+		success  bool
+		status   int
+		upstream string
+	}{
+		{name: "web", code: http.StatusOK, success: true, status: http.StatusNotFound, upstream: "web"},
+		// the service name is accepted too
+		{name: "web-down", code: http.StatusBadGateway, status: http.StatusServiceUnavailable, upstream: "web_down"},
+		{name: "db", code: http.StatusOK, success: true, upstream: "db"},
+		{name: "db_down", code: http.StatusBadGateway, upstream: "db_down"},
+		{name: "unknown", code: http.StatusNotFound},
+		{name: "split_only", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(s, http.MethodPost, "/selftest/upstream/"+tt.name, "Bearer secret")
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+			if tt.upstream == "" {
+				return
+			}
+
+			var res selfTestResult
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			require.Equal(t, tt.upstream, res.Upstream)
+			require.Equal(t, tt.success, res.Success)
+			require.Equal(t, tt.status, res.Status)
+			require.Equal(t, tt.success, res.Error == "", res.Error)
+		})
+	}
+}
+
+func TestHandleSelfTestNoConfig(t *testing.T) {
+	s := New(nil, nil, nil, Config{AdminToken: "secret"})
+
+	rec := adminRequest(s, http.MethodPost, "/selftest/upstream/db", "Bearer secret")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
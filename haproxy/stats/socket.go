@@ -3,6 +3,7 @@ package stats
 import (
 	"encoding/csv"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -20,6 +21,27 @@ func NewStatsSocket(socketPath string) *StatsSocket {
 	}
 }
 
+// Exec runs a runtime API command and returns its output
+func (s *StatsSocket) Exec(cmd string) (string, error) {
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to stats socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to send command: %w", err)
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return string(out), nil
+}
+
 func (s *StatsSocket) Stats() (models.NativeStats, error) {
 	conn, err := net.Dial("unix", s.socketPath)
 	if err != nil {
@@ -158,6 +180,8 @@ func parseStatRecord(record []string, colIndex map[string]int) *models.NativeSta
 		Ctime:         parseInt64Ptr(getCol("ctime")),
 		Rtime:         parseInt64Ptr(getCol("rtime")),
 		CheckDuration: parseInt64Ptr(getCol("check_duration")),
+		Status:        getCol("status"),
+		CheckStatus:   getCol("check_status"),
 	}
 
 	// Build the NativeStat object
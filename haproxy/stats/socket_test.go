@@ -0,0 +1,71 @@
+package stats
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSocket is a runtime API socket answering each command with reply
+type fakeSocket struct {
+	lock     sync.Mutex
+	commands []string
+}
+
+func newFakeSocket(t *testing.T, reply func(cmd string) string) (*StatsSocket, *fakeSocket) {
+	// the unix socket paths are short, the test dir may not fit
+	dir, err := os.MkdirTemp("", "stats")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "stats.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeSocket{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cmd, _ := bufio.NewReader(conn).ReadString('\n')
+			cmd = strings.TrimSpace(cmd)
+			f.lock.Lock()
+			f.commands = append(f.commands, cmd)
+			f.lock.Unlock()
+			conn.Write([]byte(reply(cmd)))
+			conn.Close()
+		}
+	}()
+	return NewStatsSocket(path), f
+}
+
+func (f *fakeSocket) Commands() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func TestStatsSocketStats(t *testing.T) {
+	sock, _ := newFakeSocket(t, func(string) string {
+		return "# pxname,svname,type,status\nback_db,srv1,2,UP\nback_db,BACKEND,1,UP\n"
+	})
+
+	stats, err := sock.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Len(t, stats[0].Stats, 2)
+	require.Equal(t, "back_db", stats[0].Stats[0].BackendName)
+	require.Equal(t, "srv1", stats[0].Stats[0].Name)
+	require.Equal(t, "server", stats[0].Stats[0].Type)
+	require.Equal(t, "UP", stats[0].Stats[0].Stats.Status)
+	require.Equal(t, "backend", stats[0].Stats[1].Type)
+}
@@ -4,18 +4,50 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/masterclient"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
 	"github.com/hashicorp/consul/api"
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	RegisterService bool
-	ListenAddr      string
-	ServiceName     string
-	ServiceID       string
+	RegisterService  bool
+	ExportMeta       bool
+	ListenAddr       string
+	AdminToken       string
+	EnableIntentions bool
+	// BasicAuth is the user:password required to read the metrics, with
+	// Token either is accepted. The metrics are open when both are empty.
+	BasicAuth string
+	Token     string
+	// TLSCertFile and TLSKeyFile serve the stats server over TLS
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSConnect serves the stats server over TLS with the Connect leaf
+	// certificate
+	TLSConnect bool
+	// StatsPagePort is the localhost port of the HAProxy stats page, proxied
+	// on /haproxy/ when set
+	StatsPagePort int
+	// Metrics is served on /metrics when it implements http.Handler
+	Metrics      metrics.Metrics
+	ServiceName  string
+	ServiceID    string
+	ConsulConfig func() consul.Config
+	// Pinner serves the upstream pin admin operations when set
+	Pinner consul.UpstreamPinner
+	// LastApply returns when a config was last applied to HAProxy
+	LastApply func() time.Time
+	// MasterPID returns the HAProxy master process checked by /live
+	MasterPID func() int
+	// Master serves the worker admin operations when set
+	Master *masterclient.Client
 }
 
 type Stats struct {
@@ -23,14 +55,25 @@ type Stats struct {
 	consulClient *api.Client
 	statsSocket  *StatsSocket
 	ready        chan struct{}
+	// stop ends the registration of the stats service
+	stop chan struct{}
+
+	// ejected lists the servers marked down by passive checks, it is only
+	// used by the poller
+	ejected map[string]bool
 }
 
 func New(consulClient *api.Client, statsSocket *StatsSocket, ready chan struct{}, cfg Config) *Stats {
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.Nop{}
+	}
 	return &Stats{
 		cfg:          cfg,
 		consulClient: consulClient,
 		statsSocket:  statsSocket,
 		ready:        ready,
+		stop:         make(chan struct{}),
+		ejected:      map[string]bool{},
 	}
 }
 
@@ -38,30 +81,32 @@ func (s *Stats) Run() error {
 	if s.cfg.RegisterService {
 		go s.register()
 	}
+	if s.cfg.ExportMeta {
+		go s.exportMeta()
+	}
+	go s.pollMetrics()
 
-	mux := http.NewServeMux()
-	mux.Handle("/ready", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		<-s.ready
-		rw.Write([]byte("ready"))
-	}))
-	mux.Handle("/health", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		ok := false
-		select {
-		case <-s.ready:
-			ok = true
-		default:
-		}
+	// only pushing metrics
+	if s.cfg.ListenAddr == "" {
+		return nil
+	}
 
-		if ok {
-			rw.Write([]byte("ok"))
-		} else {
-			rw.WriteHeader(500)
-			rw.Write([]byte("starting..."))
-		}
-	}))
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return fmt.Errorf("cannot load the stats server certificate: %w", err)
+	}
+	srv := &http.Server{
+		Addr:      s.cfg.ListenAddr,
+		Handler:   s.handler(),
+		TLSConfig: tlsConfig,
+	}
 
 	log.Infof("Starting stats server at %s", s.cfg.ListenAddr)
-	err := http.ListenAndServe(s.cfg.ListenAddr, mux)
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil {
 		log.Errorf("error starting stats server: %s", err)
 	}
@@ -69,6 +114,34 @@ func (s *Stats) Run() error {
 	return nil
 }
 
+// handler routes the requests of the stats server, the probes are not
+// authenticated
+func (s *Stats) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/live", s.handleLive)
+	mux.HandleFunc("/health", s.handleHealth)
+
+	if h, ok := s.cfg.Metrics.(http.Handler); ok {
+		mux.Handle("/metrics", s.statsAuth(h))
+	}
+	if s.cfg.StatsPagePort > 0 {
+		page := httputil.NewSingleHostReverseProxy(&url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort("127.0.0.1", strconv.Itoa(s.cfg.StatsPagePort)),
+		})
+		// the page has the same uri, its links work on both ports
+		mux.Handle("/haproxy/", s.statsAuth(page))
+	}
+	s.registerAdmin(mux)
+	return mux
+}
+
+// ServiceID is the id of the stats service registered in the local agent
+func ServiceID(serviceID string) string {
+	return fmt.Sprintf("%s-connect-stats", serviceID)
+}
+
 func (s *Stats) register() {
 	_, portStr, err := net.SplitHostPort(s.cfg.ListenAddr)
 	if err != nil {
@@ -76,14 +149,21 @@ func (s *Stats) register() {
 	}
 	port, _ := strconv.Atoi(portStr)
 
+	// the certificate is not issued for localhost
+	scheme := "http"
+	if s.cfg.TLSCertFile != "" || s.cfg.TLSConnect {
+		scheme = "https"
+	}
+
 	reg := func() {
 		err = s.consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
-			ID:   fmt.Sprintf("%s-connect-stats", s.cfg.ServiceID),
+			ID:   ServiceID(s.cfg.ServiceID),
 			Name: fmt.Sprintf("%s-connect-stats", s.cfg.ServiceName),
 			Port: port,
 			Checks: api.AgentServiceChecks{
 				&api.AgentServiceCheck{
-					HTTP:                           fmt.Sprintf("http://localhost:%d/health", port),
+					HTTP:                           fmt.Sprintf("%s://localhost:%d/health", scheme, port),
+					TLSSkipVerify:                  scheme == "https",
 					Interval:                       (10 * time.Second).String(),
 					DeregisterCriticalServiceAfter: time.Minute.String(),
 				},
@@ -97,7 +177,21 @@ func (s *Stats) register() {
 
 	reg()
 
-	for range time.Tick(time.Minute) {
-		reg()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reg()
+		case <-s.stop:
+			return
+		}
 	}
 }
+
+// Deregister stops registering the stats service and removes it from the
+// local agent
+func (s *Stats) Deregister() error {
+	close(s.stop)
+	return s.consulClient.Agent().ServiceDeregister(ServiceID(s.cfg.ServiceID))
+}
@@ -0,0 +1,57 @@
+package haproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// runTTLCheck keeps the TTL check of the proxy registration passing while
+// HAProxy runs and answers on its stats socket, so Consul marks the sidecar
+// critical when HAProxy dies even if this process survives
+func (h *HAProxy) runTTLCheck(sd *lib.Shutdown) {
+	ticker := time.NewTicker(consul.ProxyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		status, output := api.HealthPassing, "HAProxy is running"
+		if err := h.alive(); err != nil {
+			status, output = api.HealthCritical, err.Error()
+		}
+		err := h.consulClient.Agent().UpdateTTL(h.opts.TTLCheckID, output, status)
+		if err != nil {
+			log.Warnf("cannot update check %s: %s", h.opts.TTLCheckID, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sd.Stop:
+			return
+		}
+	}
+}
+
+// alive tells if a config is applied and the HAProxy master process and
+// stats socket respond
+func (h *HAProxy) alive() error {
+	select {
+	case <-h.Ready:
+	default:
+		return fmt.Errorf("no config applied yet")
+	}
+
+	pid := h.master.PID()
+	err := lib.ProcessAlive(pid)
+	if err != nil {
+		return fmt.Errorf("haproxy master process %d: %w", pid, err)
+	}
+	_, err = h.statsSocket.Exec("show info")
+	if err != nil {
+		return fmt.Errorf("stats socket: %w", err)
+	}
+	return nil
+}
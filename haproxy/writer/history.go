@@ -0,0 +1,125 @@
+package writer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+)
+
+const historyPrefix = "haproxy.conf."
+
+// History keeps the last applied configs in a directory, each one in a
+// file suffixed by its version, and logs what changed between them
+type History struct {
+	dir       string
+	retention int
+	version   int
+	previous  string
+}
+
+// NewHistory creates the history directory, numbering resumes after the
+// versions already present in it
+func NewHistory(dir string, retention int) (*History, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		dir:       dir,
+		retention: retention,
+	}
+
+	versions, err := h.versions()
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) > 0 {
+		h.version = versions[len(versions)-1]
+		b, err := os.ReadFile(h.path(h.version))
+		if err != nil {
+			return nil, err
+		}
+		h.previous = string(b)
+	}
+
+	return h, nil
+}
+
+// Record saves a new version of the config and logs the diff against the
+// previous one at debug level
+func (h *History) Record(config string) error {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(h.previous),
+			B:        difflib.SplitLines(config),
+			FromFile: h.path(h.version),
+			ToFile:   h.path(h.version + 1),
+			Context:  3,
+		})
+		if err != nil {
+			log.Errorf("failed to diff haproxy config: %s", err)
+		} else {
+			log.Debugf("haproxy config changes:\n%s", diff)
+		}
+	}
+
+	h.version++
+	h.previous = config
+
+	err := os.WriteFile(h.path(h.version), []byte(config), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write config history: %w", err)
+	}
+
+	return h.prune()
+}
+
+func (h *History) prune() error {
+	versions, err := h.versions()
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > h.retention {
+		err := os.Remove(h.path(versions[0]))
+		if err != nil {
+			return fmt.Errorf("failed to prune config history: %w", err)
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+func (h *History) versions() ([]int, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), historyPrefix) {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(e.Name(), historyPrefix))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+func (h *History) path(version int) string {
+	return filepath.Join(h.dir, historyPrefix+strconv.Itoa(version))
+}
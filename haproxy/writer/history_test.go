@@ -0,0 +1,34 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	h, err := NewHistory(dir, 2)
+	require.NoError(t, err)
+
+	for _, cfg := range []string{"a", "b", "c"} {
+		require.NoError(t, h.Record(cfg))
+	}
+
+	versions, err := h.versions()
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 3}, versions)
+
+	b, err := os.ReadFile(filepath.Join(dir, "haproxy.conf.3"))
+	require.NoError(t, err)
+	require.Equal(t, "c", string(b))
+
+	// numbering resumes after a restart
+	h, err = NewHistory(dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, h.version)
+	require.Equal(t, "c", h.previous)
+}
@@ -1,29 +1,94 @@
 package writer
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/masterclient"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// reloadConfirmTimeout is how long a new worker has to start after a
+	// reload before the previous config is restored
+	reloadConfirmTimeout = 10 * time.Second
+	reloadConfirmPoll    = 100 * time.Millisecond
+)
+
+// ValidationError is returned when HAProxy rejects the rendered config
+type ValidationError struct {
+	Err    error
+	Output string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("config validation failed: %s\nOutput: %s", e.Err, e.Output)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ReloadError is returned when HAProxy did not start a worker with the new
+// config, the previous one was restored
+type ReloadError struct {
+	Err error
+}
+
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("reload failed, previous config restored: %s", e.Err)
+}
+
+func (e *ReloadError) Unwrap() error {
+	return e.Err
+}
+
 type ConfigWriter struct {
 	configPath string
 	haproxyBin string
-	masterPID  int
+	// master reloads HAProxy and confirms the reloads, SIGUSR2 is sent to
+	// masterPID when nil or unreachable
+	master         *masterclient.Client
+	masterPID      func() int
+	confirmTimeout time.Duration
+	oldWorkers     int64
+
+	// lock serializes the reloads
+	lock sync.Mutex
 }
 
-func New(configPath, haproxyBin string, masterPID int) *ConfigWriter {
+// New returns a writer reloading HAProxy through its master CLI, or by
+// signaling the master process of masterPID, which is called on each reload
+// as HAProxy may be restarted.
+func New(configPath, haproxyBin string, master *masterclient.Client, masterPID func() int) *ConfigWriter {
 	return &ConfigWriter{
-		configPath: configPath,
-		haproxyBin: haproxyBin,
-		masterPID:  masterPID,
+		configPath:     configPath,
+		haproxyBin:     haproxyBin,
+		master:         master,
+		masterPID:      masterPID,
+		confirmTimeout: reloadConfirmTimeout,
 	}
 }
 
+// OldWorkers returns the number of workers of previous configs still
+// draining their connections after the last reload
+func (w *ConfigWriter) OldWorkers() int {
+	return int(atomic.LoadInt64(&w.oldWorkers))
+}
+
+// ApplyConfig validates the config and reloads HAProxy with it, concurrent
+// calls are serialized. When HAProxy does not start a worker with the new
+// config, the previous one is restored and a ReloadError is returned.
 func (w *ConfigWriter) ApplyConfig(config string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	tmpPath := w.configPath + ".new"
 
 	// Write to temp file
@@ -38,7 +103,12 @@ func (w *ConfigWriter) ApplyConfig(config string) error {
 	if err != nil {
 		// Remove invalid temp file
 		os.Remove(tmpPath)
-		return fmt.Errorf("config validation failed: %w\nOutput: %s", err, string(output))
+		return &ValidationError{Err: err, Output: string(output)}
+	}
+
+	previous, err := os.ReadFile(w.configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read current config: %w", err)
 	}
 
 	// Atomic rename
@@ -47,12 +117,89 @@ func (w *ConfigWriter) ApplyConfig(config string) error {
 		return fmt.Errorf("failed to rename config file: %w", err)
 	}
 
-	// Send SIGUSR2 to master process for graceful reload
-	err = syscall.Kill(w.masterPID, syscall.SIGUSR2)
+	err = w.reload()
+	if err == nil {
+		log.Info("HAProxy configuration reloaded successfully")
+		return nil
+	}
+	var reloadErr *ReloadError
+	if !errors.As(err, &reloadErr) || previous == nil {
+		return err
+	}
+
+	log.Errorf("%s, restoring the previous config", reloadErr.Err)
+	err = w.restore(previous)
 	if err != nil {
-		return fmt.Errorf("failed to send SIGUSR2 to HAProxy master (pid %d): %w", w.masterPID, err)
+		return fmt.Errorf("%s, failed to restore the previous config: %w", reloadErr.Err, err)
 	}
+	return reloadErr
+}
+
+// reload has the master process reload and waits for a worker with the new
+// config, a ReloadError is returned when none starts
+func (w *ConfigWriter) reload() error {
+	if w.master == nil {
+		return w.signalReload()
+	}
+	before, err := w.master.ShowProc()
+	if err != nil {
+		log.Warnf("cannot list the haproxy processes, reloading with a signal: %s", err)
+		return w.signalReload()
+	}
+
+	err = w.master.Reload()
+	if errors.Is(err, masterclient.ErrReloadFailed) {
+		return &ReloadError{Err: err}
+	}
+	if err != nil {
+		// the connection may be dropped by a master re-executing
+		log.Debugf("reload command: %s", err)
+	}
+
+	deadline := time.Now().Add(w.confirmTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(reloadConfirmPoll)
+
+		// the master CLI is briefly unavailable while the master re-executes
+		after, err := w.master.ShowProc()
+		if err != nil {
+			continue
+		}
+		if after.FailedReloads > before.FailedReloads {
+			return &ReloadError{Err: fmt.Errorf("haproxy reported a failed reload")}
+		}
+		if masterclient.NewWorker(before, after) {
+			atomic.StoreInt64(&w.oldWorkers, int64(len(after.OldWorkers)))
+			if len(after.OldWorkers) > 0 {
+				log.Debugf("%d old haproxy workers draining their connections", len(after.OldWorkers))
+			}
+			return nil
+		}
+	}
+	return &ReloadError{Err: fmt.Errorf("no new haproxy worker after %s", w.confirmTimeout)}
+}
 
-	log.Info("HAProxy configuration reloaded successfully")
+// signalReload sends SIGUSR2 to the master process, the reload is not
+// confirmed
+func (w *ConfigWriter) signalReload() error {
+	pid := w.masterPID()
+	err := lib.SignalReload(pid)
+	if err != nil {
+		return fmt.Errorf("failed to send SIGUSR2 to HAProxy master (pid %d): %w", pid, err)
+	}
 	return nil
 }
+
+// restore writes back the previous config and reloads HAProxy with it
+func (w *ConfigWriter) restore(previous []byte) error {
+	tmpPath := w.configPath + ".prev"
+	err := os.WriteFile(tmpPath, previous, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, w.configPath)
+	if err != nil {
+		return err
+	}
+	return w.reload()
+}
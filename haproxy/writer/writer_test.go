@@ -0,0 +1,112 @@
+//go:build !windows
+
+package writer
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/masterclient"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMaster answers reload with reload and show proc with the given outputs
+// in turn, the last one is repeated
+func fakeMaster(t *testing.T, reload string, outputs ...string) string {
+	socket := filepath.Join(t.TempDir(), "master.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var lock sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cmd, _ := bufio.NewReader(conn).ReadString('\n')
+			if cmd == "reload\n" {
+				conn.Write([]byte(reload))
+				conn.Close()
+				continue
+			}
+			lock.Lock()
+			out := outputs[0]
+			if len(outputs) > 1 {
+				outputs = outputs[1:]
+			}
+			lock.Unlock()
+			conn.Write([]byte(out))
+			conn.Close()
+		}
+	}()
+	return socket
+}
+
+func TestApplyConfigRollback(t *testing.T) {
+	// like HAProxy before 2.7, the reload command has no output
+	socket := fakeMaster(t, "",
+		// before the reload
+		"1 master 0 [failed: 0]\n# workers\n10 worker 0\n",
+		// the new config failed
+		"1 master 1 [failed: 1]\n# workers\n10 worker 0\n",
+		// before the restore
+		"1 master 1 [failed: 1]\n# workers\n10 worker 0\n",
+		// restored
+		"1 master 2 [failed: 1]\n# workers\n11 worker 0\n# old workers\n10 worker 1\n",
+	)
+
+	path := filepath.Join(t.TempDir(), "haproxy.conf")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+
+	w := New(path, "true", masterclient.New(socket), os.Getpid)
+
+	err := w.ApplyConfig("b")
+	var reloadErr *ReloadError
+	require.True(t, errors.As(err, &reloadErr), "got %v", err)
+
+	config, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(config))
+	require.Equal(t, 1, w.OldWorkers())
+}
+
+func TestApplyConfigConfirmed(t *testing.T) {
+	socket := fakeMaster(t, "",
+		"1 master 0\n# workers\n10 worker 0\n",
+		// the master re-executes
+		"",
+		"1 master 1\n# workers\n11 worker 0\n",
+	)
+
+	path := filepath.Join(t.TempDir(), "haproxy.conf")
+	w := New(path, "true", masterclient.New(socket), os.Getpid)
+	require.NoError(t, w.ApplyConfig("b"))
+	require.Equal(t, 0, w.OldWorkers())
+}
+
+func TestApplyConfigReloadFailed(t *testing.T) {
+	socket := fakeMaster(t, "Success=0\n--\n[ALERT] cannot bind\n",
+		"1 master 0\n# workers\n10 worker 0\n",
+	)
+
+	path := filepath.Join(t.TempDir(), "haproxy.conf")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+
+	w := New(path, "true", masterclient.New(socket), os.Getpid)
+	w.confirmTimeout = 200 * time.Millisecond
+
+	err := w.ApplyConfig("b")
+	require.True(t, errors.Is(err, masterclient.ErrReloadFailed), "got %v", err)
+
+	config, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(config))
+}
@@ -0,0 +1,31 @@
+// Package otlp holds the encoding shared by the OTLP/HTTP JSON exporters of
+// the metrics and the traces
+package otlp
+
+import "sort"
+
+// Attribute is an OTLP key value pair, only string values are sent
+type Attribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// Attributes encodes a set of attributes, sorted by key so the payloads
+// are stable
+func Attributes(attrs map[string]string) []Attribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]Attribute, 0, len(attrs))
+	for _, k := range keys {
+		a := Attribute{Key: k}
+		a.Value.StringValue = attrs[k]
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,19 @@
+package otlp
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributes(t *testing.T) {
+	b, err := json.Marshal(Attributes(map[string]string{"upstream": "db", "service.name": "web"}))
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"key": "service.name", "value": {"stringValue": "web"}},
+		{"key": "upstream", "value": {"stringValue": "db"}}
+	]`, string(b))
+
+	require.Empty(t, Attributes(nil))
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Artifact is something the process creates outside of its memory and
+// removes on shutdown, eg: a Consul registration or a directory
+type Artifact struct {
+	Kind string
+	Name string
+	// Exists tells whether the artifact is still there
+	Exists func() (bool, error)
+}
+
+// Artifacts lists the artifacts to verify on shutdown, the methods of a nil
+// list do nothing
+type Artifacts struct {
+	lock sync.Mutex
+	list []Artifact
+}
+
+func NewArtifacts() *Artifacts {
+	return &Artifacts{}
+}
+
+func (a *Artifacts) Add(art Artifact) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	a.list = append(a.list, art)
+	a.lock.Unlock()
+}
+
+// Verify reports the artifacts left after the shutdown and returns them
+func (a *Artifacts) Verify() []Artifact {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	left := []Artifact{}
+	unverified := 0
+	for _, art := range a.list {
+		exists, err := art.Exists()
+		switch {
+		case err != nil:
+			unverified++
+			log.Warnf("cleanup: cannot verify the removal of %s %s: %s", art.Kind, art.Name, err)
+		case exists:
+			log.Warnf("cleanup: %s %s was not removed, run the cleanup subcommand to reclaim it", art.Kind, art.Name)
+			left = append(left, art)
+		}
+	}
+	if len(left) == 0 && unverified == 0 {
+		log.Infof("cleanup: the %d artifact(s) created were removed", len(a.list))
+	}
+	return left
+}
+
+// PathArtifact is a file or directory
+func PathArtifact(kind, path string) Artifact {
+	return Artifact{
+		Kind: kind,
+		Name: path,
+		Exists: func() (bool, error) {
+			_, err := os.Stat(path)
+			if errors.Is(err, os.ErrNotExist) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}
+}
@@ -0,0 +1,28 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactsVerify(t *testing.T) {
+	dir := t.TempDir()
+	removed := path.Join(dir, "removed")
+	left := path.Join(dir, "left")
+	require.NoError(t, os.Mkdir(left, 0700))
+
+	a := NewArtifacts()
+	a.Add(PathArtifact("directory", removed))
+	a.Add(PathArtifact("directory", left))
+
+	l := a.Verify()
+	require.Len(t, l, 1)
+	require.Equal(t, left, l[0].Name)
+
+	var none *Artifacts
+	none.Add(PathArtifact("directory", left))
+	require.Empty(t, none.Verify())
+}
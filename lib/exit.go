@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ExitCode is the process exit status, each failure class has its own code
+// so that orchestrators can pick a restart policy
+type ExitCode int
+
+const (
+	ExitOK ExitCode = iota
+	ExitUnknown
+	ExitConfig
+	ExitConsulUnreachable
+	ExitDependencies
+	ExitACLDenied
+	ExitHAProxySpawn
+	ExitValidation
+)
+
+var exitKinds = map[ExitCode]string{
+	ExitOK:                "ok",
+	ExitUnknown:           "unknown",
+	ExitConfig:            "config_error",
+	ExitConsulUnreachable: "consul_unreachable",
+	ExitDependencies:      "missing_dependencies",
+	ExitACLDenied:         "acl_denied",
+	ExitHAProxySpawn:      "haproxy_spawn_failure",
+	ExitValidation:        "validation_failure",
+}
+
+func (c ExitCode) String() string {
+	k, ok := exitKinds[c]
+	if !ok {
+		return exitKinds[ExitUnknown]
+	}
+	return k
+}
+
+// ExitError tags an error with the exit code the process should end with
+type ExitError struct {
+	Code ExitCode
+	Err  error
+}
+
+func NewExitError(code ExitCode, err error) *ExitError {
+	return &ExitError{Code: code, Err: err}
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCodeOf returns the exit code carried by an error, ExitUnknown if it
+// was not tagged
+func ExitCodeOf(err error) ExitCode {
+	if err == nil {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitUnknown
+}
+
+type exitReport struct {
+	ExitCode int    `json:"exit_code"`
+	Kind     string `json:"kind"`
+	Error    string `json:"error"`
+}
+
+// Exit writes a single line JSON report of the error on stderr and exits
+// with the code matching the error
+func Exit(err error) {
+	if err == nil {
+		os.Exit(int(ExitOK))
+	}
+	code := ExitCodeOf(err)
+
+	b, jsonErr := json.Marshal(exitReport{
+		ExitCode: int(code),
+		Kind:     code.String(),
+		Error:    err.Error(),
+	})
+	if jsonErr != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", b)
+	}
+
+	os.Exit(int(code))
+}
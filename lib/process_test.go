@@ -0,0 +1,12 @@
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessAlive(t *testing.T) {
+	require.NoError(t, ProcessAlive(os.Getpid()))
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package lib
+
+import (
+	"syscall"
+)
+
+// SignalReload has a HAProxy master process reload its workers
+func SignalReload(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
+
+// Terminate asks a process to exit
+func Terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// ProcessAlive returns an error when the process is not running
+func ProcessAlive(pid int) error {
+	return syscall.Kill(pid, syscall.Signal(0))
+}
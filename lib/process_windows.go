@@ -0,0 +1,38 @@
+//go:build windows
+
+package lib
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrNoReloadSignal is returned by SignalReload on windows, which has no
+// signals: HAProxy is reloaded through its master CLI
+var ErrNoReloadSignal = errors.New("reload signals are not supported on windows, use the master CLI")
+
+// SignalReload has a HAProxy master process reload its workers
+func SignalReload(pid int) error {
+	return ErrNoReloadSignal
+}
+
+// Terminate asks a process to exit, windows has no graceful termination
+// signal so it is killed
+func Terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer p.Release()
+	return p.Kill()
+}
+
+// ProcessAlive returns an error when the process is not running
+func ProcessAlive(pid int) error {
+	// FindProcess opens the process on windows and fails when it exited
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Release()
+}
@@ -0,0 +1,178 @@
+//go:build !windows
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// reapInterval is the interval between two scans of the zombie children
+	reapInterval = 5 * time.Second
+	// killPollInterval is the interval between two checks of the children
+	// left while they are terminated
+	killPollInterval = 100 * time.Millisecond
+)
+
+// IsInit tells if the process runs as PID 1, eg: as the entrypoint of a
+// container, and inherits the orphaned processes
+func IsInit() bool {
+	return os.Getpid() == 1
+}
+
+// Reap waits for the orphaned processes reparented to this one until stop is
+// closed. The children started with os/exec are waited for by their command,
+// to leave them alone only the processes found zombie on two successive
+// scans are reaped.
+func Reap(stop <-chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	seen := map[int]bool{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		cs, err := children()
+		if err != nil {
+			log.Debugf("cannot list the child processes: %s", err)
+			continue
+		}
+		zombies := map[int]bool{}
+		for _, c := range cs {
+			if !c.zombie {
+				continue
+			}
+			if seen[c.pid] && reap(c.pid) {
+				log.Debugf("reaped orphaned process %d", c.pid)
+				continue
+			}
+			zombies[c.pid] = true
+		}
+		seen = zombies
+	}
+}
+
+// KillChildren terminates the child processes left on shutdown, the ones
+// still running after grace are killed. It must only be called once the
+// commands started with os/exec are waited for.
+func KillChildren(grace time.Duration) {
+	signalChildren(syscall.SIGTERM)
+
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		if reapChildren() == 0 {
+			return
+		}
+		time.Sleep(killPollInterval)
+	}
+
+	log.Warnf("child processes still running after %s, killing them", grace)
+	signalChildren(syscall.SIGKILL)
+	for i := 0; i < 10 && reapChildren() > 0; i++ {
+		time.Sleep(killPollInterval)
+	}
+}
+
+// reapChildren reaps the zombie children, it returns the number of children
+// still running
+func reapChildren() int {
+	cs, err := children()
+	if err != nil {
+		log.Debugf("cannot list the child processes: %s", err)
+		return 0
+	}
+	running := 0
+	for _, c := range cs {
+		if !c.zombie || !reap(c.pid) {
+			running++
+		}
+	}
+	return running
+}
+
+func signalChildren(sig syscall.Signal) {
+	cs, err := children()
+	if err != nil {
+		log.Debugf("cannot list the child processes: %s", err)
+		return
+	}
+	for _, c := range cs {
+		if c.zombie {
+			continue
+		}
+		log.Infof("sending %s to child process %d", sig, c.pid)
+		err := syscall.Kill(c.pid, sig)
+		if err != nil && err != syscall.ESRCH {
+			log.Errorf("cannot signal child process %d: %s", c.pid, err)
+		}
+	}
+}
+
+func reap(pid int) bool {
+	var ws syscall.WaitStatus
+	p, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	return err == nil && p == pid
+}
+
+type child struct {
+	pid    int
+	zombie bool
+}
+
+// children lists the child processes from /proc
+func children() ([]child, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	cs := []child{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			// exited since the listing
+			continue
+		}
+		state, ppid, err := parseStat(data)
+		if err != nil || ppid != self {
+			continue
+		}
+		cs = append(cs, child{pid: pid, zombie: state == "Z"})
+	}
+	return cs, nil
+}
+
+// parseStat returns the state and parent pid of a /proc/<pid>/stat content,
+// eg: "1234 (haproxy) Z 1 ...". The command name may contain spaces and
+// parentheses so the fields are read after the last one.
+func parseStat(data []byte) (string, int, error) {
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return "", 0, fmt.Errorf("no command name in %q", data)
+	}
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 2 {
+		return "", 0, fmt.Errorf("missing fields in %q", data)
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return "", 0, fmt.Errorf("bad parent pid in %q: %w", data, err)
+	}
+	return string(fields[0]), ppid, nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStat(t *testing.T) {
+	state, ppid, err := parseStat([]byte("1234 (haproxy) Z 1 1234 1234 0 -1 4194560"))
+	require.NoError(t, err)
+	require.Equal(t, "Z", state)
+	require.Equal(t, 1, ppid)
+
+	state, ppid, err = parseStat([]byte("42 (my (odd) cmd) S 7 42 42 0 -1"))
+	require.NoError(t, err)
+	require.Equal(t, "S", state)
+	require.Equal(t, 7, ppid)
+
+	_, _, err = parseStat([]byte("42 haproxy S 7"))
+	require.Error(t, err)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package lib
+
+import (
+	"time"
+)
+
+// IsInit tells if the process runs as PID 1, windows has no init process
+// inheriting the orphans
+func IsInit() bool {
+	return false
+}
+
+// Reap returns once stop is closed, the orphaned processes are not
+// reparented on windows
+func Reap(stop <-chan struct{}) {
+	<-stop
+}
+
+// KillChildren is a no-op on windows, the children are not listed
+func KillChildren(grace time.Duration) {}
@@ -16,6 +16,9 @@ type Shutdown struct {
 	sync.WaitGroup
 	Stop    chan struct{}
 	stopped uint32
+
+	errLock sync.Mutex
+	err     error
 }
 
 // NewShutdown build a new Shutdown struct
@@ -50,3 +53,22 @@ func (h *Shutdown) Shutdown(reason string) {
 	log.Infof("Shutting down because %s...", reason)
 	close(h.Stop)
 }
+
+// ShutdownWithError asks all processes to shutdown because of an error, the
+// first error is kept to choose the process exit code
+func (h *Shutdown) ShutdownWithError(err error) {
+	h.errLock.Lock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.errLock.Unlock()
+
+	h.Shutdown(err.Error())
+}
+
+// Err returns the error that caused the shutdown, if any
+func (h *Shutdown) Err() error {
+	h.errLock.Lock()
+	defer h.errLock.Unlock()
+	return h.err
+}
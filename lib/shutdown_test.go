@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -29,3 +31,19 @@ func Test_Shutdown(t *testing.T) {
 	require.GreaterOrEqual(t, time.Since(start).Milliseconds(), expectedDuration.Milliseconds())
 
 }
+
+func Test_ShutdownWithError(t *testing.T) {
+	sd := NewShutdown()
+	require.Nil(t, sd.Err())
+
+	first := NewExitError(ExitHAProxySpawn, errors.New("spawn"))
+	sd.ShutdownWithError(first)
+	sd.ShutdownWithError(errors.New("second"))
+	<-sd.Stop
+
+	require.Equal(t, first, sd.Err())
+	require.Equal(t, ExitHAProxySpawn, ExitCodeOf(sd.Err()))
+	require.Equal(t, ExitHAProxySpawn, ExitCodeOf(fmt.Errorf("wrapped: %w", sd.Err())))
+	require.Equal(t, ExitUnknown, ExitCodeOf(errors.New("untagged")))
+	require.Equal(t, "haproxy_spawn_failure", ExitHAProxySpawn.String())
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/haproxy_cmd"
 	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/tproxy"
+	"github.com/haproxytech/haproxy-consul-connect/tracing"
 	"github.com/haproxytech/haproxy-consul-connect/utils"
 
 	"github.com/hashicorp/consul/api"
@@ -19,6 +30,16 @@ import (
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 )
 
+// renderOnlyTimeout is how long the render and validate subcommands wait
+// for the configuration from Consul
+const renderOnlyTimeout = 30 * time.Second
+
+// childrenKillGrace is how long the processes left on shutdown have to exit
+// before being killed when running as PID 1
+const childrenKillGrace = 10 * time.Second
+
+var errNoService = lib.NewExitError(lib.ExitConfig, errors.New("Please specify -sidecar-for, -sidecar-for-tag, or provide -envoy-bootstrap with valid service information"))
+
 // Version is set by Travis build
 var Version string = "v0.1.9-Dev"
 
@@ -51,8 +72,8 @@ func (consulLogger) Errorf(format string, args ...interface{}) {
 }
 
 // validateRequirements Checks that dependencies are present
-func validateRequirements(haproxyBin string) error {
-	err := haproxy_cmd.CheckEnvironment(haproxyBin)
+func validateRequirements(haproxyBin string, opts haproxy_cmd.CheckOptions) error {
+	err := haproxy_cmd.CheckEnvironment(haproxyBin, opts)
 	if err != nil {
 		msg := fmt.Sprintf("Some external dependencies are missing: %s", err.Error())
 		os.Stderr.WriteString(fmt.Sprintf("%s\n", msg))
@@ -61,39 +82,415 @@ func validateRequirements(haproxyBin string) error {
 	return nil
 }
 
+// transparentProxyConfig builds the iptables redirection of -transparent-proxy
+func transparentProxyConfig(port, uid int, excludeCIDRs, excludePorts []string, iptablesBin string) (tproxy.Config, error) {
+	c := tproxy.Config{
+		OutboundPort: port,
+		ProxyUID:     uid,
+		ExcludeCIDRs: excludeCIDRs,
+		IPTablesBin:  iptablesBin,
+	}
+	if port <= 0 || port > 65535 {
+		return c, fmt.Errorf("bad -transparent-proxy-outbound-port %d", port)
+	}
+	if c.ProxyUID < 0 {
+		c.ProxyUID = os.Getuid()
+	}
+	for _, cidr := range excludeCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return c, fmt.Errorf("bad -transparent-proxy-exclude-cidr: %w", err)
+		}
+	}
+	for _, p := range excludePorts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return c, fmt.Errorf("bad -transparent-proxy-exclude-port %s", p)
+		}
+		c.ExcludePorts = append(c.ExcludePorts, n)
+	}
+	return c, nil
+}
+
+// validateAgentless checks the flags used with -agentless, the features
+// registering services need a local agent
+func validateAgentless(nodeName, serviceTag, registerProxy string, statsRegister, exportMeta bool) error {
+	switch {
+	case nodeName == "":
+		return errors.New("-agentless requires -node-name")
+	case registerProxy != "":
+		return errors.New("-register-proxy is not supported with -agentless")
+	case serviceTag != "":
+		return errors.New("-sidecar-for-tag is not supported with -agentless, use -sidecar-for")
+	case statsRegister:
+		return errors.New("-stats-service-register is not supported with -agentless")
+	case exportMeta:
+		return errors.New("-stats-export-meta is not supported with -agentless")
+	}
+	return nil
+}
+
+// validateInsecureDevMode checks the flags used with -insecure-dev-mode, the
+// clients cannot be verified without the leaf certificate
+func validateInsecureDevMode(intentions, logIdentity, verifyDownstream bool, trustDomain string, statsTLSConnect bool) error {
+	switch {
+	case intentions:
+		return errors.New("-enable-intentions is not supported with -insecure-dev-mode")
+	case logIdentity:
+		return errors.New("-log-identity is not supported with -insecure-dev-mode")
+	case verifyDownstream || trustDomain != "":
+		return errors.New("-verify-downstream and -trust-domain are not supported with -insecure-dev-mode")
+	case statsTLSConnect:
+		return errors.New("-stats-tls-connect is not supported with -insecure-dev-mode")
+	}
+	return nil
+}
+
+// applyBootstrapDefaults sets the agent address, namespace and partition of
+// an Envoy bootstrap file to the flags not set explicitly
+func applyBootstrapDefaults(cfg *utils.EnvoyBootstrapConfig, consulAddr, namespace, partition *string) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	agent := cfg.Agent()
+	if agent != (utils.EnvoyAgent{}) {
+		log.Infof("Envoy bootstrap: consul agent grpc address %s", agent)
+	}
+	if addr := agent.HTTPAddr(); addr != "" && !set["http-addr"] {
+		*consulAddr = addr
+		log.Infof("Using consul agent address from Envoy bootstrap: %s", addr)
+	}
+	if ns := cfg.Namespace(); ns != "" && !set["namespace"] {
+		*namespace = ns
+		log.Infof("Using namespace from Envoy bootstrap: %s", ns)
+	}
+	if ap := cfg.Partition(); ap != "" && !set["partition"] {
+		*partition = ap
+		log.Infof("Using partition from Envoy bootstrap: %s", ap)
+	}
+}
+
+// validateJWT checks the flags of the JWT validation
+func validateJWT(jwksURL, dataplaneBin string) error {
+	if jwksURL == "" {
+		return nil
+	}
+	u, err := url.Parse(jwksURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-jwt-jwks-url must be an http or https URL, got %q", jwksURL)
+	}
+	// the requests would not be checked at all
+	if dataplaneBin != "" {
+		return errors.New("-jwt-jwks-url is not supported with -dataplane")
+	}
+	return nil
+}
+
+// readLuaScripts reads the -lua-script files, by file name
+func readLuaScripts(paths []string, dataplaneBin string) (map[string]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	if dataplaneBin != "" {
+		return nil, errors.New("-lua-script is not supported with -dataplane")
+	}
+	scripts := map[string]string{}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if filepath.Ext(name) != ".lua" {
+			return nil, fmt.Errorf("-lua-script must be a .lua file, got %s", p)
+		}
+		if _, ok := scripts[name]; ok {
+			return nil, fmt.Errorf("-lua-script %s is given twice", name)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		scripts[name] = string(b)
+	}
+	return scripts, nil
+}
+
+// haproxyPrivileges checks the user, group and chroot the HAProxy workers
+// run with, the group defaults to the primary group of the user. It returns
+// the uid of the user, -1 when not set, and the group.
+func haproxyPrivileges(userName, groupName, chroot string) (int, string, error) {
+	uid := -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return uid, "", fmt.Errorf("-haproxy-user: %w", err)
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return -1, "", fmt.Errorf("-haproxy-user %s: bad uid %s", userName, u.Uid)
+		}
+		if groupName == "" {
+			g, err := user.LookupGroupId(u.Gid)
+			if err != nil {
+				return -1, "", fmt.Errorf("-haproxy-user %s: %w", userName, err)
+			}
+			groupName = g.Name
+		}
+	}
+	if groupName != "" {
+		if _, err := user.LookupGroup(groupName); err != nil {
+			return -1, "", fmt.Errorf("-haproxy-group: %w", err)
+		}
+	}
+	if chroot != "" {
+		st, err := os.Stat(chroot)
+		if err != nil || !st.IsDir() || !filepath.IsAbs(chroot) {
+			return -1, "", fmt.Errorf("-haproxy-chroot must be an absolute path to a directory, got %s", chroot)
+		}
+	}
+	return uid, groupName, nil
+}
+
+// splitServices returns the service ids of -sidecar-for
+func splitServices(values []string) []string {
+	ids := []string{}
+	for _, v := range values {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// validateMultiService checks the flags of a proxy of several services
+func validateMultiService(ids []string, serviceTag, registerProxy string) error {
+	if len(ids) < 2 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("-sidecar-for %s is given twice", id)
+		}
+		seen[id] = true
+	}
+	switch {
+	case serviceTag != "":
+		return errors.New("-sidecar-for-tag is not supported with several -sidecar-for")
+	case registerProxy != "":
+		return errors.New("-register-proxy is not supported with several -sidecar-for")
+	}
+	return nil
+}
+
+// runMode tells if the config is only rendered or validated, -render-only
+// is the deprecated form of the render subcommand
+func runMode(subcommand string, renderOnly bool) (bool, bool) {
+	return renderOnly || subcommand == "render", subcommand == "validate"
+}
+
+// renderStopped returns the error the render and validate subcommands exit
+// with when stopped before a config was received, which is a failure even
+// without a recorded error, eg: on SIGTERM
+func renderStopped(err error) error {
+	if err != nil {
+		return err
+	}
+	return errors.New("stopped before a configuration was received from consul")
+}
+
 func main() {
+	os.Exit(execute(os.Args[1:]))
+}
+
+// runProxy implements the run, render and validate subcommands, it exits
+// on the errors
+func runProxy(subcommand string, args []string) {
 	haproxyParamsFlag := utils.StringSliceFlag{}
+	tproxyExcludeCIDRs := utils.StringSliceFlag{}
+	tproxyExcludePorts := utils.StringSliceFlag{}
+	services := utils.StringSliceFlag{}
+	jwtAudiences := utils.StringSliceFlag{}
+	jwtClaims := utils.StringSliceFlag{}
+	luaScriptFiles := utils.StringSliceFlag{}
 
 	flag.Var(&haproxyParamsFlag, "haproxy-param", "Global or defaults Haproxy config parameter to set in config. Can be specified multiple times. Must be of the form `defaults.name=value` or `global.name=value`")
 	versionFlag := flag.Bool("version", false, "Show version and exit")
 	logLevel := flag.String("log-level", "INFO", "Log level")
-	consulAddr := flag.String("http-addr", "127.0.0.1:8500", "Consul agent address")
-	service := flag.String("sidecar-for", "", "The consul service id to proxy")
+	consulAddr := flag.String("http-addr", "127.0.0.1:8500", "Consul agent address: host:port, https://host:port or the path of its unix socket, eg: unix:///run/consul/consul.sock")
+	consulTLS := addConsulTLSFlags(flag.CommandLine)
+	agentless := flag.Bool("agentless", false, "Talk to the Consul servers at -http-addr instead of a local client agent, the proxy is looked up in the catalog of -node-name")
+	nodeName := flag.String("node-name", "", "Consul node the proxy service is registered on, required with -agentless")
+	registerProxy := flag.String("register-proxy", "", "Path of a JSON file with the sidecar proxy registration (port, upstreams...) in the Consul agent API format. The proxy is registered at startup and deregistered on shutdown")
+	registerProxyChecks := flag.Bool("register-proxy-checks", false, "Add to the -register-proxy registration a TCP check of the public listener, an alias check of the service and a TTL check kept passing while HAProxy runs")
+	flag.Var(&services, "sidecar-for", "The consul service id to proxy. Can be specified multiple times, or as a comma separated list, to proxy several services with the same HAProxy")
 	serviceTag := flag.String("sidecar-for-tag", "", "The consul service id to proxy")
 	haproxyBin := flag.String("haproxy", haproxy_cmd.DefaultHAProxyBin, "Haproxy binary path")
+	haproxyTemplate := flag.String("haproxy-template", "", "Path of a Go template replacing the embedded HAProxy config template, see renderer.RenderContext for the data it is executed with")
+	haproxyCheckCmd := flag.String("haproxy-check-cmd", "", "Command used to run haproxy when checking its version, defaults to the haproxy binary. Allows checking a wrapped or containerized haproxy, eg: `docker exec lb haproxy`")
+	haproxyCheckPath := flag.String("haproxy-check-path", "", "PATH used to find the haproxy check command, defaults to the current PATH")
+	dataplaneBin := flag.String("dataplane", "", "Data Plane API binary path (eg: dataplaneapi). When set, changes are applied to HAProxy through API transactions instead of rendering the config and reloading")
+	haproxyCrash := flag.String("haproxy-crash", "exit", "What to do when HAProxy exits unexpectedly: exit, or restart it with the last valid config and an exponential backoff. restart is not supported with -dataplane")
 	haproxyCfgBasePath := flag.String("haproxy-cfg-base-path", "/tmp", "Haproxy binary path")
+	noCertFiles := flag.Bool("no-cert-files", false, "Keep the certificates and their private keys in memory files HAProxy reads through /proc instead of writing them to disk. Linux only")
+	secretsDir := flag.String("secrets-dir", "", "Directory the certificates and their private keys are written to instead of -haproxy-cfg-base-path, eg: a tmpfs mount like /dev/shm. The config cached by -bootstrap-from-cache is kept there too")
+	reloadDeferRate := flag.Int64("reload-defer-rate", 0, "Request rate (req/s) above which the reloads only changing server weights are deferred to a quieter period. 0 disables it")
+	reloadDeferMax := flag.Duration("reload-defer-max", haproxy.DefaultReloadDeferMax, "How long a reload is deferred at most with -reload-defer-rate")
+	maxReloads := flag.Int("haproxy-max-reloads", 0, "Number of reloads after which an old HAProxy worker still serving long lived connections is stopped (mworker-max-reloads). 0 leaves them running")
+	haproxyUser := flag.String("haproxy-user", "", "User the HAProxy workers run as once started, eg: haproxy. Requires running as root")
+	haproxyGroup := flag.String("haproxy-group", "", "Group the HAProxy workers run as once started, defaults to the primary group of -haproxy-user. The config dir and sockets are shared with it")
+	haproxyChroot := flag.String("haproxy-chroot", "", "Directory the HAProxy workers are chrooted to once started, it must contain -haproxy-cfg-base-path. Requires running as root")
+	hardStopAfter := flag.Duration("haproxy-hard-stop-after", 0, "How long an old HAProxy worker can keep its connections after a reload before it is stopped (hard-stop-after). 0 leaves them running")
+	reloadMinInterval := flag.Duration("reload-min-interval", 0, "Minimum interval between two HAProxy reloads, the changes received meanwhile are applied together. Certificate changes are applied right away. 0 disables it")
+	reloadWarnRate := flag.Int("reload-warn-rate", 10, "Number of reloads in a minute above which a warning is logged. 0 disables it")
+	deriveMaxConn := flag.Bool("derive-maxconn", false, "Split the global maxconn between the listeners, and the share of each upstream between its instances, so that a single upstream cannot use all the connections. The maxconn and listener_maxconn upstream config keys take precedence")
+	configHistory := flag.Int("config-history", 0, "Number of applied HAProxy configs to keep, the changes between configs are logged at debug level. The configs hold the paths of the certificates. 0 disables the history")
+	bootstrapFromCache := flag.Bool("bootstrap-from-cache", false, "Keep the last applied config in the config base path and apply it at startup, before the Consul watches are ready")
+	configHistoryDir := flag.String("config-history-dir", "", "Directory to keep the applied HAProxy configs in, defaults to a history directory in the config base path")
+	renderOnly := flag.Bool("render-only", false, "Print the HAProxy config generated from the current Consul state and exit")
+	explain := flag.Bool("explain", false, "Annotate the rendered HAProxy config with comments telling the Consul data and config keys each frontend, backend and server comes from")
 	statsListenAddr := flag.String("stats-addr", "", "Listen addr for stats server")
+	statsBasicAuth := flag.String("stats-basic-auth", "", "user:password required to read the metrics of the stats server, the probes stay open. Prefer setting it from the environment")
+	statsToken := flag.String("stats-token", "", "Bearer token accepted to read the metrics of the stats server, the probes stay open")
+	statsTLSCert := flag.String("stats-tls-cert", "", "Certificate file serving the stats server over TLS, with -stats-tls-key")
+	statsTLSKey := flag.String("stats-tls-key", "", "Private key file of -stats-tls-cert")
+	statsTLSConnect := flag.Bool("stats-tls-connect", false, "Serve the stats server over TLS with the Connect leaf certificate of the service, renewed with it")
+	statsPagePort := flag.Int("haproxy-stats-port", 0, "Serve the HAProxy stats page on this localhost port, and on /haproxy/ of the stats server with its credentials. 0 disables it")
 	statsServiceRegister := flag.Bool("stats-service-register", false, "Register a consul service for connect stats")
+	statsExportMeta := flag.Bool("stats-export-meta", false, "Periodically export load stats (current sessions, request rate) to the local service instance meta")
+	metricsBackend := flag.String("metrics-backend", metrics.BackendPrometheus, "Metrics backend: prometheus (served on the stats server /metrics), statsd or otlp")
+	statsdAddr := flag.String("statsd-addr", "127.0.0.1:8125", "StatsD address the metrics are sent to with -metrics-backend statsd")
+	otlpEndpoint := flag.String("otlp-endpoint", "http://127.0.0.1:4318/v1/metrics", "OTLP/HTTP endpoint the metrics are pushed to with -metrics-backend otlp")
+	otlpInterval := flag.Duration("otlp-interval", metrics.DefaultOTLPInterval, "Interval between two pushes of the metrics with -metrics-backend otlp")
+	otlpTracesEndpoint := flag.String("otlp-traces-endpoint", "", "OTLP/HTTP endpoint the traces of the handling of the Consul changes are pushed to, eg: http://127.0.0.1:4318/v1/traces. Tracing is disabled when empty")
+	adminToken := flag.String("admin-token", "", "Token required to use the admin endpoints of the stats server. Admin endpoints are disabled when empty")
 	enableIntentions := flag.Bool("enable-intentions", false, "Enable Connect intentions")
+	intentionsAuditLog := flag.Bool("intentions-audit-log", false, "Log each allow or deny decision of the intentions with the client identity, source and destination services, the matched intention and the duration of the check")
+	intentionsAuditMetrics := flag.Bool("intentions-audit-metrics", false, "Count the decisions of the intentions per source and destination service in connect_intention_decisions_total")
+	intentionsFailMode := flag.String("intentions-fail-mode", "closed", "What happens to the clients when the intentions cannot be checked, eg: Consul is unreachable or the SPOE agent times out: closed rejects them, open accepts them")
+	logUpstreamMeta := flag.Bool("log-upstream-metadata", false, "Log the requests to the upstreams with the Consul node, datacenter and service meta of the instance they were sent to")
+	compression := flag.Bool("compression", true, "Compress the HTTP responses of the listeners, the compression key of a proxy or upstream config takes precedence")
+	compressionAlgos := flag.String("compression-algos", "gzip", "Space or comma separated compression algorithms offered to the clients, by preference: gzip, deflate, raw-deflate or identity")
+	compressionTypes := flag.String("compression-types", "text/html text/plain text/css application/javascript application/json", "Space or comma separated MIME types of the compressed responses, all when empty")
+	compressionMinSize := flag.Int("compression-min-size", 0, "Size in bytes below which a response is not compressed, requires HAProxy 3.2+. 0 disables it")
+	tlsSessionCacheSize := flag.Int("tls-session-cache-size", 0, "Number of TLS sessions HAProxy keeps for resumption (tune.ssl.cachesize). 0 keeps the HAProxy default")
+	tlsSessionLifetime := flag.Duration("tls-session-lifetime", 0, "How long a cached TLS session can be resumed (tune.ssl.lifetime). 0 keeps the HAProxy default")
+	tlsTickets := flag.Bool("tls-tickets", true, "Resume the TLS sessions of the public listeners with session tickets. Disabling them improves forward secrecy, the clients resume from the session cache")
+	tlsTicketKeysFile := flag.String("tls-ticket-keys-file", "", "File of the base64 encoded keys of the TLS session tickets of the public listeners (tls-ticket-keys), shared by the reloads and the instances. HAProxy generates new keys at each reload when empty")
+	verifyDownstream := flag.Bool("verify-downstream", false, "Require the clients of the public listener to present a certificate signed by the Connect CA, at the TLS layer, even without -enable-intentions")
+	trustDomain := flag.String("trust-domain", "", "Reject the clients of the public listener whose SPIFFE identity is not in this trust domain, eg: 11111111-2222-3333-4444-555555555555.consul. Implies -verify-downstream")
+	insecureDevMode := flag.Bool("insecure-dev-mode", false, "Serve the upstream listeners without waiting for the Connect CA and leaf certificate, in plain TCP until they are delivered. The public listener waits for the leaf certificate. For local testing only, not compatible with the features verifying the clients")
+	logIdentity := flag.Bool("log-identity", false, "Record the identity of the clients connecting to the public listener in the access logs, without enforcing intentions")
+	spoeListeners := flag.Int("spoe-listeners", 1, "Number of sockets the SPOE agent checking the intentions listens on. HAProxy health checks them and sends the frames of a stalled one to another")
 	token := flag.String("token", "", "Consul ACL token")
-	envoyBootstrapPath := flag.String("envoy-bootstrap", "", "Path to Envoy bootstrap file (optional, for extracting Consul token)")
-	flag.Parse()
+	namespace := flag.String("namespace", "", "Consul Enterprise namespace of the proxied service, used for all the Consul queries. Upstreams without a destination namespace are looked up in it")
+	partition := flag.String("partition", "", "Consul Enterprise admin partition of the proxied service, used for all the Consul queries. Upstreams without a destination partition are looked up in it")
+	tokenFile := flag.String("token-file", "", "File containing the Consul ACL token, read again every -token-refresh and when Consul denies a query to pick up rotated tokens, eg: renewed by Vault agent or consul-template")
+	tokenRefreshFlag := flag.Duration("token-refresh", 10*time.Second, "Interval between two reads of -token-file and -envoy-bootstrap to pick up a rotated token. 0 reads them again only when Consul denies a query")
+	nomadAllocID := flag.String("nomad-alloc-id", os.Getenv("NOMAD_ALLOC_ID"), "Nomad allocation of the proxied service, only its sidecar proxy is used when several allocations of the job run on the agent. Defaults to NOMAD_ALLOC_ID")
+	nomadGroup := flag.String("nomad-group", os.Getenv("NOMAD_GROUP_NAME"), "Nomad task group of the proxied service within -nomad-alloc-id. Defaults to NOMAD_GROUP_NAME")
+	envoyBootstrapPath := flag.String("envoy-bootstrap", "", "Path to Envoy bootstrap file (optional), the Consul token, sidecar proxy, namespace, partition and agent address not set by flags are taken from it")
+	caRootOverlap := flag.Duration("ca-root-overlap", consul.DefaultCARootOverlap, "How long a CA root removed by Consul is still trusted during a CA rotation")
+	consulCache := flag.Bool("consul-cache", true, "Read the leaf certificate and the CA roots from the agent cache, refreshed in the background")
+	consulCacheMaxAge := flag.Duration("consul-cache-max-age", 0, "How old the cached leaf certificate and CA roots can be before the agent fetches them from the servers, 0 leaves it to the background refresh")
+	consulMaxQueries := flag.Int("consul-max-queries", 0, "Maximum number of concurrent blocking queries to Consul, the watches above wait for a slot and the queries block for 1m instead of 10m so that the slots rotate. 0 leaves it unlimited")
+	consulReconnectAfter := flag.Duration("consul-reconnect-after", 0, "How long Consul is unreachable before a new client is created and the watches restart from scratch, eg: after a restart of the agent or a change of the address of its name. 0 disables it")
+	consulCacheStaleIfError := flag.Duration("consul-cache-stale-if-error", 0, "How old the cached leaf certificate and CA roots can be when the servers cannot be reached, 0 keeps the agent default")
+	transparentProxy := flag.Bool("transparent-proxy", false, "Redirect the outbound TCP connections with iptables to a catch-all listener sending them to the upstream owning their destination, a virtual IP of the service or the address of an instance. Requires the NET_ADMIN capability and the applications to run as another user than HAProxy")
+	tproxyOutboundPort := flag.Int("transparent-proxy-outbound-port", tproxy.DefaultOutboundPort, "Port of the catch-all listener of -transparent-proxy")
+	tproxyUID := flag.Int("transparent-proxy-uid", -1, "User HAProxy runs as, its connections are not redirected by -transparent-proxy. Defaults to -haproxy-user or the current user")
+	flag.Var(&tproxyExcludeCIDRs, "transparent-proxy-exclude-cidr", "Destination CIDR reached without the proxy with -transparent-proxy. Can be specified multiple times")
+	flag.Var(&tproxyExcludePorts, "transparent-proxy-exclude-port", "Destination port reached without the proxy with -transparent-proxy. Can be specified multiple times")
+	jwtJWKSURL := flag.String("jwt-jwks-url", "", "URL of the JWKS the JWT of the requests of the public listener are verified with, the requests without a valid bearer token are denied. Requires the http protocol. Disabled when empty")
+	jwtIssuer := flag.String("jwt-issuer", "", "Issuer the iss claim of the JWT must match with -jwt-jwks-url")
+	flag.Var(&jwtAudiences, "jwt-audience", "Audience the aud claim of the JWT must contain with -jwt-jwks-url, one of them when specified multiple times")
+	flag.Var(&jwtClaims, "jwt-claim", "Claim of the JWT set as the txn.jwt.claim_<name> HAProxy variable with -jwt-jwks-url. Can be specified multiple times")
+	flag.Var(&luaScriptFiles, "lua-script", "Lua script loaded by HAProxy, its actions are called with the lua_actions of the proxy and upstream config. Can be specified multiple times")
+	luaFromConfig := flag.Bool("lua-from-config", false, "Load the lua_scripts of the proxy config too, the scripts run in HAProxy so anyone able to register the service can run code in the proxy")
+	iptablesBin := flag.String("iptables", tproxy.DefaultIPTablesBin, "iptables binary programming the -transparent-proxy redirection, eg: iptables-nft for nftables")
+	upstreamHookExec := flag.String("upstream-hook-exec", "", "Command to run when an upstream loses all its healthy instances or recovers, the event is passed as JSON on stdin")
+	upstreamHookURL := flag.String("upstream-hook-url", "", "URL to POST a JSON event to when an upstream loses all its healthy instances or recovers")
+	auditKVPrefix := flag.String("audit-kv-prefix", "", "Consul KV prefix the last applied HAProxy config of the instance is recorded under, as <prefix>/<service id>, to audit the reloads of a fleet. Requires the key:write ACL")
+	auditEvent := flag.String("audit-event", "", "Name of the Consul event fired for each applied HAProxy config, to audit the reloads of a fleet. Requires the event:write ACL")
+
+	flags := utils.NewFlags(flag.CommandLine, utils.FlagEnvPrefix)
+	flags.NoEnv("version")
+	flags.Deprecate("render-only", "use the render subcommand instead")
+	flagWarnings, err := flags.Parse(args)
+	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
 	if versionFlag != nil && *versionFlag {
-		fmt.Printf("Version: %s ; BuildTime: %s ; GitHash: %s\n", Version, BuildTime, GitHash)
-		os.Exit(0)
+		os.Exit(runVersion(nil))
+	}
+	var validate bool
+	*renderOnly, validate = runMode(subcommand, *renderOnly)
+	// rendering the config only does not run haproxy
+	if !*renderOnly {
+		if err := validateRequirements(*haproxyBin, haproxy_cmd.CheckOptions{
+			Argv: strings.Fields(*haproxyCheckCmd),
+			Path: *haproxyCheckPath,
+		}); err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitDependencies, fmt.Errorf("HAProxy dependencies are not satisfied: %w", err)))
+		}
+		if *dataplaneBin != "" {
+			if _, err := exec.LookPath(*dataplaneBin); err != nil {
+				lib.Exit(lib.NewExitError(lib.ExitDependencies, fmt.Errorf("Data Plane API binary not found: %w", err)))
+			}
+		}
+	}
+
+	switch {
+	case *haproxyCrash != "exit" && *haproxyCrash != "restart":
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-haproxy-crash must be exit or restart, got %s", *haproxyCrash)))
+	// the Data Plane API signals the pid of the first master process
+	case *haproxyCrash == "restart" && *dataplaneBin != "":
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-haproxy-crash restart is not supported with -dataplane")))
+	// the Data Plane API reloads HAProxy with kill -SIGUSR2
+	case runtime.GOOS == "windows" && *dataplaneBin != "":
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-dataplane is not supported on windows")))
+	case runtime.GOOS == "windows" && *transparentProxy:
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-transparent-proxy is not supported on windows")))
+	case *noCertFiles && runtime.GOOS != "linux":
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-no-cert-files is not supported on %s", runtime.GOOS)))
+	case *noCertFiles && *dataplaneBin != "":
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-no-cert-files is not supported with -dataplane")))
+	// the cached config holds the private key of the leaf certificate
+	case *noCertFiles && *bootstrapFromCache:
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-no-cert-files cannot be used with -bootstrap-from-cache, which writes the private key to disk")))
 	}
-	if err := validateRequirements(*haproxyBin); err != nil {
-		fmt.Printf("ERROR: HAProxy dependencies are not satisfied: %s\n", err)
-		os.Exit(4)
+
+	serviceIDs := splitServices(services)
+	if err := validateMultiService(serviceIDs, *serviceTag, *registerProxy); err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+
+	if *agentless {
+		if err := validateAgentless(*nodeName, *serviceTag, *registerProxy, *statsServiceRegister, *statsExportMeta); err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+		}
+	} else {
+		*nodeName = ""
 	}
 
 	ll, err := log.ParseLevel(*logLevel)
 	if err != nil {
-		log.Fatal(err)
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
 	}
 	log.SetLevel(ll)
+	for _, w := range flagWarnings {
+		log.Warn(w)
+	}
 
 	sd := lib.NewShutdown()
+	artifacts := lib.NewArtifacts()
+
+	// as the entrypoint of a container, the HAProxy workers left by a
+	// crashed master process are reparented to this process
+	if lib.IsInit() {
+		log.Info("running as PID 1, reaping orphaned processes")
+		go lib.Reap(sd.Stop)
+	}
 
 	// Auto-detect Nomad secrets directory if envoy-bootstrap not explicitly set
 	if *envoyBootstrapPath == "" {
@@ -114,41 +511,59 @@ func main() {
 			log.Warnf("Failed to parse envoy bootstrap file: %s", err)
 		} else if bootstrapConfig != nil {
 			log.Info("Successfully parsed Envoy bootstrap configuration")
+			applyBootstrapDefaults(bootstrapConfig, consulAddr, namespace, partition)
 		}
 	}
 
-	consulConfig := &api.Config{
-		Address: *consulAddr,
+	if err := validateConsulAddr(*consulAddr); err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
 	}
-
-	// Token priority (lowest to highest):
-	// 1. Envoy bootstrap file
-	// 2. Environment variable
-	// 3. Command line flag
-	if bootstrapConfig != nil {
-		if bootstrapToken := bootstrapConfig.ExtractConsulToken(); bootstrapToken != "" {
-			consulConfig.Token = bootstrapToken
-			log.Info("Setting token from Envoy bootstrap file")
-		}
+	if err := validateConsulTLS(consulTLS); err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
 	}
-	env_token, env_token_exists := os.LookupEnv("CONNECT_CONSUL_TOKEN")
-	if env_token_exists {
-		consulConfig.Token = env_token
-		log.Info("Setting token from env variable CONNECT_CONSUL_TOKEN")
+	consulConfig := newConsulConfig(*consulAddr, consulTLS)
+	consulConfig.Namespace = *namespace
+	consulConfig.Partition = *partition
+
+	// the token of the command line and the environment cannot change
+	tokenRefresh := *tokenRefreshFlag
+	if *tokenFile == "" && *envoyBootstrapPath == "" {
+		tokenRefresh = 0
 	}
-	if *token != "" {
-		consulConfig.Token = *token
-		log.Info("Setting token from command line")
+	consulToken, tokenSource, err := resolveToken(*envoyBootstrapPath, *tokenFile, *token)
+	if err != nil {
+		log.Warnf("Failed to resolve consul token: %s", err)
+	} else if tokenSource != "" {
+		consulConfig.Token = consulToken
+		log.Infof("Setting token from %s", tokenSource)
 	}
 	consulClient, err := api.NewClient(consulConfig)
 	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
 	}
+	// the requests outside the watcher follow the rotations of the token
+	// too, eg: the registrations
+	currentToken := &rotatingToken{token: consulConfig.Token}
+	consul.SetClientToken(consulConfig, currentToken.Get)
 
-	var serviceID string
+	agentInfo, err := consul.CheckAgent(consulClient)
+	switch {
+	case lib.ExitCodeOf(err) == lib.ExitACLDenied:
+		log.Warnf("cannot check the consul agent, the token needs agent:read: %s", err)
+	case err != nil:
+		lib.Exit(err)
+	default:
+		log.Infof("consul agent %s in datacenter %s, grpc port: %d", agentInfo.Version, agentInfo.Datacenter, agentInfo.GRPCPort)
+		if err := agentInfo.CheckTenancy(*namespace, *partition); err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+		}
+	}
+
+	var serviceID, bootstrapProxyID string
 	if *serviceTag != "" {
 		svcs, err := consulClient.Agent().Services()
 		if err != nil {
-			log.Fatal(err)
+			lib.Exit(consul.ExitError(err))
 		}
 	OUTER:
 		for _, s := range svcs {
@@ -163,53 +578,335 @@ func main() {
 			}
 		}
 		if serviceID == "" {
-			log.Fatalf("No sidecar proxy found for service with tag %s", *serviceTag)
+			lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("No sidecar proxy found for service with tag %s", *serviceTag)))
 		}
-	} else if *service != "" {
-		serviceID = *service
+	} else if len(serviceIDs) > 0 {
+		serviceID = serviceIDs[0]
 	} else if bootstrapConfig != nil {
 		// Try to extract service name from Envoy bootstrap
 		if extractedService := bootstrapConfig.ExtractServiceName(); extractedService != "" {
 			serviceID = extractedService
-			log.Infof("Using service name from Envoy bootstrap: %s", serviceID)
+			bootstrapProxyID = bootstrapConfig.ProxyID()
+			log.Infof("Using service name from Envoy bootstrap: %s, sidecar proxy %s", serviceID, bootstrapProxyID)
 		} else {
-			log.Fatalf("Please specify -sidecar-for, -sidecar-for-tag, or provide -envoy-bootstrap with valid service information")
+			lib.Exit(errNoService)
 		}
 	} else {
-		log.Fatalf("Please specify -sidecar-for, -sidecar-for-tag, or provide -envoy-bootstrap with valid service information")
+		lib.Exit(errNoService)
+	}
+
+	if *registerProxyChecks && *registerProxy == "" {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, errors.New("-register-proxy-checks requires -register-proxy")))
+	}
+
+	var ttlCheckID string
+	if *registerProxy != "" {
+		reg, err := consul.LoadProxyRegistration(*registerProxy, serviceID)
+		if err != nil {
+			lib.Exit(err)
+		}
+		if *registerProxyChecks {
+			ttlCheckID = consul.AddProxyChecks(reg)
+		}
+		deregister, err := consul.RegisterProxy(consulClient, reg)
+		if err != nil {
+			lib.Exit(err)
+		}
+		log.Infof("registered sidecar proxy %s on port %d", reg.ID, reg.Port)
+		artifacts.Add(consul.ServiceArtifact(consulClient, "sidecar proxy", reg.ID))
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			<-sd.Stop
+			if err := deregister(); err != nil {
+				log.Errorf("cannot deregister sidecar proxy %s: %s", reg.ID, err)
+				return
+			}
+			log.Infof("deregistered sidecar proxy %s", reg.ID)
+		}()
 	}
 
 	haproxyParams, err := utils.MakeHAProxyParams(haproxyParamsFlag)
 	if err != nil {
-		log.Fatal(err)
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+	haproxyParams = haproxyParams.WithOldWorkerLimits(*maxReloads, *hardStopAfter)
+	haproxyParams = haproxyParams.WithTLSSessionCache(*tlsSessionCacheSize, *tlsSessionLifetime)
+	haproxyUID, haproxyGroupName, err := haproxyPrivileges(*haproxyUser, *haproxyGroup, *haproxyChroot)
+	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+	haproxyParams = haproxyParams.WithPrivileges(*haproxyUser, haproxyGroupName, *haproxyChroot)
+	if strings.ContainsAny(*trustDomain, "/ \t\r\n") {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-trust-domain must be a domain name, got %q", *trustDomain)))
+	}
+	if *intentionsFailMode != "open" && *intentionsFailMode != "closed" {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-intentions-fail-mode must be open or closed, got %s", *intentionsFailMode)))
+	}
+	if err := validateJWT(*jwtJWKSURL, *dataplaneBin); err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+	luaScripts, err := readLuaScripts(luaScriptFiles, *dataplaneBin)
+	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+	if *spoeListeners < 1 {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-spoe-listeners must be at least 1, got %d", *spoeListeners)))
+	}
+	if (*statsTLSCert == "") != (*statsTLSKey == "") {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-stats-tls-cert and -stats-tls-key must be set together")))
+	}
+	if *statsTLSCert != "" && *statsTLSConnect {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-stats-tls-cert cannot be used with -stats-tls-connect")))
+	}
+	if *insecureDevMode {
+		if err := validateInsecureDevMode(*enableIntentions, *logIdentity, *verifyDownstream, *trustDomain, *statsTLSConnect); err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+		}
+		log.Warn("insecure dev mode: the upstreams are served in plain TCP until the leaf certificate is delivered")
+	}
+	if *statsBasicAuth != "" && !strings.Contains(*statsBasicAuth, ":") {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-stats-basic-auth must be user:password")))
+	}
+	if *tlsTicketKeysFile != "" && !*tlsTickets {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-tls-ticket-keys-file cannot be used with -tls-tickets=false")))
+	}
+
+	m, err := metrics.New(metrics.Config{
+		Backend:      *metricsBackend,
+		StatsDAddr:   *statsdAddr,
+		OTLPEndpoint: *otlpEndpoint,
+		OTLPInterval: *otlpInterval,
+		ServiceName:  serviceID,
+	})
+	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+	}
+	if r, ok := m.(metrics.Runner); ok && !*renderOnly && !validate {
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			r.Run(sd.Stop)
+		}()
+	}
+
+	var tracer tracing.Tracer = tracing.Nop{}
+	if *otlpTracesEndpoint != "" && !*renderOnly && !validate {
+		t := tracing.NewOTLP(*otlpTracesEndpoint, tracing.DefaultOTLPInterval, serviceID)
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			t.Run(sd.Stop)
+		}()
+		tracer = t
 	}
 
+	algos, err := consul.ParseCompressionList(*compressionAlgos, true)
+	if err != nil {
+		lib.Exit(lib.NewExitError(lib.ExitConfig, fmt.Errorf("-compression-algos: %w", err)))
+	}
+	types, _ := consul.ParseCompressionList(*compressionTypes, false)
+
 	consulLogger := &consulLogger{}
-	watcher := consul.New(serviceID, consulClient, consulLogger)
+	watcherOpts := consul.Options{
+		CARootOverlap: *caRootOverlap,
+		Metrics:       m,
+		Agent:         agentInfo,
+		NodeName:      *nodeName,
+		Cache: consul.CacheOptions{
+			Enabled:      *consulCache,
+			MaxAge:       *consulCacheMaxAge,
+			StaleIfError: *consulCacheStaleIfError,
+		},
+		MaxQueries:      *consulMaxQueries,
+		InsecureDevMode: *insecureDevMode,
+		Reconnect: func() (consul.ConsulClient, error) {
+			cfg := newConsulConfig(*consulAddr, consulTLS)
+			cfg.Namespace = *namespace
+			cfg.Partition = *partition
+			cfg.Token = currentToken.Get()
+			c, err := api.NewClient(cfg)
+			if err != nil {
+				return nil, err
+			}
+			consul.SetClientToken(cfg, currentToken.Get)
+			return consul.NewClient(c), nil
+		},
+		ReconnectAfter: *consulReconnectAfter,
+		Compression: consul.Compression{
+			Disabled: !*compression,
+			Algos:    algos,
+			Types:    types,
+			MinSize:  *compressionMinSize,
+		},
+		TokenSource: func() (string, error) {
+			t, _, err := resolveToken(*envoyBootstrapPath, *tokenFile, *token)
+			return t, err
+		},
+		TokenRefresh:  tokenRefresh,
+		OnTokenChange: currentToken.Set,
+		ProxyIDPrefix: consul.NomadProxyIDPrefix(*nomadAllocID, *nomadGroup),
+	}
+	// the other services are not in the bootstrap file
+	mainOpts := watcherOpts
+	mainOpts.ProxyID = bootstrapProxyID
+	if *nomadAllocID != "" {
+		log.Infof("nomad allocation %s, index %s, group %s", *nomadAllocID, os.Getenv("NOMAD_ALLOC_INDEX"), *nomadGroup)
+	}
+	// the other services proxied are merged into the config of the first
+	watchers := []*consul.Watcher{consul.NewWithOptions(serviceID, consulClient, consulLogger, mainOpts)}
+	if len(serviceIDs) > 1 {
+		for _, id := range serviceIDs[1:] {
+			watchers = append(watchers, consul.NewWithOptions(id, consulClient, consulLogger, watcherOpts))
+		}
+		log.Infof("proxying services %s", strings.Join(serviceIDs, ", "))
+	}
+	watcher := consul.NewMulti(watchers...)
 	go func() {
 		if err := watcher.Run(); err != nil {
 			log.Error(err)
-			sd.Shutdown(err.Error())
+			sd.ShutdownWithError(err)
 		}
 	}()
+	// the blocking queries return right away on shutdown
+	go func() {
+		<-sd.Stop
+		watcher.Stop()
+	}()
 
-	hap := haproxy.New(consulClient, watcher.C, utils.Options{
+	opts := utils.Options{
 		HAProxyBin:           *haproxyBin,
+		HAProxyTemplate:      *haproxyTemplate,
+		DataplaneBin:         *dataplaneBin,
 		ConfigBaseDir:        *haproxyCfgBasePath,
+		SecretsDir:           *secretsDir,
+		NoCertFiles:          *noCertFiles,
 		EnableIntentions:     *enableIntentions,
+		LogIdentity:          *logIdentity,
+		LogUpstreamMeta:      *logUpstreamMeta,
 		StatsListenAddr:      *statsListenAddr,
 		StatsRegisterService: *statsServiceRegister,
+		StatsExportMeta:      *statsExportMeta,
+		AdminToken:           *adminToken,
+		StatsBasicAuth:       *statsBasicAuth,
+		StatsToken:           *statsToken,
+		StatsTLSCertFile:     *statsTLSCert,
+		StatsTLSKeyFile:      *statsTLSKey,
+		StatsTLSConnect:      *statsTLSConnect,
+		StatsPagePort:        *statsPagePort,
 		LogRequests:          ll == log.TraceLevel,
 		HAProxyParams:        haproxyParams,
-	})
+		ReloadWarnRate:       *reloadWarnRate,
+		ReloadMinInterval:    *reloadMinInterval,
+		DeriveMaxConn:        *deriveMaxConn,
+		UpstreamHookExec:     *upstreamHookExec,
+		UpstreamHookURL:      *upstreamHookURL,
+		AuditKVPrefix:        *auditKVPrefix,
+		AuditEvent:           *auditEvent,
+		ConfigHistory:        *configHistory,
+		ConfigHistoryDir:     *configHistoryDir,
+		Metrics:              m,
+		Tracer:               tracer,
+		UpstreamPinner:       watcher,
+		ReloadDeferRate:      *reloadDeferRate,
+		ReloadDeferMax:       *reloadDeferMax,
+		Explain:              *explain,
+		TTLCheckID:           ttlCheckID,
+		HAProxyRestart:       *haproxyCrash == "restart",
+		Artifacts:            artifacts,
+		TLSTicketKeys:        *tlsTicketKeysFile,
+		NoTLSTickets:         !*tlsTickets,
+		VerifyDownstream:     *verifyDownstream,
+		TrustDomain:          *trustDomain,
+		SPOEListeners:        *spoeListeners,
+		IntentionsFailOpen:   *intentionsFailMode == "open",
+		IntentionsAuditLog:   *intentionsAuditLog,
+		JWTJWKSURL:           *jwtJWKSURL,
+		JWTIssuer:            *jwtIssuer,
+		JWTAudiences:         jwtAudiences,
+		JWTClaims:            jwtClaims,
+		IntentionsMetrics:    *intentionsAuditMetrics,
+		LuaScripts:           luaScripts,
+		LuaFromConfig:        *luaFromConfig,
+		InsecureDevMode:      *insecureDevMode,
+	}
+	if *transparentProxy {
+		opts.TransparentProxyPort = *tproxyOutboundPort
+	}
+	if *bootstrapFromCache {
+		// the cached config holds the private key of the leaf certificate
+		cacheDir := *haproxyCfgBasePath
+		if *secretsDir != "" {
+			cacheDir = *secretsDir
+		}
+		opts.ConfigCacheFile = filepath.Join(cacheDir, "haproxy-connect-"+serviceID+".json")
+	}
+
+	if *renderOnly || validate {
+		select {
+		case c := <-watcher.C:
+			var cfg string
+			if validate {
+				err = haproxy.ValidateOnly(sd, c, opts)
+			} else {
+				cfg, err = haproxy.RenderOnly(sd, c, opts)
+			}
+			sd.Shutdown("render done")
+			sd.Wait()
+			if err != nil {
+				lib.Exit(err)
+			}
+			fmt.Print(cfg)
+			os.Exit(0)
+		case <-sd.Stop:
+			lib.Exit(renderStopped(sd.Err()))
+		case <-time.After(renderOnlyTimeout):
+			lib.Exit(lib.NewExitError(lib.ExitConsulUnreachable, fmt.Errorf("no configuration received from consul after %s", renderOnlyTimeout)))
+		}
+	}
+
+	if *transparentProxy {
+		// the connections of the HAProxy workers are not redirected
+		if *tproxyUID < 0 {
+			*tproxyUID = haproxyUID
+		}
+		tp, err := transparentProxyConfig(*tproxyOutboundPort, *tproxyUID, tproxyExcludeCIDRs, tproxyExcludePorts, *iptablesBin)
+		if err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitConfig, err))
+		}
+		if err := tp.Setup(); err != nil {
+			lib.Exit(lib.NewExitError(lib.ExitDependencies, fmt.Errorf("cannot set up the transparent proxy: %w", err)))
+		}
+		log.Infof("transparent proxy: redirecting the outbound connections to port %d", tp.OutboundPort)
+		artifacts.Add(lib.Artifact{Kind: "iptables chain", Name: tproxy.Chain, Exists: tp.Installed})
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			<-sd.Stop
+			if err := tp.Cleanup(); err != nil {
+				log.Errorf("cannot remove the transparent proxy redirection: %s", err)
+			}
+		}()
+	}
+
+	hap := haproxy.New(consulClient, watcher.C, opts)
 	sd.Add(1)
 	go func() {
 		defer sd.Done()
 		if err := hap.Run(sd); err != nil {
 			log.Error(err)
-			sd.Shutdown(err.Error())
+			sd.ShutdownWithError(err)
 		}
 	}()
 
 	sd.Wait()
+	artifacts.Verify()
+
+	if lib.IsInit() {
+		lib.KillChildren(childrenKillGrace)
+	}
+
+	if err := sd.Err(); err != nil {
+		lib.Exit(err)
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubcommands(t *testing.T) {
+	root := newCommand(new(int))
+	for _, tc := range []struct {
+		args       []string
+		subcommand string
+		rest       []string
+	}{
+		{nil, "run", []string{}},
+		{[]string{"-sidecar-for", "web"}, "run", []string{"-sidecar-for", "web"}},
+		{[]string{"-render-only", "-sidecar-for", "web"}, "run", []string{"-render-only", "-sidecar-for", "web"}},
+		{[]string{"-version"}, "run", []string{"-version"}},
+		{[]string{"run", "-sidecar-for", "web"}, "run", []string{"-sidecar-for", "web"}},
+		{[]string{"render", "-sidecar-for", "web"}, "render", []string{"-sidecar-for", "web"}},
+		{[]string{"validate"}, "validate", []string{}},
+		{[]string{"version"}, "version", []string{}},
+		{[]string{"stats", "-health"}, "stats", []string{"-health"}},
+		{[]string{"check", "-sidecar-for", "web"}, "check", []string{"-sidecar-for", "web"}},
+		{[]string{"chaos"}, "chaos", []string{}},
+		{[]string{"cleanup", "-dry-run"}, "cleanup", []string{"-dry-run"}},
+		{[]string{"help"}, "help", []string{}},
+		// a flag value named like a subcommand is not one
+		{[]string{"-sidecar-for", "stats"}, "run", []string{"-sidecar-for", "stats"}},
+	} {
+		cmd, rest, err := root.Find(withSubcommand(root, tc.args))
+		require.NoError(t, err, tc.args)
+		require.Equal(t, tc.subcommand, cmd.Name(), tc.args)
+		require.Equal(t, tc.rest, rest, tc.args)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	require.Equal(t, 0, execute([]string{"version"}))
+	require.Equal(t, 0, execute([]string{"help"}))
+}
+
+func TestRunMode(t *testing.T) {
+	for _, tc := range []struct {
+		subcommand string
+		renderOnly bool
+		render     bool
+		validate   bool
+	}{
+		{"run", false, false, false},
+		{"run", true, true, false},
+		{"render", false, true, false},
+		{"validate", false, false, true},
+	} {
+		render, validate := runMode(tc.subcommand, tc.renderOnly)
+		require.Equal(t, tc.render, render, tc.subcommand)
+		require.Equal(t, tc.validate, validate, tc.subcommand)
+	}
+}
+
+func TestRenderStopped(t *testing.T) {
+	err := renderStopped(nil)
+	require.Error(t, err)
+	require.Equal(t, lib.ExitUnknown, lib.ExitCodeOf(err))
+
+	err = renderStopped(lib.NewExitError(lib.ExitACLDenied, errors.New("denied")))
+	require.Equal(t, lib.ExitACLDenied, lib.ExitCodeOf(err))
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	BackendPrometheus = "prometheus"
+	BackendStatsD     = "statsd"
+	BackendOTLP       = "otlp"
+)
+
+// Labels are the dimensions of a sample
+type Labels map[string]string
+
+// Metrics is implemented by each backend, callers record samples without
+// knowing how they are exported. Names are snake_case, durations are named
+// without unit, backends add the one they use.
+type Metrics interface {
+	IncrCounter(name string, value float64, labels Labels)
+	SetGauge(name string, value float64, labels Labels)
+	ObserveDuration(name string, d time.Duration, labels Labels)
+}
+
+// Runner is implemented by backends that need a background loop, eg: to
+// push samples periodically
+type Runner interface {
+	Run(stop <-chan struct{})
+}
+
+// Nop discards all samples
+type Nop struct{}
+
+func (Nop) IncrCounter(string, float64, Labels)           {}
+func (Nop) SetGauge(string, float64, Labels)              {}
+func (Nop) ObserveDuration(string, time.Duration, Labels) {}
+
+type Config struct {
+	Backend      string
+	StatsDAddr   string
+	OTLPEndpoint string
+	OTLPInterval time.Duration
+	// ServiceName identifies the samples pushed to an external collector
+	ServiceName string
+}
+
+// New builds the backend selected in the config
+func New(cfg Config) (Metrics, error) {
+	switch cfg.Backend {
+	case "", BackendPrometheus:
+		return NewPrometheus(), nil
+	case BackendStatsD:
+		return NewStatsD(cfg.StatsDAddr)
+	case BackendOTLP:
+		return NewOTLP(cfg.OTLPEndpoint, cfg.OTLPInterval, cfg.ServiceName), nil
+	default:
+		return nil, fmt.Errorf("unknown metrics backend %s, expected %s, %s or %s", cfg.Backend, BackendPrometheus, BackendStatsD, BackendOTLP)
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus()
+	p.IncrCounter("connect_reloads_total", 1, Labels{"result": "success"})
+	p.IncrCounter("connect_reloads_total", 2, Labels{"result": "success"})
+	p.IncrCounter("connect_reloads_total", 1, Labels{"result": "failure"})
+	p.SetGauge("connect_cert_expiry_seconds", 3600, Labels{"service": "web"})
+	p.ObserveDuration("connect_apply_duration", 1500*time.Millisecond, nil)
+	p.ObserveDuration("connect_apply_duration", 500*time.Millisecond, nil)
+
+	var buf bytes.Buffer
+	p.Write(&buf)
+	require.Equal(t, `# TYPE connect_apply_duration_seconds summary
+connect_apply_duration_seconds_sum 2
+connect_apply_duration_seconds_count 2
+# TYPE connect_cert_expiry_seconds gauge
+connect_cert_expiry_seconds{service="web"} 3600
+# TYPE connect_reloads_total counter
+connect_reloads_total{result="failure"} 1
+connect_reloads_total{result="success"} 3
+`, buf.String())
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	require.Equal(t, `{path="C:\\tmp",service="web \"été\"\n"}`, promLabels(Labels{"service": "web \"été\"\n", "path": `C:\tmp`}))
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String())
+	require.NoError(t, err)
+
+	read := func() string {
+		buf := make([]byte, 512)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	s.IncrCounter("connect_reloads_total", 1, Labels{"result": "success", "kind": "reload"})
+	require.Equal(t, "connect_reloads_total:1|c|#kind:reload,result:success", read())
+	s.SetGauge("connect_sessions", 12, nil)
+	require.Equal(t, "connect_sessions:12|g", read())
+	s.ObserveDuration("connect_apply_duration", 1500*time.Microsecond, nil)
+	require.Equal(t, "connect_apply_duration:1.5|ms", read())
+}
+
+func TestOTLP(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	o := NewOTLP(srv.URL+"/v1/metrics", time.Hour, "web")
+	o.IncrCounter("connect_reloads_total", 1, Labels{"result": "success"})
+	o.ObserveDuration("connect_apply_duration", time.Second, nil)
+	require.NoError(t, o.push())
+
+	var payload struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []otlpMetric `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	require.NoError(t, json.Unmarshal(<-bodies, &payload))
+
+	metrics := payload.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+	require.Equal(t, "connect_apply_duration", metrics[0].Name)
+	require.Equal(t, "1", metrics[0].Summary.DataPoints[0].Count)
+	require.Equal(t, 1.0, *metrics[0].Summary.DataPoints[0].Sum)
+	require.Equal(t, "connect_reloads_total", metrics[1].Name)
+	require.True(t, metrics[1].Sum.IsMonotonic)
+	require.Equal(t, 1.0, *metrics[1].Sum.DataPoints[0].AsDouble)
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(Config{})
+	require.NoError(t, err)
+	require.IsType(t, &Prometheus{}, m)
+
+	_, err = New(Config{Backend: "graphite"})
+	require.Error(t, err)
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/internal/otlp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	otlpTimeout         = 10 * time.Second
+	otlpCumulative      = 2
+	otlpScopeName       = "haproxy-consul-connect"
+	DefaultOTLPInterval = 30 * time.Second
+)
+
+// OTLP aggregates the samples in memory and pushes them periodically to an
+// OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type OTLP struct {
+	*registry
+
+	endpoint    string
+	interval    time.Duration
+	serviceName string
+	client      *http.Client
+}
+
+func NewOTLP(endpoint string, interval time.Duration, serviceName string) *OTLP {
+	if interval == 0 {
+		interval = DefaultOTLPInterval
+	}
+	return &OTLP{
+		registry:    newRegistry(),
+		endpoint:    endpoint,
+		interval:    interval,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+// Run pushes the samples until stop is closed, then a last time
+func (o *OTLP) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			o.pushAndLog()
+			return
+		case <-ticker.C:
+			o.pushAndLog()
+		}
+	}
+}
+
+func (o *OTLP) pushAndLog() {
+	err := o.push()
+	if err != nil {
+		log.Errorf("metrics: cannot push to %s: %s", o.endpoint, err)
+	}
+}
+
+func (o *OTLP) push() error {
+	body, err := json.Marshal(o.payload(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlp.Attribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	TimeUnixNano      string           `json:"timeUnixNano"`
+	AsDouble          *float64         `json:"asDouble,omitempty"`
+	Count             string           `json:"count,omitempty"`
+	Sum               *float64         `json:"sum,omitempty"`
+}
+
+type otlpPoints struct {
+	AggregationTemporality int             `json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name    string      `json:"name"`
+	Unit    string      `json:"unit,omitempty"`
+	Sum     *otlpPoints `json:"sum,omitempty"`
+	Gauge   *otlpPoints `json:"gauge,omitempty"`
+	Summary *otlpPoints `json:"summary,omitempty"`
+}
+
+func (o *OTLP) payload(now time.Time) map[string]interface{} {
+	start := strconv.FormatInt(o.start.UnixNano(), 10)
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := []*otlpMetric{}
+	byName := map[string]*otlpMetric{}
+	for _, s := range o.snapshot() {
+		m, ok := byName[s.name]
+		if !ok {
+			m = &otlpMetric{Name: s.name}
+			switch s.kind {
+			case kindCounter:
+				m.Sum = &otlpPoints{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			case kindGauge:
+				m.Gauge = &otlpPoints{}
+			case kindSummary:
+				m.Unit = "s"
+				m.Summary = &otlpPoints{}
+			}
+			byName[s.name] = m
+			metrics = append(metrics, m)
+		}
+
+		value := s.value
+		dp := otlpDataPoint{
+			Attributes:        otlp.Attributes(s.labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      ts,
+		}
+		switch {
+		case m.Sum != nil:
+			dp.AsDouble = &value
+			m.Sum.DataPoints = append(m.Sum.DataPoints, dp)
+		case m.Gauge != nil:
+			dp.AsDouble = &value
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+		case m.Summary != nil:
+			dp.Sum = &value
+			dp.Count = strconv.FormatUint(s.count, 10)
+			m.Summary.DataPoints = append(m.Summary.DataPoints, dp)
+		}
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlp.Attributes(map[string]string{"service.name": o.serviceName}),
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": otlpScopeName},
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+}
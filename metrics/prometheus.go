@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Prometheus keeps the samples in memory and serves them in the text
+// exposition format
+type Prometheus struct {
+	*registry
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{registry: newRegistry()}
+}
+
+func (p *Prometheus) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.Write(rw)
+}
+
+// Write writes the current samples, durations are exported as summaries in
+// seconds
+func (p *Prometheus) Write(w io.Writer) {
+	last := ""
+	for _, s := range p.snapshot() {
+		name := s.name
+		if s.kind == kindSummary {
+			name += "_seconds"
+		}
+		if name != last {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, promType(s.kind))
+			last = name
+		}
+
+		labels := promLabels(s.labels)
+		switch s.kind {
+		case kindSummary:
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, labels, s.count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(s.value))
+		}
+	}
+}
+
+func promType(k kind) string {
+	switch k {
+	case kindCounter:
+		return "counter"
+	case kindGauge:
+		return "gauge"
+	default:
+		return "summary"
+	}
+}
+
+// labelEscaper escapes a label value as the text exposition format wants it,
+// %q would also escape the non ASCII and control characters
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, k := range sortedLabelNames(labels) {
+		parts = append(parts, k+`="`+labelEscaper.Replace(labels[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
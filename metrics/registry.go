@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kind int
+
+const (
+	kindCounter kind = iota
+	kindGauge
+	kindSummary
+)
+
+type series struct {
+	name   string
+	labels Labels
+	kind   kind
+	value  float64
+	count  uint64
+}
+
+// registry aggregates samples in memory for the backends exporting the
+// current values rather than each sample
+type registry struct {
+	lock   sync.Mutex
+	series map[string]*series
+	start  time.Time
+}
+
+func newRegistry() *registry {
+	return &registry{
+		series: map[string]*series{},
+		start:  time.Now(),
+	}
+}
+
+func (r *registry) get(name string, labels Labels, k kind) *series {
+	key := name + "{" + labelsKey(labels) + "}"
+	s, ok := r.series[key]
+	if !ok {
+		s = &series{name: name, labels: labels, kind: k}
+		r.series[key] = s
+	}
+	return s
+}
+
+func (r *registry) IncrCounter(name string, value float64, labels Labels) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.get(name, labels, kindCounter).value += value
+}
+
+func (r *registry) SetGauge(name string, value float64, labels Labels) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.get(name, labels, kindGauge).value = value
+}
+
+func (r *registry) ObserveDuration(name string, d time.Duration, labels Labels) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := r.get(name, labels, kindSummary)
+	s.value += d.Seconds()
+	s.count++
+}
+
+// snapshot returns a copy of the series sorted by name and labels
+func (r *registry) snapshot() []series {
+	r.lock.Lock()
+	keys := make([]string, 0, len(r.series))
+	for k := range r.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]series, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, *r.series[k])
+	}
+	r.lock.Unlock()
+	return res
+}
+
+func sortedLabelNames(labels Labels) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func labelsKey(labels Labels) string {
+	parts := make([]string, 0, len(labels))
+	for _, k := range sortedLabelNames(labels) {
+		parts = append(parts, k+"="+labels[k])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsD sends each sample as a UDP packet, labels are sent as DogStatsD
+// tags which most agents understand
+type StatsD struct {
+	conn net.Conn
+}
+
+func NewStatsD(addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach statsd at %s: %s", addr, err)
+	}
+	return &StatsD{conn: conn}, nil
+}
+
+func (s *StatsD) IncrCounter(name string, value float64, labels Labels) {
+	s.send(name, formatFloat(value), "c", labels)
+}
+
+func (s *StatsD) SetGauge(name string, value float64, labels Labels) {
+	s.send(name, formatFloat(value), "g", labels)
+}
+
+func (s *StatsD) ObserveDuration(name string, d time.Duration, labels Labels) {
+	s.send(name, formatFloat(float64(d.Microseconds())/1000), "ms", labels)
+}
+
+func (s *StatsD) send(name, value, typ string, labels Labels) {
+	_, err := s.conn.Write([]byte(statsdLine(name, value, typ, labels)))
+	if err != nil {
+		log.Debugf("metrics: cannot send to statsd: %s", err)
+	}
+}
+
+func statsdLine(name, value, typ string, labels Labels) string {
+	line := name + ":" + value + "|" + typ
+	if len(labels) == 0 {
+		return line
+	}
+	tags := make([]string, 0, len(labels))
+	for _, k := range sortedLabelNames(labels) {
+		tags = append(tags, k+":"+labels[k])
+	}
+	return line + "|#" + strings.Join(tags, ",")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+)
+
+// runStats implements the stats subcommand, it prints the metrics or the
+// health summary of a running instance and returns the exit code
+func runStats(args []string) int {
+	fs := utils.NewFlags(flag.NewFlagSet("stats", flag.ExitOnError), utils.FlagEnvPrefix)
+	statsAddr := fs.String("stats-addr", "127.0.0.1:8080", "Address of the stats server of the instance")
+	statsBasicAuth := fs.String("stats-basic-auth", "", "user:password of the stats server")
+	statsToken := fs.String("stats-token", "", "Bearer token of the stats server")
+	statsTLS := fs.Bool("stats-tls", false, "The stats server is served over TLS")
+	statsCAFile := fs.String("stats-ca-file", "", "CA certificates verifying the certificate of the stats server with -stats-tls, eg: the Connect CA roots for -stats-tls-connect. Its name is not checked as the certificate is not issued for its address")
+	health := fs.Bool("health", false, "Print the health summary instead of the metrics")
+	_, err := fs.Parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	path := "/metrics"
+	if *health {
+		path = "/health"
+	}
+
+	scheme := "http"
+	client := &http.Client{Timeout: checkTimeout}
+	if *statsTLS {
+		scheme = "https"
+		tlsConfig, err := statsTLSConfig(*statsCAFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		if *statsCAFile == "" && (*statsToken != "" || *statsBasicAuth != "") {
+			fmt.Fprintln(os.Stderr, "WARNING: the certificate of the stats server is not verified without -stats-ca-file, the credentials could be sent to another server")
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+*statsAddr+path, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	switch {
+	case *statsToken != "":
+		req.Header.Set("Authorization", "Bearer "+*statsToken)
+	case *statsBasicAuth != "":
+		user, password, _ := strings.Cut(*statsBasicAuth, ":")
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	// the health summary of an unhealthy instance is still printed
+	if resp.StatusCode != http.StatusOK && !*health {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// statsTLSConfig returns the TLS config of the requests to the stats server,
+// verifying its certificate chain with the CAs of caFile when set
+func statsTLSConfig(caFile string) (*tls.Config, error) {
+	// the name is not checked, the chain is verified below instead
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		if len(certs) == 0 {
+			return errors.New("no certificate presented by the stats server")
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStats(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte("connect_up 1\n"))
+	})
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	require.Equal(t, 0, runStats([]string{"-stats-addr", addr, "-stats-token", "secret"}))
+	require.Equal(t, 1, runStats([]string{"-stats-addr", addr, "-stats-token", "wrong"}))
+
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	tlsAddr := strings.TrimPrefix(tlsSrv.URL, "https://")
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw}), 0600))
+	require.Equal(t, 0, runStats([]string{"-stats-addr", tlsAddr, "-stats-tls", "-stats-ca-file", caFile, "-stats-token", "secret"}))
+
+	// the token is not sent to a server the CA did not sign
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	otherCA, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	otherCAFile := filepath.Join(dir, "other.pem")
+	require.NoError(t, os.WriteFile(otherCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCA}), 0600))
+	require.Equal(t, 1, runStats([]string{"-stats-addr", tlsAddr, "-stats-tls", "-stats-ca-file", otherCAFile, "-stats-token", "secret"}))
+
+	require.Equal(t, 2, runStats([]string{"-stats-addr", tlsAddr, "-stats-tls", "-stats-ca-file", filepath.Join(dir, "missing.pem")}))
+}
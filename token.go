@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/haproxytech/haproxy-consul-connect/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveToken returns the Consul ACL token and where it was found. Sources
+// by priority (lowest to highest): Envoy bootstrap file, token file,
+// environment variable, command line flag. Files are read on each call so
+// that a rotated token is picked up. A file that cannot be read is logged and
+// skipped, the error is only returned when no other source has a token.
+func resolveToken(bootstrapPath, tokenFile, flagToken string) (string, string, error) {
+	token, source := "", ""
+	var firstErr error
+
+	if bootstrapPath != "" {
+		bootstrapConfig, err := utils.ParseEnvoyBootstrap(bootstrapPath)
+		switch {
+		case err != nil:
+			log.Warnf("cannot read the consul token of the Envoy bootstrap file %s: %s", bootstrapPath, err)
+			firstErr = err
+		case bootstrapConfig != nil:
+			if bootstrapToken := bootstrapConfig.ExtractConsulToken(); bootstrapToken != "" {
+				token, source = bootstrapToken, "Envoy bootstrap file"
+			}
+		}
+	}
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			log.Warnf("cannot read the consul token file %s: %s", tokenFile, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if fileToken := strings.TrimSpace(string(b)); fileToken != "" {
+			token, source = fileToken, "token file"
+		}
+	}
+	if envToken, ok := os.LookupEnv("CONNECT_CONSUL_TOKEN"); ok {
+		token, source = envToken, "env variable CONNECT_CONSUL_TOKEN"
+	}
+	if flagToken != "" {
+		token, source = flagToken, "command line"
+	}
+
+	if source == "" && firstErr != nil {
+		return "", "", firstErr
+	}
+	return token, source, nil
+}
+
+// rotatingToken is the current token of the Consul clients, updated by the
+// watcher when it rotates
+type rotatingToken struct {
+	lock  sync.RWMutex
+	token string
+}
+
+func (t *rotatingToken) Get() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.token
+}
+
+func (t *rotatingToken) Set(token string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = token
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveToken(t *testing.T) {
+	os.Unsetenv("CONNECT_CONSUL_TOKEN")
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0600))
+	missing := filepath.Join(dir, "missing")
+
+	token, source, err := resolveToken("", tokenFile, "")
+	require.NoError(t, err)
+	require.Equal(t, "file-token", token)
+	require.Equal(t, "token file", source)
+
+	// an unreadable file falls through to the other sources
+	token, source, err = resolveToken(missing, missing, "flag-token")
+	require.NoError(t, err)
+	require.Equal(t, "flag-token", token)
+	require.Equal(t, "command line", source)
+
+	t.Setenv("CONNECT_CONSUL_TOKEN", "env-token")
+	token, _, err = resolveToken("", missing, "")
+	require.NoError(t, err)
+	require.Equal(t, "env-token", token)
+	os.Unsetenv("CONNECT_CONSUL_TOKEN")
+
+	token, _, err = resolveToken(missing, tokenFile, "")
+	require.NoError(t, err)
+	require.Equal(t, "file-token", token)
+
+	// without another source the error is returned, a refresh keeps the
+	// current token
+	_, _, err = resolveToken("", missing, "")
+	require.Error(t, err)
+}
@@ -0,0 +1,116 @@
+// Package tproxy redirects the outbound TCP connections of the host, or of
+// the network namespace of a pod, to the catch-all listener of the
+// transparent proxy with iptables, like consul connect redirect-traffic
+// does for Envoy
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Chain holds the redirection rules in the nat table
+	Chain = "HAPROXY_CONNECT_OUTPUT"
+
+	DefaultOutboundPort = 15001
+	DefaultIPTablesBin  = "iptables"
+)
+
+type Config struct {
+	// OutboundPort is the port of the catch-all listener
+	OutboundPort int
+	// ProxyUID is the user HAProxy runs as, its connections are not
+	// redirected. The applications must run as another user.
+	ProxyUID int
+	// ExcludeCIDRs are destinations reached without the proxy
+	ExcludeCIDRs []string
+	// ExcludePorts are destination ports reached without the proxy
+	ExcludePorts []int
+	// IPTablesBin is the iptables binary, iptables-nft programs nftables
+	IPTablesBin string
+}
+
+// Setup installs the redirection, the rules left by a previous run are
+// removed first. The rules installed are removed when one fails.
+func (c Config) Setup() error {
+	c.Cleanup()
+	for _, args := range c.rules() {
+		if err := c.run(args); err != nil {
+			c.Cleanup()
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the redirection, it returns the first error but tries
+// all the rules
+func (c Config) Cleanup() error {
+	var first error
+	for _, args := range c.cleanupRules() {
+		if err := c.run(args); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// rules are the iptables arguments installing the redirection
+func (c Config) rules() [][]string {
+	rules := [][]string{
+		{"-t", "nat", "-N", Chain},
+		// the connections of the proxy to the upstream instances
+		{"-t", "nat", "-A", Chain, "-m", "owner", "--uid-owner", strconv.Itoa(c.ProxyUID), "-j", "RETURN"},
+		// the local upstream listeners and the agent
+		{"-t", "nat", "-A", Chain, "-d", "127.0.0.0/8", "-j", "RETURN"},
+	}
+	for _, cidr := range c.ExcludeCIDRs {
+		rules = append(rules, []string{"-t", "nat", "-A", Chain, "-d", cidr, "-j", "RETURN"})
+	}
+	for _, port := range c.ExcludePorts {
+		rules = append(rules, []string{"-t", "nat", "-A", Chain, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "RETURN"})
+	}
+	return append(rules,
+		[]string{"-t", "nat", "-A", Chain, "-p", "tcp", "-j", "REDIRECT", "--to-ports", strconv.Itoa(c.OutboundPort)},
+		[]string{"-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-j", Chain},
+	)
+}
+
+func (c Config) cleanupRules() [][]string {
+	return [][]string{
+		{"-t", "nat", "-D", "OUTPUT", "-p", "tcp", "-j", Chain},
+		{"-t", "nat", "-F", Chain},
+		{"-t", "nat", "-X", Chain},
+	}
+}
+
+// Installed tells whether the chain of the redirection exists, eg: left by
+// a crashed process
+func (c Config) Installed() (bool, error) {
+	err := exec.Command(c.bin(), "-t", "nat", "-S", Chain).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c Config) bin() string {
+	if c.IPTablesBin == "" {
+		return DefaultIPTablesBin
+	}
+	return c.IPTablesBin
+}
+
+func (c Config) run(args []string) error {
+	bin := c.bin()
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package tproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules(t *testing.T) {
+	c := Config{
+		OutboundPort: 15001,
+		ProxyUID:     1000,
+		ExcludeCIDRs: []string{"10.0.0.0/8"},
+		ExcludePorts: []int{8500},
+	}
+
+	require.Equal(t, [][]string{
+		{"-t", "nat", "-N", "HAPROXY_CONNECT_OUTPUT"},
+		{"-t", "nat", "-A", "HAPROXY_CONNECT_OUTPUT", "-m", "owner", "--uid-owner", "1000", "-j", "RETURN"},
+		{"-t", "nat", "-A", "HAPROXY_CONNECT_OUTPUT", "-d", "127.0.0.0/8", "-j", "RETURN"},
+		{"-t", "nat", "-A", "HAPROXY_CONNECT_OUTPUT", "-d", "10.0.0.0/8", "-j", "RETURN"},
+		{"-t", "nat", "-A", "HAPROXY_CONNECT_OUTPUT", "-p", "tcp", "--dport", "8500", "-j", "RETURN"},
+		{"-t", "nat", "-A", "HAPROXY_CONNECT_OUTPUT", "-p", "tcp", "-j", "REDIRECT", "--to-ports", "15001"},
+		{"-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-j", "HAPROXY_CONNECT_OUTPUT"},
+	}, c.rules())
+}
+
+func TestSetupFailure(t *testing.T) {
+	c := Config{IPTablesBin: "false"}
+	require.Error(t, c.Setup())
+	require.Error(t, c.Cleanup())
+}
@@ -0,0 +1,170 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/internal/otlp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	otlpTimeout   = 10 * time.Second
+	otlpScopeName = "haproxy-consul-connect"
+	// otlpMaxSpans is the number of ended spans kept until the next push,
+	// the oldest ones are dropped when the collector is unreachable
+	otlpMaxSpans = 10000
+	// DefaultOTLPInterval is the interval between two pushes of the spans
+	DefaultOTLPInterval = 5 * time.Second
+
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// OTLP buffers the ended spans and pushes them periodically to an
+// OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type OTLP struct {
+	endpoint    string
+	interval    time.Duration
+	serviceName string
+	client      *http.Client
+
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func NewOTLP(endpoint string, interval time.Duration, serviceName string) *OTLP {
+	if interval == 0 {
+		interval = DefaultOTLPInterval
+	}
+	return &OTLP{
+		endpoint:    endpoint,
+		interval:    interval,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+func (o *OTLP) StartSpan(name string, start time.Time, parent *Span) *Span {
+	return newSpan(name, start, parent, o.add)
+}
+
+func (o *OTLP) add(s *Span) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.spans) >= otlpMaxSpans {
+		o.spans = o.spans[1:]
+	}
+	o.spans = append(o.spans, s)
+}
+
+// Run pushes the spans until stop is closed, then a last time
+func (o *OTLP) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			o.pushAndLog()
+			return
+		case <-ticker.C:
+			o.pushAndLog()
+		}
+	}
+}
+
+func (o *OTLP) pushAndLog() {
+	err := o.push()
+	if err != nil {
+		log.Errorf("tracing: cannot push to %s: %s", o.endpoint, err)
+	}
+}
+
+func (o *OTLP) push() error {
+	o.lock.Lock()
+	spans := o.spans
+	o.spans = nil
+	o.lock.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(o.payload(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []otlp.Attribute `json:"attributes,omitempty"`
+	Status            otlpStatus       `json:"status"`
+}
+
+func (o *OTLP) payload(spans []*Span) map[string]interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.lock.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlp.Attributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		s.lock.Unlock()
+		out = append(out, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlp.Attributes(map[string]string{"service.name": o.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": otlpScopeName},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLP(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	o := NewOTLP(srv.URL+"/v1/traces", time.Hour, "web")
+	root := o.StartSpan("consul.change", time.Now().Add(-time.Second), nil)
+	child := o.StartSpan("haproxy.reload", time.Now(), root)
+	child.SetAttribute("method", "reload")
+	child.SetError(errors.New("validation failed"))
+	child.End()
+	root.End()
+	root.End()
+	require.NoError(t, o.push())
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	require.NoError(t, json.Unmarshal(<-bodies, &payload))
+
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	require.Equal(t, "haproxy.reload", spans[0].Name)
+	require.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	require.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	require.Equal(t, "method", spans[0].Attributes[0].Key)
+	require.Equal(t, otlpStatusError, spans[0].Status.Code)
+	require.Equal(t, "consul.change", spans[1].Name)
+	require.Empty(t, spans[1].ParentSpanID)
+
+	// nothing left to push
+	require.NoError(t, o.push())
+}
+
+func TestNopSpan(t *testing.T) {
+	s := Nop{}.StartSpan("consul.change", time.Now(), nil)
+	s.SetAttribute("k", "v")
+	s.SetError(errors.New("failed"))
+	s.End()
+	require.Nil(t, s)
+}
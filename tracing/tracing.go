@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Tracer records spans of the control plane operations, from a Consul change
+// to its application to HAProxy
+type Tracer interface {
+	// StartSpan begins a span at start, as a child of parent or as the root
+	// of a new trace when parent is nil
+	StartSpan(name string, start time.Time, parent *Span) *Span
+}
+
+// Nop discards all spans, the spans it returns are nil and their methods do
+// nothing
+type Nop struct{}
+
+func (Nop) StartSpan(string, time.Time, *Span) *Span { return nil }
+
+// Span is a timed operation, all its methods accept a nil span
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	export  func(*Span)
+
+	lock  sync.Mutex
+	end   time.Time
+	attrs map[string]string
+	err   string
+}
+
+func newSpan(name string, start time.Time, parent *Span, export func(*Span)) *Span {
+	s := &Span{
+		name:   name,
+		start:  start,
+		export: export,
+		attrs:  map[string]string{},
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttribute describes the span with a key and a value
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attrs[key] = value
+	s.lock.Unlock()
+}
+
+// SetError marks the span as failed, a nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.err = err.Error()
+	s.lock.Unlock()
+}
+
+// End ends the span now and exports it, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if !s.end.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.lock.Unlock()
+	s.export(s)
+}
@@ -3,22 +3,67 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultAgentHTTPPort is the HTTP port of the agent, the bootstrap file
+// only has its gRPC port
+const defaultAgentHTTPPort = 8500
+
 // EnvoyBootstrapConfig represents the relevant parts of Envoy's bootstrap configuration
 type EnvoyBootstrapConfig struct {
 	Node struct {
-		ID      string `json:"id"`
-		Cluster string `json:"cluster"`
+		ID       string                 `json:"id"`
+		Cluster  string                 `json:"cluster"`
+		Metadata map[string]interface{} `json:"metadata"`
 	} `json:"node"`
+	StaticResources struct {
+		Clusters []envoyCluster `json:"clusters"`
+	} `json:"static_resources"`
 	// Use RawMessage to handle flexible JSON structure
 	DynamicResources json.RawMessage `json:"dynamic_resources"`
 	// Store extracted values
 	consulToken string
+	agent       EnvoyAgent
+}
+
+// EnvoyAgent is the address of the Consul agent Envoy gets its config from
+type EnvoyAgent struct {
+	// Host and GRPCPort are set for an agent reached over TCP
+	Host     string
+	GRPCPort int
+	// Socket is set for an agent reached through a unix socket, eg: the
+	// one Nomad creates in the allocation directory
+	Socket string
+}
+
+type envoyCluster struct {
+	Name           string `json:"name"`
+	LoadAssignment struct {
+		Endpoints []struct {
+			LBEndpoints []struct {
+				Endpoint struct {
+					Address envoyAddress `json:"address"`
+				} `json:"endpoint"`
+			} `json:"lb_endpoints"`
+		} `json:"endpoints"`
+	} `json:"load_assignment"`
+}
+
+type envoyAddress struct {
+	SocketAddress *struct {
+		Address   string `json:"address"`
+		PortValue int    `json:"port_value"`
+	} `json:"socket_address"`
+	Pipe *struct {
+		Path string `json:"path"`
+	} `json:"pipe"`
 }
 
 // ParseEnvoyBootstrap reads and parses an Envoy bootstrap file
@@ -36,7 +81,8 @@ func ParseEnvoyBootstrap(path string) (*EnvoyBootstrapConfig, error) {
 		return nil, fmt.Errorf("failed to read envoy bootstrap file: %w", err)
 	}
 
-	log.Infof("Envoy bootstrap data %s", string(data))
+	// the file holds the token
+	log.Debugf("Envoy bootstrap file read from %s", path)
 
 	var config EnvoyBootstrapConfig
 	if err := json.Unmarshal(data, &config); err != nil {
@@ -49,10 +95,47 @@ func ParseEnvoyBootstrap(path string) (*EnvoyBootstrapConfig, error) {
 	if config.consulToken != "" {
 		log.Debug("Extracted Consul token from Envoy bootstrap")
 	}
+	config.agent = config.extractAgent()
 
 	return &config, nil
 }
 
+// extractAgent returns the address of the cluster the ADS config is
+// fetched from, local_agent in the files generated by Consul and Nomad
+func (c *EnvoyBootstrapConfig) extractAgent() EnvoyAgent {
+	name := "local_agent"
+	var data struct {
+		ADSConfig struct {
+			GRPCServices struct {
+				EnvoyGRPC struct {
+					ClusterName string `json:"cluster_name"`
+				} `json:"envoy_grpc"`
+			} `json:"grpc_services"`
+		} `json:"ads_config"`
+	}
+	if err := json.Unmarshal(c.DynamicResources, &data); err == nil && data.ADSConfig.GRPCServices.EnvoyGRPC.ClusterName != "" {
+		name = data.ADSConfig.GRPCServices.EnvoyGRPC.ClusterName
+	}
+
+	for _, cluster := range c.StaticResources.Clusters {
+		if cluster.Name != name {
+			continue
+		}
+		for _, e := range cluster.LoadAssignment.Endpoints {
+			for _, lb := range e.LBEndpoints {
+				addr := lb.Endpoint.Address
+				switch {
+				case addr.SocketAddress != nil:
+					return EnvoyAgent{Host: addr.SocketAddress.Address, GRPCPort: addr.SocketAddress.PortValue}
+				case addr.Pipe != nil:
+					return EnvoyAgent{Socket: addr.Pipe.Path}
+				}
+			}
+		}
+	}
+	return EnvoyAgent{}
+}
+
 // extractTokenFromJSON searches for x-consul-token in the dynamic_resources JSON
 // Expected structure: dynamic_resources.ads_config.grpc_services.initial_metadata[].{key,value}
 func extractTokenFromJSON(rawJSON json.RawMessage) string {
@@ -135,3 +218,65 @@ func (c *EnvoyBootstrapConfig) ExtractServiceName() string {
 
 	return ""
 }
+
+// ProxyID returns the id of the sidecar proxy service, node.id in the files
+// generated by Consul and Nomad
+func (c *EnvoyBootstrapConfig) ProxyID() string {
+	if c == nil {
+		return ""
+	}
+	return c.Node.ID
+}
+
+// Namespace returns the Consul Enterprise namespace of the proxy, empty
+// when not set
+func (c *EnvoyBootstrapConfig) Namespace() string {
+	if c == nil {
+		return ""
+	}
+	ns, _ := c.Node.Metadata["namespace"].(string)
+	return ns
+}
+
+// Partition returns the Consul Enterprise admin partition of the proxy,
+// empty when not set
+func (c *EnvoyBootstrapConfig) Partition() string {
+	if c == nil {
+		return ""
+	}
+	ap, _ := c.Node.Metadata["partition"].(string)
+	return ap
+}
+
+// Agent returns the gRPC address of the Consul agent
+func (c *EnvoyBootstrapConfig) Agent() EnvoyAgent {
+	if c == nil {
+		return EnvoyAgent{}
+	}
+	return c.agent
+}
+
+// HTTPAddr returns the HTTP address of the agent of the bootstrap file, in
+// the format of -http-addr, or empty when it cannot be told. For an agent
+// reached over TCP it is its host with the default HTTP port. For a unix
+// socket it is the consul_http.sock next to the gRPC one, when Nomad
+// created it.
+func (a EnvoyAgent) HTTPAddr() string {
+	switch {
+	case a.Host != "":
+		return net.JoinHostPort(a.Host, strconv.Itoa(defaultAgentHTTPPort))
+	case a.Socket != "":
+		sock := filepath.Join(filepath.Dir(a.Socket), "consul_http.sock")
+		if _, err := os.Stat(sock); err == nil {
+			return "unix://" + sock
+		}
+	}
+	return ""
+}
+
+func (a EnvoyAgent) String() string {
+	if a.Socket != "" {
+		return "unix://" + a.Socket
+	}
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.GRPCPort))
+}
@@ -98,3 +98,63 @@ func TestExtractServiceName_Various(t *testing.T) {
 		})
 	}
 }
+
+func TestParseEnvoyBootstrap_Agent(t *testing.T) {
+	tmpDir := t.TempDir()
+	bootstrapPath := filepath.Join(tmpDir, "envoy_bootstrap.json")
+
+	bootstrapJSON := `{
+  "node": {
+    "cluster": "web",
+    "id": "web-sidecar-proxy",
+    "metadata": {
+      "namespace": "team-a",
+      "partition": "default",
+      "envoy_version": "1.29.0"
+    }
+  },
+  "static_resources": {
+    "clusters": [{
+      "name": "local_agent",
+      "load_assignment": {
+        "cluster_name": "local_agent",
+        "endpoints": [{
+          "lb_endpoints": [{
+            "endpoint": {
+              "address": {
+                "socket_address": {"address": "10.0.0.5", "port_value": 8502}
+              }
+            }
+          }]
+        }]
+      }
+    }]
+  },
+  "dynamic_resources": {
+    "ads_config": {
+      "grpc_services": {
+        "envoy_grpc": {"cluster_name": "local_agent"}
+      }
+    }
+  }
+}`
+	require.NoError(t, os.WriteFile(bootstrapPath, []byte(bootstrapJSON), 0600))
+
+	config, err := ParseEnvoyBootstrap(bootstrapPath)
+	require.NoError(t, err)
+	require.Equal(t, "web-sidecar-proxy", config.ProxyID())
+	require.Equal(t, "team-a", config.Namespace())
+	require.Equal(t, "default", config.Partition())
+	require.Equal(t, EnvoyAgent{Host: "10.0.0.5", GRPCPort: 8502}, config.Agent())
+	require.Equal(t, "10.0.0.5:8500", config.Agent().HTTPAddr())
+}
+
+func TestEnvoyAgent_Socket(t *testing.T) {
+	tmpDir := t.TempDir()
+	agent := EnvoyAgent{Socket: filepath.Join(tmpDir, "consul_grpc.sock")}
+	require.Equal(t, "", agent.HTTPAddr())
+
+	httpSock := filepath.Join(tmpDir, "consul_http.sock")
+	require.NoError(t, os.WriteFile(httpSock, nil, 0600))
+	require.Equal(t, "unix://"+httpSock, agent.HTTPAddr())
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -57,3 +58,37 @@ func TestMakeHAProxyParams(t *testing.T) {
 		},
 	}, r)
 }
+
+func TestWithOldWorkerLimits(t *testing.T) {
+	p := HAProxyParams{Globals: map[string][]string{"hard-stop-after": {"1h"}}}
+	r := p.WithOldWorkerLimits(20, 30*time.Minute)
+	require.Equal(t, []string{"20"}, r.Globals["mworker-max-reloads"])
+	// set with -haproxy-param
+	require.Equal(t, []string{"1h"}, r.Globals["hard-stop-after"])
+
+	r = HAProxyParams{Globals: map[string][]string{}}.WithOldWorkerLimits(0, 90*time.Second)
+	require.Equal(t, map[string][]string{"hard-stop-after": {"90000ms"}}, r.Globals)
+}
+
+func TestWithTLSSessionCache(t *testing.T) {
+	p := HAProxyParams{Globals: map[string][]string{"tune.ssl.lifetime": {"60"}}}
+	r := p.WithTLSSessionCache(50000, 10*time.Minute)
+	require.Equal(t, []string{"50000"}, r.Globals["tune.ssl.cachesize"])
+	// set with -haproxy-param
+	require.Equal(t, []string{"60"}, r.Globals["tune.ssl.lifetime"])
+
+	r = HAProxyParams{Globals: map[string][]string{}}.WithTLSSessionCache(0, 0)
+	require.Empty(t, r.Globals)
+}
+
+func TestWithPrivileges(t *testing.T) {
+	p := HAProxyParams{Globals: map[string][]string{"group": {"proxies"}}}
+	r := p.WithPrivileges("haproxy", "haproxy", "/var/lib/haproxy")
+	require.Equal(t, []string{"haproxy"}, r.Globals["user"])
+	require.Equal(t, []string{"/var/lib/haproxy"}, r.Globals["chroot"])
+	// set with -haproxy-param
+	require.Equal(t, []string{"proxies"}, r.Globals["group"])
+
+	r = HAProxyParams{Globals: map[string][]string{}}.WithPrivileges("", "", "")
+	require.Empty(t, r.Globals)
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FlagEnvPrefix prefixes the environment variables of the flags
+const FlagEnvPrefix = "CONNECT_"
+
+// Flags adds deprecations and environment variables to a FlagSet.
+// Every flag can be set with an environment variable, eg: -http-addr with
+// CONNECT_HTTP_ADDR, the command line takes precedence.
+type Flags struct {
+	*flag.FlagSet
+	envPrefix  string
+	deprecated map[string]string
+	noEnv      map[string]bool
+}
+
+func NewFlags(fs *flag.FlagSet, envPrefix string) *Flags {
+	return &Flags{
+		FlagSet:    fs,
+		envPrefix:  envPrefix,
+		deprecated: map[string]string{},
+		noEnv:      map[string]bool{},
+	}
+}
+
+// FlagEnvName returns the environment variable of a flag
+func FlagEnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Deprecate makes the use of a flag log a warning with the given advice
+func (f *Flags) Deprecate(name, advice string) {
+	f.deprecated[name] = advice
+}
+
+// NoEnv excludes a flag from the environment variables, for flags whose
+// variable name is commonly used for something else
+func (f *Flags) NoEnv(name string) {
+	f.noEnv[name] = true
+}
+
+// Parse parses the command line then the environment variables of the flags
+// left unset, it returns the deprecation warnings to log
+func (f *Flags) Parse(args []string) ([]string, error) {
+	err := f.FlagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	warnings := []string{}
+	var envErr error
+	f.VisitAll(func(fl *flag.Flag) {
+		if envErr != nil {
+			return
+		}
+		if set[fl.Name] {
+			if advice, ok := f.deprecated[fl.Name]; ok {
+				warnings = append(warnings, fmt.Sprintf("flag -%s is deprecated, %s", fl.Name, advice))
+			}
+			return
+		}
+		if f.noEnv[fl.Name] {
+			return
+		}
+
+		env := FlagEnvName(f.envPrefix, fl.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		err := f.Set(fl.Name, v)
+		if err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", v, env, err)
+			return
+		}
+		if advice, ok := f.deprecated[fl.Name]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s is deprecated, %s", env, advice))
+		}
+	})
+	return warnings, envErr
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlagsEnv(t *testing.T) {
+	t.Setenv("CONNECT_HTTP_ADDR", "10.0.0.1:8500")
+	t.Setenv("CONNECT_LOG_LEVEL", "DEBUG")
+	t.Setenv("CONNECT_VERSION", "1.2.3")
+
+	f := NewFlags(flag.NewFlagSet("test", flag.ContinueOnError), FlagEnvPrefix)
+	addr := f.String("http-addr", "127.0.0.1:8500", "")
+	level := f.String("log-level", "INFO", "")
+	f.Bool("version", false, "")
+	f.NoEnv("version")
+
+	warnings, err := f.Parse([]string{"-log-level", "WARN"})
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+	require.Equal(t, "10.0.0.1:8500", *addr)
+	// the command line wins
+	require.Equal(t, "WARN", *level)
+}
+
+func TestFlagsDeprecate(t *testing.T) {
+	f := NewFlags(flag.NewFlagSet("test", flag.ContinueOnError), FlagEnvPrefix)
+	f.Bool("render-only", false, "")
+	f.Deprecate("render-only", "use the render subcommand instead")
+
+	warnings, err := f.Parse([]string{"-render-only"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"flag -render-only is deprecated, use the render subcommand instead"}, warnings)
+
+	t.Setenv("CONNECT_RENDER_ONLY", "true")
+	f = NewFlags(flag.NewFlagSet("test", flag.ContinueOnError), FlagEnvPrefix)
+	f.Bool("render-only", false, "")
+	f.Deprecate("render-only", "use the render subcommand instead")
+
+	warnings, err = f.Parse(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"CONNECT_RENDER_ONLY is deprecated, use the render subcommand instead"}, warnings)
+}
+
+func TestFlagsBadEnv(t *testing.T) {
+	t.Setenv("CONNECT_CONFIG_HISTORY", "many")
+
+	f := NewFlags(flag.NewFlagSet("test", flag.ContinueOnError), FlagEnvPrefix)
+	f.Int("config-history", 10, "")
+
+	_, err := f.Parse(nil)
+	require.Error(t, err)
+}
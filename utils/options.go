@@ -1,5 +1,16 @@
 package utils
 
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/haproxytech/haproxy-consul-connect/metrics"
+	"github.com/haproxytech/haproxy-consul-connect/tracing"
+)
+
 type HAProxyParams struct {
 	Defaults map[string][]string
 	Globals  map[string][]string
@@ -11,13 +22,13 @@ type HAProxyParams struct {
 var DefaultHAProxyParams = HAProxyParams{
 	Globals: map[string][]string{
 		"stats":                     {"timeout 2m"},
-		"nbthread":                  {"2"},     // Matches Envoy default (concurrency: 2) for better multi-core utilization
+		"nbthread":                  {"2"}, // Matches Envoy default (concurrency: 2) for better multi-core utilization
 		"ulimit-n":                  {"4096"},
 		"maxconn":                   {"1024"},  // Matches Envoy default soft limit
 		"tune.bufsize":              {"16384"}, // 16 KB - better for service mesh payloads (still 64x smaller than Envoy's 1MB)
 		"tune.maxrewrite":           {"1024"},
-		"tune.ssl.cachesize":        {"500"},   // Optimized for repeated connections to mesh peers
-		"tune.ssl.default-dh-param": {"2048"},  // Explicitly set (prevents larger default)
+		"tune.ssl.cachesize":        {"500"},  // Optimized for repeated connections to mesh peers
+		"tune.ssl.default-dh-param": {"2048"}, // Explicitly set (prevents larger default)
 	},
 	Defaults: map[string][]string{
 		// Connection pooling - critical for service mesh performance
@@ -73,13 +84,176 @@ func (p HAProxyParams) With(other HAProxyParams) HAProxyParams {
 	return new
 }
 
+// WithTLSSessionCache returns the params with the global settings of the TLS
+// session cache, the ones already set are kept. A setting of 0 is not set.
+func (p HAProxyParams) WithTLSSessionCache(size int, lifetime time.Duration) HAProxyParams {
+	cache := HAProxyParams{Globals: map[string][]string{}}
+	if size > 0 {
+		cache.Globals["tune.ssl.cachesize"] = []string{strconv.Itoa(size)}
+	}
+	if lifetime > 0 {
+		cache.Globals["tune.ssl.lifetime"] = []string{fmt.Sprintf("%ds", int(lifetime.Seconds()))}
+	}
+	return cache.With(p)
+}
+
+// WithOldWorkerLimits returns the params with the global settings capping the
+// old workers kept by HAProxy after the reloads, the ones already set are
+// kept. A limit of 0 is not set.
+func (p HAProxyParams) WithOldWorkerLimits(maxReloads int, hardStopAfter time.Duration) HAProxyParams {
+	limits := HAProxyParams{Globals: map[string][]string{}}
+	if maxReloads > 0 {
+		limits.Globals["mworker-max-reloads"] = []string{strconv.Itoa(maxReloads)}
+	}
+	if hardStopAfter > 0 {
+		limits.Globals["hard-stop-after"] = []string{fmt.Sprintf("%dms", hardStopAfter.Milliseconds())}
+	}
+	return limits.With(p)
+}
+
+// WithPrivileges returns the params with the global settings the HAProxy
+// workers drop their privileges with, the ones already set are kept. Empty
+// values are not set.
+func (p HAProxyParams) WithPrivileges(user, group, chroot string) HAProxyParams {
+	privileges := HAProxyParams{Globals: map[string][]string{}}
+	if user != "" {
+		privileges.Globals["user"] = []string{user}
+	}
+	if group != "" {
+		privileges.Globals["group"] = []string{group}
+	}
+	if chroot != "" {
+		privileges.Globals["chroot"] = []string{chroot}
+	}
+	return privileges.With(p)
+}
+
 type Options struct {
-	HAProxyBin           string
-	ConfigBaseDir        string
+	HAProxyBin      string
+	HAProxyTemplate string
+	DataplaneBin    string
+	ConfigBaseDir   string
+	SecretsDir      string
+	// NoCertFiles keeps the certificates in memory files
+	NoCertFiles          bool
 	SPOEAddress          string
 	EnableIntentions     bool
+	LogIdentity          bool
+	LogUpstreamMeta      bool
 	StatsListenAddr      string
 	StatsRegisterService bool
-	LogRequests          bool
-	HAProxyParams        HAProxyParams
+	StatsExportMeta      bool
+	AdminToken           string
+	// StatsBasicAuth and StatsToken protect the metrics of the stats server
+	StatsBasicAuth string
+	StatsToken     string
+	// StatsTLSCertFile and StatsTLSKeyFile serve the stats server over TLS,
+	// with the Connect leaf certificate when StatsTLSConnect is set
+	StatsTLSCertFile string
+	StatsTLSKeyFile  string
+	StatsTLSConnect  bool
+	// StatsPagePort is the localhost port of the HAProxy stats page, it is
+	// also served on /haproxy/ by the stats server. Disabled when 0.
+	StatsPagePort    int
+	LogRequests      bool
+	HAProxyParams    HAProxyParams
+	UpstreamHookExec string
+	UpstreamHookURL  string
+	// ConfigHistory is the number of rendered configs kept in ConfigHistoryDir
+	ConfigHistory    int
+	ConfigHistoryDir string
+	// Metrics receives the samples of the reload loop, SPOE handler and
+	// stats poller, they are discarded when nil
+	Metrics metrics.Metrics
+	// Tracer receives the spans of the handling of the Consul changes, they
+	// are discarded when nil
+	Tracer tracing.Tracer
+	// UpstreamPinner serves the pin and unpin admin operations, they are
+	// disabled when nil
+	UpstreamPinner consul.UpstreamPinner
+	// ReloadDeferRate is the request rate above which the reloads only
+	// changing server weights are deferred, 0 disables it
+	ReloadDeferRate int64
+	// ReloadDeferMax is how long a reload is deferred at most
+	ReloadDeferMax time.Duration
+	// Explain annotates the rendered config with the Consul data and config
+	// keys each section comes from
+	Explain bool
+	// TTLCheckID is the Consul TTL check kept passing while HAProxy runs,
+	// disabled when empty
+	TTLCheckID string
+	// HAProxyRestart restarts HAProxy when it exits unexpectedly instead
+	// of shutting down
+	HAProxyRestart bool
+	// ReloadWarnRate is the number of reloads in a minute above which a
+	// warning is logged, 0 disables it
+	ReloadWarnRate int
+	// ReloadMinInterval is the minimum interval between two reloads, the
+	// changes received meanwhile are applied together. The certificate
+	// changes are applied right away.
+	ReloadMinInterval time.Duration
+	// DeriveMaxConn splits the global maxconn between the listeners and the
+	// servers of the upstreams
+	DeriveMaxConn bool
+	// TransparentProxyPort is the port of the catch-all listener of the
+	// transparent proxy, disabled when 0
+	TransparentProxyPort int
+	// TLSTicketKeys is the file of the keys of the TLS session tickets of
+	// the public listeners, HAProxy generates them at each reload when empty
+	TLSTicketKeys string
+	// NoTLSTickets disables the TLS session tickets of the public listeners
+	NoTLSTickets bool
+	// VerifyDownstream requires the clients of the public listeners to
+	// present a certificate signed by the Connect CA
+	VerifyDownstream bool
+	// TrustDomain, when set, rejects the clients of the public listeners
+	// whose SPIFFE identity is not in this trust domain
+	TrustDomain string
+	// IntentionsFailOpen allows the downstream clients when the intentions
+	// cannot be checked, eg: during a Consul outage
+	IntentionsFailOpen bool
+	// IntentionsAuditLog logs each allow or deny decision of the
+	// intentions
+	IntentionsAuditLog bool
+	// IntentionsMetrics counts the decisions of the intentions per
+	// source and destination service
+	IntentionsMetrics bool
+	// JWTJWKSURL enables the validation of the JWT of the requests of the
+	// public listeners against the keys served at this URL
+	JWTJWKSURL string
+	// JWTIssuer and JWTAudiences, when set, are checked against the iss
+	// and aud claims of the tokens
+	JWTIssuer    string
+	JWTAudiences []string
+	// JWTClaims are the claims of the tokens set as HAProxy variables
+	JWTClaims []string
+	// LuaScripts are the sources of the -lua-script files, by file name
+	LuaScripts map[string]string
+	// LuaFromConfig loads the lua_scripts of the proxy config
+	LuaFromConfig bool
+	// SPOEListeners is the number of sockets the SPOE agent listens on,
+	// HAProxy retries the frames on another one when an agent stalls
+	SPOEListeners int
+	// AuditKVPrefix is the Consul KV prefix the last applied config of each
+	// instance is recorded under, disabled when empty
+	AuditKVPrefix string
+	// AuditEvent is the name of the Consul event fired for each applied
+	// config, disabled when empty
+	AuditEvent string
+	// InsecureDevMode serves the listeners before the leaf certificate is
+	// delivered, in plain TCP until then
+	InsecureDevMode bool
+	// ConfigCacheFile is where the last applied Consul config is kept, it
+	// is applied at startup before the Consul watches are ready. Disabled
+	// when empty.
+	ConfigCacheFile string
+	// Artifacts records what is created outside of the process, verified
+	// on shutdown
+	Artifacts *lib.Artifacts
+}
+
+// SPOE tells if the SPOE agent reads the identity of the downstream clients
+// or validates their JWT
+func (o Options) SPOE() bool {
+	return o.EnableIntentions || o.LogIdentity || o.TrustDomain != "" || o.JWTJWKSURL != ""
 }